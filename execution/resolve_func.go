@@ -81,23 +81,20 @@ func (fr *funcResolver) Execute(rc *ResolverContext, valOf reflect.Value) {
 		// Build arguments object.
 		argValPtr := reflect.New(fr.argsType)
 		argVal := argValPtr.Elem()
+		argValues := qnode.ArgumentValues()
 		for fieldName, fieldInfo := range fr.argsFields {
-			varRef, varOk := qnode.Arguments[fieldName]
-			if !varOk || varRef.Value == nil {
+			argValue, argOk := argValues[fieldName]
+			if !argOk || argValue == nil {
 				continue
 			}
 			field := argVal.FieldByIndex(fieldInfo.index)
 			fieldType := field.Type()
-			varVal := reflect.ValueOf(varRef.Value)
-			varValType := varVal.Type()
 			if fieldInfo.isPtr {
 				fieldType = fieldType.Elem()
 			}
-			if !varValType.AssignableTo(fieldType) {
-				if !varValType.ConvertibleTo(fieldType) {
-					continue
-				}
-				varVal = varVal.Convert(fieldType)
+			varVal, ok := convertArgValue(reflect.ValueOf(argValue), fieldType)
+			if !ok {
+				continue
 			}
 			if fieldInfo.isPtr {
 				if varVal.CanAddr() {
@@ -190,6 +187,65 @@ func (fr *funcResolver) executeFunc(rc *ResolverContext,
 	}
 }
 
+// convertArgValue converts an argument value to the Go type of an argument field.
+// Input objects are decoded into structs by field name, lists into slices.
+func convertArgValue(val reflect.Value, typ reflect.Type) (reflect.Value, bool) {
+	valType := val.Type()
+	if valType.AssignableTo(typ) {
+		return val, true
+	}
+
+	switch {
+	case typ.Kind() == reflect.Ptr:
+		elem, ok := convertArgValue(val, typ.Elem())
+		if !ok {
+			return val, false
+		}
+		ptr := reflect.New(typ.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, true
+	case valType.Kind() == reflect.Map && typ.Kind() == reflect.Struct:
+		obj, ok := val.Interface().(map[string]interface{})
+		if !ok {
+			return val, false
+		}
+		res := reflect.New(typ).Elem()
+		for name, fval := range obj {
+			field := res.FieldByName(util.ToPascalCase(name))
+			if !field.IsValid() || !field.CanSet() || fval == nil {
+				continue
+			}
+			cval, ok := convertArgValue(reflect.ValueOf(fval), field.Type())
+			if !ok {
+				return val, false
+			}
+			field.Set(cval)
+		}
+		return res, true
+	case valType.Kind() == reflect.Slice && typ.Kind() == reflect.Slice:
+		res := reflect.MakeSlice(typ, val.Len(), val.Len())
+		for i := 0; i < val.Len(); i++ {
+			item := val.Index(i)
+			if item.Kind() == reflect.Interface {
+				if item.IsNil() {
+					continue
+				}
+				item = item.Elem()
+			}
+			cval, ok := convertArgValue(item, typ.Elem())
+			if !ok {
+				return val, false
+			}
+			res.Index(i).Set(cval)
+		}
+		return res, true
+	case valType.ConvertibleTo(typ):
+		return val.Convert(typ), true
+	default:
+		return val, false
+	}
+}
+
 func (rt *modelBuilder) buildFuncResolver(f *reflect.Method, fieldt *ast.FieldDefinition) (Resolver, error) {
 	res := &funcResolver{f: f, fieldName: fieldt.Name.Value}
 
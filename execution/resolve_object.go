@@ -32,6 +32,11 @@ func (r *objectResolver) Execute(rc *ResolverContext, resolver reflect.Value) {
 
 	fieldCancels := make(map[uint32]func())
 	processChild := func(nod *qtree.QueryTreeNode) {
+		// Errored nodes are not resolved, excluded nodes are re-added when included.
+		if nod.ResolveError != nil || nod.Inactive {
+			return
+		}
+
 		fieldName := nod.FieldName
 		fr, ok := r.fieldResolvers[fieldName]
 		if !ok {
@@ -85,6 +90,13 @@ func (r *objectResolver) Execute(rc *ResolverContext, resolver reflect.Value) {
 					childCancel()
 					delete(fieldCancels, id)
 				}
+			case qtree.Operation_ArgsChanged:
+				id := qs.Child.Id
+				if childCancel, ok := fieldCancels[id]; ok {
+					childCancel()
+					delete(fieldCancels, id)
+				}
+				processChild(qs.Child)
 			case qtree.Operation_Delete:
 				rc.Purge()
 				return
@@ -40,6 +40,10 @@ func (rt *modelBuilder) buildPrimitiveResolver(value reflect.Type, gtyp *ast.Nam
 		return rt.buildChanValueResolver(value, gtyp)
 	}
 
+	if scalar, ok := types.LookupScalar(gtyp.Name.Value); ok {
+		return buildScalarResolver(value, scalar), nil
+	}
+
 	// Check primitives match
 	expectedKind, ok := types.GraphQLPrimitives[gtyp.Name.Value]
 	if !ok {
@@ -76,3 +80,39 @@ func (rt *modelBuilder) buildPrimitiveResolver(value reflect.Type, gtyp *ast.Nam
 		primKind:  expectedPrimKind,
 	}, nil
 }
+
+// scalarResolver transmits values of a custom scalar type.
+type scalarResolver struct {
+	ptrDepth int
+	scalar   *types.Scalar
+}
+
+func (sr *scalarResolver) Execute(rc *ResolverContext, resolver reflect.Value) {
+	rc.SetPrimitiveKind(sr.scalar.Kind)
+	for i := 0; i < sr.ptrDepth; i++ {
+		if resolver.IsNil() {
+			rc.SetValue(resolver, true)
+			return
+		}
+		resolver = resolver.Elem()
+	}
+	if sr.scalar.Serialize == nil {
+		rc.SetValue(resolver, true)
+		return
+	}
+	val, err := sr.scalar.Serialize(resolver.Interface())
+	if err != nil {
+		rc.SetError(err)
+		return
+	}
+	rc.SetValue(reflect.ValueOf(val), true)
+}
+
+func buildScalarResolver(value reflect.Type, scalar *types.Scalar) Resolver {
+	ptrDepth := 0
+	for value.Kind() == reflect.Ptr {
+		ptrDepth++
+		value = value.Elem()
+	}
+	return &scalarResolver{ptrDepth: ptrDepth, scalar: scalar}
+}
@@ -108,6 +108,8 @@ type ClientInstance struct {
 	schema      *schema.Schema
 	models      map[string]*execution.Model
 	resolvers   map[string]interface{}
+	// schemaVersion is the schema version the client built its queries against, empty if unknown.
+	schemaVersion string
 }
 
 // BuildClient builds a new ClientInstance given a ServerSendChan write channel and root resolver instances.
@@ -149,6 +151,16 @@ func (s *Server) BuildClient(ctx context.Context, sendChan ServerSendChan, query
 	}, nil
 }
 
+// SetSchemaVersion sets the schema version the client built its queries against, as declared by the client
+// when connecting. Tree mutations of the client are rejected if it does not match the SchemaVersion of the
+// tree options of the schema, so the client knows to fetch the schema again.
+func (ci *ClientInstance) SetSchemaVersion(version string) {
+	ci.mtx.Lock()
+	defer ci.mtx.Unlock()
+
+	ci.schemaVersion = version
+}
+
 func (ci *ClientInstance) send(msg *proto.RGQLServerMessage) {
 	select {
 	case <-ci.clientCtx.Done():
@@ -174,6 +186,11 @@ func (ci *ClientInstance) handleInitQuery(msg *proto.RGQLQueryInit) (err error)
 		return errors.New("Duplicate query ID.")
 	}
 
+	mod := ci.models[msg.OperationType]
+	if mod == nil {
+		return errors.New("No resolvers are defined for " + msg.OperationType + " operations.")
+	}
+
 	nctx, nctxCancel := context.WithCancel(ci.clientCtx)
 	errCh := make(chan *proto.RGQLQueryError, 10)
 	outpCh := make(chan []byte, ResolverBufferSize)
@@ -182,9 +199,9 @@ func (ci *ClientInstance) handleInitQuery(msg *proto.RGQLQueryInit) (err error)
 		nctxCancel()
 		return err
 	}
+	go ci.forwardQueryErrors(nctx, qt.Context(), msg.QueryId, errCh)
 	enc := encoding.NewResultEncoder(int(PathCacheSize))
 	go enc.Run(nctx, outpCh)
-	mod := ci.models[msg.OperationType]
 	ec, err := mod.Execute(nctx, enc, qt, ci.resolvers[msg.OperationType], mod.IsSerialOnly() || msg.ForceSerial)
 	e := &queryExecution{
 		ctx:        nctx,
@@ -200,6 +217,25 @@ func (ci *ClientInstance) handleInitQuery(msg *proto.RGQLQueryInit) (err error)
 	return nil
 }
 
+// forwardQueryErrors relays query tree errors to the client until the query ends.
+// Errors are drained until the tree is disposed, the ones sent after the query ended are dropped.
+func (ci *ClientInstance) forwardQueryErrors(ctx, treeCtx context.Context, queryId uint32, errCh <-chan *proto.RGQLQueryError) {
+	for {
+		select {
+		case <-treeCtx.Done():
+			return
+		case <-ci.clientCtx.Done():
+			return
+		case qerr := <-errCh:
+			if ctx.Err() != nil {
+				continue
+			}
+			qerr.QueryId = queryId
+			ci.send(&proto.RGQLServerMessage{QueryError: qerr})
+		}
+	}
+}
+
 func (ci *ClientInstance) handleFinishQuery(msg *proto.RGQLQueryFinish) {
 	id := msg.QueryId
 	q, ok := ci.queries[id]
@@ -207,6 +243,9 @@ func (ci *ClientInstance) handleFinishQuery(msg *proto.RGQLQueryFinish) {
 		return
 	}
 	q.ctxCancel()
+	if q.ec != nil {
+		q.ec.QNodeRoot.Dispose()
+	}
 	delete(ci.queries, id)
 }
 
@@ -222,7 +261,7 @@ func (ci *ClientInstance) HandleMessage(msg *proto.RGQLClientMessage) {
 	if msg.MutateTree != nil {
 		query, ok := ci.queries[msg.MutateTree.QueryId]
 		if ok {
-			query.ec.QNodeRoot.ApplyTreeMutation(msg.MutateTree)
+			query.ec.QNodeRoot.ApplyTreeMutationVersioned(msg.MutateTree, ci.schemaVersion)
 		}
 	}
 
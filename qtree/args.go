@@ -0,0 +1,107 @@
+package qtree
+
+import (
+	"math"
+)
+
+// argumentValue returns the current value of an argument.
+// Arguments referencing variables no longer in the variable store are treated as missing.
+func (qt *QueryTreeNode) argumentValue(name string) (interface{}, bool) {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	ref, ok := qt.Arguments[name]
+	if !ok || (!ref.IsConstant() && !qt.VariableStore.Has(ref.Id)) {
+		return nil, false
+	}
+	return ref.Value, true
+}
+
+// ArgInt returns an integer argument.
+// Floats without a fractional part, as decoded from JSON values, are accepted.
+func (qt *QueryTreeNode) ArgInt(name string) (int, bool) {
+	val, ok := qt.argumentValue(name)
+	if !ok {
+		return 0, false
+	}
+	switch v := val.(type) {
+	case int32:
+		return int(v), true
+	case int:
+		return v, true
+	case int64:
+		if int64(int(v)) != v {
+			return 0, false
+		}
+		return int(v), true
+	case float64:
+		if v != math.Trunc(v) || v > math.MaxInt32 || v < math.MinInt32 {
+			return 0, false
+		}
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
+// ArgFloat returns a float argument, integers are promoted.
+func (qt *QueryTreeNode) ArgFloat(name string) (float64, bool) {
+	val, ok := qt.argumentValue(name)
+	if !ok {
+		return 0, false
+	}
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// ArgString returns a string argument.
+func (qt *QueryTreeNode) ArgString(name string) (string, bool) {
+	val, ok := qt.argumentValue(name)
+	if !ok {
+		return "", false
+	}
+	str, ok := val.(string)
+	return str, ok
+}
+
+// ArgBool returns a boolean argument.
+func (qt *QueryTreeNode) ArgBool(name string) (bool, bool) {
+	val, ok := qt.argumentValue(name)
+	if !ok {
+		return false, false
+	}
+	b, ok := val.(bool)
+	return b, ok
+}
+
+// ReferencedVariables returns the IDs of the variables referenced by the arguments and directives in the subtree.
+// Constants, from inline values and defaults, are not included.
+func (qt *QueryTreeNode) ReferencedVariables() map[uint32]struct{} {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	ids := make(map[uint32]struct{})
+	qt.walk(func(nod *QueryTreeNode) bool {
+		for _, refs := range []map[string]*VariableReference{nod.Arguments, nod.Directives} {
+			for _, ref := range refs {
+				if !ref.IsConstant() {
+					ids[ref.Id] = struct{}{}
+				}
+			}
+		}
+		return true
+	})
+	return ids
+}
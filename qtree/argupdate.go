@@ -0,0 +1,135 @@
+package qtree
+
+import (
+	"fmt"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// updateArguments refreshes the arguments of nodes referencing the given variables.
+// The parent of each affected node receives an Operation_ArgsChanged update.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) updateArguments(changed map[uint32]struct{}) {
+	qt.Root.walk(func(nod *QueryTreeNode) bool {
+		if len(nod.Arguments) == 0 || nod.ResolveError != nil || nod.Parent == nil {
+			return true
+		}
+
+		affected := false
+		for _, ref := range nod.Arguments {
+			if _, ok := changed[ref.Id]; ok && !ref.IsConstant() {
+				affected = true
+				break
+			}
+		}
+		if !affected {
+			return true
+		}
+
+		if err := nod.refreshArguments(changed); err != nil {
+			// Invalid values keep the current arguments.
+			qt.sendError(nod.Id, err)
+			if onError := qt.Root.options.OnError; onError != nil {
+				onError(nod, nod.nodeError(err))
+			}
+			return true
+		}
+		if nod.Inactive {
+			return true
+		}
+		nod.Parent.nextUpdate(&QTNodeUpdate{
+			Operation: Operation_ArgsChanged,
+			Child:     nod,
+		})
+		return true
+	})
+}
+
+// refreshArguments replaces the references to changed variables with new references.
+// Arguments are copied to a new map, as resolvers may be reading the old one.
+func (qt *QueryTreeNode) refreshArguments(changed map[uint32]struct{}) error {
+	argMap := make(map[string]*VariableReference, len(qt.Arguments))
+	var added, replaced []*VariableReference
+	for name, ref := range qt.Arguments {
+		if _, ok := changed[ref.Id]; !ok || ref.IsConstant() {
+			argMap[name] = ref
+			continue
+		}
+
+		nref := qt.VariableStore.Get(ref.Id)
+		if nref == nil {
+			argMap[name] = ref
+			continue
+		}
+		added = append(added, nref)
+		val, err := coerceFieldArgument(qt.Root.types, qt.fieldDef, name, nref.Value)
+		if err == nil {
+			err = qt.checkImmutable(name, val)
+		}
+		if err != nil {
+			for _, aref := range added {
+				aref.Unsubscribe()
+			}
+			return err
+		}
+		nref.Value = val
+		argMap[name] = nref
+		replaced = append(replaced, ref)
+	}
+
+	for _, ref := range replaced {
+		ref.Unsubscribe()
+	}
+	qt.Arguments = argMap
+	return nil
+}
+
+// RebindArgument binds a field argument of the node to another variable in place.
+// The parent receives an Operation_ArgsChanged update, the subtree is kept.
+func (qt *QueryTreeNode) RebindArgument(name string, variableId uint32) error {
+	qt.Root.rootMtx.Lock()
+	defer qt.Root.rootMtx.Unlock()
+
+	if qt.disposed || qt.Parent == nil {
+		return fmt.Errorf("Invalid node %d, arguments cannot be rebound.", qt.Id)
+	}
+	if argumentDefinition(qt.fieldDef, name) == nil {
+		return fmt.Errorf("Invalid argument %s on field %s.", name, qt.FieldName)
+	}
+	if ref, ok := qt.Arguments[name]; ok && !ref.IsConstant() && ref.Id == variableId {
+		return nil
+	}
+
+	nref := qt.VariableStore.Get(variableId)
+	if nref == nil {
+		return variableNotFoundError(&proto.FieldArgument{Name: name, VariableId: variableId})
+	}
+	val, err := coerceFieldArgument(qt.Root.types, qt.fieldDef, name, nref.Value)
+	if err == nil {
+		err = qt.checkImmutable(name, val)
+	}
+	if err != nil {
+		nref.Unsubscribe()
+		return err
+	}
+	nref.Value = val
+
+	// Arguments are copied to a new map, as resolvers may be reading the old one.
+	argMap := make(map[string]*VariableReference, len(qt.Arguments)+1)
+	for aname, ref := range qt.Arguments {
+		argMap[aname] = ref
+	}
+	if ref, ok := argMap[name]; ok {
+		ref.Unsubscribe()
+	}
+	argMap[name] = nref
+	qt.Arguments = argMap
+
+	if !qt.Inactive {
+		qt.Parent.nextUpdate(&QTNodeUpdate{
+			Operation: Operation_ArgsChanged,
+			Child:     qt,
+		})
+	}
+	return nil
+}
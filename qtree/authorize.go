@@ -0,0 +1,82 @@
+package qtree
+
+import (
+	"fmt"
+	"time"
+)
+
+// With a FieldAuthorizer set, every field selection added to the tree is checked against it. A node
+// selecting a denied field is kept in the tree, with its subtree, marked with the ResolveError of an
+// *AuthorizationError so resolvers skip it. With the RetryBackoff option, retrying the node checks the
+// field again, so a grant can be applied by selecting the node once more.
+
+// FieldAuthorizer decides which fields of the schema a client may select.
+type FieldAuthorizer interface {
+	// Allow checks if the field fieldName may be selected below the node. Returning false or an error denies
+	// the field. It is called with the tree locked and must not call back into the tree.
+	Allow(node *QueryTreeNode, fieldName string) (bool, error)
+}
+
+// FieldAuthorizerFunc adapts a function to a FieldAuthorizer.
+type FieldAuthorizerFunc func(node *QueryTreeNode, fieldName string) (bool, error)
+
+// Allow calls the function.
+func (f FieldAuthorizerFunc) Allow(node *QueryTreeNode, fieldName string) (bool, error) {
+	return f(node, fieldName)
+}
+
+// AuthorizationError marks a node selecting a field denied by the FieldAuthorizer.
+type AuthorizationError struct {
+	NodeId    uint32
+	FieldName string
+	// Err is the error returned by the authorizer, if any.
+	Err error
+}
+
+// Error returns the error message.
+func (e *AuthorizationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Invalid node %d, not authorized to select field %s: %v", e.NodeId, e.FieldName, e.Err)
+	}
+	return fmt.Sprintf("Invalid node %d, not authorized to select field %s.", e.NodeId, e.FieldName)
+}
+
+// Unwrap returns the error returned by the authorizer.
+func (e *AuthorizationError) Unwrap() error {
+	return e.Err
+}
+
+// SetFieldAuthorizer sets the authorizer checking the fields selected by nodes added afterwards, nil for none.
+func (qt *QueryTreeNode) SetFieldAuthorizer(authorizer FieldAuthorizer) {
+	qt.Root.rootMtx.Lock()
+	defer qt.Root.rootMtx.Unlock()
+
+	qt.Root.fieldAuthorizer = authorizer
+}
+
+// authorize checks if the node nodeId may select fieldName below this node, expects the root lock to be held.
+// Returns an *AuthorizationError if the field is denied.
+func (qt *QueryTreeNode) authorize(nodeId uint32, fieldName string) error {
+	authorizer := qt.Root.fieldAuthorizer
+	if authorizer == nil {
+		return nil
+	}
+	if qt.Root.nodePool != nil {
+		qt.escaped = true
+	}
+	allowed, err := authorizer.Allow(qt, fieldName)
+	if allowed && err == nil {
+		return nil
+	}
+	return &AuthorizationError{NodeId: nodeId, FieldName: fieldName, Err: err}
+}
+
+// markUnauthorized marks an added node with the authorization error of its field, expects the root lock to be held.
+func (qt *QueryTreeNode) markUnauthorized(err error) {
+	qt.ResolveError = err
+	qt.nextRetry = time.Now().Add(qt.Root.options.retryDelay(qt.retries))
+	qt.sendError(qt.Id, err)
+	if onError := qt.Root.options.OnError; onError != nil {
+		onError(qt, qt.nodeError(err))
+	}
+}
@@ -0,0 +1,220 @@
+package qtree
+
+import (
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// CloneOptions configures a query tree clone.
+type CloneOptions struct {
+	// CopyVariables gives the clone its own copy of the variable store.
+	// Otherwise the clone references the variable store of the original tree.
+	CopyVariables bool
+	// ErrorCh receives the errors of the clone, nil to share the error channel of the original tree.
+	ErrorCh chan<- *proto.RGQLQueryError
+}
+
+// Clone deep-copies the subtree into a new tree sharing the variable store of the original.
+// The clone has no subscribers, resolvers or dispose callbacks, and changes to either tree do not affect the other.
+// Cloning a node other than the root gives a tree rooted at the copy of the node.
+// Dispose the clone to release its variable references, until then a shared store reports them as leaked.
+func (qt *QueryTreeNode) Clone() *QueryTreeNode {
+	return qt.CloneWithOptions(CloneOptions{})
+}
+
+// CloneWithOptions deep-copies the subtree into a new tree configured by opts.
+func (qt *QueryTreeNode) CloneWithOptions(opts CloneOptions) *QueryTreeNode {
+	unlock := qt.rlockTree()
+	defer unlock()
+
+	store := qt.VariableStore
+	if opts.CopyVariables {
+		store = qt.VariableStore.clone()
+	}
+	errCh := opts.ErrorCh
+	if errCh == nil {
+		errCh = qt.Root.errCh
+	}
+
+	cloned := make(map[*QueryTreeNode]*QueryTreeNode)
+	nroot := qt.cloneNode(nil, nil, store, errCh, cloned)
+	nroot.RootNodeMap = make(map[uint32]*QueryTreeNode, len(cloned))
+	nroot.RootNodeMap[nroot.Id] = nroot
+	for id, nod := range qt.Root.RootNodeMap {
+		if cnod, ok := cloned[nod]; ok {
+			nroot.RootNodeMap[id] = cnod
+		}
+	}
+	nroot.fragmentSpreads = make(map[uint32]*fragmentSpread)
+	for id, spread := range qt.Root.fragmentSpreads {
+		nspread := &fragmentSpread{}
+		for _, nod := range spread.nodes {
+			if cnod, ok := cloned[nod]; ok {
+				nspread.nodes = append(nspread.nodes, cnod)
+			}
+		}
+		if len(nspread.nodes) == len(spread.nodes) && len(spread.nodes) != 0 {
+			nroot.fragmentSpreads[id] = nspread
+		}
+	}
+
+	nroot.emptyCh = make(chan struct{}, 1)
+	nroot.types = qt.Root.types
+	nroot.idCounter = qt.Root.idCounter
+	nroot.options = qt.Root.options
+	if qt.Root.nodePool != nil {
+		nroot.nodePool = newNodePool()
+	}
+	nroot.OperationType = qt.Root.OperationType
+	nroot.fieldAuthorizer = qt.Root.fieldAuthorizer
+	if len(qt.Root.fragments) != 0 {
+		nroot.fragments = make(map[string]*ast.FragmentDefinition, len(qt.Root.fragments))
+		for name, def := range qt.Root.fragments {
+			nroot.fragments[name] = def
+		}
+	}
+	if len(qt.Root.directiveHandlers) != 0 {
+		nroot.directiveHandlers = make(map[string]DirectiveHandler, len(qt.Root.directiveHandlers))
+		for name, handler := range qt.Root.directiveHandlers {
+			nroot.directiveHandlers[name] = handler
+		}
+	}
+	if qt.Root == qt {
+		nroot.stats = qt.stats
+		nroot.complexity = qt.complexity
+	} else {
+		nroot.stats.LiveNodes = len(cloned) - 1
+		for _, cnod := range cloned {
+			nroot.complexity += cnod.cost
+		}
+	}
+	if opts.CopyVariables {
+		store.tree = nroot
+	}
+	return nroot
+}
+
+// cloneNode copies the node and its children, expects the root lock to be held.
+// The Root of copies is set to root, or to the copy itself when root is nil.
+func (qt *QueryTreeNode) cloneNode(root, parent *QueryTreeNode,
+	store *VariableStore,
+	errCh chan<- *proto.RGQLQueryError,
+	cloned map[*QueryTreeNode]*QueryTreeNode) *QueryTreeNode {
+	nnod := &QueryTreeNode{
+		Id:               qt.Id,
+		level:            qt.level,
+		Root:             root,
+		Parent:           parent,
+		SchemaResolver:   qt.SchemaResolver,
+		VariableStore:    store,
+		FieldName:        qt.FieldName,
+		ResolverName:     qt.ResolverName,
+		Alias:            qt.Alias,
+		fieldDef:         qt.fieldDef,
+		immutableArgs:    qt.immutableArgs,
+		AST:              qt.AST,
+		IsPrimitive:      qt.IsPrimitive,
+		PrimitiveName:    qt.PrimitiveName,
+		IsList:           qt.IsList,
+		ListDepth:        qt.ListDepth,
+		PossibleTypes:    qt.PossibleTypes,
+		TypeCondition:    qt.TypeCondition,
+		Inactive:         qt.Inactive,
+		cost:             qt.cost,
+		fragmentSpreadId: qt.fragmentSpreadId,
+		ResolveError:     qt.ResolveError,
+		retries:          qt.retries,
+		nextRetry:        qt.nextRetry,
+		pending:          qt.pending,
+		ResolveTimeout:   qt.ResolveTimeout,
+		Incremental:      qt.Incremental,
+		subscribers:      make(map[uint32]*qtNodeSubscription),
+		errCh:            errCh,
+		disposeChan:      make(chan struct{}),
+		disposed:         qt.disposed,
+	}
+	if root == nil {
+		nnod.Root = nnod
+		root = nnod
+	}
+	if qt.disposed {
+		close(nnod.disposeChan)
+	}
+	if qt.Arguments != nil {
+		nnod.Arguments = cloneReferences(store, qt.Arguments)
+	}
+	if qt.Directives != nil {
+		nnod.Directives = cloneReferences(store, qt.Directives)
+	}
+	if qt.literals != nil {
+		nnod.literals = make(map[string]string, len(qt.literals))
+		for name, literal := range qt.literals {
+			nnod.literals[name] = literal
+		}
+	}
+	if qt.directiveLiterals != nil {
+		nnod.directiveLiterals = make(map[string]string, len(qt.directiveLiterals))
+		for name, literal := range qt.directiveLiterals {
+			nnod.directiveLiterals[name] = literal
+		}
+	}
+	if qt.Annotations != nil {
+		nnod.Annotations = make(map[string]interface{}, len(qt.Annotations))
+		for key, val := range qt.Annotations {
+			nnod.Annotations[key] = val
+		}
+	}
+	if qt.refs != nil {
+		nnod.refs = make(map[uint32]uint32, len(qt.refs))
+		for id, parentRef := range qt.refs {
+			nnod.refs[id] = parentRef
+		}
+	}
+	cloned[qt] = nnod
+	for _, child := range qt.Children {
+		nchild := child.cloneNode(root, nnod, store, errCh, cloned)
+		nnod.Children = append(nnod.Children, nchild)
+		nnod.indexTypedChild(nchild)
+	}
+	return nnod
+}
+
+// cloneReferences adds a reference in store for each variable reference, keeping the current values.
+func cloneReferences(store *VariableStore, refs map[string]*VariableReference) map[string]*VariableReference {
+	nrefs := make(map[string]*VariableReference, len(refs))
+	for name, ref := range refs {
+		if ref.IsConstant() {
+			nrefs[name] = ref
+			continue
+		}
+		nref := store.Get(ref.Id)
+		if nref == nil {
+			// The variable is kept alive by ref, this should not happen.
+			nref = NewConstantReference(ref.Value)
+		} else {
+			nref.Value = ref.Value
+		}
+		nrefs[name] = nref
+	}
+	return nrefs
+}
+
+// clone copies the variable values, defaults and types into a new store without references or subscribers.
+func (vs *VariableStore) clone() *VariableStore {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	nvs := NewVariableStore()
+	for id, varb := range vs.Variables {
+		nvarb := NewVariable(id)
+		nvarb.Value = varb.Value
+		nvs.Variables[id] = nvarb
+	}
+	for id, def := range vs.defaults {
+		nvs.defaults[id] = def
+	}
+	for id, typ := range vs.types {
+		nvs.DeclareType(id, typ)
+	}
+	return nvs
+}
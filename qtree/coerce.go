@@ -0,0 +1,234 @@
+package qtree
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/rgraphql/magellan/types"
+)
+
+// coerceArgument checks a variable value against the argument type, applying the coercion rules.
+// Int values are promoted to Float and ID, single values are wrapped into lists.
+func coerceArgument(schemaResolver SchemaResolver, typ ast.Type, value interface{}) (interface{}, error) {
+	if nn, ok := typ.(*ast.NonNull); ok {
+		if value == nil {
+			return nil, fmt.Errorf("Expected non-null %s, got null.", typeString(nn.Type))
+		}
+		return coerceArgument(schemaResolver, nn.Type, value)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	switch t := typ.(type) {
+	case *ast.List:
+		if list, ok := value.([]interface{}); ok {
+			res := make([]interface{}, len(list))
+			for i, item := range list {
+				citem, err := coerceArgument(schemaResolver, t.Type, item)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid list item %d: %v", i, err)
+				}
+				res[i] = citem
+			}
+			return res, nil
+		}
+		item, err := coerceArgument(schemaResolver, t.Type, value)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{item}, nil
+	case *ast.Named:
+		return coerceNamed(schemaResolver, t, value)
+	default:
+		return value, nil
+	}
+}
+
+// coerceNamed checks a value against a named scalar or enum type.
+func coerceNamed(schemaResolver SchemaResolver, typ *ast.Named, value interface{}) (interface{}, error) {
+	if typ.Name == nil {
+		return value, nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("Expected %s, got %#v.", typ.Name.Value, value)
+	}
+
+	switch typ.Name.Value {
+	case "Int":
+		switch v := value.(type) {
+		case int32:
+		case float64:
+			// Numbers decoded from JSON objects.
+			if v != math.Trunc(v) || v > math.MaxInt32 || v < math.MinInt32 {
+				return nil, mismatch()
+			}
+			return int32(v), nil
+		default:
+			return nil, mismatch()
+		}
+	case "Float":
+		switch v := value.(type) {
+		case float64:
+		case int32:
+			return float64(v), nil
+		default:
+			return nil, mismatch()
+		}
+	case "String":
+		if _, ok := value.(string); !ok {
+			return nil, mismatch()
+		}
+	case "Boolean":
+		if _, ok := value.(bool); !ok {
+			return nil, mismatch()
+		}
+	case "ID":
+		// IDs are serialized as strings, integers are accepted and normalized.
+		switch v := value.(type) {
+		case string:
+		case int32:
+			return strconv.Itoa(int(v)), nil
+		case float64:
+			// Numbers decoded from JSON objects.
+			if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+				return nil, mismatch()
+			}
+			return strconv.FormatInt(int64(v), 10), nil
+		default:
+			return nil, mismatch()
+		}
+	default:
+		if scalar, ok := types.LookupScalar(typ.Name.Value); ok {
+			if scalar.Coerce == nil {
+				return value, nil
+			}
+			cval, err := scalar.Coerce(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", typ.Name.Value, err)
+			}
+			return cval, nil
+		}
+		if schemaResolver == nil {
+			return value, nil
+		}
+		var ed *ast.EnumDefinition
+		switch def := schemaResolver.LookupType(typ).(type) {
+		case *ast.EnumDefinition:
+			ed = def
+		case *ast.InputObjectDefinition:
+			return coerceInputObject(schemaResolver, def, value)
+		default:
+			// Custom scalars are passed through.
+			return value, nil
+		}
+		str, ok := value.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		for _, ev := range ed.Values {
+			if ev.Name != nil && ev.Name.Value == str {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("Invalid value %s for enum %s.", str, typ.Name.Value)
+	}
+	return value, nil
+}
+
+// coerceInputObject checks an object value field-by-field against an input object type.
+// Omitted fields with defaults are filled in.
+func coerceInputObject(schemaResolver SchemaResolver, def *ast.InputObjectDefinition, value interface{}) (interface{}, error) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected %s, got %#v.", def.Name.Value, value)
+	}
+
+	res := make(map[string]interface{}, len(def.Fields))
+	for _, field := range def.Fields {
+		if field.Name == nil {
+			continue
+		}
+		name := field.Name.Value
+		fval, ok := obj[name]
+		if !ok {
+			if field.DefaultValue != nil {
+				dval, err := valueFromAST(field.DefaultValue)
+				if err != nil {
+					return nil, err
+				}
+				res[name] = dval
+				continue
+			}
+			if _, nonNull := field.Type.(*ast.NonNull); nonNull {
+				return nil, fmt.Errorf("Missing required field %s on input %s.", name, def.Name.Value)
+			}
+			continue
+		}
+		cval, err := coerceArgument(schemaResolver, field.Type, fval)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for field %s on input %s: %v", name, def.Name.Value, err)
+		}
+		res[name] = cval
+	}
+
+	for name := range obj {
+		if _, ok := res[name]; ok {
+			continue
+		}
+		known := false
+		for _, field := range def.Fields {
+			if field.Name != nil && field.Name.Value == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Invalid field %s on input %s.", name, def.Name.Value)
+		}
+	}
+	return res, nil
+}
+
+// typeString formats a type reference as in the schema.
+func typeString(typ ast.Type) string {
+	switch t := typ.(type) {
+	case *ast.NonNull:
+		return typeString(t.Type) + "!"
+	case *ast.List:
+		return "[" + typeString(t.Type) + "]"
+	case *ast.Named:
+		if t.Name != nil {
+			return t.Name.Value
+		}
+	}
+	return ""
+}
+
+// argumentDefinition finds an argument definition on a field by name.
+func argumentDefinition(field *ast.FieldDefinition, name string) *ast.InputValueDefinition {
+	if field == nil {
+		return nil
+	}
+	for _, def := range field.Arguments {
+		if def.Name != nil && def.Name.Value == name {
+			return def
+		}
+	}
+	return nil
+}
+
+// coerceFieldArgument coerces a variable value bound to a field argument.
+func coerceFieldArgument(schemaResolver SchemaResolver, field *ast.FieldDefinition, argName string, value interface{}) (interface{}, error) {
+	def := argumentDefinition(field, argName)
+	if def == nil {
+		return value, nil
+	}
+	cval, err := coerceArgument(schemaResolver, def.Type, value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for argument %s on field %s: %v", argName, field.Name.Value, err)
+	}
+	return cval, nil
+}
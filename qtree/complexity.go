@@ -0,0 +1,115 @@
+package qtree
+
+import (
+	"fmt"
+)
+
+// ComplexityEstimator estimates the cost of resolving a query tree node.
+// Nodes are estimated once their field, arguments and parents are known.
+type ComplexityEstimator interface {
+	Cost(node *QueryTreeNode) int
+}
+
+// ListComplexityEstimator charges one per node, multiplied by the size of every enclosing list.
+type ListComplexityEstimator struct {
+	// ListSize is the assumed size of lists without a size argument.
+	ListSize int
+	// SizeArguments are the names of arguments bounding the size of a list, like "first".
+	SizeArguments []string
+}
+
+// Cost estimates the cost of a node.
+func (e *ListComplexityEstimator) Cost(node *QueryTreeNode) int {
+	cost := 1
+	for nod := node.Parent; nod != nil && nod.Parent != nil; nod = nod.Parent {
+		if nod.IsList {
+			cost *= e.listSize(nod)
+		}
+	}
+	return cost
+}
+
+// listSize returns the expected size of a list node.
+func (e *ListComplexityEstimator) listSize(nod *QueryTreeNode) int {
+	for _, name := range e.SizeArguments {
+		ref, ok := nod.Arguments[name]
+		if !ok {
+			continue
+		}
+		if size, ok := ref.Value.(int32); ok && size >= 0 {
+			return int(size)
+		}
+	}
+	if e.ListSize > 0 {
+		return e.ListSize
+	}
+	return 1
+}
+
+// chargeComplexity adds the cost of a new node to the tree total.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) chargeComplexity(nod *QueryTreeNode) error {
+	opts := qt.Root.options
+	if opts.Complexity == nil {
+		return nil
+	}
+
+	cost := opts.Complexity.Cost(nod)
+	qt.Root.sharedMtx.Lock()
+	defer qt.Root.sharedMtx.Unlock()
+
+	if opts.MaxComplexity > 0 && qt.Root.complexity+cost > opts.MaxComplexity {
+		return fmt.Errorf("Invalid node %d, exceeds the maximum complexity of %d.", nod.Id, opts.MaxComplexity)
+	}
+	nod.cost = cost
+	qt.Root.complexity += cost
+	return nil
+}
+
+// rechargeComplexity estimates the subtree again after the node changed, expects the root lock to be held.
+// Fails without changes if the tree would exceed the maximum complexity, otherwise adjusts the tree total.
+func (qt *QueryTreeNode) rechargeComplexity() error {
+	opts := qt.Root.options
+	if opts.Complexity == nil {
+		return nil
+	}
+
+	costs := make(map[*QueryTreeNode]int)
+	delta := 0
+	qt.walk(func(n *QueryTreeNode) bool {
+		costs[n] = opts.Complexity.Cost(n)
+		delta += costs[n] - n.cost
+		return true
+	})
+
+	qt.Root.sharedMtx.Lock()
+	defer qt.Root.sharedMtx.Unlock()
+	if opts.MaxComplexity > 0 && delta > 0 && qt.Root.complexity+delta > opts.MaxComplexity {
+		return fmt.Errorf("Invalid node %d, exceeds the maximum complexity of %d.", qt.Id, opts.MaxComplexity)
+	}
+	for n, cost := range costs {
+		n.cost = cost
+	}
+	qt.Root.complexity += delta
+	return nil
+}
+
+// Complexity returns the estimated cost of the subtree including this node.
+func (qt *QueryTreeNode) Complexity() int {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	if qt == qt.Root {
+		return qt.complexity
+	}
+	return qt.subtreeCost()
+}
+
+// subtreeCost sums the cost of the subtree, expects the root lock to be held.
+func (qt *QueryTreeNode) subtreeCost() int {
+	cost := qt.cost
+	for _, child := range qt.Children {
+		cost += child.subtreeCost()
+	}
+	return cost
+}
@@ -0,0 +1,69 @@
+package qtree
+
+// typeConditionNames returns the names of the concrete types an inline fragment node applies to.
+// Without known possible types, the type condition itself is used.
+func (qt *QueryTreeNode) typeConditionNames() []string {
+	if len(qt.PossibleTypes) == 0 {
+		return []string{qt.TypeCondition}
+	}
+	names := make([]string, 0, len(qt.PossibleTypes))
+	for _, typ := range qt.PossibleTypes {
+		if typ.Name != nil {
+			names = append(names, typ.Name.Value)
+		}
+	}
+	return names
+}
+
+// indexTypedChild adds an inline fragment child to the groups of its concrete types.
+// Other children are ignored. Expects the root lock to be held.
+func (qt *QueryTreeNode) indexTypedChild(child *QueryTreeNode) {
+	if child.TypeCondition == "" {
+		return
+	}
+	if qt.typedChildren == nil {
+		qt.typedChildren = make(map[string][]*QueryTreeNode)
+	}
+	for _, name := range child.typeConditionNames() {
+		qt.typedChildren[name] = append(qt.typedChildren[name], child)
+	}
+}
+
+// unindexTypedChild removes an inline fragment child from the groups of its concrete types.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) unindexTypedChild(child *QueryTreeNode) {
+	if child.TypeCondition == "" || qt.typedChildren == nil {
+		return
+	}
+	for _, name := range child.typeConditionNames() {
+		group := qt.typedChildren[name]
+		for i, item := range group {
+			if item == child {
+				group = append(group[:i:i], group[i+1:]...)
+				break
+			}
+		}
+		if len(group) == 0 {
+			delete(qt.typedChildren, name)
+		} else {
+			qt.typedChildren[name] = group
+		}
+	}
+}
+
+// SelectionsFor returns the children selected when the node resolves to the named concrete type:
+// the children without a type condition, followed by the inline fragments applying to the type.
+// Nested inline fragments are returned as nodes, call SelectionsFor on them in turn.
+func (qt *QueryTreeNode) SelectionsFor(typeName string) []*QueryTreeNode {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	typed := qt.typedChildren[typeName]
+	res := make([]*QueryTreeNode, 0, len(qt.Children))
+	for _, child := range qt.Children {
+		if child.TypeCondition == "" {
+			res = append(res, child)
+		}
+	}
+	return append(res, typed...)
+}
@@ -0,0 +1,67 @@
+package qtree
+
+import (
+	"time"
+)
+
+// pendingArgsChanged is a debounced Operation_ArgsChanged update of a node, see the ArgsChangedDebounce option.
+type pendingArgsChanged struct {
+	timer *time.Timer
+}
+
+// debounceArgsChanged delays the Operation_ArgsChanged update of child by the ArgsChangedDebounce option,
+// restarting the delay of a pending update. Returns false if updates are not debounced.
+func (qt *QueryTreeNode) debounceArgsChanged(child *QueryTreeNode) bool {
+	interval := qt.options.ArgsChangedDebounce
+	if interval <= 0 || child == nil {
+		return false
+	}
+
+	qt.debounceMtx.Lock()
+	defer qt.debounceMtx.Unlock()
+
+	if prev, ok := qt.debounced[child]; ok {
+		prev.timer.Stop()
+	}
+	if qt.debounced == nil {
+		qt.debounced = make(map[*QueryTreeNode]*pendingArgsChanged)
+	}
+	pending := &pendingArgsChanged{}
+	pending.timer = time.AfterFunc(interval, func() {
+		qt.flushArgsChanged(child, pending)
+	})
+	qt.debounced[child] = pending
+	return true
+}
+
+// flushArgsChanged delivers the debounced update of child to its parent, unless it was superseded.
+func (qt *QueryTreeNode) flushArgsChanged(child *QueryTreeNode, pending *pendingArgsChanged) {
+	unlock := qt.rlockTree()
+	defer unlock()
+
+	qt.debounceMtx.Lock()
+	current := qt.debounced[child] == pending
+	if current {
+		delete(qt.debounced, child)
+	}
+	qt.debounceMtx.Unlock()
+
+	if !current || child.disposed || child.Inactive || child.Parent == nil {
+		return
+	}
+	child.Parent.deliverUpdate(&QTNodeUpdate{
+		Operation: Operation_ArgsChanged,
+		Child:     child,
+	})
+}
+
+// cancelArgsChanged drops the debounced update of a disposed node, expects the root lock to be held.
+func (qt *QueryTreeNode) cancelArgsChanged() {
+	root := qt.Root
+	root.debounceMtx.Lock()
+	if pending, ok := root.debounced[qt]; ok {
+		pending.timer.Stop()
+		delete(root.debounced, qt)
+	}
+	root.debounceMtx.Unlock()
+}
@@ -0,0 +1,74 @@
+package qtree
+
+import (
+	"reflect"
+	"sort"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// Diff returns the mutation turning the tree of old into the tree of new, matching nodes by ID.
+// Nodes selecting a different field or alias, with different arguments or under a different parent
+// are deleted and added again. Deletes come first, then adds, each in depth-first ID order, so trees with the
+// same nodes give the same mutation regardless of the order the nodes were added in.
+// Variable values are not part of the mutation.
+func Diff(old, new *QueryTreeNode) *proto.RGQLQueryTreeMutation {
+	oldSnap := old.ToProto()
+	newSnap := new.ToProto()
+	sortChildren(oldSnap)
+	sortChildren(newSnap)
+
+	var deletes, adds []*proto.RGQLQueryTreeMutation_NodeMutation
+	diffChildren(old.Id, oldSnap, newSnap, &deletes, &adds)
+	return &proto.RGQLQueryTreeMutation{NodeMutation: append(deletes, adds...)}
+}
+
+// diffChildren appends the operations turning the children of old into the children of new.
+// The children of both snapshots are sorted by ID.
+func diffChildren(parentId uint32,
+	old, new *proto.RGQLQueryTreeNode,
+	deletes, adds *[]*proto.RGQLQueryTreeMutation_NodeMutation) {
+	newChildren := make(map[uint32]*proto.RGQLQueryTreeNode, len(new.Children))
+	for _, child := range new.Children {
+		newChildren[child.Id] = child
+	}
+	matched := make(map[uint32]bool, len(old.Children))
+	for _, child := range old.Children {
+		nchild, ok := newChildren[child.Id]
+		if !ok || !sameSelection(child, nchild) {
+			*deletes = append(*deletes, &proto.RGQLQueryTreeMutation_NodeMutation{
+				NodeId:    child.Id,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+			})
+			continue
+		}
+		matched[child.Id] = true
+		diffChildren(child.Id, child, nchild, deletes, adds)
+	}
+	for _, nchild := range new.Children {
+		if matched[nchild.Id] {
+			continue
+		}
+		*adds = append(*adds, &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    parentId,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      nchild,
+		})
+	}
+}
+
+// sameSelection checks if two snapshot nodes select the same field with the same arguments.
+// Snapshot arguments are sorted by name.
+func sameSelection(a, b *proto.RGQLQueryTreeNode) bool {
+	return a.FieldName == b.FieldName && reflect.DeepEqual(a.Args, b.Args)
+}
+
+// sortChildren sorts the children of a snapshot node and their descendants by ID.
+func sortChildren(nod *proto.RGQLQueryTreeNode) {
+	sort.Slice(nod.Children, func(i, j int) bool {
+		return nod.Children[i].Id < nod.Children[j].Id
+	})
+	for _, child := range nod.Children {
+		sortChildren(child)
+	}
+}
@@ -0,0 +1,360 @@
+package qtree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// directiveArgPrefix prefixes the name of an argument carrying a directive, as in "@include".
+// The argument references a boolean variable, e.g. {Name: "@skip", VariableId: 2} for @skip(if: $v).
+// Custom directives reference an object of their arguments, e.g. {"role": "admin"} for @auth(role: "admin").
+// The value can also be given inline, as in {Name: "@include: true"} or {Name: `@auth: {role: "admin"}`}.
+const directiveArgPrefix = "@"
+
+const (
+	directiveSkip    = "skip"
+	directiveInclude = "include"
+)
+
+// directiveArgName returns the directive name if the argument name carries a directive.
+func directiveArgName(argName string) (string, bool) {
+	if !strings.HasPrefix(argName, directiveArgPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(argName, directiveArgPrefix), true
+}
+
+// DirectiveHandler hooks a directive into tree construction.
+// Handlers run with the tree locked, and may also be called on detached nodes when a mutation is validated.
+type DirectiveHandler interface {
+	// HandleDirective is called with a node being added and the directive arguments.
+	// Returning an error rejects the node.
+	HandleDirective(node *QueryTreeNode, args map[string]interface{}) error
+}
+
+// DirectiveHandlerFunc adapts a function to a DirectiveHandler.
+type DirectiveHandlerFunc func(node *QueryTreeNode, args map[string]interface{}) error
+
+// HandleDirective calls the function.
+func (f DirectiveHandlerFunc) HandleDirective(node *QueryTreeNode, args map[string]interface{}) error {
+	return f(node, args)
+}
+
+// RegisterDirective registers a handler for a directive, replacing any existing one.
+// Handlers apply to nodes added afterwards.
+// Handlers for @skip and @include are called in addition to the built-in evaluation.
+func (qt *QueryTreeNode) RegisterDirective(name string, handler DirectiveHandler) {
+	qt.Root.rootMtx.Lock()
+	defer qt.Root.rootMtx.Unlock()
+
+	if qt.Root.directiveHandlers == nil {
+		qt.Root.directiveHandlers = make(map[string]DirectiveHandler)
+	}
+	qt.Root.directiveHandlers[name] = handler
+}
+
+// isBuiltinDirective checks if a directive is evaluated by the tree itself.
+func isBuiltinDirective(name string) bool {
+	return name == directiveSkip || name == directiveInclude
+}
+
+// checkDirective checks that a directive is supported on query tree nodes, expects the root lock to be held.
+func (qt *QueryTreeNode) checkDirective(name string) error {
+	if isBuiltinDirective(name) || name == directiveTimeout || name == directiveDefer || name == directiveStream {
+		return nil
+	}
+	if _, ok := qt.Root.directiveHandlers[name]; ok {
+		return nil
+	}
+	return fmt.Errorf("Unknown directive @%s.", name)
+}
+
+// directiveConditionType is the type of the condition of the @skip and @include directives.
+var directiveConditionType ast.Type = &ast.NonNull{
+	Kind: "NonNull",
+	Type: &ast.Named{Kind: "Named", Name: &ast.Name{Kind: "Name", Value: "Boolean"}},
+}
+
+// ResolveDirectiveArg resolves the value of a directive argument, given inline or referencing a variable in
+// variableStore, coerced as for field arguments. @skip and @include take a Boolean! condition.
+// Every directive argument of a node is resolved with it, when added and when its variables change.
+func ResolveDirectiveArg(arg *proto.FieldArgument, variableStore *VariableStore) (interface{}, error) {
+	name, literal, isInline := splitInlineArgument(arg.Name)
+	directive, ok := directiveArgName(name)
+	if !ok {
+		return nil, fmt.Errorf("Invalid directive argument %s.", name)
+	}
+	if isInline {
+		return inlineDirectiveValue(directive, literal)
+	}
+	val, ok := variableStore.Value(arg.VariableId)
+	if !ok {
+		return nil, variableNotFoundError(arg)
+	}
+	return coerceDirectiveValue(directive, val)
+}
+
+// directiveReference resolves a directive argument with ResolveDirectiveArg, returning the reference kept on
+// the node. Inline values give a constant reference, references to variables must be released with Unsubscribe.
+func directiveReference(arg *proto.FieldArgument, variableStore *VariableStore) (*VariableReference, error) {
+	val, err := ResolveDirectiveArg(arg, variableStore)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, isInline := splitInlineArgument(arg.Name); isInline {
+		return NewConstantReference(val), nil
+	}
+	vref := variableStore.Get(arg.VariableId)
+	if vref == nil {
+		return nil, variableNotFoundError(arg)
+	}
+	vref.Value = val
+	return vref, nil
+}
+
+// inlineDirectiveValue parses and coerces the value of a directive given inline.
+func inlineDirectiveValue(directive, literal string) (interface{}, error) {
+	val, err := parseLiteral(literal)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for directive @%s: %v", directive, err)
+	}
+	return coerceDirectiveValue(directive, val)
+}
+
+// coerceDirectiveValue checks the value of a directive argument, applying the coercion rules of field arguments.
+// @skip and @include take a Boolean condition, other directives an object of arguments checked where they apply.
+func coerceDirectiveValue(directive string, val interface{}) (interface{}, error) {
+	if isBuiltinDirective(directive) {
+		cval, err := coerceArgument(nil, directiveConditionType, val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for directive @%s: %v", directive, err)
+		}
+		return cval, nil
+	}
+	if _, err := directiveArguments(directive, val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// directiveArguments returns the arguments of a directive given the referenced variable value.
+func directiveArguments(name string, val interface{}) (map[string]interface{}, error) {
+	if isBuiltinDirective(name) {
+		return map[string]interface{}{"if": val}, nil
+	}
+	switch args := val.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return args, nil
+	default:
+		return nil, fmt.Errorf("Directive @%s requires an object of arguments, got %#v.", name, val)
+	}
+}
+
+// handleDirectives calls the registered handlers of the node directives in name order.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) handleDirectives(node *QueryTreeNode, values map[string]interface{}) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if _, ok := qt.Root.directiveHandlers[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) != 0 {
+		node.escaped = true
+	}
+	for _, name := range names {
+		args, err := directiveArguments(name, values[name])
+		if err != nil {
+			return err
+		}
+		if err := qt.Root.directiveHandlers[name].HandleDirective(node, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Annotate stores a value on the node, for directive handlers to annotate the nodes they accept.
+// Annotate does not lock the tree, it is intended to be called from a DirectiveHandler.
+func (qt *QueryTreeNode) Annotate(key string, value interface{}) {
+	if qt.Annotations == nil {
+		qt.Annotations = make(map[string]interface{})
+	}
+	qt.Annotations[key] = value
+}
+
+// rootDirective returns the directive an argument of the root node carries, expects the root lock to be held.
+// The root type has no field arguments, so the root only accepts custom directives.
+func (qt *QueryTreeNode) rootDirective(arg *proto.FieldArgument) (string, error) {
+	name, _, _ := splitInlineArgument(arg.Name)
+	directive, isDirective := directiveArgName(name)
+	if !isDirective {
+		return "", fmt.Errorf("Invalid argument %s on %s, the root only accepts directives.", name, typeDefinitionName(qt.Root.AST))
+	}
+	switch directive {
+	case directiveSkip, directiveInclude, directiveTimeout, directiveDefer, directiveStream:
+		return "", fmt.Errorf("Directive @%s cannot be used on the root.", directive)
+	}
+	if err := qt.checkDirective(directive); err != nil {
+		return "", err
+	}
+	return directive, nil
+}
+
+// extendRoot applies a child tree with the ID of the root to the root itself, expects the root lock to be held.
+// The directives of the tree are handled on the root, replacing earlier ones, and its children are added.
+func (qt *QueryTreeNode) extendRoot(data *proto.RGQLQueryTreeNode) error {
+	directiveMap := make(map[string]*VariableReference, len(data.Args))
+	cleanup := func() {
+		for _, ref := range directiveMap {
+			ref.Unsubscribe()
+		}
+	}
+	values := make(map[string]interface{}, len(data.Args))
+	literals := make(map[string]string)
+	for _, arg := range data.Args {
+		directive, err := qt.rootDirective(arg)
+		if err == nil {
+			var vref *VariableReference
+			if vref, err = directiveReference(arg, qt.VariableStore); err == nil {
+				if _, literal, isInline := splitInlineArgument(arg.Name); isInline {
+					literals[directive] = literal
+				}
+				directiveMap[directive] = vref
+				values[directive] = vref.Value
+				continue
+			}
+		}
+		cleanup()
+		qt.sendError(qt.Id, err)
+		return err
+	}
+	if err := qt.handleDirectives(qt, values); err != nil {
+		cleanup()
+		qt.sendError(qt.Id, err)
+		return err
+	}
+	if err := qt.extend(data); err != nil {
+		cleanup()
+		return err
+	}
+
+	if len(directiveMap) == 0 {
+		return nil
+	}
+	if qt.Directives == nil {
+		qt.Directives = make(map[string]*VariableReference, len(directiveMap))
+	}
+	for name, ref := range directiveMap {
+		if old, ok := qt.Directives[name]; ok {
+			old.Unsubscribe()
+		}
+		qt.Directives[name] = ref
+		if literal, ok := literals[name]; ok {
+			if qt.directiveLiterals == nil {
+				qt.directiveLiterals = make(map[string]string)
+			}
+			qt.directiveLiterals[name] = literal
+		} else {
+			delete(qt.directiveLiterals, name)
+		}
+	}
+	return nil
+}
+
+// evaluateDirectives checks if the directive values include the node.
+// Only the built-in directives affect inclusion.
+func evaluateDirectives(values map[string]interface{}) (bool, error) {
+	include := true
+	for name, val := range values {
+		if !isBuiltinDirective(name) {
+			continue
+		}
+		cond, ok := val.(bool)
+		if !ok {
+			return false, fmt.Errorf("Directive @%s requires a boolean, got %#v.", name, val)
+		}
+		switch name {
+		case directiveSkip:
+			include = include && !cond
+		case directiveInclude:
+			include = include && cond
+		}
+	}
+	return include, nil
+}
+
+// currentDirectiveValues resolves the current variable values of the node directives with ResolveDirectiveArg.
+func (qt *QueryTreeNode) currentDirectiveValues() (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(qt.Directives))
+	for name, ref := range qt.Directives {
+		if ref.IsConstant() {
+			values[name] = ref.Value
+			continue
+		}
+		arg := &proto.FieldArgument{Name: directiveArgPrefix + name, VariableId: ref.Id}
+		val, err := ResolveDirectiveArg(arg, qt.VariableStore)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = val
+	}
+	return values, nil
+}
+
+// updateDirectives re-evaluates the directives of nodes referencing the given variables.
+// Nodes flipping state are added to or removed from the parent resolver.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) updateDirectives(changed map[uint32]struct{}) {
+	qt.Root.walk(func(nod *QueryTreeNode) bool {
+		if len(nod.Directives) == 0 || nod.ResolveError != nil || nod.Parent == nil {
+			return true
+		}
+
+		affected := false
+		for _, ref := range nod.Directives {
+			if _, ok := changed[ref.Id]; ok && !ref.IsConstant() {
+				affected = true
+				break
+			}
+		}
+		if !affected {
+			return true
+		}
+
+		values, err := nod.currentDirectiveValues()
+		var include bool
+		if err == nil {
+			include, err = evaluateDirectives(values)
+		}
+		if err != nil {
+			// Invalid values keep the current state.
+			qt.sendError(nod.Id, err)
+			if onError := qt.Root.options.OnError; onError != nil {
+				onError(nod, nod.nodeError(err))
+			}
+			return true
+		}
+		if include != nod.Inactive {
+			return true
+		}
+
+		nod.Inactive = !include
+		op := Operation_AddChild
+		if nod.Inactive {
+			op = Operation_DelChild
+		}
+		nod.Parent.nextUpdate(&QTNodeUpdate{
+			Operation: op,
+			Child:     nod,
+		})
+		return true
+	})
+}
@@ -0,0 +1,92 @@
+package qtree
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// ValidateQueryDocument checks a query document, a root node and its child tree, against the schema without
+// building a tree, as for persisted queries. The children of root select from the query root type of resolver.
+// Returns every error found in depth-first order, nil if the document is valid. Subtrees of fields failing to
+// resolve are not checked further. Variable values, directives, fragment spreads and the limits set by tree
+// options depend on the tree and are checked when the document is added to one, directives given inline are
+// checked here.
+func ValidateQueryDocument(root *proto.RGQLQueryTreeNode, resolver SchemaResolver) []error {
+	if root == nil {
+		return []error{fmt.Errorf("Invalid query document, no root node.")}
+	}
+	rootType := resolver.RootType(OperationQuery)
+	if rootType == nil {
+		return []error{fmt.Errorf("Root %s object not found.", OperationQuery)}
+	}
+	dv := &documentValidator{resolver: resolver, seen: map[uint32]struct{}{root.Id: {}}}
+	dv.validateChildren(rootType, root)
+	return dv.errs
+}
+
+// documentValidator collects the errors of a query document.
+type documentValidator struct {
+	resolver SchemaResolver
+	// seen are the node IDs used so far.
+	seen map[uint32]struct{}
+	errs []error
+}
+
+// validateChildren checks the children of a node of type parent and their subtrees.
+func (dv *documentValidator) validateChildren(parent ast.TypeDefinition, data *proto.RGQLQueryTreeNode) {
+	for _, child := range data.Children {
+		dv.validateNode(parent, child)
+	}
+}
+
+// validateNode checks a node selecting a field of type parent and its subtree.
+func (dv *documentValidator) validateNode(parent ast.TypeDefinition, data *proto.RGQLQueryTreeNode) {
+	if err := checkClientNodeId(data.Id); err != nil {
+		dv.errs = append(dv.errs, err)
+	} else if _, ok := dv.seen[data.Id]; ok {
+		dv.errs = append(dv.errs, fmt.Errorf("Invalid node ID (used more than once): %d", data.Id))
+	}
+	dv.seen[data.Id] = struct{}{}
+	if _, ok := fragmentSpreadName(data.FieldName); ok {
+		// Fragments are registered on a tree.
+		return
+	}
+
+	sel, err := resolveFieldSelection(dv.resolver, parent, data)
+	if err != nil {
+		dv.errs = append(dv.errs, err)
+		return
+	}
+	if sel.typeCondition == "" {
+		if err := checkFieldArguments(sel.field, data.Args); err != nil {
+			dv.errs = append(dv.errs, err)
+		}
+		for _, arg := range data.Args {
+			name, literal, isInline := splitInlineArgument(arg.Name)
+			if !isInline {
+				continue
+			}
+			if directive, ok := directiveArgName(name); ok {
+				if _, err := inlineDirectiveValue(directive, literal); err != nil {
+					dv.errs = append(dv.errs, err)
+				}
+				continue
+			}
+			if argumentDefinition(sel.field, name) == nil {
+				// Reported by checkFieldArguments.
+				continue
+			}
+			if _, err := inlineArgument(dv.resolver, sel.field, name, literal); err != nil {
+				dv.errs = append(dv.errs, err)
+			}
+		}
+	}
+	if err := sel.checkSelections(data); err != nil {
+		dv.errs = append(dv.errs, err)
+	}
+	if sel.typeDef != nil && !sel.isPrimitive {
+		dv.validateChildren(sel.typeDef, data)
+	}
+}
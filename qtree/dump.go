@@ -0,0 +1,124 @@
+package qtree
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// String renders the subtree as indented pseudo-GraphQL for debugging.
+// Each field shows its arguments, node ID and, for primitives, the primitive type.
+// Variables are rendered as $<id>, constant arguments with their value.
+func (qt *QueryTreeNode) String() string {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	var sb strings.Builder
+	if qt == qt.Root {
+		sb.WriteString(qt.OperationType.String())
+		sb.WriteString(" {\n")
+		for _, child := range qt.Children {
+			child.dump(&sb, 1)
+		}
+		sb.WriteString("}\n")
+	} else {
+		qt.dump(&sb, 0)
+	}
+	return sb.String()
+}
+
+// dump renders the subtree at the given indent, expects the root lock to be held.
+func (qt *QueryTreeNode) dump(sb *strings.Builder, indent int) {
+	sb.WriteString(strings.Repeat("  ", indent))
+	sb.WriteString(joinFieldAlias(qt.Alias, qt.FieldName))
+
+	var args []string
+	for name, ref := range qt.Arguments {
+		args = append(args, name+": "+formatReference(ref))
+	}
+	if len(args) != 0 {
+		sort.Strings(args)
+		sb.WriteString("(" + strings.Join(args, ", ") + ")")
+	}
+
+	var directives []string
+	for name, ref := range qt.Directives {
+		directives = append(directives, directiveArgPrefix+name+"(if: "+formatReference(ref)+")")
+	}
+	sort.Strings(directives)
+	for _, directive := range directives {
+		sb.WriteString(" " + directive)
+	}
+
+	fmt.Fprintf(sb, " #%d", qt.Id)
+	if qt.IsPrimitive {
+		primitive := qt.PrimitiveName
+		primitive = strings.Repeat("[", qt.ListDepth) + primitive + strings.Repeat("]", qt.ListDepth)
+		sb.WriteString(" <" + primitive + ">")
+	}
+	if qt.Inactive {
+		sb.WriteString(" (inactive)")
+	}
+
+	if len(qt.Children) == 0 {
+		sb.WriteString("\n")
+		return
+	}
+	sb.WriteString(" {\n")
+	for _, child := range qt.Children {
+		child.dump(sb, indent+1)
+	}
+	sb.WriteString(strings.Repeat("  ", indent) + "}\n")
+}
+
+// formatReference renders a variable reference as $<id>, or a constant as its value.
+func formatReference(ref *VariableReference) string {
+	if !ref.IsConstant() {
+		return "$" + strconv.FormatUint(uint64(ref.Id), 10)
+	}
+	if str, ok := ref.Value.(string); ok {
+		return strconv.Quote(str)
+	}
+	return fmt.Sprintf("%v", ref.Value)
+}
+
+// jsonNode is the JSON representation of a query tree node.
+type jsonNode struct {
+	Id            uint32      `json:"id"`
+	FieldName     string      `json:"fieldName,omitempty"`
+	Alias         string      `json:"alias,omitempty"`
+	IsPrimitive   bool        `json:"isPrimitive"`
+	PrimitiveName string      `json:"primitiveName,omitempty"`
+	Arguments     []string    `json:"arguments,omitempty"`
+	Children      []*jsonNode `json:"children,omitempty"`
+}
+
+// MarshalJSON encodes the structure of the subtree for debugging.
+// Argument values, the schema and the variable store are not included.
+func (qt *QueryTreeNode) MarshalJSON() ([]byte, error) {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return json.Marshal(qt.toJSONNode())
+}
+
+// toJSONNode builds the JSON representation of the subtree, expects the root lock to be held.
+func (qt *QueryTreeNode) toJSONNode() *jsonNode {
+	nod := &jsonNode{
+		Id:            qt.Id,
+		FieldName:     qt.FieldName,
+		Alias:         qt.Alias,
+		IsPrimitive:   qt.IsPrimitive,
+		PrimitiveName: qt.PrimitiveName,
+	}
+	for name := range qt.Arguments {
+		nod.Arguments = append(nod.Arguments, name)
+	}
+	sort.Strings(nod.Arguments)
+	for _, child := range qt.Children {
+		nod.Children = append(nod.Children, child.toJSONNode())
+	}
+	return nod
+}
@@ -0,0 +1,54 @@
+package qtree
+
+import (
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// QTError is an error adding a node to the query tree.
+// It marshals to a GraphQL error object for the errors array of a response.
+type QTError struct {
+	Message string `json:"message"`
+	// Path contains the response keys from the root to the failed node.
+	Path []string `json:"path,omitempty"`
+	// Extensions contains additional error details, like the ID of the failed node.
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Error returns the error message.
+func (e *QTError) Error() string {
+	return e.Message
+}
+
+// nodeError wraps an error recorded on this node, expects the root lock to be held.
+func (qt *QueryTreeNode) nodeError(err error) *QTError {
+	return &QTError{
+		Message:    err.Error(),
+		Path:       qt.path(),
+		Extensions: map[string]interface{}{"nodeId": qt.Id},
+	}
+}
+
+// newNodeError wraps an error adding a child node of this node.
+// Errors that are already wrapped are returned as-is. Expects the root lock to be held.
+func (qt *QueryTreeNode) newNodeError(data *proto.RGQLQueryTreeNode, err error) error {
+	switch err.(type) {
+	case *QTError, *subtreeError:
+		return err
+	}
+
+	path := qt.path()
+	_, isSpread := fragmentSpreadName(data.FieldName)
+	_, isFragment := inlineFragmentTypeCondition(data.FieldName)
+	if !isSpread && !isFragment {
+		alias, fieldName := splitFieldAlias(data.FieldName)
+		if alias == "" {
+			alias = fieldName
+		}
+		path = append(path, alias)
+	}
+	return &QTError{
+		Message:    err.Error(),
+		Path:       path,
+		Extensions: map[string]interface{}{"nodeId": data.Id},
+	}
+}
@@ -0,0 +1,254 @@
+package qtree
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// fragmentSpreadPrefix prefixes the field name of a node spreading a fragment, as in "...UserFields".
+const fragmentSpreadPrefix = "..."
+
+// fragmentSpread tracks the nodes a fragment spread was expanded into.
+type fragmentSpread struct {
+	nodes []*QueryTreeNode
+}
+
+// RegisterFragment registers a fragment definition that nodes can spread by name.
+func (qt *QueryTreeNode) RegisterFragment(name string, def *ast.FragmentDefinition) {
+	qt.Root.rootMtx.Lock()
+	defer qt.Root.rootMtx.Unlock()
+
+	if qt.Root.fragments == nil {
+		qt.Root.fragments = make(map[string]*ast.FragmentDefinition)
+	}
+	qt.Root.fragments[name] = def
+}
+
+// fragmentSpreadName returns the fragment name if the field name is a fragment spread.
+func fragmentSpreadName(fieldName string) (string, bool) {
+	if !strings.HasPrefix(fieldName, fragmentSpreadPrefix) ||
+		strings.HasPrefix(fieldName, inlineFragmentPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(fieldName, fragmentSpreadPrefix)), true
+}
+
+// expandConditional expands a selection set under a type condition on the parent type.
+// Conditions narrowing an abstract parent produce an inline fragment node.
+func (qt *QueryTreeNode) expandConditional(parent ast.TypeDefinition, cond *ast.Named, set *ast.SelectionSet) ([]*proto.RGQLQueryTreeNode, error) {
+	narrowed, err := resolveTypeCondition(qt.Root.types, parent, cond)
+	if err != nil {
+		return nil, err
+	}
+	if narrowed == nil {
+		return qt.expandSelections(parent, set)
+	}
+	children, err := qt.expandSelections(narrowed, set)
+	if err != nil {
+		return nil, err
+	}
+	return []*proto.RGQLQueryTreeNode{{
+		FieldName: inlineFragmentPrefix + cond.Name.Value,
+		Children:  children,
+	}}, nil
+}
+
+// walkFragmentSpreads calls cb for every fragment spread in a selection set.
+func walkFragmentSpreads(set *ast.SelectionSet, cb func(name string) error) error {
+	if set == nil {
+		return nil
+	}
+	for _, sel := range set.Selections {
+		switch s := sel.(type) {
+		case *ast.FragmentSpread:
+			if s.Name == nil {
+				continue
+			}
+			if err := cb(s.Name.Value); err != nil {
+				return err
+			}
+		case *ast.Field:
+			if err := walkFragmentSpreads(s.SelectionSet, cb); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := walkFragmentSpreads(s.SelectionSet, cb); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkFragmentCycles checks that a fragment does not spread itself, directly or indirectly.
+func (qt *QueryTreeNode) checkFragmentCycles(name string, visiting map[string]bool) error {
+	if visiting[name] {
+		return fmt.Errorf("Fragment %s cannot spread itself.", name)
+	}
+	frag, ok := qt.Root.fragments[name]
+	if !ok {
+		return nil
+	}
+
+	visiting[name] = true
+	defer delete(visiting, name)
+	return walkFragmentSpreads(frag.SelectionSet, func(spread string) error {
+		return qt.checkFragmentCycles(spread, visiting)
+	})
+}
+
+// lookupFragment finds a registered fragment by name.
+func (qt *QueryTreeNode) lookupFragment(name string) (*ast.FragmentDefinition, error) {
+	frag, ok := qt.Root.fragments[name]
+	if !ok || frag == nil {
+		return nil, fmt.Errorf("Unknown fragment %s.", name)
+	}
+	return frag, nil
+}
+
+// expandSelections converts a selection set on the parent type to query tree nodes.
+// Fragment spreads and inline fragments on the parent type are flattened into the result.
+// The returned nodes have no IDs assigned.
+func (qt *QueryTreeNode) expandSelections(parent ast.TypeDefinition, set *ast.SelectionSet) ([]*proto.RGQLQueryTreeNode, error) {
+	if set == nil {
+		return nil, nil
+	}
+
+	var nodes []*proto.RGQLQueryTreeNode
+	for _, sel := range set.Selections {
+		switch s := sel.(type) {
+		case *ast.Field:
+			if s.Name == nil {
+				continue
+			}
+			alias := ""
+			if s.Alias != nil {
+				alias = s.Alias.Value
+			}
+			nod := &proto.RGQLQueryTreeNode{FieldName: joinFieldAlias(alias, s.Name.Value)}
+			for _, arg := range s.Arguments {
+				if arg.Name == nil {
+					continue
+				}
+				lit, err := printLiteral(arg.Value)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid argument %s on field %s in fragment: %v", arg.Name.Value, s.Name.Value, err)
+				}
+				// Carried inline, fragments cannot reference query variables.
+				nod.Args = append(nod.Args, &proto.FieldArgument{Name: joinInlineArgument(arg.Name.Value, lit)})
+			}
+			fsel, err := resolveFieldSelection(qt.Root.types, parent, nod)
+			if err != nil {
+				return nil, err
+			}
+			nod.Children, err = qt.expandSelections(fsel.typeDef, s.SelectionSet)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, nod)
+		case *ast.FragmentSpread:
+			if s.Name == nil {
+				continue
+			}
+			frag, err := qt.lookupFragment(s.Name.Value)
+			if err != nil {
+				return nil, err
+			}
+			fnodes, err := qt.expandConditional(parent, frag.TypeCondition, frag.SelectionSet)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, fnodes...)
+		case *ast.InlineFragment:
+			fnodes, err := qt.expandConditional(parent, s.TypeCondition, s.SelectionSet)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, fnodes...)
+		}
+	}
+	return nodes, nil
+}
+
+// expandFragmentSpread expands the fragment spread by a node on the parent type.
+func (qt *QueryTreeNode) expandFragmentSpread(parent ast.TypeDefinition, name string) ([]*proto.RGQLQueryTreeNode, error) {
+	if err := qt.checkFragmentCycles(name, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	frag, err := qt.lookupFragment(name)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := qt.expandConditional(parent, frag.TypeCondition, frag.SelectionSet)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("Fragment %s selects no fields.", name)
+	}
+	return nodes, nil
+}
+
+// assignNodeIds mints server IDs for expanded nodes.
+func (qt *QueryTreeNode) assignNodeIds(nodes []*proto.RGQLQueryTreeNode) {
+	for _, nod := range nodes {
+		nod.Id = qt.mintServerNodeId()
+		qt.assignNodeIds(nod.Children)
+	}
+}
+
+// addFragmentSpread expands a fragment spread into children of this node.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) addFragmentSpread(data *proto.RGQLQueryTreeNode, name string) error {
+	nodes, err := qt.expandFragmentSpread(qt.AST, name)
+	if err != nil {
+		qt.sendError(data.Id, err)
+		return err
+	}
+
+	qt.assignNodeIds(nodes)
+	spread := &fragmentSpread{}
+	for _, nod := range nodes {
+		if err := qt.addChild(nod, qt.Id); err != nil {
+			// Roll back the nodes of the spread already added.
+			for _, nnod := range spread.nodes {
+				nnod.dispose()
+			}
+			failedId := nod.Id
+			if serr, ok := err.(*subtreeError); ok {
+				failedId, err = serr.nodeId, serr.err
+			}
+			qt.sendError(data.Id, fmt.Errorf("Invalid node %d, descendant %d failed: %v", data.Id, failedId, err))
+			return err
+		}
+		nnod, _ := qt.lookupNode(nod.Id)
+		nnod.fragmentSpreadId = data.Id
+		spread.nodes = append(spread.nodes, nnod)
+	}
+	qt.Root.sharedMtx.Lock()
+	defer qt.Root.sharedMtx.Unlock()
+
+	if qt.Root.fragmentSpreads == nil {
+		qt.Root.fragmentSpreads = make(map[uint32]*fragmentSpread)
+	}
+	qt.Root.fragmentSpreads[data.Id] = spread
+	return nil
+}
+
+// disposeFragmentSpread disposes the nodes a fragment spread expanded into.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) disposeFragmentSpread(id uint32) {
+	qt.Root.sharedMtx.Lock()
+	spread, ok := qt.Root.fragmentSpreads[id]
+	delete(qt.Root.fragmentSpreads, id)
+	qt.Root.sharedMtx.Unlock()
+	if !ok {
+		return
+	}
+	for _, nod := range spread.nodes {
+		nod.dispose()
+	}
+}
@@ -0,0 +1,37 @@
+package qtree
+
+import (
+	"fmt"
+)
+
+// Freeze makes the structure of the tree read-only until Unfreeze is called.
+// While frozen, AddChild and node mutations fail and Dispose reports an error and keeps the node.
+// Variables can still change, and disposing the root still tears down the tree.
+func (qt *QueryTreeNode) Freeze() {
+	qt.Root.rootMtx.Lock()
+	qt.Root.frozen = true
+	qt.Root.rootMtx.Unlock()
+}
+
+// Unfreeze makes the tree mutable again after Freeze.
+func (qt *QueryTreeNode) Unfreeze() {
+	qt.Root.rootMtx.Lock()
+	qt.Root.frozen = false
+	qt.Root.rootMtx.Unlock()
+}
+
+// Frozen checks if the tree is frozen.
+func (qt *QueryTreeNode) Frozen() bool {
+	qt.Root.rootMtx.RLock()
+	defer qt.Root.rootMtx.RUnlock()
+
+	return qt.Root.frozen
+}
+
+// checkFrozen returns an error if the tree is frozen, expects the root lock to be held.
+func (qt *QueryTreeNode) checkFrozen() error {
+	if qt.Root.frozen {
+		return fmt.Errorf("Invalid mutation, the tree is frozen.")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package qtree
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// directiveImmutable marks a field argument in the schema that keeps its value once a node selecting the
+// field was added, as in subscribe(topic: String! @immutable). RebindArgument, SubtreeSetArgs and changes
+// to the referenced variables are rejected if they would change the value.
+const directiveImmutable = "immutable"
+
+// immutableArguments returns the names of the arguments of a field marked immutable, nil for none.
+func immutableArguments(field *ast.FieldDefinition) map[string]bool {
+	if field == nil {
+		return nil
+	}
+	var res map[string]bool
+	for _, def := range field.Arguments {
+		if def.Name == nil {
+			continue
+		}
+		for _, directive := range def.Directives {
+			if directive.Name == nil || directive.Name.Value != directiveImmutable {
+				continue
+			}
+			if res == nil {
+				res = make(map[string]bool)
+			}
+			res[def.Name.Value] = true
+		}
+	}
+	return res
+}
+
+// IsImmutableArgument checks if a field argument of the node is marked immutable in the schema.
+func (qt *QueryTreeNode) IsImmutableArgument(name string) bool {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.immutableArgs[name]
+}
+
+// checkImmutable checks that an argument marked immutable keeps its current value, nil if it is missing.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) checkImmutable(name string, value interface{}) error {
+	if !qt.immutableArgs[name] {
+		return nil
+	}
+	var current interface{}
+	if ref, ok := qt.Arguments[name]; ok {
+		current = ref.Value
+	}
+	if reflect.DeepEqual(current, value) {
+		return nil
+	}
+	return fmt.Errorf("Invalid argument %s on field %s, the argument is immutable.", name, qt.FieldName)
+}
+
+// checkImmutableArguments checks that the arguments marked immutable keep their values in argMap.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) checkImmutableArguments(argMap map[string]*VariableReference) error {
+	for name := range qt.immutableArgs {
+		var value interface{}
+		if ref, ok := argMap[name]; ok {
+			value = ref.Value
+		}
+		if err := qt.checkImmutable(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package qtree
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// directiveDefer delivers a node after its parent, as in @defer(label: "details", if: true).
+	directiveDefer = "defer"
+	// directiveStream delivers the items of a list node as they resolve, as in @stream(initialCount: 5).
+	directiveStream = "stream"
+)
+
+// IncrementalDelivery is the incremental delivery requested for a node with @defer or @stream.
+// The resolver of a deferred node may send a placeholder with the parent and the value later,
+// the resolver of a streamed list may send the first InitialCount items with the parent and the others later.
+type IncrementalDelivery struct {
+	// Stream is set for @stream, otherwise the node is deferred with @defer.
+	Stream bool
+	// Label is the label argument, identifying the delivered parts in the response.
+	Label string
+	// InitialCount is the number of list items delivered with the parent, for @stream.
+	InitialCount int
+}
+
+// resolveIncremental returns the incremental delivery requested by the directive values, nil for none.
+// The if argument defaults to true. Streams require a list field.
+func resolveIncremental(nodeId uint32, isList bool, directiveValues map[string]interface{}) (*IncrementalDelivery, error) {
+	_, isDefer := directiveValues[directiveDefer]
+	_, isStream := directiveValues[directiveStream]
+	if !isDefer && !isStream {
+		return nil, nil
+	}
+	if isDefer && isStream {
+		return nil, fmt.Errorf("Invalid node %d, directives @%s and @%s cannot be combined.", nodeId, directiveDefer, directiveStream)
+	}
+	name := directiveDefer
+	if isStream {
+		name = directiveStream
+		if !isList {
+			return nil, fmt.Errorf("Invalid node %d, directive @%s requires a list field.", nodeId, directiveStream)
+		}
+	}
+	args, err := directiveArguments(name, directiveValues[name])
+	if err != nil {
+		return nil, err
+	}
+
+	if cond, ok := args["if"]; ok && cond != nil {
+		enabled, ok := cond.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Directive @%s requires a boolean if argument, got %#v.", name, cond)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	}
+	inc := &IncrementalDelivery{Stream: isStream}
+	if label, ok := args["label"]; ok && label != nil {
+		if inc.Label, ok = label.(string); !ok {
+			return nil, fmt.Errorf("Directive @%s requires a string label argument, got %#v.", name, label)
+		}
+	}
+	if count, ok := args["initialCount"]; ok && isStream && count != nil {
+		if inc.InitialCount, ok = countArgument(count); !ok {
+			return nil, fmt.Errorf("Directive @%s requires a non-negative integer initialCount argument, got %#v.", name, count)
+		}
+	}
+	return inc, nil
+}
+
+// countArgument converts a non-negative integer directive argument.
+func countArgument(val interface{}) (int, bool) {
+	var n float64
+	switch v := val.(type) {
+	case int32:
+		n = float64(v)
+	case float64:
+		// Numbers decoded from JSON objects.
+		n = v
+	default:
+		return 0, false
+	}
+	if n != math.Trunc(n) || n < 0 || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
@@ -0,0 +1,140 @@
+package qtree
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// An argument named "name: literal" carries its value inline as a GraphQL literal instead of
+// referencing a variable, as in {Name: "unit: FOOT"} for height(unit: FOOT). The VariableId is ignored.
+// Directives can be given inline the same way, see directiveArgPrefix.
+
+// splitInlineArgument splits an inline argument into the argument name and the literal.
+func splitInlineArgument(argName string) (string, string, bool) {
+	idx := strings.Index(argName, ":")
+	if idx < 0 {
+		return argName, "", false
+	}
+	return strings.TrimSpace(argName[:idx]), strings.TrimSpace(argName[idx+1:]), true
+}
+
+// joinInlineArgument builds the name of an inline argument from the argument name and the literal.
+func joinInlineArgument(name, literal string) string {
+	return name + ": " + literal
+}
+
+// printLiteral prints a constant AST value as the GraphQL literal of an inline argument.
+func printLiteral(val ast.Value) (string, error) {
+	switch v := val.(type) {
+	case *ast.IntValue:
+		return v.Value, nil
+	case *ast.FloatValue:
+		return v.Value, nil
+	case *ast.StringValue:
+		return quoteString(v.Value), nil
+	case *ast.BooleanValue:
+		return strconv.FormatBool(v.Value), nil
+	case *ast.EnumValue:
+		return v.Value, nil
+	case *ast.ListValue:
+		items := make([]string, len(v.Values))
+		for i, item := range v.Values {
+			lit, err := printLiteral(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = lit
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case *ast.ObjectValue:
+		fields := make([]string, 0, len(v.Fields))
+		for _, field := range v.Fields {
+			if field.Name == nil {
+				continue
+			}
+			lit, err := printLiteral(field.Value)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, field.Name.Value+": "+lit)
+		}
+		return "{" + strings.Join(fields, ", ") + "}", nil
+	case *ast.Variable:
+		name := ""
+		if v.Name != nil {
+			name = v.Name.Value
+		}
+		return "", fmt.Errorf("Variable $%s cannot be used in a fragment.", name)
+	default:
+		return "", fmt.Errorf("Unsupported constant value %#v.", val)
+	}
+}
+
+// quoteString quotes a string value with the GraphQL escape sequences.
+func quoteString(str string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range str {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&sb, `\u%04x`, r)
+				continue
+			}
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// parseLiteral parses the GraphQL literal of an inline argument.
+func parseLiteral(literal string) (interface{}, error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: "{ f(a: " + literal + ") }"})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid literal %s: %v", literal, err)
+	}
+	var arg *ast.Argument
+	if len(doc.Definitions) == 1 {
+		if op, ok := doc.Definitions[0].(*ast.OperationDefinition); ok && op.SelectionSet != nil &&
+			len(op.SelectionSet.Selections) == 1 {
+			if field, ok := op.SelectionSet.Selections[0].(*ast.Field); ok && len(field.Arguments) == 1 {
+				arg = field.Arguments[0]
+			}
+		}
+	}
+	if arg == nil {
+		return nil, fmt.Errorf("Invalid literal %s.", literal)
+	}
+	if arg.Value == nil {
+		return nil, nil
+	}
+	return valueFromAST(arg.Value)
+}
+
+// inlineArgument builds a constant reference to the value of an inline argument, coerced to the argument type.
+func inlineArgument(schemaResolver SchemaResolver, field *ast.FieldDefinition, name, literal string) (*VariableReference, error) {
+	val, err := parseLiteral(literal)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for argument %s on field %s: %v", name, field.Name.Value, err)
+	}
+	val, err = coerceFieldArgument(schemaResolver, field, name, val)
+	if err != nil {
+		return nil, err
+	}
+	return NewConstantReference(val), nil
+}
@@ -0,0 +1,102 @@
+package qtree
+
+// The tree is guarded by rootMtx on the root node. With the ShardedLocks option, the subtree of each
+// top-level selection is also guarded by the shardMtx of the selection: AddChild and Dispose below a
+// top-level selection hold rootMtx for reading and the shard for writing, so mutations of different
+// top-level selections run concurrently. The state shared by the whole tree, the RootNodeMap, fragment
+// spreads, ID counter, stats and complexity, is then guarded by sharedMtx on the root.
+// Everything else holding rootMtx for writing excludes the shard writers.
+
+// shard returns the top-level selection the node is in, nil for the root.
+func (qt *QueryTreeNode) shard() *QueryTreeNode {
+	if qt.Parent == nil {
+		return nil
+	}
+	nod := qt
+	for nod.Parent.Parent != nil {
+		nod = nod.Parent
+	}
+	return nod
+}
+
+// lockSubtree locks the tree for mutating the children of this node, returns the unlock func.
+// With sharded locks, only the shard of the node is locked for writing if it is below the root.
+// Parent pointers only change with rootMtx held for writing, so the shard is found after locking rootMtx.
+func (qt *QueryTreeNode) lockSubtree() func() {
+	root := qt.Root
+	if root.options.ShardedLocks {
+		root.rootMtx.RLock()
+		if shard := qt.shard(); shard != nil {
+			shard.shardMtx.Lock()
+			return func() {
+				shard.shardMtx.Unlock()
+				root.rootMtx.RUnlock()
+			}
+		}
+		root.rootMtx.RUnlock()
+	}
+	root.rootMtx.Lock()
+	return root.rootMtx.Unlock
+}
+
+// rlockSubtree locks the tree for reading the subtree of this node, returns the unlock func.
+func (qt *QueryTreeNode) rlockSubtree() func() {
+	root := qt.Root
+	if root.options.ShardedLocks {
+		root.rootMtx.RLock()
+		if shard := qt.shard(); shard != nil {
+			shard.shardMtx.RLock()
+			return func() {
+				shard.shardMtx.RUnlock()
+				root.rootMtx.RUnlock()
+			}
+		}
+		root.rootMtx.RUnlock()
+	}
+	return qt.rlockTree()
+}
+
+// rlockTree locks the whole tree for reading, returns the unlock func.
+// With sharded locks, every shard is locked for reading, which also guards the shared state.
+func (qt *QueryTreeNode) rlockTree() func() {
+	root := qt.Root
+	root.rootMtx.RLock()
+	if !root.options.ShardedLocks {
+		return root.rootMtx.RUnlock
+	}
+	// The top-level selections only change with rootMtx held for writing.
+	shards := make([]*QueryTreeNode, len(root.Children))
+	copy(shards, root.Children)
+	for _, shard := range shards {
+		shard.shardMtx.RLock()
+	}
+	return func() {
+		for _, shard := range shards {
+			shard.shardMtx.RUnlock()
+		}
+		root.rootMtx.RUnlock()
+	}
+}
+
+// lookupNode finds a node in the RootNodeMap, expects the root lock to be held.
+func (qt *QueryTreeNode) lookupNode(id uint32) (*QueryTreeNode, bool) {
+	qt.Root.sharedMtx.Lock()
+	defer qt.Root.sharedMtx.Unlock()
+
+	nod, ok := qt.Root.RootNodeMap[id]
+	return nod, ok
+}
+
+// registerNode adds a node to the RootNodeMap under id, expects the root lock to be held.
+func (qt *QueryTreeNode) registerNode(id uint32, nod *QueryTreeNode) {
+	qt.Root.sharedMtx.Lock()
+	qt.Root.RootNodeMap[id] = nod
+	qt.Root.sharedMtx.Unlock()
+}
+
+// unregisterNode removes an ID from the RootNodeMap, expects the root lock to be held.
+func (qt *QueryTreeNode) unregisterNode(id uint32) {
+	qt.Root.sharedMtx.Lock()
+	delete(qt.Root.RootNodeMap, id)
+	qt.Root.sharedMtx.Unlock()
+}
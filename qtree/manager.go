@@ -0,0 +1,104 @@
+package qtree
+
+import (
+	"sync"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// TreeManager mints the query trees of a server hosting many clients, one independent tree per client.
+// The trees share the schema resolver and its type cache, and are tracked until they are disposed.
+type TreeManager struct {
+	rootQuery      *ast.ObjectDefinition
+	schemaResolver SchemaResolver
+	types          *typeCache
+	errCh          chan<- *proto.RGQLQueryError
+	opts           QueryTreeOptions
+
+	// mtx guards trees. It is taken with the lock of a tree held when the tree is disposed,
+	// so trees are not locked while holding mtx.
+	mtx   sync.Mutex
+	trees map[*QueryTreeNode]struct{}
+}
+
+// NewTreeManager builds a tree manager minting trees selecting from rootQuery, configured by opts.
+// errorCh receives the errors of trees minted with NewTree.
+func NewTreeManager(rootQuery *ast.ObjectDefinition,
+	schemaResolver SchemaResolver,
+	errorCh chan<- *proto.RGQLQueryError,
+	opts QueryTreeOptions) *TreeManager {
+	return &TreeManager{
+		rootQuery:      rootQuery,
+		schemaResolver: schemaResolver,
+		types:          newTypeCache(schemaResolver),
+		errCh:          errorCh,
+		opts:           opts,
+		trees:          make(map[*QueryTreeNode]struct{}),
+	}
+}
+
+// NewTree mints a new tree reporting its errors to the error channel of the manager.
+func (m *TreeManager) NewTree() *QueryTreeNode {
+	return m.NewTreeWithErrors(m.errCh)
+}
+
+// NewTreeWithErrors mints a new tree reporting its errors to errorCh, as for one error channel per client.
+// The tree is tracked until its root is disposed.
+func (m *TreeManager) NewTreeWithErrors(errorCh chan<- *proto.RGQLQueryError) *QueryTreeNode {
+	nqt := NewQueryTreeForRoot(m.rootQuery, OperationQuery, m.schemaResolver, errorCh, m.opts)
+	nqt.types = m.types
+
+	m.mtx.Lock()
+	m.trees[nqt] = struct{}{}
+	m.mtx.Unlock()
+	nqt.OnDispose(func() {
+		m.mtx.Lock()
+		delete(m.trees, nqt)
+		m.mtx.Unlock()
+	})
+	return nqt
+}
+
+// Trees returns a snapshot of the trees not yet disposed.
+func (m *TreeManager) Trees() []*QueryTreeNode {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	trees := make([]*QueryTreeNode, 0, len(m.trees))
+	for nqt := range m.trees {
+		trees = append(trees, nqt)
+	}
+	return trees
+}
+
+// Len returns the number of trees not yet disposed.
+func (m *TreeManager) Len() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return len(m.trees)
+}
+
+// Stats returns the sum of the counters of the trees not yet disposed.
+// Counters of disposed trees are no longer included.
+func (m *TreeManager) Stats() TreeStats {
+	var total TreeStats
+	for _, nqt := range m.Trees() {
+		stats := nqt.Stats()
+		total.NodesAdded += stats.NodesAdded
+		total.NodesDeleted += stats.NodesDeleted
+		total.FailedAdds += stats.FailedAdds
+		total.LiveNodes += stats.LiveNodes
+		total.ErrorsDropped += stats.ErrorsDropped
+	}
+	return total
+}
+
+// DisposeAll disposes every tree not yet disposed, as when the server shuts down.
+// Trees minted meanwhile are kept.
+func (m *TreeManager) DisposeAll() {
+	for _, nqt := range m.Trees() {
+		nqt.Dispose()
+	}
+}
@@ -0,0 +1,192 @@
+package qtree
+
+import (
+	"fmt"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// findSibling finds a child selecting the same field with the same argument references.
+// Nodes of fragment spreads are never merged, as they are disposed with the spread.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) findSibling(alias, fieldName string, args []*proto.FieldArgument) *QueryTreeNode {
+	for _, child := range qt.Children {
+		if child.fragmentSpreadId != 0 || child.Id&serverNodeIdFlag != 0 || child.pending != nil {
+			continue
+		}
+		if child.Alias == alias && child.FieldName == fieldName && child.sameArguments(args) {
+			return child
+		}
+	}
+	return nil
+}
+
+// sameArguments checks if the node references exactly the given variables.
+func (qt *QueryTreeNode) sameArguments(args []*proto.FieldArgument) bool {
+	for _, arg := range args {
+		if name, literal, isInline := splitInlineArgument(arg.Name); isInline {
+			literals := qt.literals
+			if directive, ok := directiveArgName(name); ok {
+				name, literals = directive, qt.directiveLiterals
+			}
+			if src, ok := literals[name]; !ok || src != literal {
+				return false
+			}
+			continue
+		}
+		ref := qt.Arguments[arg.Name]
+		if directive, ok := directiveArgName(arg.Name); ok {
+			ref = qt.Directives[directive]
+		}
+		if ref == nil || ref.IsConstant() || ref.Id != arg.VariableId {
+			return false
+		}
+	}
+
+	refCount := 0
+	for _, refs := range []map[string]*VariableReference{qt.Arguments, qt.Directives} {
+		for _, ref := range refs {
+			if !ref.IsConstant() {
+				refCount++
+			}
+		}
+	}
+	return refCount+len(qt.literals)+len(qt.directiveLiterals) == len(args)
+}
+
+// merge registers a duplicate selection of this node under a new ID.
+// Children of the duplicate are added to this node, under the new ID.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) merge(data *proto.RGQLQueryTreeNode, parentRef uint32) error {
+	sel := &fieldSelection{field: qt.fieldDef, typeDef: qt.AST, typeCondition: qt.TypeCondition}
+	if err := sel.checkSelections(data); err != nil {
+		qt.sendError(data.Id, err)
+		return err
+	}
+
+	qt.refs[data.Id] = parentRef
+	qt.registerNode(data.Id, qt)
+	for _, child := range data.Children {
+		if err := qt.addChild(child, data.Id); err != nil {
+			qt.release(data.Id)
+			if _, ok := err.(*subtreeError); ok {
+				return err
+			}
+			return &subtreeError{nodeId: child.Id, err: err}
+		}
+	}
+	return nil
+}
+
+// release drops the reference to the node under the given ID, with the children added under it.
+// The node is disposed when the last reference is dropped. Expects the root lock to be held.
+func (qt *QueryTreeNode) release(id uint32) {
+	if _, ok := qt.refs[id]; !ok {
+		return
+	}
+	if len(qt.refs) == 1 {
+		qt.dispose()
+		return
+	}
+
+	delete(qt.refs, id)
+	qt.unregisterNode(id)
+	children := make([]*QueryTreeNode, len(qt.Children))
+	copy(children, qt.Children)
+	for _, child := range children {
+		var childRefs []uint32
+		for childId, parentRef := range child.refs {
+			if parentRef == id {
+				childRefs = append(childRefs, childId)
+			}
+		}
+		for _, childId := range childRefs {
+			child.release(childId)
+		}
+	}
+}
+
+// isSelection checks if the node is the selection a child tree adds again below parent under parentRef.
+func (qt *QueryTreeNode) isSelection(parent *QueryTreeNode, data *proto.RGQLQueryTreeNode, parentRef uint32) bool {
+	if qt.Parent != parent || qt.disposed {
+		return false
+	}
+	if ref, ok := qt.refs[data.Id]; !ok || ref != parentRef {
+		return false
+	}
+	if qt.pending != nil {
+		return qt.pending.FieldName == data.FieldName && sameProtoArguments(qt.pending.Args, data.Args)
+	}
+	alias, fieldName := splitFieldAlias(data.FieldName)
+	return qt.Alias == alias && qt.FieldName == fieldName && qt.sameArguments(data.Args)
+}
+
+// extend adds the children of a child tree selecting this node again, under the same ID.
+// Children already in the tree extend their nodes in turn, so only new selections are added.
+// Either every new selection is added or none are. Expects the root lock to be held.
+func (qt *QueryTreeNode) extend(data *proto.RGQLQueryTreeNode) error {
+	type addition struct {
+		parent *QueryTreeNode
+		data   *proto.RGQLQueryTreeNode
+		ref    uint32
+	}
+	var additions []addition
+	retries := []*QueryTreeNode{qt}
+	var plan func(nod *QueryTreeNode, data *proto.RGQLQueryTreeNode) error
+	plan = func(nod *QueryTreeNode, data *proto.RGQLQueryTreeNode) error {
+		for _, child := range data.Children {
+			existing, ok := qt.lookupNode(child.Id)
+			if !ok {
+				additions = append(additions, addition{parent: nod, data: child, ref: data.Id})
+				continue
+			}
+			if !existing.isSelection(nod, child, data.Id) {
+				err := fmt.Errorf("Invalid node ID (already exists): %d", child.Id)
+				qt.sendError(child.Id, err)
+				return &subtreeError{nodeId: child.Id, err: err}
+			}
+			if existing.pending != nil {
+				// Added again with the children of the selection, if the backoff passed.
+				additions = append(additions, addition{parent: nod, data: child, ref: data.Id})
+				continue
+			}
+			retries = append(retries, existing)
+			if err := plan(existing, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := plan(qt, data); err != nil {
+		return err
+	}
+
+	for i, add := range additions {
+		err := add.parent.addChild(add.data, add.ref)
+		if err == nil {
+			continue
+		}
+		for _, added := range additions[:i] {
+			if nod, ok := qt.lookupNode(added.data.Id); ok {
+				nod.release(added.data.Id)
+			}
+		}
+		if _, ok := err.(*subtreeError); ok {
+			return err
+		}
+		return &subtreeError{nodeId: add.data.Id, err: err}
+	}
+	// Retried only once the child tree is in, so a rejected tree leaves the nodes untouched.
+	for _, nod := range retries {
+		nod.retry()
+	}
+	return nil
+}
+
+// RefCount returns the number of IDs the node was added with.
+func (qt *QueryTreeNode) RefCount() int {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return len(qt.refs)
+}
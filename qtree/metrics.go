@@ -0,0 +1,116 @@
+package qtree
+
+import (
+	"sync/atomic"
+)
+
+// Depth returns the maximum depth of the subtree from this node, counting this node as 1.
+func (qt *QueryTreeNode) Depth() int {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.depth()
+}
+
+// depth returns the subtree depth, expects the root lock to be held.
+func (qt *QueryTreeNode) depth() int {
+	max := 0
+	for _, child := range qt.Children {
+		if d := child.depth(); d > max {
+			max = d
+		}
+	}
+	return max + 1
+}
+
+// Size returns the number of nodes in the subtree, including this node.
+func (qt *QueryTreeNode) Size() int {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.size()
+}
+
+// size returns the subtree node count, expects the root lock to be held.
+func (qt *QueryTreeNode) size() int {
+	count := 1
+	for _, child := range qt.Children {
+		count += child.size()
+	}
+	return count
+}
+
+// IsLeafComplete checks if every leaf of the subtree is a primitive field.
+// An object node left without selections, as after its children were deleted, is not complete.
+func (qt *QueryTreeNode) IsLeafComplete() bool {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.isLeafComplete()
+}
+
+// isLeafComplete checks the leaves of the subtree, expects the root lock to be held.
+func (qt *QueryTreeNode) isLeafComplete() bool {
+	if len(qt.Children) == 0 {
+		return qt.IsPrimitive
+	}
+	for _, child := range qt.Children {
+		if !child.isLeafComplete() {
+			return false
+		}
+	}
+	return true
+}
+
+// SubscriberCount returns the number of subscriptions to the node.
+func (qt *QueryTreeNode) SubscriberCount() int {
+	qt.subscribersMtx.Lock()
+	defer qt.subscribersMtx.Unlock()
+
+	return len(qt.subscribers)
+}
+
+// SubtreeSubscriberCount returns the number of subscriptions to the node and its descendants.
+// Called on the root, it counts the subscriptions of the whole tree.
+func (qt *QueryTreeNode) SubtreeSubscriberCount() int {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	count := 0
+	qt.walk(func(nod *QueryTreeNode) bool {
+		count += nod.SubscriberCount()
+		return true
+	})
+	return count
+}
+
+// TreeStats are counters of the changes applied to a query tree.
+type TreeStats struct {
+	// NodesAdded is the total number of nodes added to the tree.
+	NodesAdded uint64
+	// NodesDeleted is the total number of nodes disposed.
+	NodesDeleted uint64
+	// FailedAdds is the total number of subtree adds that were rejected.
+	FailedAdds uint64
+	// LiveNodes is the number of nodes currently in the tree, excluding the root.
+	LiveNodes int
+	// ErrorsDropped is the total number of errors dropped because the error channel was full.
+	ErrorsDropped uint64
+}
+
+// Stats returns the counters of the tree.
+func (qt *QueryTreeNode) Stats() TreeStats {
+	unlock := qt.rlockTree()
+	defer unlock()
+
+	stats := qt.Root.stats
+	stats.ErrorsDropped = atomic.LoadUint64(&qt.Root.errorsDropped)
+	return stats
+}
+
+// countFailedAdd counts a child tree that failed to be added, expects the root lock to be held.
+func (qt *QueryTreeNode) countFailedAdd() {
+	qt.Root.sharedMtx.Lock()
+	qt.Root.stats.FailedAdds++
+	qt.Root.sharedMtx.Unlock()
+}
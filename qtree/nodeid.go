@@ -0,0 +1,30 @@
+package qtree
+
+import "fmt"
+
+// Node IDs are split in two ranges. Clients pick the IDs of the nodes they add from 1 to MaxClientNodeId,
+// the IDs with the high bit set are minted by the server for the nodes it synthesizes, like the nodes a
+// fragment spread expands into. Adding a node with a server ID is rejected, so the ranges never collide.
+
+// serverNodeIdFlag is set on node IDs minted by the server.
+const serverNodeIdFlag uint32 = 1 << 31
+
+// MaxClientNodeId is the largest node ID a client can use.
+const MaxClientNodeId = serverNodeIdFlag - 1
+
+// mintServerNodeId allocates an ID for a node synthesized by the server from the ID counter of the root.
+func (qt *QueryTreeNode) mintServerNodeId() uint32 {
+	qt.Root.sharedMtx.Lock()
+	defer qt.Root.sharedMtx.Unlock()
+
+	qt.Root.idCounter++
+	return serverNodeIdFlag | qt.Root.idCounter
+}
+
+// checkClientNodeId checks that a node ID sent by a client is not in the server range.
+func checkClientNodeId(id uint32) error {
+	if id&serverNodeIdFlag != 0 {
+		return fmt.Errorf("Invalid node ID (reserved for the server): %d", id)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package qtree
+
+import (
+	"fmt"
+)
+
+// OperationType is the kind of root operation a query tree selects from.
+type OperationType int
+
+const (
+	// OperationQuery selects from the root query type.
+	OperationQuery OperationType = iota
+	// OperationMutation selects from the root mutation type.
+	OperationMutation
+	// OperationSubscription selects from the root subscription type.
+	OperationSubscription
+)
+
+// String returns the operation keyword, like "query".
+func (o OperationType) String() string {
+	switch o {
+	case OperationQuery:
+		return "query"
+	case OperationMutation:
+		return "mutation"
+	case OperationSubscription:
+		return "subscription"
+	default:
+		return fmt.Sprintf("OperationType(%d)", int(o))
+	}
+}
+
+// ParseOperationType parses an operation keyword, like "subscription".
+func ParseOperationType(kind string) (OperationType, error) {
+	switch kind {
+	case "query":
+		return OperationQuery, nil
+	case "mutation":
+		return OperationMutation, nil
+	case "subscription":
+		return OperationSubscription, nil
+	default:
+		return OperationQuery, fmt.Errorf("Unknown operation type %s.", kind)
+	}
+}
@@ -0,0 +1,197 @@
+package qtree
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// QueryTreeOptions configures the limits of a query tree.
+type QueryTreeOptions struct {
+	// MaxDepth is the maximum distance of a node to the root, zero for no limit.
+	MaxDepth int
+	// MaxTypeRecursion is the maximum number of times a named type can appear
+	// on the path from the root to a node, zero for no limit.
+	MaxTypeRecursion int
+	// DisableIntrospection rejects the __schema and __type introspection fields.
+	DisableIntrospection bool
+	// Complexity estimates the cost of added nodes, nil to disable cost tracking.
+	Complexity ComplexityEstimator
+	// MaxComplexity is the maximum estimated cost of the tree, zero for no limit.
+	MaxComplexity int
+	// MaxNodes is the maximum number of node IDs in the tree, counting the root, zero for no limit.
+	MaxNodes int
+	// RejectDeprecated rejects selections of fields marked @deprecated.
+	RejectDeprecated bool
+	// OnDeprecated is called with a warning when a selection of a deprecated field is added.
+	// It is called with the tree locked and must not call back into the tree.
+	OnDeprecated func(warning error)
+	// FieldNameMapper maps schema field names to the names resolvers are looked up by, nil to use the schema names.
+	FieldNameMapper func(schemaName string) string
+	// MaxPausedUpdates is the number of updates a paused subscription buffers
+	// before falling back to a resync, zero for no limit.
+	MaxPausedUpdates int
+	// ShardedLocks locks the subtree of each top-level selection separately,
+	// so AddChild and Dispose below different top-level selections run concurrently.
+	// Mutations of the root and ApplyTreeMutation still lock the whole tree.
+	ShardedLocks bool
+	// OnSubscriberPanic is called with the value recovered from a panicking subscriber callback,
+	// nil to log the panic. It is called with the tree locked and must not call back into the tree.
+	OnSubscriberPanic func(recovered interface{})
+	// UnsubscribeOnPanic removes subscribers after their callback panicked.
+	UnsubscribeOnPanic bool
+	// OnError is called when a node is kept in an error state, marked with SetError or keeping its
+	// arguments after invalid variable values. err is a *QTError with the path of the node.
+	// Failed additions are rolled back and returned by AddChild instead.
+	// It may be called with the tree locked and must not call back into the tree.
+	OnError func(node *QueryTreeNode, err error)
+	// AddWorkers is the number of goroutines resolving the independent child subtrees of a tree added
+	// with AddChild or ApplyTreeMutation against the schema, before the tree is locked to add the nodes.
+	// Zero or one resolves them while adding, with the tree locked.
+	AddWorkers int
+	// RetryBackoff is the time after which a node marked with SetError is retried, when a mutation selects
+	// it again: the field and arguments are resolved against the schema once more and the error is cleared
+	// on success. Nodes whose type the schema resolver fails to look up, like a schema still loading, are kept
+	// marked with an *UnresolvedTypeError and added again when retried. The backoff doubles with each failed
+	// retry, zero disables retries.
+	RetryBackoff time.Duration
+	// MaxRetryBackoff is the maximum backoff between retries of a node, zero for no limit.
+	MaxRetryBackoff time.Duration
+	// OnSubscriberLeak is called when a node is disposed while it still has subscribers, after they were sent
+	// the Operation_Delete update, to find subscriptions that are never ended with Unsubscribe. Subscribers
+	// ending the subscription when they receive the update from a channel, like the ResolverTree, are still
+	// counted. It is called with the tree locked and must not call back into the tree.
+	OnSubscriberLeak func(node *QueryTreeNode, subscribers int)
+	// PoolNodes reuses the nodes of failed additions for new nodes, reducing allocations when clients send
+	// many invalid selections. Only nodes no code outside the tree could have seen are reused, disposed
+	// nodes are never reused. It has no effect with ShardedLocks.
+	PoolNodes bool
+	// SchemaVersion identifies the schema the tree is built with, as a version or hash of the schema source.
+	// ApplyTreeMutationVersioned rejects mutations built against another version, empty to accept any.
+	// It is also set by NewQueryTreeWithVersion.
+	SchemaVersion string
+	// ArgsChangedDebounce delays the Operation_ArgsChanged updates of a node by the interval, so arguments
+	// changing in quick succession, as bound to a slider, send one update once they settle. A change within
+	// the interval restarts it. Zero sends the updates immediately.
+	ArgsChangedDebounce time.Duration
+}
+
+// resolverName maps a schema field name with the FieldNameMapper, if any.
+func (opts *QueryTreeOptions) resolverName(fieldName string) string {
+	if opts.FieldNameMapper == nil {
+		return fieldName
+	}
+	return opts.FieldNameMapper(fieldName)
+}
+
+// subscriberPanic reports a panic recovered from a subscriber callback.
+func (opts *QueryTreeOptions) subscriberPanic(recovered interface{}) {
+	if opts.OnSubscriberPanic == nil {
+		log.Printf("qtree: recovered from subscriber panic: %v", recovered)
+		return
+	}
+	opts.OnSubscriberPanic(recovered)
+}
+
+// checkDepth checks that a child of this node would not exceed the maximum depth.
+func (qt *QueryTreeNode) checkDepth(data *proto.RGQLQueryTreeNode) error {
+	return checkDepthLimit(qt.Root.options.MaxDepth, qt.level+1, data.Id)
+}
+
+// checkDepthLimit checks a node level against the maximum depth.
+func checkDepthLimit(maxDepth, level int, nodeId uint32) error {
+	if maxDepth > 0 && level > maxDepth {
+		return fmt.Errorf("Invalid node %d, exceeds the maximum depth of %d.", nodeId, maxDepth)
+	}
+	return nil
+}
+
+// checkNodeCount checks that the tree can register another node ID.
+func (qt *QueryTreeNode) checkNodeCount(nodeId uint32) error {
+	qt.Root.sharedMtx.Lock()
+	count := len(qt.Root.RootNodeMap)
+	qt.Root.sharedMtx.Unlock()
+	return checkNodeLimit(qt.Root.options.MaxNodes, count, nodeId)
+}
+
+// checkNodeLimit checks a node count against the maximum node count.
+func checkNodeLimit(maxNodes, count int, nodeId uint32) error {
+	if maxNodes > 0 && count >= maxNodes {
+		return fmt.Errorf("Invalid node %d, the tree has %d nodes, the maximum is %d.", nodeId, count, maxNodes)
+	}
+	return nil
+}
+
+// deprecationError describes the selection of a deprecated field on parent, nil if the field is not deprecated.
+func deprecationError(nodeId uint32, parent ast.TypeDefinition, field *ast.FieldDefinition) error {
+	reason, ok := deprecationReason(field)
+	if !ok {
+		return nil
+	}
+	return fmt.Errorf("Invalid node %d, field %s on %s is deprecated (%s).", nodeId, field.Name.Value, typeDefinitionName(parent), reason)
+}
+
+// deprecationReason returns the reason given by the @deprecated directive of a field, if any.
+func deprecationReason(field *ast.FieldDefinition) (string, bool) {
+	if field == nil {
+		return "", false
+	}
+	for _, directive := range field.Directives {
+		if directive.Name == nil || directive.Name.Value != "deprecated" {
+			continue
+		}
+		for _, arg := range directive.Arguments {
+			if arg.Name == nil || arg.Name.Value != "reason" {
+				continue
+			}
+			if str, ok := arg.Value.(*ast.StringValue); ok {
+				return str.Value, true
+			}
+		}
+		return "No longer supported", true
+	}
+	return "", false
+}
+
+// checkIntrospection checks that an introspection field is allowed.
+func (qt *QueryTreeNode) checkIntrospection(fieldName string) error {
+	if !qt.Root.options.DisableIntrospection {
+		return nil
+	}
+	if fieldName == "__schema" || fieldName == "__type" {
+		return fmt.Errorf("Invalid field %s, introspection is disabled.", fieldName)
+	}
+	return nil
+}
+
+// protoDepth returns the maximum depth of a set of node trees.
+func protoDepth(nodes []*proto.RGQLQueryTreeNode) int {
+	max := 0
+	for _, nod := range nodes {
+		if d := protoDepth(nod.Children) + 1; d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// checkTypeRecursion checks that the named type of a selection does not recur too often in its ancestor types.
+func checkTypeRecursion(maxRecursion int, nodeId uint32, typeDef ast.TypeDefinition, ancestors []ast.TypeDefinition) error {
+	name := typeDefinitionName(typeDef)
+	if maxRecursion <= 0 || name == "" {
+		return nil
+	}
+	count := 1
+	for _, atyp := range ancestors {
+		if typeDefinitionName(atyp) == name {
+			count++
+		}
+	}
+	if count > maxRecursion {
+		return fmt.Errorf("Invalid node %d, type %s recurses more than %d times.", nodeId, name, maxRecursion)
+	}
+	return nil
+}
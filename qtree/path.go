@@ -0,0 +1,69 @@
+package qtree
+
+// Path returns the response keys from the root to this node, excluding the root.
+// Inline fragment nodes are not part of the path.
+func (qt *QueryTreeNode) Path() []string {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.path()
+}
+
+// path returns the field path, expects the root lock to be held.
+func (qt *QueryTreeNode) path() []string {
+	var rev []string
+	for nod := qt; nod != nil && nod.Parent != nil; nod = nod.Parent {
+		if nod.TypeCondition != "" {
+			continue
+		}
+		rev = append(rev, nod.ResponseKey())
+	}
+	res := make([]string, len(rev))
+	for i, name := range rev {
+		res[len(rev)-i-1] = name
+	}
+	return res
+}
+
+// PrimitivePaths returns the Path of every primitive field in the subtree in pre-order, as a column projection.
+func (qt *QueryTreeNode) PrimitivePaths() [][]string {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	var res [][]string
+	qt.walk(func(nod *QueryTreeNode) bool {
+		if nod.IsPrimitive {
+			res = append(res, nod.path())
+		}
+		return true
+	})
+	return res
+}
+
+// FindByPath returns the nodes below this node matching a path of field names, as in ["user", "friends"].
+// Several nodes can match when a field is selected with different arguments or aliases.
+// Inline fragment nodes are not part of the path, an empty path matches this node.
+func (qt *QueryTreeNode) FindByPath(path []string) []*QueryTreeNode {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	var res []*QueryTreeNode
+	qt.findByPath(path, &res)
+	return res
+}
+
+// findByPath appends the nodes matching the path to res, expects the root lock to be held.
+func (qt *QueryTreeNode) findByPath(path []string, res *[]*QueryTreeNode) {
+	if len(path) == 0 {
+		*res = append(*res, qt)
+		return
+	}
+	for _, child := range qt.Children {
+		switch {
+		case child.TypeCondition != "":
+			child.findByPath(path, res)
+		case child.FieldName == path[0]:
+			child.findByPath(path[1:], res)
+		}
+	}
+}
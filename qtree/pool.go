@@ -0,0 +1,62 @@
+package qtree
+
+import (
+	"sync"
+)
+
+// With the PoolNodes option, the nodes of a failed addition are reset and reused for the nodes added later.
+// A node is only reused if the tree can tell its pointer never left the package: it was never announced,
+// neither it nor its parent was ever subscribed to, and it was never passed to a DirectiveHandler, the
+// FieldAuthorizer or a callback of the options. Disposed nodes may still be held by resolvers and by callers
+// of LookupNode, Nodes or Children, they are never reused. With ShardedLocks, LookupNode may return a node
+// while it is added, so no node is reused. Each tree pools its own nodes.
+
+// newNodePool builds the pool of reset nodes of a tree.
+func newNodePool() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return &QueryTreeNode{
+				subscribers: make(map[uint32]*qtNodeSubscription),
+				refs:        make(map[uint32]uint32),
+			}
+		},
+	}
+}
+
+// newNode returns a zeroed node with empty subscribers and refs maps, on the root.
+// The node is taken from the pool if the tree pools nodes.
+func (qt *QueryTreeNode) newNode() *QueryTreeNode {
+	if qt.nodePool == nil {
+		return &QueryTreeNode{
+			subscribers: make(map[uint32]*qtNodeSubscription),
+			refs:        make(map[uint32]uint32),
+		}
+	}
+	return qt.nodePool.Get().(*QueryTreeNode)
+}
+
+// recycle resets a node of a failed addition and returns it to the pool, expects the root lock to be held.
+// Nodes of trees without a pool and nodes which might be referenced outside the tree are kept.
+func (qt *QueryTreeNode) recycle() {
+	if qt.Root == nil || qt.Root == qt || qt.Root.nodePool == nil || qt.Parent == nil || qt.escaped {
+		return
+	}
+	if qt.wasSubscribed() || qt.Parent.wasSubscribed() {
+		return
+	}
+
+	pool, subscribers, refs := qt.Root.nodePool, qt.subscribers, qt.refs
+	for id := range refs {
+		delete(refs, id)
+	}
+	*qt = QueryTreeNode{subscribers: subscribers, refs: refs}
+	pool.Put(qt)
+}
+
+// wasSubscribed checks if the node ever had a subscriber.
+func (qt *QueryTreeNode) wasSubscribed() bool {
+	qt.subscribersMtx.Lock()
+	defer qt.subscribersMtx.Unlock()
+
+	return qt.subCtr != 0
+}
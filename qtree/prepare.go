@@ -0,0 +1,185 @@
+package qtree
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// With the AddWorkers option, the field selections of the child subtrees of an added tree are resolved
+// against the schema on a pool of goroutines before the tree lock is taken. Adding the tree then uses the
+// prepared selections and only registers the nodes under the lock. Nodes failing to resolve are not
+// prepared, adding them resolves them again and reports the error as before. Disposing the node being
+// added to cancels the preparation, the addition then fails as the parent was disposed.
+
+// preparedSelection is a field selection resolved ahead of adding a node.
+type preparedSelection struct {
+	parent ast.TypeDefinition
+	sel    *fieldSelection
+}
+
+// preparedSelections are the prepared selections of a child tree by node.
+type preparedSelections map[*proto.RGQLQueryTreeNode]preparedSelection
+
+// prepareSelections resolves the selections of a child tree of a node of type parent, ctx is the context of the node.
+// The child subtrees are resolved on up to AddWorkers goroutines, the first failure or disposing the node
+// cancels the remaining work. Returns nil if the tree is too small, the option is not set or it was canceled.
+func (qt *QueryTreeNode) prepareSelections(ctx context.Context,
+	parent ast.TypeDefinition,
+	data *proto.RGQLQueryTreeNode) preparedSelections {
+	workers := qt.Root.options.AddWorkers
+	if workers < 2 || parent == nil || len(data.Children) < 2 {
+		return nil
+	}
+	if _, ok := fragmentSpreadName(data.FieldName); ok {
+		return nil
+	}
+	types := qt.Root.types
+	sel, err := resolveFieldSelection(types, parent, data)
+	if err != nil || sel.typeDef == nil {
+		return nil
+	}
+	if workers > len(data.Children) {
+		workers = len(data.Children)
+	}
+
+	res := preparedSelections{data: {parent: parent, sel: sel}}
+	var failed int32
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan *proto.RGQLQueryTreeNode)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make(preparedSelections)
+			for child := range jobs {
+				if atomic.LoadInt32(&failed) != 0 || ctx.Err() != nil {
+					continue
+				}
+				if !prepareSubtree(types, sel.typeDef, child, local) {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+			mtx.Lock()
+			for nod, prep := range local {
+				res[nod] = prep
+			}
+			mtx.Unlock()
+		}()
+	}
+feed:
+	for _, child := range data.Children {
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		select {
+		case jobs <- child:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return res
+}
+
+// prepareSubtree resolves the selections of a subtree into res, returns false on the first failure.
+// Fragment spreads are expanded when added and are not prepared.
+func prepareSubtree(schemaResolver SchemaResolver, parent ast.TypeDefinition, data *proto.RGQLQueryTreeNode, res preparedSelections) bool {
+	if _, ok := fragmentSpreadName(data.FieldName); ok {
+		return true
+	}
+	sel, err := resolveFieldSelection(schemaResolver, parent, data)
+	if err != nil {
+		return false
+	}
+	res[data] = preparedSelection{parent: parent, sel: sel}
+	if sel.typeDef == nil {
+		return len(data.Children) == 0
+	}
+	for _, child := range data.Children {
+		if !prepareSubtree(schemaResolver, sel.typeDef, child, res) {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareMutation prepares the child trees added by a mutation, looking up their parents with the tree locked.
+func (qt *QueryTreeNode) prepareMutation(mutation *proto.RGQLQueryTreeMutation) preparedSelections {
+	if qt.Root.options.AddWorkers < 2 {
+		return nil
+	}
+	// The parents are not used unlocked, they may be disposed meanwhile.
+	type addition struct {
+		ctx     context.Context
+		typeDef ast.TypeDefinition
+		data    *proto.RGQLQueryTreeNode
+	}
+	var additions []addition
+	unlock := qt.rlockTree()
+	for _, aqn := range mutation.NodeMutation {
+		if aqn.Operation != proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD || aqn.Node == nil {
+			continue
+		}
+		if nod, ok := qt.Root.RootNodeMap[aqn.NodeId]; ok {
+			additions = append(additions, addition{ctx: nod.Context(), typeDef: nod.AST, data: aqn.Node})
+		}
+	}
+	unlock()
+
+	var res preparedSelections
+	for _, add := range additions {
+		for nod, prep := range qt.Root.prepareSelections(add.ctx, add.typeDef, add.data) {
+			if res == nil {
+				res = make(preparedSelections)
+			}
+			res[nod] = prep
+		}
+	}
+	return res
+}
+
+// addPrepared makes prepared selections available to addChild, returns the func removing them again.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) addPrepared(prepared preparedSelections) func() {
+	if len(prepared) == 0 {
+		return func() {}
+	}
+	root := qt.Root
+	root.sharedMtx.Lock()
+	if root.prepared == nil {
+		root.prepared = make(preparedSelections, len(prepared))
+	}
+	for nod, prep := range prepared {
+		root.prepared[nod] = prep
+	}
+	root.sharedMtx.Unlock()
+	return func() {
+		root.sharedMtx.Lock()
+		for nod := range prepared {
+			delete(root.prepared, nod)
+		}
+		root.sharedMtx.Unlock()
+	}
+}
+
+// resolveSelection resolves the field selected by data on the parent type, using a prepared selection if any.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) resolveSelection(parent ast.TypeDefinition, data *proto.RGQLQueryTreeNode) (*fieldSelection, error) {
+	root := qt.Root
+	root.sharedMtx.Lock()
+	prep, ok := root.prepared[data]
+	root.sharedMtx.Unlock()
+	if ok && prep.parent == parent {
+		return prep.sel, nil
+	}
+	return resolveFieldSelection(root.types, parent, data)
+}
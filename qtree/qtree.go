@@ -1,11 +1,14 @@
 package qtree
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/graphql-go/graphql/language/ast"
-	"github.com/rgraphql/magellan/types"
 	proto "github.com/rgraphql/rgraphql/pkg/proto"
 )
 
@@ -13,186 +16,896 @@ import (
 type QueryTreeNode struct {
 	Id        uint32
 	idCounter uint32
+	// level is the distance of the node to the root.
+	level int
 
-	Root     *QueryTreeNode
-	Parent   *QueryTreeNode
+	Root   *QueryTreeNode
+	Parent *QueryTreeNode
+	// Children are the live child nodes in the order they were added.
+	// Deleting a child keeps the order of the others, a node added again goes to the end.
 	Children []*QueryTreeNode
 
+	// RootNodeMap and the tree structure are guarded by rootMtx on the root node, see lock.go.
 	RootNodeMap    map[uint32]*QueryTreeNode
+	rootMtx        sync.RWMutex
 	SchemaResolver SchemaResolver
 	VariableStore  *VariableStore
+	// sharedMtx guards the state shared by the shards with the ShardedLocks option, on the root.
+	sharedMtx sync.Mutex
+	// shardMtx guards the subtree of a top-level selection with the ShardedLocks option.
+	shardMtx sync.RWMutex
+	// types caches the type lookups of the schema resolver, on the root.
+	types *typeCache
+	// prepared are the selections resolved by the AddWorkers ahead of adding, on the root, guarded by sharedMtx.
+	prepared preparedSelections
+	// options are the tree options, on the root.
+	options QueryTreeOptions
+	// stats are the tree counters, on the root.
+	stats TreeStats
+	// errorsDropped counts the errors dropped with the error channel full, on the root, accessed atomically.
+	errorsDropped uint64
+	// nodePool holds the reset nodes of failed additions with the PoolNodes option, on the root.
+	nodePool *sync.Pool
+	// escaped is set once the node was passed to code outside the package while it was added.
+	escaped bool
+	// refs maps the IDs the node was added with to the ID of the parent they were added under.
+	// Results are delivered under Id, the ID the node was first added with.
+	refs map[uint32]uint32
+	// OperationType is the operation the tree selects from, on the root.
+	OperationType OperationType
 
-	FieldName     string
+	FieldName string
+	// ResolverName is the field name mapped by the FieldNameMapper option, used to look up resolvers.
+	ResolverName string
+	// Alias is the response key requested instead of the field name, if any.
+	Alias         string
+	fieldDef      *ast.FieldDefinition
 	AST           ast.TypeDefinition
 	IsPrimitive   bool
 	PrimitiveName string
-	Arguments     map[string]*VariableReference
+	// IsList is set if the field returns a list, the children are then selected on each element.
+	IsList bool
+	// ListDepth is the number of nested lists the field returns, e.g. 2 for [[Person!]!]!.
+	ListDepth int
+	Arguments map[string]*VariableReference
+	// PossibleTypes are the concrete object types the node can resolve to.
+	PossibleTypes []*ast.ObjectDefinition
+	// TypeCondition is set if the node is an inline fragment narrowing the parent type.
+	TypeCondition string
+	// typedChildren are the inline fragment children by the names of the concrete types they apply to.
+	typedChildren map[string][]*QueryTreeNode
+	// literals are the sources of the arguments given inline by argument name.
+	literals map[string]string
+	// immutableArgs are the names of the arguments marked immutable in the schema.
+	immutableArgs map[string]bool
+	// Directives are the @skip and @include conditions and custom directive arguments by directive name.
+	Directives map[string]*VariableReference
+	// directiveLiterals are the sources of the directives given inline by directive name.
+	directiveLiterals map[string]string
+	// Inactive is set when the node is excluded by its directives.
+	// Inactive nodes stay in the tree and are re-evaluated when the variables change.
+	Inactive bool
+	// Annotations are values set by directive handlers when the node was added.
+	Annotations map[string]interface{}
+	// directiveHandlers are the registered custom directive handlers, on the root.
+	directiveHandlers map[string]DirectiveHandler
+	// fieldAuthorizer checks the fields selected by added nodes, on the root, see SetFieldAuthorizer.
+	fieldAuthorizer FieldAuthorizer
+
+	// cost is the complexity charged for the node.
+	cost int
+	// complexity is the running complexity total of the tree, on the root.
+	complexity int
+
+	// fragments are the fragment definitions registered on the root.
+	fragments map[string]*ast.FragmentDefinition
+	// fragmentSpreads are the expanded fragment spreads by spread node ID, on the root.
+	fragmentSpreads map[uint32]*fragmentSpread
+	// fragmentSpreadId is the ID of the spread this node was expanded from, if any.
+	fragmentSpreadId uint32
 
 	subCtr         uint32
 	subscribers    map[uint32]*qtNodeSubscription
 	subscribersMtx sync.Mutex
+	// batchDepth counts the tree mutations in progress, on the root, guarded by batchMtx.
+	batchDepth int
+	// batchQueue are the batch subscriptions with updates to flush when the mutations end, on the root.
+	batchQueue []*qtNodeSubscription
+	batchMtx   sync.Mutex
+	// debounced are the delayed Operation_ArgsChanged updates by child node, on the root, guarded by debounceMtx.
+	debounced   map[*QueryTreeNode]*pendingArgsChanged
+	debounceMtx sync.Mutex
 
-	err   error
-	errCh chan<- *proto.RGQLQueryError
+	// ResolveError is set when the node was marked as invalid with SetError.
+	// Subtrees failing to resolve when added are not kept in the tree, unless RetryBackoff keeps a node whose type
+	// failed to resolve. See RetryBackoff for retrying marked nodes.
+	ResolveError error
+	errCh        chan<- *proto.RGQLQueryError
+	// retries counts the failed retries since the node was marked with an error, nextRetry is the earliest next retry.
+	retries   int
+	nextRetry time.Time
+	// pending is the selection of a node kept in the tree after its type failed to resolve, added again on retry.
+	pending *proto.RGQLQueryTreeNode
+	// ResolveTimeout is the time the resolver of the node may spend, zero for no limit.
+	// It is set with the @timeout(ms:) directive in the query or on the field in the schema.
+	ResolveTimeout time.Duration
+	// Incremental is set if the node is delivered incrementally with the @defer or @stream directives.
+	// It is evaluated when the node is added.
+	Incremental *IncrementalDelivery
 
 	disposeChan chan struct{}
-	disposeOnce sync.Once
+	// emptyCh is signaled when the tree loses its last selection, on the root.
+	emptyCh chan struct{}
+	// disposed is set once the node is disposed, guarded by rootMtx.
+	disposed bool
+	// frozen is set while the tree is read-only, on the root, guarded by rootMtx.
+	frozen bool
+	// disposeCallbacks are called when the node is disposed, guarded by rootMtx.
+	disposeCallbacks []func()
 }
 
 // NewQueryTree builds a new query tree given the RootQuery AST object and a schemaResolver to lookup types.
+// Errors are sent to errorCh without blocking, they are dropped and counted in Stats if it is full.
 func NewQueryTree(rootQuery *ast.ObjectDefinition,
 	schemaResolver SchemaResolver,
 	errorCh chan<- *proto.RGQLQueryError) *QueryTreeNode {
+	return NewQueryTreeWithOptions(rootQuery, schemaResolver, errorCh, QueryTreeOptions{})
+}
+
+// NewQueryTreeWithVersion builds a new query tree like NewQueryTree, for the given version of the schema.
+// See the SchemaVersion option.
+func NewQueryTreeWithVersion(rootQuery *ast.ObjectDefinition,
+	schemaResolver SchemaResolver,
+	errorCh chan<- *proto.RGQLQueryError,
+	schemaVersion string) *QueryTreeNode {
+	return NewQueryTreeWithOptions(rootQuery, schemaResolver, errorCh, QueryTreeOptions{SchemaVersion: schemaVersion})
+}
+
+// NewQueryTreeWithOptions builds a new query tree with limits given by opts.
+func NewQueryTreeWithOptions(rootQuery *ast.ObjectDefinition,
+	schemaResolver SchemaResolver,
+	errorCh chan<- *proto.RGQLQueryError,
+	opts QueryTreeOptions) *QueryTreeNode {
+	return NewQueryTreeForRoot(rootQuery, OperationQuery, schemaResolver, errorCh, opts)
+}
+
+// NewQueryTreeForOperation builds a new query tree selecting from the root type the schema resolver has for op.
+func NewQueryTreeForOperation(op OperationType,
+	schemaResolver SchemaResolver,
+	errorCh chan<- *proto.RGQLQueryError,
+	opts QueryTreeOptions) (*QueryTreeNode, error) {
+	root := schemaResolver.RootType(op)
+	if root == nil {
+		return nil, fmt.Errorf("Root %s object not found.", op)
+	}
+	return NewQueryTreeForRoot(root, op, schemaResolver, errorCh, opts), nil
+}
+
+// NewQueryTreeForRoot builds a new query tree selecting from the root type of an operation.
+func NewQueryTreeForRoot(root *ast.ObjectDefinition,
+	opType OperationType,
+	schemaResolver SchemaResolver,
+	errorCh chan<- *proto.RGQLQueryError,
+	opts QueryTreeOptions) *QueryTreeNode {
 	nqt := &QueryTreeNode{
 		Id:             0,
 		RootNodeMap:    map[uint32]*QueryTreeNode{},
-		AST:            rootQuery,
+		AST:            root,
 		SchemaResolver: schemaResolver,
+		types:          newTypeCache(schemaResolver),
 		VariableStore:  NewVariableStore(),
+		PossibleTypes:  []*ast.ObjectDefinition{root},
+		OperationType:  opType,
+		options:        opts,
 		subscribers:    make(map[uint32]*qtNodeSubscription),
 		errCh:          errorCh,
 		disposeChan:    make(chan struct{}),
+		emptyCh:        make(chan struct{}, 1),
+	}
+	if opts.PoolNodes && !opts.ShardedLocks {
+		nqt.nodePool = newNodePool()
 	}
 	nqt.Root = nqt
 	nqt.RootNodeMap[0] = nqt
+	nqt.VariableStore.tree = nqt
 	return nqt
 }
 
-// ApplyTreeMutation applies a tree mutation to the query tree. Errors leave nodes in a failed state.
+// LookupNode finds a node in the tree by ID.
+func (qt *QueryTreeNode) LookupNode(id uint32) (*QueryTreeNode, bool) {
+	qt.Root.rootMtx.RLock()
+	defer qt.Root.rootMtx.RUnlock()
+
+	return qt.lookupNode(id)
+}
+
+// Nodes returns a snapshot of the nodes in the RootNodeMap, including the root, ordered by node ID.
+// Nodes selected by several IDs are returned once. The slice is taken with the whole tree locked,
+// and is not changed by later mutations.
+func (qt *QueryTreeNode) Nodes() []*QueryTreeNode {
+	unlock := qt.rlockTree()
+	defer unlock()
+
+	nodeMap := qt.Root.RootNodeMap
+	nodes := make([]*QueryTreeNode, 0, len(nodeMap))
+	seen := make(map[*QueryTreeNode]struct{}, len(nodeMap))
+	for _, nod := range nodeMap {
+		if _, ok := seen[nod]; ok {
+			continue
+		}
+		seen[nod] = struct{}{}
+		nodes = append(nodes, nod)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+// ApplyTreeMutation applies a tree mutation to the query tree. Failed operations are reported and skipped.
+// Variables are validated against their declared types first, if a node operation references an invalid
+// variable no node operations are applied. Deletes of existing nodes are applied first, so a batch can
+// reuse the IDs it frees, see orderNodeMutations. Object nodes the mutation leaves without children are
+// marked with an *IncompleteSelectionError.
+// The mutation proto carries no schema version, so the version is not checked: clients declaring the version
+// their query was built against are served with ApplyTreeMutationVersioned.
 func (qt *QueryTreeNode) ApplyTreeMutation(mutation *proto.RGQLQueryTreeMutation) {
+	qt.ApplyTreeMutationErr(mutation)
+}
+
+// NodeMutationError is the error of a failed node mutation.
+type NodeMutationError struct {
+	// NodeId is the ID of the node the mutation targeted.
+	NodeId uint32
+	Err    error
+}
+
+// Error returns the message of the underlying error.
+func (e *NodeMutationError) Error() string {
+	return e.Err.Error()
+}
+
+// ApplyTreeMutationErr applies a tree mutation like ApplyTreeMutation, returning the errors of failed operations in order.
+func (qt *QueryTreeNode) ApplyTreeMutationErr(mutation *proto.RGQLQueryTreeMutation) []*NodeMutationError {
+	qt.Root.beginBatch()
+	defer qt.Root.endBatch()
+
 	// Apply all variables.
+	changedVariables, invalidVariables := qt.putVariables(mutation)
+	if errs := qt.rejectInvalidVariables(mutation, invalidVariables); errs != nil {
+		return errs
+	}
+
+	prepared := qt.prepareMutation(mutation)
+	qt.Root.rootMtx.Lock()
+	drop := qt.addPrepared(prepared)
+	hadChildren := len(qt.Root.Children) != 0
+	errs := qt.applyNodeMutations(mutation, changedVariables, nil)
+	qt.Root.notifyEmpty(hadChildren)
+	drop()
+	qt.Root.rootMtx.Unlock()
+
+	// Garbage collect variables
+	qt.VariableStore.GarbageCollect()
+	return errs
+}
+
+// ApplyTreeMutationScoped applies a tree mutation to the subtree of this node.
+// Node ID 0 refers to this node, other IDs must refer to this node or its descendants.
+// Operations on nodes outside the subtree are reported and skipped, variables apply to the whole tree.
+func (qt *QueryTreeNode) ApplyTreeMutationScoped(mutation *proto.RGQLQueryTreeMutation) {
+	qt.Root.beginBatch()
+	defer qt.Root.endBatch()
+
+	changedVariables, invalidVariables := qt.putVariables(mutation)
+	if errs := qt.rejectInvalidVariables(mutation, invalidVariables); errs != nil {
+		return
+	}
+
+	qt.Root.rootMtx.Lock()
+	hadChildren := len(qt.Root.Children) != 0
+	qt.applyNodeMutations(mutation, changedVariables, qt)
+	qt.Root.notifyEmpty(hadChildren)
+	qt.Root.rootMtx.Unlock()
+
+	// Garbage collect variables
+	qt.VariableStore.GarbageCollect()
+}
+
+// ApplyTreeMutationAtomic applies a tree mutation only if every operation would succeed.
+// Operations are checked in the order they are applied, so a batch may add below a node and then delete it,
+// but not the reverse.
+// If any operation fails the tree and variables are left untouched and the errors are returned as MutationErrors.
+func (qt *QueryTreeNode) ApplyTreeMutationAtomic(mutation *proto.RGQLQueryTreeMutation) error {
+	qt.Root.beginBatch()
+	defer qt.Root.endBatch()
+
+	qt.Root.rootMtx.Lock()
+	if errs := qt.validateTreeMutation(mutation); len(errs) != 0 {
+		qt.Root.rootMtx.Unlock()
+		return errs
+	}
+	hadChildren := len(qt.Root.Children) != 0
+	changedVariables, _ := qt.putVariables(mutation)
+	qt.applyNodeMutations(mutation, changedVariables, nil)
+	qt.Root.notifyEmpty(hadChildren)
+	qt.Root.rootMtx.Unlock()
+
+	// Garbage collect variables
+	qt.VariableStore.GarbageCollect()
+	return nil
+}
+
+// putVariables stores the variables of a mutation, returning the IDs of changed variables.
+// Values invalid for their declared type are not stored and returned by variable ID.
+func (qt *QueryTreeNode) putVariables(mutation *proto.RGQLQueryTreeMutation) (map[uint32]struct{}, map[uint32]error) {
+	changedVariables := make(map[uint32]struct{}, len(mutation.Variables))
+	var invalidVariables map[uint32]error
 	for _, variable := range mutation.Variables {
-		qt.VariableStore.Put(variable)
+		changed, err := qt.VariableStore.TryPut(variable)
+		if err != nil {
+			if invalidVariables == nil {
+				invalidVariables = make(map[uint32]error)
+			}
+			invalidVariables[variable.Id] = err
+			continue
+		}
+		if changed {
+			changedVariables[variable.Id] = struct{}{}
+		}
 	}
+	return changedVariables, invalidVariables
+}
 
-	for _, aqn := range mutation.NodeMutation {
+// rejectInvalidVariables checks if any node operation of a mutation references an invalid variable.
+// If so none of the node operations are applied: each is reported with the error of the first invalid variable
+// it references, or as skipped. Invalid variables not referenced by the mutation are reported on node 0.
+func (qt *QueryTreeNode) rejectInvalidVariables(mutation *proto.RGQLQueryTreeMutation,
+	invalidVariables map[uint32]error) []*NodeMutationError {
+	if len(invalidVariables) == 0 {
+		return nil
+	}
+
+	referenced := make([]error, len(mutation.NodeMutation))
+	rejected := false
+	for i, aqn := range mutation.NodeMutation {
+		if aqn.Node != nil {
+			referenced[i] = invalidReference(aqn.Node, invalidVariables)
+			rejected = rejected || referenced[i] != nil
+		}
+	}
+	if !rejected {
+		ids := make([]uint32, 0, len(invalidVariables))
+		for id := range invalidVariables {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			qt.Root.sendError(0, invalidVariables[id])
+		}
+		return nil
+	}
+
+	errs := make([]*NodeMutationError, len(mutation.NodeMutation))
+	for i, aqn := range mutation.NodeMutation {
+		err := referenced[i]
+		if err == nil {
+			err = fmt.Errorf("Invalid mutation on node %d, skipped because of invalid variables.", aqn.NodeId)
+		}
+		qt.Root.sendError(aqn.NodeId, err)
+		errs[i] = &NodeMutationError{NodeId: aqn.NodeId, Err: err}
+	}
+	return errs
+}
+
+// invalidReference returns the error of the first invalid variable referenced in the subtree, if any.
+func invalidReference(data *proto.RGQLQueryTreeNode, invalidVariables map[uint32]error) error {
+	for _, arg := range data.Args {
+		if _, _, isInline := splitInlineArgument(arg.Name); isInline {
+			continue
+		}
+		if err, ok := invalidVariables[arg.VariableId]; ok {
+			return err
+		}
+	}
+	for _, child := range data.Children {
+		if err := invalidReference(child, invalidVariables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyNodeMutations applies the node mutations, returning the errors of failed operations.
+// If scope is set, node IDs are resolved within its subtree, with ID 0 referring to scope.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) applyNodeMutations(mutation *proto.RGQLQueryTreeMutation,
+	changedVariables map[uint32]struct{},
+	scope *QueryTreeNode) []*NodeMutationError {
+	if len(changedVariables) != 0 {
+		qt.updateDirectives(changedVariables)
+		qt.updateArguments(changedVariables)
+	}
+	top := qt.Root
+	if scope != nil {
+		top = scope
+	}
+	var errs []*NodeMutationError
+	fail := func(nodeId uint32, err error) {
+		errs = append(errs, &NodeMutationError{NodeId: nodeId, Err: err})
+	}
+	// vacated are the nodes children were deleted or moved from.
+	var vacated []*QueryTreeNode
+	for _, aqn := range qt.orderNodeMutations(mutation, scope) {
 		// Find the node we are operating on.
 		nod, ok := qt.Root.RootNodeMap[aqn.NodeId]
+		parentRef := aqn.NodeId
+		if scope != nil && aqn.NodeId == 0 {
+			nod, ok, parentRef = scope, true, scope.Id
+		}
 		if !ok {
+			if aqn.Operation == proto.RGQLQueryTreeMutation_SUBTREE_DELETE && scope.containsSpread(aqn.NodeId) {
+				qt.disposeFragmentSpread(aqn.NodeId)
+				continue
+			}
+			fail(aqn.NodeId, fmt.Errorf("Invalid node ID (not found): %d", aqn.NodeId))
+			continue
+		}
+		if scope != nil && !scope.contains(nod) {
+			err := fmt.Errorf("Invalid node ID (not in scope): %d", aqn.NodeId)
+			qt.sendError(aqn.NodeId, err)
+			fail(aqn.NodeId, err)
+			continue
+		}
+		if err := qt.checkFrozen(); err != nil && aqn.Operation != proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD {
+			// Additions report the error for the child.
+			qt.sendError(aqn.NodeId, err)
+			fail(aqn.NodeId, err)
 			continue
 		}
 
 		switch aqn.Operation {
 		case proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD:
-			nod.AddChild(aqn.Node)
+			if aqn.Node == nil {
+				fail(aqn.NodeId, fmt.Errorf("Invalid mutation on node %d, no child given.", aqn.NodeId))
+				continue
+			}
+			if err := nod.addSubtree(aqn.Node, parentRef); err != nil {
+				fail(aqn.NodeId, err)
+			}
 		case proto.RGQLQueryTreeMutation_SUBTREE_DELETE:
-			if aqn.NodeId != 0 && nod != qt.Root {
-				nod.Dispose()
+			if aqn.NodeId != 0 && nod != top {
+				vacated = append(vacated, nod.Parent)
+				nod.release(aqn.NodeId)
+			}
+		case SubtreeReparent:
+			if aqn.Node == nil {
+				fail(aqn.NodeId, fmt.Errorf("Invalid mutation on node %d, no child given.", aqn.NodeId))
+				continue
 			}
+			if moved, ok := qt.Root.RootNodeMap[aqn.Node.Id]; ok && scope != nil && (moved == scope || !scope.contains(moved)) {
+				err := fmt.Errorf("Invalid node ID (not in scope): %d", aqn.Node.Id)
+				qt.sendError(aqn.Node.Id, err)
+				fail(aqn.NodeId, err)
+				continue
+			}
+			if moved, ok := qt.Root.RootNodeMap[aqn.Node.Id]; ok && moved.Parent != nil {
+				vacated = append(vacated, moved.Parent)
+			}
+			if err := nod.reparent(aqn.Node.Id, parentRef); err != nil {
+				qt.sendError(aqn.Node.Id, err)
+				fail(aqn.NodeId, err)
+			}
+		case SubtreeSetArgs:
+			if aqn.Node == nil {
+				fail(aqn.NodeId, fmt.Errorf("Invalid mutation on node %d, no child given.", aqn.NodeId))
+				continue
+			}
+			if err := nod.setArguments(aqn.Node.Args); err != nil {
+				qt.sendError(aqn.NodeId, err)
+				fail(aqn.NodeId, err)
+			}
+		default:
+			err := unknownOperationError(aqn)
+			qt.sendError(aqn.NodeId, err)
+			fail(aqn.NodeId, err)
 		}
 	}
+	return append(errs, checkSelectionsLeft(vacated)...)
+}
 
-	// Garbage collect variables
-	qt.VariableStore.GarbageCollect()
+// orderNodeMutations returns the node mutations in the order they are applied, expects the root lock to be held.
+// Deletes of nodes in scope existing before the batch are moved to the front, keeping their order, unless an
+// earlier operation is on the deleted subtree. Deleting a node and adding a child reusing its ID then works in
+// either order.
+func (qt *QueryTreeNode) orderNodeMutations(mutation *proto.RGQLQueryTreeMutation,
+	scope *QueryTreeNode) []*proto.RGQLQueryTreeMutation_NodeMutation {
+	var deletes, rest []*proto.RGQLQueryTreeMutation_NodeMutation
+	var touched []*QueryTreeNode
+	for _, aqn := range mutation.NodeMutation {
+		if aqn.Operation == proto.RGQLQueryTreeMutation_SUBTREE_DELETE {
+			if nod, ok := qt.Root.RootNodeMap[aqn.NodeId]; ok && aqn.NodeId != 0 && scope.contains(nod) {
+				hoist := true
+				for _, t := range touched {
+					hoist = hoist && !nod.contains(t)
+				}
+				if hoist {
+					deletes = append(deletes, aqn)
+					continue
+				}
+			}
+		} else {
+			if nod, ok := qt.Root.RootNodeMap[aqn.NodeId]; ok {
+				touched = append(touched, nod)
+			}
+			if aqn.Operation == SubtreeReparent && aqn.Node != nil {
+				if nod, ok := qt.Root.RootNodeMap[aqn.Node.Id]; ok {
+					touched = append(touched, nod)
+				}
+			}
+		}
+		rest = append(rest, aqn)
+	}
+	if len(deletes) == 0 {
+		return mutation.NodeMutation
+	}
+	return append(deletes, rest...)
+}
+
+// contains checks if nod is this node or one of its descendants, a nil scope contains every node.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) contains(nod *QueryTreeNode) bool {
+	if qt == nil {
+		return true
+	}
+	for ; nod != nil; nod = nod.Parent {
+		if nod == qt {
+			return true
+		}
+	}
+	return false
+}
+
+// containsSpread checks if the nodes of a fragment spread are below this node, a nil scope contains every spread.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) containsSpread(id uint32) bool {
+	if qt == nil {
+		return true
+	}
+	spread, ok := qt.Root.fragmentSpreads[id]
+	return ok && len(spread.nodes) != 0 && qt.contains(spread.nodes[0].Parent)
 }
 
 // AddChild validates and adds a child tree.
-func (qt *QueryTreeNode) AddChild(data *proto.RGQLQueryTreeNode) (addChildErr error) {
-	if _, ok := qt.RootNodeMap[data.Id]; ok {
-		return fmt.Errorf("Invalid node ID (already exists): %d", data.Id)
+// If any node in the tree fails to resolve, none of the tree is added and a *QTError is returned.
+// A tree with the ID of the root, added to the root, applies its directives to the root and adds its children.
+func (qt *QueryTreeNode) AddChild(data *proto.RGQLQueryTreeNode) error {
+	prepared := qt.prepareSelections(qt.Context(), qt.AST, data)
+	unlock := qt.lockSubtree()
+	defer unlock()
+
+	drop := qt.addPrepared(prepared)
+	defer drop()
+	return qt.addSubtree(data, qt.Id)
+}
+
+// subtreeError is returned for a subtree when a descendant failed.
+// The descendant has already reported the error.
+type subtreeError struct {
+	nodeId uint32
+	err    error
+}
+
+// Error returns the error of the failed descendant.
+func (e *subtreeError) Error() string {
+	return e.err.Error()
+}
+
+// addSubtree adds a child tree, reporting an error for the subtree root if a descendant failed.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) addSubtree(data *proto.RGQLQueryTreeNode, parentRef uint32) error {
+	if err := qt.checkFrozen(); err != nil {
+		qt.countFailedAdd()
+		qt.sendError(data.Id, err)
+		return qt.newNodeError(data, err)
 	}
+	if dupId, err := checkUniqueIds(data); err != nil {
+		qt.countFailedAdd()
+		qt.sendError(dupId, err)
+		return qt.newNodeError(data, err)
+	}
+	var err error
+	if data.Id == qt.Id && qt.Parent == nil {
+		err = qt.extendRoot(data)
+	} else {
+		err = qt.addChild(data, parentRef)
+	}
+	if err != nil {
+		qt.countFailedAdd()
+	}
+	if serr, ok := err.(*subtreeError); ok {
+		qt.sendError(data.Id, fmt.Errorf("Invalid node %d, descendant %d failed: %v", data.Id, serr.nodeId, serr.err))
+		return serr.err
+	}
+	return err
+}
 
-	// Mint the new node.
-	nnod := &QueryTreeNode{
-		Id:             data.Id,
-		Parent:         qt,
-		Root:           qt.Root,
-		SchemaResolver: qt.SchemaResolver,
-		VariableStore:  qt.VariableStore,
-		FieldName:      data.FieldName,
-		errCh:          qt.errCh,
-		subscribers:    make(map[uint32]*qtNodeSubscription),
-		disposeChan:    make(chan struct{}),
+// checkUniqueIds checks that no ID is used more than once in a child tree before any of it is added,
+// and that no ID is in the server range. Returns the first invalid ID in depth-first order.
+func checkUniqueIds(data *proto.RGQLQueryTreeNode) (uint32, error) {
+	seen := make(map[uint32]struct{})
+	var check func(nod *proto.RGQLQueryTreeNode) (uint32, error)
+	check = func(nod *proto.RGQLQueryTreeNode) (uint32, error) {
+		if err := checkClientNodeId(nod.Id); err != nil {
+			return nod.Id, err
+		}
+		if _, ok := seen[nod.Id]; ok {
+			return nod.Id, fmt.Errorf("Invalid node ID (used more than once): %d", nod.Id)
+		}
+		seen[nod.Id] = struct{}{}
+		for _, child := range nod.Children {
+			if id, err := check(child); err != nil {
+				return id, err
+			}
+		}
+		return 0, nil
 	}
-	// TODO: Mutex
-	qt.Root.RootNodeMap[nnod.Id] = nnod
-	qt.Children = append(qt.Children, nnod)
+	return check(data)
+}
 
+// addChild adds a child tree under the given ID of this node, expects the root lock to be held.
+// Children selecting the same field with the same arguments as a sibling are merged into the sibling.
+func (qt *QueryTreeNode) addChild(data *proto.RGQLQueryTreeNode, parentRef uint32) (addChildErr error) {
 	defer func() {
 		if addChildErr != nil {
-			nnod.SetError(addChildErr)
+			addChildErr = qt.newNodeError(data, addChildErr)
 		}
 	}()
 
-	// Figure out the AST for this child.
-	od, ok := qt.AST.(*ast.ObjectDefinition)
-	if !ok {
-		return fmt.Errorf("Invalid node %d, parent is not selectable.", data.Id)
+	if qt.disposed {
+		err := fmt.Errorf("Invalid node %d, parent %d was disposed.", data.Id, qt.Id)
+		qt.sendError(data.Id, err)
+		return err
 	}
 
-	var selectedField *ast.FieldDefinition
-	if data.FieldName == "__typename" {
-		selectedField = typeNameDef
-	} else {
-		for _, field := range od.Fields {
-			name := field.Name.Value
-			if name == data.FieldName {
-				selectedField = field
-				break
-			}
+	nod, nodeExists := qt.lookupNode(data.Id)
+	if nodeExists && nod.isSelection(qt, data, parentRef) {
+		if nod.pending != nil {
+			return nod.retryPending(data)
 		}
+		return nod.extend(data)
+	}
+	qt.Root.sharedMtx.Lock()
+	_, spreadExists := qt.Root.fragmentSpreads[data.Id]
+	qt.Root.sharedMtx.Unlock()
+	if nodeExists || spreadExists {
+		err := fmt.Errorf("Invalid node ID (already exists): %d", data.Id)
+		qt.sendError(data.Id, err)
+		return err
 	}
 
-	if selectedField == nil {
-		return fmt.Errorf("Invalid field %s on %s.", data.FieldName, od.Name.Value)
+	if err := qt.checkDepth(data); err != nil {
+		qt.sendError(data.Id, err)
+		return err
 	}
 
-	selectedType := selectedField.Type
-	if stl, ok := selectedType.(*ast.List); ok {
-		selectedType = stl.Type
+	if name, ok := fragmentSpreadName(data.FieldName); ok {
+		return qt.addFragmentSpread(data, name)
 	}
 
-	isPrimitive := false
-	var primitiveName string
-	var selectedTypeDef ast.TypeDefinition
-	var namedType *ast.Named
+	if err := qt.checkNodeCount(data.Id); err != nil {
+		qt.sendError(data.Id, err)
+		return err
+	}
 
-	if n, ok := selectedType.(*ast.NonNull); ok {
-		selectedType = n.Type
+	alias, fieldName := splitFieldAlias(data.FieldName)
+	if sibling := qt.findSibling(alias, fieldName, data.Args); sibling != nil {
+		return sibling.merge(data, parentRef)
 	}
 
-	if n, ok := selectedType.(*ast.Named); ok {
-		namedType = n
-		if types.IsPrimitive(n.Name.Value) {
-			primitiveName = n.Name.Value
-			isPrimitive = true
-		}
+	// Mint the new node.
+	nnod := qt.Root.newNode()
+	*nnod = QueryTreeNode{
+		Id:             data.Id,
+		level:          qt.level + 1,
+		Parent:         qt,
+		Root:           qt.Root,
+		SchemaResolver: qt.SchemaResolver,
+		VariableStore:  qt.VariableStore,
+		FieldName:      fieldName,
+		Alias:          alias,
+		errCh:          qt.errCh,
+		subscribers:    nnod.subscribers,
+		disposeChan:    make(chan struct{}),
+		refs:           nnod.refs,
 	}
+	nnod.refs[data.Id] = parentRef
+	qt.registerNode(nnod.Id, nnod)
+	qt.Children = append(qt.Children, nnod)
 
-	if selectedTypeDef == nil && !isPrimitive {
-		selectedTypeDef = qt.SchemaResolver.LookupType(selectedType)
-		if selectedTypeDef == nil {
-			if namedType != nil {
-				return fmt.Errorf("Unable to resolve named %s.", namedType.Name.Value)
-			}
-			return fmt.Errorf("Unable to resolve type %#v.", selectedType)
+	defer func() {
+		if addChildErr == nil {
+			return
+		}
+		// Roll back the node and every descendant it added.
+		// The node is recycled last, it may be reused by another tree right after.
+		id := nnod.Id
+		qt.dropChild(nnod)
+		nnod.unregister()
+		if _, ok := addChildErr.(*subtreeError); !ok {
+			qt.sendError(id, addChildErr)
+		}
+		nnod.recycle()
+	}()
+
+	// Figure out the AST for this child.
+	if err := qt.checkIntrospection(fieldName); err != nil {
+		return err
+	}
+	sel, err := qt.resolveSelection(qt.AST, data)
+	if err != nil {
+		if qt.keepPending(nnod, data, err) {
+			return nil
+		}
+		return err
+	}
+	var deprecation, denied error
+	if sel.typeCondition == "" {
+		denied = qt.authorize(data.Id, fieldName)
+		deprecation = deprecationError(data.Id, qt.AST, sel.field)
+		if deprecation != nil && qt.Root.options.RejectDeprecated {
+			return deprecation
+		}
+		if err := checkFieldArguments(sel.field, data.Args); err != nil {
+			return err
+		}
+		if err := qt.checkTypeRecursion(data.Id, sel.typeDef); err != nil {
+			return err
 		}
 	}
 
 	argMap := make(map[string]*VariableReference)
+	directiveMap := make(map[string]*VariableReference)
+	cleanupArgs := func() {
+		for _, marg := range argMap {
+			marg.Unsubscribe()
+		}
+		for _, marg := range directiveMap {
+			marg.Unsubscribe()
+		}
+	}
+	var literals, directiveLiterals map[string]string
 	for _, arg := range data.Args {
+		name, literal, isInline := splitInlineArgument(arg.Name)
+		if directive, isDirective := directiveArgName(name); isDirective {
+			if err := qt.checkDirective(directive); err != nil {
+				cleanupArgs()
+				return err
+			}
+			ref, err := directiveReference(arg, qt.VariableStore)
+			if err != nil {
+				cleanupArgs()
+				return err
+			}
+			directiveMap[directive] = ref
+			if isInline {
+				if directiveLiterals == nil {
+					directiveLiterals = make(map[string]string)
+				}
+				directiveLiterals[directive] = literal
+			}
+			continue
+		}
+		if isInline {
+			ref, err := inlineArgument(qt.Root.types, sel.field, name, literal)
+			if err != nil {
+				cleanupArgs()
+				return err
+			}
+			if literals == nil {
+				literals = make(map[string]string)
+			}
+			argMap[name] = ref
+			literals[name] = literal
+			continue
+		}
 		vref := qt.VariableStore.Get(arg.VariableId)
 		if vref == nil {
 			// Cleanup a bit
-			for _, marg := range argMap {
-				marg.Unsubscribe()
-			}
-			return fmt.Errorf("Variable id %d not found for argument %s.", arg.VariableId, arg.Name)
+			cleanupArgs()
+			return variableNotFoundError(arg)
 		}
 		argMap[arg.Name] = vref
+		vref.Value, err = coerceFieldArgument(qt.Root.types, sel.field, arg.Name, vref.Value)
+		if err != nil {
+			cleanupArgs()
+			return err
+		}
 	}
 
-	nnod.AST = selectedTypeDef
-	nnod.IsPrimitive = isPrimitive
-	nnod.PrimitiveName = primitiveName
+	directiveValues := make(map[string]interface{}, len(directiveMap))
+	for name, ref := range directiveMap {
+		directiveValues[name] = ref.Value
+	}
+	include, err := evaluateDirectives(directiveValues)
+	if err != nil {
+		cleanupArgs()
+		return err
+	}
+	timeout, err := resolveTimeout(sel.field, directiveValues)
+	if err != nil {
+		cleanupArgs()
+		return err
+	}
+	incremental, err := resolveIncremental(data.Id, sel.isList, directiveValues)
+	if err != nil {
+		cleanupArgs()
+		return err
+	}
+	if err := defaultArguments(sel.field, argMap); err != nil {
+		cleanupArgs()
+		return err
+	}
+	if err := sel.checkSelections(data); err != nil {
+		cleanupArgs()
+		return err
+	}
+
+	nnod.AST = sel.typeDef
+	nnod.fieldDef = sel.field
+	nnod.IsPrimitive = sel.isPrimitive
+	nnod.PrimitiveName = sel.primitiveName
+	nnod.IsList = sel.isList
+	nnod.ResolverName = qt.Root.options.resolverName(fieldName)
+	nnod.ListDepth = sel.listDepth
 	nnod.Arguments = argMap
+	nnod.literals = literals
+	nnod.immutableArgs = immutableArguments(sel.field)
+	if len(directiveMap) != 0 {
+		nnod.Directives = directiveMap
+		nnod.directiveLiterals = directiveLiterals
+	}
+	nnod.Inactive = !include
+	nnod.ResolveTimeout = timeout
+	nnod.Incremental = incremental
 
-	// Apply any children
+	if err := qt.chargeComplexity(nnod); err != nil {
+		return err
+	}
+	nnod.TypeCondition = sel.typeCondition
+	if !sel.isPrimitive {
+		nnod.PossibleTypes = possibleTypes(qt.Root.types, sel.typeDef)
+	}
+	qt.indexTypedChild(nnod)
+	if err := qt.handleDirectives(nnod, directiveValues); err != nil {
+		return err
+	}
+
+	// Apply any children, a failing child fails the whole subtree.
 	for _, child := range data.Children {
-		nnod.AddChild(child)
+		if err := nnod.addChild(child, nnod.Id); err != nil {
+			if _, ok := err.(*subtreeError); ok {
+				return err
+			}
+			return &subtreeError{nodeId: child.Id, err: err}
+		}
+	}
+
+	if deprecation != nil && qt.Root.options.OnDeprecated != nil {
+		qt.Root.options.OnDeprecated(deprecation)
+	}
+	qt.Root.sharedMtx.Lock()
+	qt.Root.stats.NodesAdded++
+	qt.Root.stats.LiveNodes++
+	qt.Root.sharedMtx.Unlock()
+
+	qt.completeSelections()
+	if denied != nil {
+		nnod.markUnauthorized(denied)
 	}
 
 	// Apply to the resolver tree (start resolution for this node).
+	if nnod.Inactive {
+		return nil
+	}
 	qt.nextUpdate(&QTNodeUpdate{
 		Operation: Operation_AddChild,
 		Child:     nnod,
@@ -200,32 +913,116 @@ func (qt *QueryTreeNode) AddChild(data *proto.RGQLQueryTreeNode) (addChildErr er
 	return nil
 }
 
+// checkTypeRecursion checks the recursion bound of a child type, expects the root lock to be held.
+// Inline fragment nodes repeat the type of their parent and are not counted.
+func (qt *QueryTreeNode) checkTypeRecursion(nodeId uint32, typeDef ast.TypeDefinition) error {
+	var ancestors []ast.TypeDefinition
+	for nod := qt; nod != nil; nod = nod.Parent {
+		if nod.TypeCondition == "" {
+			ancestors = append(ancestors, nod.AST)
+		}
+	}
+	return checkTypeRecursion(qt.Root.options.MaxTypeRecursion, nodeId, typeDef, ancestors)
+}
+
+// unregister removes a node that was never announced and its subtree from the tree.
+// The descendants are recycled, recycling the node itself is left to the caller. Expects the root lock to be held.
+func (qt *QueryTreeNode) unregister() {
+	// Children of the node were added and are counted.
+	for _, child := range qt.Children {
+		child.unregister()
+		qt.Root.sharedMtx.Lock()
+		qt.Root.stats.NodesAdded--
+		qt.Root.stats.LiveNodes--
+		qt.Root.sharedMtx.Unlock()
+		child.recycle()
+	}
+	qt.Children = nil
+	qt.typedChildren = nil
+	qt.runDisposeCallbacks()
+	qt.disposed = true
+	if qt.disposeChan != nil {
+		close(qt.disposeChan)
+	}
+	qt.Root.sharedMtx.Lock()
+	for id := range qt.refs {
+		delete(qt.Root.RootNodeMap, id)
+	}
+	qt.Root.complexity -= qt.cost
+	if qt.fragmentSpreadId != 0 {
+		delete(qt.Root.fragmentSpreads, qt.fragmentSpreadId)
+	}
+	qt.Root.sharedMtx.Unlock()
+	qt.cost = 0
+	for _, ref := range qt.Arguments {
+		ref.Unsubscribe()
+	}
+	qt.Arguments = nil
+	for _, ref := range qt.Directives {
+		ref.Unsubscribe()
+	}
+	qt.Directives = nil
+	if qt.Root != nil && qt.Root.options.OnSubscriberLeak != nil {
+		if count := qt.SubscriberCount(); count != 0 {
+			qt.Root.options.OnSubscriberLeak(qt, count)
+		}
+	}
+}
+
 // removeChild deletes the given child from the children array.
 func (qt *QueryTreeNode) removeChild(nod *QueryTreeNode) {
+	if qt.dropChild(nod) {
+		qt.nextUpdate(&QTNodeUpdate{
+			Operation: Operation_DelChild,
+			Child:     nod,
+		})
+	}
+}
+
+// dropChild removes a child from the slice without notifying, keeping the order of the others.
+// Returns false if nod is not a child.
+func (qt *QueryTreeNode) dropChild(nod *QueryTreeNode) bool {
+	qt.unindexTypedChild(nod)
 	for i, item := range qt.Children {
 		if item == nod {
 			a := qt.Children
 			copy(a[i:], a[i+1:])
 			a[len(a)-1] = nil
 			qt.Children = a[:len(a)-1]
-			qt.nextUpdate(&QTNodeUpdate{
-				Operation: Operation_DelChild,
-				Child:     item,
-			})
-			break
+			return true
+		}
+	}
+	return false
+}
+
+// sendError reports an error for a node ID to the error channel.
+// The tree may be locked, so the error is dropped and counted if the channel is full.
+func (qt *QueryTreeNode) sendError(nodeId uint32, err error) {
+	select {
+	case qt.errCh <- &proto.RGQLQueryError{
+		Error:       err.Error(),
+		QueryNodeId: nodeId,
+	}:
+	default:
+		if qt.Root != nil {
+			atomic.AddUint64(&qt.Root.errorsDropped, 1)
 		}
 	}
 }
 
 // SetError marks a query tree node as invalid against the schema.
 func (qt *QueryTreeNode) SetError(err error) {
-	if qt.err == err {
+	if qt.ResolveError == err {
 		return
 	}
-	qt.err = err
-	qt.errCh <- &proto.RGQLQueryError{
-		Error:       err.Error(),
-		QueryNodeId: qt.Id,
+	qt.ResolveError = err
+	qt.nextRetry = time.Now().Add(qt.Root.options.retryDelay(qt.retries))
+	qt.sendError(qt.Id, err)
+	if onError := qt.Root.options.OnError; onError != nil {
+		unlock := qt.rlockSubtree()
+		qerr := qt.nodeError(err)
+		unlock()
+		onError(qt, qerr)
 	}
 	// Note: this is not currently observed anywhere.
 	qt.nextUpdate(&QTNodeUpdate{
@@ -233,10 +1030,33 @@ func (qt *QueryTreeNode) SetError(err error) {
 	})
 }
 
+// ResponseKey returns the alias of the node, or the field name if there is no alias.
+func (qt *QueryTreeNode) ResponseKey() string {
+	if qt.Alias != "" {
+		return qt.Alias
+	}
+	return qt.FieldName
+}
+
+// ArgumentValues returns a snapshot of the current, coerced value of every argument.
+// Arguments referencing variables no longer in the variable store are omitted.
+func (qt *QueryTreeNode) ArgumentValues() map[string]interface{} {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	values := make(map[string]interface{}, len(qt.Arguments))
+	for name, ref := range qt.Arguments {
+		if !ref.IsConstant() && !qt.VariableStore.Has(ref.Id) {
+			continue
+		}
+		values[name] = ref.Value
+	}
+	return values
+}
+
 // Error returns any error the node might have.
-// TODO: Add mechanism to communicate query tree errors.
 func (qt *QueryTreeNode) Error() error {
-	return qt.err
+	return qt.ResolveError
 }
 
 func (qt *QueryTreeNode) removeSubscription(id uint32) {
@@ -250,20 +1070,128 @@ func (qt *QueryTreeNode) SubscribeChanges() QTNodeSubscription {
 	defer qt.subscribersMtx.Unlock()
 
 	nsub := &qtNodeSubscription{
-		id:   qt.subCtr,
-		node: qt,
+		id:     qt.subCtr,
+		node:   qt,
+		doneCh: make(chan struct{}),
 	}
 	qt.subCtr++
 	qt.subscribers[nsub.id] = nsub
 	return nsub
 }
 
+// SubscribeChangesFunc subscribes to changes, calling fn with each update.
+// fn is called with the tree locked and must not call back into the tree.
+// A panic in fn is recovered and reported to the OnSubscriberPanic option.
+func (qt *QueryTreeNode) SubscribeChangesFunc(fn func(upd *QTNodeUpdate)) QTNodeSubscription {
+	nsub := qt.SubscribeChanges().(*qtNodeSubscription)
+	nsub.mtx.Lock()
+	nsub.callbacks = append(nsub.callbacks, fn)
+	nsub.mtx.Unlock()
+	return nsub
+}
+
+// SubscribeChangesBatched subscribes to changes, delivering the updates of each tree mutation as one slice.
+func (qt *QueryTreeNode) SubscribeChangesBatched() QTNodeBatchSubscription {
+	return qt.SubscribeChanges().(*qtNodeSubscription)
+}
+
+// beginBatch starts collecting updates for batch subscriptions, on the root.
+func (qt *QueryTreeNode) beginBatch() {
+	qt.batchMtx.Lock()
+	qt.batchDepth++
+	qt.batchMtx.Unlock()
+}
+
+// endBatch flushes the collected updates once no tree mutation is in progress, on the root.
+// Expects the root lock to be released.
+func (qt *QueryTreeNode) endBatch() {
+	qt.batchMtx.Lock()
+	qt.batchDepth--
+	var subs []*qtNodeSubscription
+	if qt.batchDepth == 0 {
+		subs, qt.batchQueue = qt.batchQueue, nil
+	}
+	qt.batchMtx.Unlock()
+
+	for _, sub := range subs {
+		sub.flushBatch()
+	}
+}
+
+// queueBatch queues sub to be flushed if a tree mutation is in progress, on the root.
+// Returns false if the update should be delivered immediately. Expects the subscription lock to be held.
+func (qt *QueryTreeNode) queueBatch(sub *qtNodeSubscription) bool {
+	qt.batchMtx.Lock()
+	defer qt.batchMtx.Unlock()
+
+	if qt.batchDepth == 0 {
+		return false
+	}
+	if len(sub.batch) == 0 {
+		qt.batchQueue = append(qt.batchQueue, sub)
+	}
+	return true
+}
+
+// SubscribeChangesContext subscribes to changes until the context is canceled.
+// The subscription can still be removed early with Unsubscribe.
+func (qt *QueryTreeNode) SubscribeChangesContext(ctx context.Context) QTNodeSubscription {
+	nsub := qt.SubscribeChanges().(*qtNodeSubscription)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nsub.Unsubscribe()
+		case <-nsub.doneCh:
+		}
+	}()
+	return nsub
+}
+
+// SubscribeChangesChan subscribes to changes on a buffered channel, cancel ends the subscription and closes it.
+// Delivery never blocks the tree: when the channel is full, updates are dropped and a single Operation_Resync
+// is delivered once the channel has room again, after which the receiver should reload the children of the node.
+// A resync is only delivered with a later update, so a receiver that falls behind at the end of a burst
+// sees it with the next change of the node.
+func (qt *QueryTreeNode) SubscribeChangesChan() (<-chan *QTNodeUpdate, func()) {
+	nsub := qt.SubscribeChanges().(*qtNodeSubscription)
+	rc := &resyncChan{ch: make(chan *QTNodeUpdate, 50)}
+	nsub.mtx.Lock()
+	nsub.resyncChans = append(nsub.resyncChans, rc)
+	nsub.mtx.Unlock()
+
+	var once sync.Once
+	return rc.ch, func() {
+		once.Do(func() {
+			nsub.Unsubscribe()
+			nsub.removeResyncChan(rc)
+		})
+	}
+}
+
+// nextUpdate delivers an update to the subscribers of the node, see ArgsChangedDebounce for delayed updates.
 func (qt *QueryTreeNode) nextUpdate(update *QTNodeUpdate) {
-	qt.subscribersMtx.Lock()
-	defer qt.subscribersMtx.Unlock()
+	if update.Operation == Operation_ArgsChanged && qt.Root.debounceArgsChanged(update.Child) {
+		return
+	}
+	qt.deliverUpdate(update)
+}
 
+// deliverUpdate sends an update to the subscribers of the node.
+// Subscribers panicking are skipped, and removed with the UnsubscribeOnPanic option.
+func (qt *QueryTreeNode) deliverUpdate(update *QTNodeUpdate) {
+	var panicked []*qtNodeSubscription
+	qt.subscribersMtx.Lock()
 	for _, sub := range qt.subscribers {
-		sub.nextChange(update)
+		if !sub.nextChangeSafe(update) {
+			panicked = append(panicked, sub)
+		}
+	}
+	qt.subscribersMtx.Unlock()
+
+	if qt.Root.options.UnsubscribeOnPanic {
+		for _, sub := range panicked {
+			sub.Unsubscribe()
+		}
 	}
 }
 
@@ -272,33 +1200,182 @@ func (qt *QueryTreeNode) Done() <-chan struct{} {
 	return qt.disposeChan
 }
 
-// Dispose deletes the node and all children.
+// Context returns a context canceled when the node is disposed.
+func (qt *QueryTreeNode) Context() context.Context {
+	return nodeContext{done: qt.disposeChan}
+}
+
+// nodeContext is the context of a node, it is done when the node is disposed.
+// It keeps the dispose channel rather than the node, the node may be reused once disposed.
+type nodeContext struct {
+	done <-chan struct{}
+}
+
+// Deadline returns no deadline.
+func (c nodeContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done returns the dispose channel of the node.
+func (c nodeContext) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns context.Canceled once the node is disposed.
+func (c nodeContext) Err() error {
+	select {
+	case <-c.done:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// Value returns nil, the context carries no values.
+func (c nodeContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+// OnDispose registers a callback called once when the node is disposed.
+// Callbacks are called in registration order after the children are disposed.
+// The root lock is held during the callbacks, they must not call back into the tree.
+// If the node is already disposed, fn is called immediately.
+func (qt *QueryTreeNode) OnDispose(fn func()) {
+	qt.Root.rootMtx.Lock()
+	if !qt.disposed {
+		qt.disposeCallbacks = append(qt.disposeCallbacks, fn)
+		qt.Root.rootMtx.Unlock()
+		return
+	}
+	qt.Root.rootMtx.Unlock()
+	fn()
+}
+
+// runDisposeCallbacks calls and clears the dispose callbacks, expects the root lock to be held.
+func (qt *QueryTreeNode) runDisposeCallbacks() {
+	callbacks := qt.disposeCallbacks
+	qt.disposeCallbacks = nil
+	for _, fn := range callbacks {
+		fn()
+	}
+}
+
+// Dispose deletes the node and all children. Disposing a node again is a no-op.
 func (qt *QueryTreeNode) Dispose() {
-	if qt == nil {
+	if qt == nil || qt.Root == nil {
 		return
 	}
-	qt.disposeOnce.Do(func() {
-		if qt.disposeChan != nil {
-			close(qt.disposeChan)
+
+	// Disposing the node mutates the children of the parent.
+	// The node may be moved while waiting for the lock, then the new parent is locked.
+	unlock := qt.lockParent()
+	defer unlock()
+
+	if err := qt.checkFrozen(); err != nil && qt != qt.Root {
+		qt.sendError(qt.Id, err)
+		return
+	}
+
+	root := qt.Root
+	hadChildren := len(root.Children) != 0
+	qt.dispose()
+	root.notifyEmpty(hadChildren)
+}
+
+// lockParent locks the subtree of the parent of the node, or of the root node, returns the unlock func.
+func (qt *QueryTreeNode) lockParent() func() {
+	for {
+		qt.Root.rootMtx.RLock()
+		parent := qt.Root
+		if qt.Parent != nil {
+			parent = qt.Parent
 		}
-		qt.nextUpdate(&QTNodeUpdate{
-			Operation: Operation_Delete,
-		})
-		for _, child := range qt.Children {
-			child.Dispose()
+		qt.Root.rootMtx.RUnlock()
+
+		unlock := parent.lockSubtree()
+		if qt.Parent == parent || (qt.Parent == nil && parent == qt.Root) {
+			return unlock
 		}
-		qt.Children = nil
-		if qt.Root != nil && qt.Root.RootNodeMap != nil {
+		unlock()
+	}
+}
+
+// Empty returns a channel signaled when the tree loses its last selection.
+// The tree is checked after each mutation and Dispose, so a batch deleting and adding selections does not signal.
+// Signals are not queued, a slow receiver sees at most one pending signal.
+func (qt *QueryTreeNode) Empty() <-chan struct{} {
+	return qt.Root.emptyCh
+}
+
+// notifyEmpty signals the empty channel if the root had children and has none left.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) notifyEmpty(hadChildren bool) {
+	if !hadChildren || len(qt.Children) != 0 || qt.disposed {
+		return
+	}
+	select {
+	case qt.emptyCh <- struct{}{}:
+	default:
+	}
+}
+
+// dispose deletes the node and all children, expects the root lock to be held.
+func (qt *QueryTreeNode) dispose() {
+	if qt.disposed {
+		return
+	}
+	qt.disposed = true
+
+	if qt.disposeChan != nil {
+		close(qt.disposeChan)
+	}
+	qt.nextUpdate(&QTNodeUpdate{
+		Operation: Operation_Delete,
+	})
+	// Children remove themselves from the slice as they are disposed.
+	children := make([]*QueryTreeNode, len(qt.Children))
+	copy(children, qt.Children)
+	for _, child := range children {
+		child.dispose()
+	}
+	qt.Children = nil
+	qt.typedChildren = nil
+	qt.runDisposeCallbacks()
+	if qt.Root != nil {
+		qt.cancelArgsChanged()
+		qt.Root.sharedMtx.Lock()
+		if qt.Root.RootNodeMap != nil {
 			delete(qt.Root.RootNodeMap, qt.Id)
+			for id := range qt.refs {
+				delete(qt.Root.RootNodeMap, id)
+			}
 		}
-		if qt.Parent != nil {
-			qt.Parent.removeChild(qt)
+		qt.Root.complexity -= qt.cost
+		if qt != qt.Root {
+			qt.Root.stats.NodesDeleted++
+			qt.Root.stats.LiveNodes--
 		}
-		if qt.Arguments != nil {
-			for _, arg := range qt.Arguments {
-				arg.Unsubscribe()
-			}
-			qt.Arguments = nil
+		if qt.fragmentSpreadId != 0 {
+			delete(qt.Root.fragmentSpreads, qt.fragmentSpreadId)
 		}
-	})
+		qt.Root.sharedMtx.Unlock()
+	}
+	if qt.Parent != nil {
+		qt.Parent.removeChild(qt)
+	}
+	if qt.Arguments != nil {
+		for _, arg := range qt.Arguments {
+			arg.Unsubscribe()
+		}
+		qt.Arguments = nil
+	}
+	for _, ref := range qt.Directives {
+		ref.Unsubscribe()
+	}
+	qt.Directives = nil
+	if qt.Root != nil && qt.Root.options.OnSubscriberLeak != nil {
+		if count := qt.SubscriberCount(); count != 0 {
+			qt.Root.options.OnSubscriberLeak(qt, count)
+		}
+	}
 }
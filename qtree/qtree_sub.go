@@ -11,6 +11,12 @@ const (
 	Operation_DelChild
 	Operation_Delete
 	Operation_Error
+	// Operation_ArgsChanged is sent to the parent when the argument values of Child change.
+	Operation_ArgsChanged
+	// Operation_Resync is sent on Resume when the updates buffered while paused were dropped,
+	// and on channels of SubscribeChangesChan after updates were dropped as the channel was full.
+	// The receiver should reload the children of the node.
+	Operation_Resync
 )
 
 // A update to a QueryTreeNode
@@ -24,18 +30,167 @@ type qtNodeSubscription struct {
 	node    *QueryTreeNode
 	mtx     sync.RWMutex
 	chChans []chan<- *QTNodeUpdate
+	// resyncChans are the channels of SubscribeChangesChan.
+	resyncChans []*resyncChan
+	// callbacks are called with each update, see SubscribeChangesFunc.
+	callbacks []func(*QTNodeUpdate)
+	// batchChans receive the updates of each tree mutation as one slice.
+	batchChans []chan<- []*QTNodeUpdate
+	// batch are the updates of the current tree mutation not yet flushed to batchChans, guarded by mtx.
+	batch []*QTNodeUpdate
+
+	doneCh    chan struct{}
+	unsubOnce sync.Once
+
+	// paused is set while updates are buffered instead of delivered, guarded by mtx.
+	paused bool
+	// pending are the updates buffered while paused, guarded by mtx.
+	pending []*QTNodeUpdate
+	// overflowed is set when the pending updates exceeded the limit and were dropped, guarded by mtx.
+	overflowed bool
 }
 
 func (sub *qtNodeSubscription) nextChange(upd *QTNodeUpdate) {
-	sub.mtx.RLock()
-	defer sub.mtx.RUnlock()
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	if !sub.paused {
+		sub.deliver(upd)
+		return
+	}
+	if sub.overflowed {
+		return
+	}
+	limit := sub.node.Root.options.MaxPausedUpdates
+	if limit > 0 && len(sub.pending) >= limit {
+		sub.pending = nil
+		sub.overflowed = true
+		return
+	}
+	sub.pending = append(sub.pending, upd)
+}
+
+// nextChangeSafe delivers an update, recovering from a panicking callback.
+// Returns false if the subscription panicked.
+func (sub *qtNodeSubscription) nextChangeSafe(upd *QTNodeUpdate) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			sub.node.Root.options.subscriberPanic(r)
+			ok = false
+		}
+	}()
+	sub.nextChange(upd)
+	return true
+}
 
+// deliver sends an update to every channel and callback, expects mtx to be held.
+func (sub *qtNodeSubscription) deliver(upd *QTNodeUpdate) {
 	for _, ch := range sub.chChans {
 		select {
 		case ch <- upd:
 		default:
 		}
 	}
+	for _, rc := range sub.resyncChans {
+		rc.send(upd)
+	}
+	for _, fn := range sub.callbacks {
+		fn(upd)
+	}
+	if len(sub.batchChans) == 0 {
+		return
+	}
+	if sub.node.Root.queueBatch(sub) {
+		sub.batch = append(sub.batch, upd)
+		return
+	}
+	sub.sendBatch([]*QTNodeUpdate{upd})
+}
+
+// sendBatch sends a batch of updates to every batch channel, expects mtx to be held.
+func (sub *qtNodeSubscription) sendBatch(batch []*QTNodeUpdate) {
+	for _, ch := range sub.batchChans {
+		select {
+		case ch <- batch:
+		default:
+		}
+	}
+}
+
+// flushBatch sends the updates collected during the last tree mutation.
+func (sub *qtNodeSubscription) flushBatch() {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	batch := sub.batch
+	sub.batch = nil
+	if len(batch) != 0 {
+		sub.sendBatch(batch)
+	}
+}
+
+// Pause buffers updates until Resume is called.
+func (sub *qtNodeSubscription) Pause() {
+	sub.mtx.Lock()
+	sub.paused = true
+	sub.mtx.Unlock()
+}
+
+// Resume delivers the updates buffered while paused and stops buffering.
+// Children added and deleted again while paused are left out.
+// If more updates than the MaxPausedUpdates option were buffered, a single Operation_Resync is delivered instead.
+func (sub *qtNodeSubscription) Resume() {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	if !sub.paused {
+		return
+	}
+	pending, overflowed := sub.pending, sub.overflowed
+	sub.paused, sub.pending, sub.overflowed = false, nil, false
+	if overflowed {
+		sub.deliver(&QTNodeUpdate{Operation: Operation_Resync})
+		return
+	}
+	for _, upd := range coalesceUpdates(pending) {
+		sub.deliver(upd)
+	}
+}
+
+// coalesceUpdates drops children that were added and deleted again, along with the updates in between.
+func coalesceUpdates(updates []*QTNodeUpdate) []*QTNodeUpdate {
+	dropped := make(map[int]bool)
+	added := make(map[*QueryTreeNode]int)
+	for i, upd := range updates {
+		if upd.Child == nil {
+			continue
+		}
+		switch upd.Operation {
+		case Operation_AddChild:
+			added[upd.Child] = i
+		case Operation_DelChild:
+			start, ok := added[upd.Child]
+			if !ok {
+				continue
+			}
+			delete(added, upd.Child)
+			for j := start; j <= i; j++ {
+				if updates[j].Child == upd.Child {
+					dropped[j] = true
+				}
+			}
+		}
+	}
+	if len(dropped) == 0 {
+		return updates
+	}
+	res := make([]*QTNodeUpdate, 0, len(updates)-len(dropped))
+	for i, upd := range updates {
+		if !dropped[i] {
+			res = append(res, upd)
+		}
+	}
+	return res
 }
 
 func (sub *qtNodeSubscription) Changes() <-chan *QTNodeUpdate {
@@ -46,12 +201,78 @@ func (sub *qtNodeSubscription) Changes() <-chan *QTNodeUpdate {
 	return nch
 }
 
+// resyncChan is a channel of SubscribeChangesChan.
+// Updates not fitting in the channel are dropped and replaced by one Operation_Resync.
+type resyncChan struct {
+	ch chan *QTNodeUpdate
+	// overflowed is set when updates were dropped and no resync was sent yet.
+	overflowed bool
+}
+
+// send delivers an update without blocking, expects the subscription lock to be held.
+// After dropping updates, a resync is sent first once the channel has room, followed by the update if it fits.
+func (rc *resyncChan) send(upd *QTNodeUpdate) {
+	if rc.overflowed {
+		select {
+		case rc.ch <- &QTNodeUpdate{Operation: Operation_Resync}:
+			rc.overflowed = false
+		default:
+			return
+		}
+	}
+	select {
+	case rc.ch <- upd:
+	default:
+		rc.overflowed = true
+	}
+}
+
+// removeResyncChan removes and closes a channel of SubscribeChangesChan.
+func (sub *qtNodeSubscription) removeResyncChan(rc *resyncChan) {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	for i, c := range sub.resyncChans {
+		if c == rc {
+			sub.resyncChans = append(sub.resyncChans[:i:i], sub.resyncChans[i+1:]...)
+			close(rc.ch)
+			return
+		}
+	}
+}
+
+// Batches returns a channel receiving the updates of each tree mutation as one slice.
+func (sub *qtNodeSubscription) Batches() <-chan []*QTNodeUpdate {
+	nch := make(chan []*QTNodeUpdate, 50)
+	sub.mtx.Lock()
+	sub.batchChans = append(sub.batchChans, nch)
+	sub.mtx.Unlock()
+	return nch
+}
+
 func (sub *qtNodeSubscription) Unsubscribe() {
-	sub.node.removeSubscription(sub.id)
+	sub.unsubOnce.Do(func() {
+		sub.node.removeSubscription(sub.id)
+		if sub.doneCh != nil {
+			close(sub.doneCh)
+		}
+	})
 }
 
 // A subscription to changes to the node
 type QTNodeSubscription interface {
 	Changes() <-chan *QTNodeUpdate
 	Unsubscribe()
+	// Pause buffers updates until Resume is called.
+	Pause()
+	// Resume delivers the updates buffered while paused.
+	Resume()
+}
+
+// A subscription to changes to the node delivered in batches.
+// Updates made by one ApplyTreeMutation call are delivered together once the tree is unlocked.
+// Updates made outside of a tree mutation are delivered as a batch of one.
+type QTNodeBatchSubscription interface {
+	Batches() <-chan []*QTNodeUpdate
+	Unsubscribe()
 }
@@ -0,0 +1,142 @@
+package qtree
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// extendedSubtreeOperation is the first value of the node mutation operations the proto does not define.
+// It is far outside the values of the proto enum, so operations added to the proto do not collide with them.
+const extendedSubtreeOperation proto.RGQLQueryTreeMutation_SubtreeOperation = 1 << 20
+
+// SubtreeReparent is the node mutation moving an existing node and its subtree below the node NodeId.
+// The node to move is given by the ID of Node, the rest of Node is ignored.
+// The proto does not name the operation, clients send its numeric value, 1048576.
+const SubtreeReparent = extendedSubtreeOperation
+
+// checkMove checks that the field of a node can be selected below a parent of type parentType.
+// The field must have the same type there and accept the arguments of the node.
+func (qt *QueryTreeNode) checkMove(schemaResolver SchemaResolver,
+	parentType ast.TypeDefinition,
+	nod *QueryTreeNode,
+	args []*proto.FieldArgument) (*fieldSelection, error) {
+	if err := qt.checkIntrospection(nod.FieldName); err != nil {
+		return nil, err
+	}
+	data := &proto.RGQLQueryTreeNode{Id: nod.Id, FieldName: joinFieldAlias(nod.Alias, nod.FieldName), Args: args}
+	sel, err := resolveFieldSelection(schemaResolver, parentType, data)
+	if err != nil {
+		return nil, err
+	}
+	if sel.typeDef != nod.AST || sel.primitiveName != nod.PrimitiveName ||
+		sel.listDepth != nod.ListDepth || sel.typeCondition != nod.TypeCondition {
+		return nil, fmt.Errorf("Invalid node %d, field %s has a different type on %s.",
+			nod.Id, nod.FieldName, typeDefinitionName(parentType))
+	}
+	if sel.typeCondition == "" {
+		if err := checkFieldArguments(sel.field, args); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// checkMovable checks that a node can be moved below newParent, expects the root lock to be held.
+func (qt *QueryTreeNode) checkMovable(newParent *QueryTreeNode) error {
+	switch {
+	case qt.Parent == nil:
+		return fmt.Errorf("Invalid node %d, the root cannot be moved.", qt.Id)
+	case len(qt.refs) > 1 || qt.fragmentSpreadId != 0 || qt.Id&serverNodeIdFlag != 0:
+		return fmt.Errorf("Invalid node %d, merged and generated selections cannot be moved.", qt.Id)
+	case qt.contains(newParent):
+		return fmt.Errorf("Invalid node %d, cannot be moved below itself.", qt.Id)
+	}
+	return nil
+}
+
+// reparent moves the node with the given ID and its subtree below this node, expects the root lock to be held.
+// parentRef is the ID this node was referenced by.
+func (qt *QueryTreeNode) reparent(id, parentRef uint32) error {
+	if qt.disposed {
+		return fmt.Errorf("Invalid node %d, parent %d was disposed.", id, qt.Id)
+	}
+	nod, ok := qt.lookupNode(id)
+	if !ok {
+		return fmt.Errorf("Invalid node ID (not found): %d", id)
+	}
+	if nod.Parent == qt {
+		return nil
+	}
+	if err := nod.checkMovable(qt); err != nil {
+		return err
+	}
+	args := nod.protoArgs()
+	sel, err := qt.checkMove(qt.Root.types, qt.AST, nod, args)
+	if err != nil {
+		return err
+	}
+	if sibling := qt.findSibling(nod.Alias, nod.FieldName, args); sibling != nil {
+		return fmt.Errorf("Invalid node %d, node %d already selects %s below %d.", id, sibling.Id, nod.FieldName, qt.Id)
+	}
+
+	// Move the node, then check the limits depending on its position.
+	oldParent := nod.Parent
+	oldChildren := append([]*QueryTreeNode(nil), oldParent.Children...)
+	oldParent.dropChild(nod)
+	nod.attach(qt)
+	if err := nod.checkMoved(); err != nil {
+		qt.dropChild(nod)
+		nod.attach(oldParent)
+		oldParent.Children = oldChildren
+		return err
+	}
+	nod.fieldDef = sel.field
+	nod.refs[id] = parentRef
+	qt.completeSelections()
+
+	if nod.Inactive {
+		return nil
+	}
+	oldParent.nextUpdate(&QTNodeUpdate{
+		Operation: Operation_DelChild,
+		Child:     nod,
+	})
+	qt.nextUpdate(&QTNodeUpdate{
+		Operation: Operation_AddChild,
+		Child:     nod,
+	})
+	return nil
+}
+
+// attach appends the node to the children of parent and updates the levels of the subtree.
+func (qt *QueryTreeNode) attach(parent *QueryTreeNode) {
+	qt.Parent = parent
+	parent.Children = append(parent.Children, qt)
+	parent.indexTypedChild(qt)
+	qt.walk(func(n *QueryTreeNode) bool {
+		n.level = n.Parent.level + 1
+		return true
+	})
+}
+
+// checkMoved checks the depth, type recursion and complexity limits of a moved subtree.
+// On success the complexity of the subtree is charged again at its new position.
+func (qt *QueryTreeNode) checkMoved() error {
+	opts := qt.Root.options
+	var err error
+	qt.walk(func(n *QueryTreeNode) bool {
+		if err = checkDepthLimit(opts.MaxDepth, n.level, n.Id); err != nil {
+			return false
+		}
+		if n.TypeCondition == "" {
+			err = n.Parent.checkTypeRecursion(n.Id, n.AST)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return qt.rechargeComplexity()
+}
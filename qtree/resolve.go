@@ -0,0 +1,388 @@
+package qtree
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/rgraphql/magellan/types"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// inlineFragmentPrefix prefixes the field name of an inline fragment node, as in "... on Droid".
+const inlineFragmentPrefix = "... on "
+
+// fieldSelection is a field selection resolved against the schema.
+type fieldSelection struct {
+	field         *ast.FieldDefinition
+	typeDef       ast.TypeDefinition
+	isPrimitive   bool
+	primitiveName string
+	isList        bool
+	listDepth     int
+	// typeCondition is set if the selection is an inline fragment.
+	typeCondition string
+}
+
+// checkSelections enforces the leaf field rules on a node.
+// Fields of object, interface and union types and inline fragments must have selections, other fields cannot.
+func (sel *fieldSelection) checkSelections(data *proto.RGQLQueryTreeNode) error {
+	if sel.typeCondition != "" {
+		if len(data.Children) == 0 {
+			return fmt.Errorf("Invalid node %d, inline fragment on %s must have selections.", data.Id, sel.typeCondition)
+		}
+		return nil
+	}
+
+	selectable := false
+	switch sel.typeDef.(type) {
+	case *ast.ObjectDefinition, *ast.InterfaceDefinition, *ast.UnionDefinition:
+		selectable = true
+	}
+	fieldName := sel.field.Name.Value
+	switch {
+	case selectable && len(data.Children) == 0:
+		return fmt.Errorf("Invalid node %d, field %s of type %s must have selections.", data.Id, fieldName, typeString(sel.field.Type))
+	case !selectable && len(data.Children) != 0:
+		return fmt.Errorf("Invalid node %d, field %s of leaf type %s cannot have selections.", data.Id, fieldName, typeString(sel.field.Type))
+	}
+	return nil
+}
+
+// inlineFragmentTypeCondition returns the type condition if the field name is an inline fragment.
+func inlineFragmentTypeCondition(fieldName string) (string, bool) {
+	if !strings.HasPrefix(fieldName, inlineFragmentPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(fieldName, inlineFragmentPrefix)), true
+}
+
+// splitFieldAlias splits a node field name in the "alias: field" form into the alias and the field name.
+func splitFieldAlias(fieldName string) (string, string) {
+	idx := strings.Index(fieldName, ":")
+	if idx < 0 {
+		return "", fieldName
+	}
+	return strings.TrimSpace(fieldName[:idx]), strings.TrimSpace(fieldName[idx+1:])
+}
+
+// joinFieldAlias builds a node field name from an alias and a field name.
+func joinFieldAlias(alias, fieldName string) string {
+	if alias == "" {
+		return fieldName
+	}
+	return alias + ": " + fieldName
+}
+
+// typeDefinitionName returns the name of a type definition, if it has one.
+func typeDefinitionName(def ast.TypeDefinition) string {
+	switch d := def.(type) {
+	case *ast.ObjectDefinition:
+		if d.Name != nil {
+			return d.Name.Value
+		}
+	case *ast.InterfaceDefinition:
+		if d.Name != nil {
+			return d.Name.Value
+		}
+	case *ast.UnionDefinition:
+		if d.Name != nil {
+			return d.Name.Value
+		}
+	}
+	return ""
+}
+
+// possibleTypes returns the concrete object types a type definition can resolve to.
+func possibleTypes(schemaResolver SchemaResolver, def ast.TypeDefinition) []*ast.ObjectDefinition {
+	switch d := def.(type) {
+	case *ast.ObjectDefinition:
+		return []*ast.ObjectDefinition{d}
+	case *ast.UnionDefinition:
+		var res []*ast.ObjectDefinition
+		for _, member := range d.Types {
+			if od, ok := schemaResolver.LookupType(member).(*ast.ObjectDefinition); ok {
+				res = append(res, od)
+			}
+		}
+		return res
+	case *ast.InterfaceDefinition:
+		if ir, ok := schemaResolver.(ImplementationResolver); ok {
+			return ir.LookupImplementations(d)
+		}
+	}
+	return nil
+}
+
+// resolveTypeCondition resolves a fragment type condition against the parent type.
+// Returns the narrowed type, or nil if the fragment applies to the parent type as-is.
+func resolveTypeCondition(schemaResolver SchemaResolver, parent ast.TypeDefinition, cond *ast.Named) (ast.TypeDefinition, error) {
+	if cond == nil || cond.Name == nil {
+		return nil, nil
+	}
+	parentName := typeDefinitionName(parent)
+	if parentName == "" {
+		return nil, fmt.Errorf("Fragment on %s cannot be spread here, parent is not selectable.", cond.Name.Value)
+	}
+	if parentName == cond.Name.Value {
+		return nil, nil
+	}
+
+	condDef := schemaResolver.LookupType(cond)
+	if typeDefinitionName(condDef) == "" {
+		return nil, fmt.Errorf("Unable to resolve fragment type condition %s.", cond.Name.Value)
+	}
+
+	// Check the two types share at least one concrete type.
+	condTypes := possibleTypes(schemaResolver, condDef)
+	for _, pt := range possibleTypes(schemaResolver, parent) {
+		for _, ct := range condTypes {
+			if pt != ct {
+				continue
+			}
+			// Fragments on an abstract type of an object apply to the object as-is.
+			if _, ok := parent.(*ast.ObjectDefinition); ok {
+				return nil, nil
+			}
+			return condDef, nil
+		}
+	}
+	return nil, fmt.Errorf("Fragment on %s cannot be spread on %s.", cond.Name.Value, parentName)
+}
+
+// resolveInlineFragment resolves an inline fragment node narrowing the parent type.
+func resolveInlineFragment(schemaResolver SchemaResolver, parent ast.TypeDefinition, cond string, data *proto.RGQLQueryTreeNode) (*fieldSelection, error) {
+	if len(data.Args) != 0 {
+		return nil, fmt.Errorf("Invalid node %d, inline fragments cannot have arguments.", data.Id)
+	}
+	narrowed, err := resolveTypeCondition(schemaResolver, parent, &ast.Named{
+		Kind: "Named",
+		Name: &ast.Name{Kind: "Name", Value: cond},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if narrowed == nil {
+		narrowed = parent
+	}
+	return &fieldSelection{typeDef: narrowed, typeCondition: cond}, nil
+}
+
+// UnresolvedTypeError is returned when the schema resolver cannot resolve the named type of a field.
+type UnresolvedTypeError struct {
+	NodeId   uint32
+	TypeName string
+}
+
+// Error returns the error message.
+func (e *UnresolvedTypeError) Error() string {
+	return fmt.Sprintf("Unable to resolve named %s.", e.TypeName)
+}
+
+// resolveFieldSelection resolves the field selected by data on the parent type.
+func resolveFieldSelection(schemaResolver SchemaResolver, parent ast.TypeDefinition, data *proto.RGQLQueryTreeNode) (*fieldSelection, error) {
+	var fields []*ast.FieldDefinition
+	switch pd := parent.(type) {
+	case *ast.ObjectDefinition:
+		fields = pd.Fields
+	case *ast.InterfaceDefinition:
+		fields = pd.Fields
+	case *ast.UnionDefinition:
+		// Unions only have __typename, other fields need an inline fragment.
+	default:
+		return nil, fmt.Errorf("Invalid node %d, parent is not selectable.", data.Id)
+	}
+
+	if cond, ok := inlineFragmentTypeCondition(data.FieldName); ok {
+		return resolveInlineFragment(schemaResolver, parent, cond, data)
+	}
+
+	_, fieldName := splitFieldAlias(data.FieldName)
+	var selectedField *ast.FieldDefinition
+	if fieldName == "__typename" {
+		selectedField = typeNameDef
+	} else {
+		for _, field := range fields {
+			name := field.Name.Value
+			if name == fieldName {
+				selectedField = field
+				break
+			}
+		}
+	}
+
+	if selectedField == nil {
+		return nil, fmt.Errorf("Invalid field %s on %s.", fieldName, typeDefinitionName(parent))
+	}
+
+	sel := &fieldSelection{field: selectedField}
+	selectedType, listDepth := unwrapType(selectedField.Type)
+	sel.listDepth = listDepth
+	sel.isList = listDepth > 0
+
+	var namedType *ast.Named
+	if n, ok := selectedType.(*ast.Named); ok {
+		namedType = n
+		if types.IsPrimitive(n.Name.Value) {
+			sel.primitiveName = n.Name.Value
+			sel.isPrimitive = true
+		}
+	}
+
+	if !sel.isPrimitive {
+		sel.typeDef = schemaResolver.LookupType(selectedType)
+		if sel.typeDef == nil {
+			if namedType != nil {
+				return nil, &UnresolvedTypeError{NodeId: data.Id, TypeName: namedType.Name.Value}
+			}
+			return nil, fmt.Errorf("Unable to resolve type %#v.", selectedType)
+		}
+	}
+
+	return sel, nil
+}
+
+// unwrapType peels any nesting of list and non-null wrappers off a type.
+// Returns the named type and the number of list wrappers, e.g. 2 for [[User!]!]!.
+func unwrapType(typ ast.Type) (ast.Type, int) {
+	depth := 0
+	for {
+		switch t := typ.(type) {
+		case *ast.NonNull:
+			typ = t.Type
+		case *ast.List:
+			typ = t.Type
+			depth++
+		default:
+			return typ, depth
+		}
+	}
+}
+
+// ResolvedType returns the type definition of the node with the list and non-null wrapping of its field.
+// listDepth counts the list wrappers and nonNull is set if the field itself is non-null, e.g. 2 and true for [[User!]!]!.
+// def is nil for primitive fields, see PrimitiveName. The root and inline fragments have no wrapping.
+func (qt *QueryTreeNode) ResolvedType() (def ast.TypeDefinition, listDepth int, nonNull bool) {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	if qt.fieldDef == nil || qt.TypeCondition != "" {
+		return qt.AST, 0, false
+	}
+	_, nonNull = qt.fieldDef.Type.(*ast.NonNull)
+	return qt.AST, qt.ListDepth, nonNull
+}
+
+// checkFieldArguments checks the argument names of a node against the field definition.
+// Directive arguments are not checked here.
+func checkFieldArguments(field *ast.FieldDefinition, args []*proto.FieldArgument) error {
+	fieldName := ""
+	if field != nil && field.Name != nil {
+		fieldName = field.Name.Value
+	}
+
+	given := make(map[string]bool, len(args))
+	for _, arg := range args {
+		name, _, _ := splitInlineArgument(arg.Name)
+		if _, ok := directiveArgName(name); ok {
+			continue
+		}
+		if given[name] {
+			return fmt.Errorf("Duplicate argument %s on field %s.", name, fieldName)
+		}
+		given[name] = true
+
+		if argumentDefinition(field, name) == nil {
+			return fmt.Errorf("Invalid argument %s on field %s.", name, fieldName)
+		}
+	}
+
+	if field == nil {
+		return nil
+	}
+	for _, def := range field.Arguments {
+		if def.Name == nil || given[def.Name.Value] {
+			continue
+		}
+		if _, ok := def.Type.(*ast.NonNull); ok && def.DefaultValue == nil {
+			return fmt.Errorf("Missing required argument %s on field %s.", def.Name.Value, fieldName)
+		}
+	}
+	return nil
+}
+
+// valueFromAST converts a constant AST value into a Go value, as variables are unpacked.
+func valueFromAST(val ast.Value) (interface{}, error) {
+	switch v := val.(type) {
+	case *ast.IntValue:
+		i, err := strconv.ParseInt(v.Value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid int value %s.", v.Value)
+		}
+		return int32(i), nil
+	case *ast.FloatValue:
+		f, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid float value %s.", v.Value)
+		}
+		return f, nil
+	case *ast.StringValue:
+		return v.Value, nil
+	case *ast.BooleanValue:
+		return v.Value, nil
+	case *ast.EnumValue:
+		return v.Value, nil
+	case *ast.ListValue:
+		res := make([]interface{}, len(v.Values))
+		for i, item := range v.Values {
+			ival, err := valueFromAST(item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = ival
+		}
+		return res, nil
+	case *ast.ObjectValue:
+		res := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			if field.Name == nil {
+				continue
+			}
+			fval, err := valueFromAST(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			res[field.Name.Value] = fval
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("Unsupported constant value %#v.", val)
+	}
+}
+
+// defaultArguments builds constant references for omitted arguments with default values.
+func defaultArguments(field *ast.FieldDefinition, argMap map[string]*VariableReference) error {
+	if field == nil {
+		return nil
+	}
+	for _, def := range field.Arguments {
+		if def.Name == nil || def.DefaultValue == nil {
+			continue
+		}
+		if _, ok := argMap[def.Name.Value]; ok {
+			continue
+		}
+		val, err := valueFromAST(def.DefaultValue)
+		if err != nil {
+			return fmt.Errorf("Invalid default for argument %s on field %s: %v", def.Name.Value, field.Name.Value, err)
+		}
+		argMap[def.Name.Value] = NewConstantReference(val)
+	}
+	return nil
+}
+
+// variableNotFoundError builds the error for an argument referencing an unknown variable.
+func variableNotFoundError(arg *proto.FieldArgument) error {
+	return fmt.Errorf("Variable id %d not found for argument %s.", arg.VariableId, arg.Name)
+}
@@ -0,0 +1,176 @@
+package qtree
+
+import (
+	"context"
+	"sync"
+)
+
+// FieldResolver resolves a query tree node.
+type FieldResolver interface {
+	// Resolve resolves the node until ctx is canceled.
+	// The context is canceled when the node is removed or its arguments change.
+	// If the node has a ResolveTimeout, the context also has a deadline.
+	Resolve(ctx context.Context, node *QueryTreeNode)
+}
+
+// FieldResolverFunc is a function implementing FieldResolver.
+type FieldResolverFunc func(ctx context.Context, node *QueryTreeNode)
+
+// Resolve calls the function.
+func (f FieldResolverFunc) Resolve(ctx context.Context, node *QueryTreeNode) {
+	f(ctx, node)
+}
+
+// ResolverTree mirrors a query tree and runs the registered field resolvers on its nodes.
+type ResolverTree struct {
+	root      *QueryTreeNode
+	resolvers map[string]FieldResolver
+
+	mtx    sync.Mutex
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+// resolverNode is the resolution state of a node in the mirror tree.
+type resolverNode struct {
+	tree   *ResolverTree
+	node   *QueryTreeNode
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// children are the live children by node ID, only accessed by the watch goroutine.
+	children map[uint32]*resolverNode
+}
+
+// NewResolverTree builds a resolver tree for a query tree node.
+func NewResolverTree(root *QueryTreeNode) *ResolverTree {
+	return &ResolverTree{
+		root:      root,
+		resolvers: make(map[string]FieldResolver),
+	}
+}
+
+// Register sets the resolver for a field on a type.
+// The field name is matched against the ResolverName of nodes, as mapped by the FieldNameMapper option.
+// Must be called before Start.
+func (t *ResolverTree) Register(typeName, fieldName string, resolver FieldResolver) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.resolvers[typeName+"."+fieldName] = resolver
+}
+
+// Start starts resolving the tree until ctx is canceled or Stop is called.
+func (t *ResolverTree) Start(ctx context.Context) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.cancel != nil {
+		return
+	}
+	nctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	rn := &resolverNode{tree: t, node: t.root, ctx: nctx, cancel: cancel}
+	rn.watch()
+}
+
+// Stop cancels all resolvers and waits for them to exit.
+func (t *ResolverTree) Stop() {
+	t.mtx.Lock()
+	cancel := t.cancel
+	t.cancel = nil
+	t.mtx.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	t.wg.Wait()
+}
+
+// lookupResolver finds the resolver for a node.
+func (t *ResolverTree) lookupResolver(nod *QueryTreeNode) FieldResolver {
+	if nod.Parent == nil {
+		return nil
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.resolvers[typeDefinitionName(nod.Parent.AST)+"."+nod.ResolverName]
+}
+
+// watch subscribes to the node and mirrors its children until the node context is canceled.
+func (rn *resolverNode) watch() {
+	qsub := rn.node.SubscribeChangesContext(rn.ctx)
+	changes := qsub.Changes()
+
+	// Read the existing children after subscribing, duplicates are ignored.
+	var existing []*QueryTreeNode
+	unlock := rn.node.rlockSubtree()
+	existing = append(existing, rn.node.Children...)
+	unlock()
+
+	rn.tree.wg.Add(1)
+	go func() {
+		defer rn.tree.wg.Done()
+		defer qsub.Unsubscribe()
+
+		rn.children = make(map[uint32]*resolverNode)
+		for _, child := range existing {
+			rn.addChild(child)
+		}
+		for {
+			select {
+			case <-rn.ctx.Done():
+				return
+			case upd := <-changes:
+				switch upd.Operation {
+				case Operation_AddChild:
+					rn.addChild(upd.Child)
+				case Operation_DelChild:
+					rn.removeChild(upd.Child)
+				case Operation_ArgsChanged:
+					rn.removeChild(upd.Child)
+					rn.addChild(upd.Child)
+				case Operation_Delete:
+					rn.cancel()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// addChild starts resolving a child node.
+func (rn *resolverNode) addChild(nod *QueryTreeNode) {
+	if _, ok := rn.children[nod.Id]; ok || nod.ResolveError != nil || nod.Inactive {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(rn.ctx)
+	child := &resolverNode{tree: rn.tree, node: nod, ctx: ctx, cancel: cancel}
+	rn.children[nod.Id] = child
+	if resolver := rn.tree.lookupResolver(nod); resolver != nil {
+		rn.tree.wg.Add(1)
+		go func() {
+			defer rn.tree.wg.Done()
+			rctx := ctx
+			if nod.ResolveTimeout > 0 {
+				var rcancel context.CancelFunc
+				rctx, rcancel = context.WithTimeout(ctx, nod.ResolveTimeout)
+				defer rcancel()
+			}
+			resolver.Resolve(rctx, nod)
+		}()
+	}
+	child.watch()
+}
+
+// removeChild cancels resolving a child node.
+func (rn *resolverNode) removeChild(nod *QueryTreeNode) {
+	child, ok := rn.children[nod.Id]
+	if !ok {
+		return
+	}
+	delete(rn.children, nod.Id)
+	child.cancel()
+}
@@ -0,0 +1,159 @@
+package qtree
+
+import (
+	"time"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// Nodes marked with SetError are skipped by resolvers. With the RetryBackoff option, a mutation selecting
+// such a node again resolves its field and arguments against the schema once more, after a backoff doubling
+// with each failed retry. A successful retry clears the error and restarts the resolvers of the node.
+// A node whose type fails to resolve when added is kept without children or arguments, marked with the
+// *UnresolvedTypeError, and added again from the selection of the mutation retrying it.
+
+// Retries returns the number of failed retries of a node marked with SetError and the earliest time of the next retry.
+func (qt *QueryTreeNode) Retries() (count int, next time.Time) {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.retries, qt.nextRetry
+}
+
+// retryDelay returns the backoff before retrying a node after a number of failed retries.
+func (opts *QueryTreeOptions) retryDelay(retries int) time.Duration {
+	delay := opts.RetryBackoff
+	for i := 0; i < retries && delay < time.Duration(1<<62); i++ {
+		delay *= 2
+	}
+	if opts.MaxRetryBackoff > 0 && delay > opts.MaxRetryBackoff {
+		delay = opts.MaxRetryBackoff
+	}
+	return delay
+}
+
+// retry resolves a node marked with an error again if the backoff passed, expects the root lock to be held.
+func (qt *QueryTreeNode) retry() {
+	opts := qt.Root.options
+	if qt.ResolveError == nil || qt.Parent == nil || opts.RetryBackoff <= 0 || time.Now().Before(qt.nextRetry) {
+		return
+	}
+	if _, ok := qt.ResolveError.(*IncompleteSelectionError); ok {
+		// Cleared by adding a child.
+		return
+	}
+	if err := qt.revalidate(); err != nil {
+		qt.retries++
+		qt.nextRetry = time.Now().Add(opts.retryDelay(qt.retries))
+		qt.ResolveError = err
+		qt.sendError(qt.Id, err)
+		if opts.OnError != nil {
+			opts.OnError(qt, qt.nodeError(err))
+		}
+		return
+	}
+
+	qt.ResolveError = nil
+	qt.retries = 0
+	qt.nextRetry = time.Time{}
+	if !qt.Inactive {
+		qt.Parent.nextUpdate(&QTNodeUpdate{
+			Operation: Operation_ArgsChanged,
+			Child:     qt,
+		})
+	}
+}
+
+// revalidate resolves the field of the node on the parent type, checks it with the FieldAuthorizer and
+// coerces the current argument values.
+// Types are looked up in the schema resolver of the tree, bypassing the type cache.
+func (qt *QueryTreeNode) revalidate() error {
+	schemaResolver := qt.Root.SchemaResolver
+	sel, err := qt.checkMove(schemaResolver, qt.Parent.AST, qt, qt.protoArgs())
+	if err != nil {
+		return err
+	}
+	if sel.typeCondition == "" {
+		if err := qt.Parent.authorize(qt.Id, qt.FieldName); err != nil {
+			return err
+		}
+		for name, ref := range qt.Arguments {
+			if ref.IsConstant() {
+				continue
+			}
+			val, ok := qt.VariableStore.Value(ref.Id)
+			if !ok {
+				continue
+			}
+			if _, err := coerceFieldArgument(schemaResolver, sel.field, name, val); err != nil {
+				return err
+			}
+		}
+	}
+	qt.fieldDef = sel.field
+	return nil
+}
+
+// keepPending keeps a new node whose type failed to resolve in the tree, marked with the error, if the
+// tree retries nodes. Returns false if the addition fails instead, expects the root lock to be held.
+func (qt *QueryTreeNode) keepPending(nnod *QueryTreeNode, data *proto.RGQLQueryTreeNode, err error) bool {
+	opts := qt.Root.options
+	if _, ok := err.(*UnresolvedTypeError); !ok || opts.RetryBackoff <= 0 {
+		return false
+	}
+	nnod.pending = data
+	nnod.ResolveError = err
+	nnod.nextRetry = time.Now().Add(opts.retryDelay(0))
+	qt.Root.sharedMtx.Lock()
+	qt.Root.stats.NodesAdded++
+	qt.Root.stats.LiveNodes++
+	qt.Root.sharedMtx.Unlock()
+	qt.sendError(nnod.Id, err)
+	if opts.OnError != nil {
+		nnod.escaped = true
+		opts.OnError(nnod, nnod.nodeError(err))
+	}
+	return true
+}
+
+// retryPending adds a node kept after its type failed to resolve again from data, if the backoff passed.
+// The node is replaced, a node failing to resolve its type again keeps counting the retries.
+// Expects the root lock to be held.
+func (qt *QueryTreeNode) retryPending(data *proto.RGQLQueryTreeNode) error {
+	if time.Now().Before(qt.nextRetry) {
+		return nil
+	}
+	parent, parentRef, retries := qt.Parent, qt.refs[qt.Id], qt.retries
+	parent.dropChild(qt)
+	qt.unregister()
+	qt.Root.sharedMtx.Lock()
+	qt.Root.stats.NodesAdded--
+	qt.Root.stats.LiveNodes--
+	qt.Root.sharedMtx.Unlock()
+
+	if err := parent.addChild(data, parentRef); err != nil {
+		return err
+	}
+	if nod, ok := parent.lookupNode(data.Id); ok && nod.pending != nil {
+		nod.retries = retries + 1
+		nod.nextRetry = time.Now().Add(parent.Root.options.retryDelay(nod.retries))
+	}
+	return nil
+}
+
+// sameProtoArguments checks if two selections have the same arguments, in any order.
+func sameProtoArguments(a, b []*proto.FieldArgument) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := make(map[string]uint32, len(a))
+	for _, arg := range a {
+		ids[arg.Name] = arg.VariableId
+	}
+	for _, arg := range b {
+		if id, ok := ids[arg.Name]; !ok || id != arg.VariableId {
+			return false
+		}
+	}
+	return true
+}
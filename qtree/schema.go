@@ -7,9 +7,17 @@ import (
 // SchemaResolver is a object that can lookup AST types.
 type SchemaResolver interface {
 	LookupType(ast.Type) ast.TypeDefinition
+	// RootType returns the root object of an operation type, or nil if the schema has none.
+	RootType(op OperationType) *ast.ObjectDefinition
 }
 
-// typeNameDef is a reference variable for __typename, applied to all objects.
+// ImplementationResolver is a SchemaResolver that can find the implementations of an interface.
+// Without it, interface nodes have no known possible types.
+type ImplementationResolver interface {
+	LookupImplementations(*ast.InterfaceDefinition) []*ast.ObjectDefinition
+}
+
+// typeNameDef is a reference variable for __typename, applied to all objects, interfaces and unions.
 var typeNameDef *ast.FieldDefinition = &ast.FieldDefinition{
 	Kind: "FieldDefinition",
 	Name: &ast.Name{Kind: "Name", Value: "__typename"},
@@ -0,0 +1,98 @@
+package qtree
+
+import (
+	"fmt"
+)
+
+// Nodes of object, interface and union types must have selections when added. A mutation deleting or moving
+// away the last children of such a node marks it as incomplete with the ResolveError of an
+// *IncompleteSelectionError, so resolvers skip it, until a child is added to it again.
+
+// IncompleteSelectionError marks a node left without selections by a tree mutation.
+type IncompleteSelectionError struct {
+	NodeId    uint32
+	FieldName string
+}
+
+// Error returns the error message.
+func (e *IncompleteSelectionError) Error() string {
+	return fmt.Sprintf("Invalid node %d, field %s has no selections left.", e.NodeId, e.FieldName)
+}
+
+// needsSelections checks if a node stays incomplete without children.
+func (qt *QueryTreeNode) needsSelections() bool {
+	return qt.Parent != nil && !qt.disposed && !qt.IsPrimitive && qt.ResolveError == nil
+}
+
+// checkSelectionsLeft marks the nodes a mutation took children from as incomplete if they have none left.
+// Returns the errors of the marked nodes, expects the root lock to be held.
+func checkSelectionsLeft(vacated []*QueryTreeNode) []*NodeMutationError {
+	var errs []*NodeMutationError
+	for _, nod := range vacated {
+		if len(nod.Children) != 0 || !nod.needsSelections() {
+			continue
+		}
+		err := &IncompleteSelectionError{NodeId: nod.Id, FieldName: nod.FieldName}
+		nod.ResolveError = err
+		nod.sendError(nod.Id, err)
+		if onError := nod.Root.options.OnError; onError != nil {
+			onError(nod, nod.nodeError(err))
+		}
+		nod.nextUpdate(&QTNodeUpdate{
+			Operation: Operation_Error,
+		})
+		errs = append(errs, &NodeMutationError{NodeId: nod.Id, Err: err})
+	}
+	return errs
+}
+
+// completeSelections clears the mark of an incomplete node after a child was added to it.
+// The resolvers of the node are restarted, expects the root lock to be held.
+func (qt *QueryTreeNode) completeSelections() {
+	if _, ok := qt.ResolveError.(*IncompleteSelectionError); !ok {
+		return
+	}
+	qt.ResolveError = nil
+	if !qt.Inactive {
+		qt.Parent.nextUpdate(&QTNodeUpdate{
+			Operation: Operation_ArgsChanged,
+			Child:     qt,
+		})
+	}
+}
+
+// checkSelectionsLeft returns the errors for the virtual nodes a mutation took children from and left empty.
+func (v *mutationValidator) checkSelectionsLeft(vacated []*validateNode) MutationErrors {
+	var errs MutationErrors
+	seen := make(map[*validateNode]bool)
+	for _, vn := range vacated {
+		if vn == nil {
+			continue
+		}
+		// Fragment spreads are tracked with the node they are spread into.
+		for vn.parent != nil && vn.node == vn.parent.node {
+			vn = vn.parent
+		}
+		if seen[vn] || vn.parent == nil || vn.node == nil || vn.node.IsPrimitive || !vn.alive() || v.hasSelections(vn) {
+			continue
+		}
+		seen[vn] = true
+		errs = append(errs, &IncompleteSelectionError{NodeId: vn.node.Id, FieldName: vn.node.FieldName})
+	}
+	return errs
+}
+
+// hasSelections checks if a virtual node has live children.
+func (v *mutationValidator) hasSelections(vn *validateNode) bool {
+	for _, nod := range vn.existing {
+		if child := v.wrapExisting(nod); !child.deleted && child.parent == vn {
+			return true
+		}
+	}
+	for _, child := range vn.children {
+		if !child.deleted && child.parent == vn {
+			return true
+		}
+	}
+	return false
+}
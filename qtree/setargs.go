@@ -0,0 +1,182 @@
+package qtree
+
+import (
+	"fmt"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// SubtreeSetArgs is the node mutation replacing the field arguments of the node NodeId in place.
+// The new arguments are the Args of Node, the rest of Node is ignored and the directives are kept.
+// The node keeps its ID and subtree, its parent receives an Operation_ArgsChanged update.
+// The proto does not name the operation, clients send its numeric value, 1048577.
+const SubtreeSetArgs = extendedSubtreeOperation + 1
+
+// checkSettable checks that the arguments of a node can be replaced by args.
+// refs is the number of IDs the node is selected by.
+func checkSettable(nod *QueryTreeNode, refs int, args []*proto.FieldArgument) error {
+	switch {
+	case nod.Parent == nil:
+		return fmt.Errorf("Invalid node %d, the root has no arguments.", nod.Id)
+	case nod.TypeCondition != "":
+		return fmt.Errorf("Invalid node %d, inline fragments have no arguments.", nod.Id)
+	case refs > 1 || nod.fragmentSpreadId != 0 || nod.Id&serverNodeIdFlag != 0:
+		return fmt.Errorf("Invalid node %d, arguments of merged and generated selections cannot be set.", nod.Id)
+	}
+	for _, arg := range args {
+		name, _, _ := splitInlineArgument(arg.Name)
+		if directive, ok := directiveArgName(name); ok {
+			return fmt.Errorf("Invalid node %d, directive %s cannot be set with the arguments.", nod.Id, directive)
+		}
+	}
+	return checkFieldArguments(nod.fieldDef, args)
+}
+
+// setArguments replaces the field arguments of the node, expects the root lock to be held.
+// The complexity of the subtree is estimated again, list sizes may depend on the arguments.
+func (qt *QueryTreeNode) setArguments(args []*proto.FieldArgument) error {
+	if qt.disposed {
+		return fmt.Errorf("Invalid node %d, node was disposed.", qt.Id)
+	}
+	if err := checkSettable(qt, len(qt.refs), args); err != nil {
+		return err
+	}
+
+	argMap := make(map[string]*VariableReference, len(args))
+	cleanupArgs := func() {
+		for _, ref := range argMap {
+			ref.Unsubscribe()
+		}
+	}
+	var literals map[string]string
+	for _, arg := range args {
+		if name, literal, isInline := splitInlineArgument(arg.Name); isInline {
+			ref, err := inlineArgument(qt.Root.types, qt.fieldDef, name, literal)
+			if err != nil {
+				cleanupArgs()
+				return err
+			}
+			if literals == nil {
+				literals = make(map[string]string)
+			}
+			argMap[name] = ref
+			literals[name] = literal
+			continue
+		}
+		vref := qt.VariableStore.Get(arg.VariableId)
+		if vref == nil {
+			cleanupArgs()
+			return variableNotFoundError(arg)
+		}
+		argMap[arg.Name] = vref
+		val, err := coerceFieldArgument(qt.Root.types, qt.fieldDef, arg.Name, vref.Value)
+		if err != nil {
+			cleanupArgs()
+			return err
+		}
+		vref.Value = val
+	}
+	if err := defaultArguments(qt.fieldDef, argMap); err != nil {
+		cleanupArgs()
+		return err
+	}
+	if err := qt.checkImmutableArguments(argMap); err != nil {
+		cleanupArgs()
+		return err
+	}
+
+	// The node must stay distinguishable from its siblings, including its directives.
+	if sibling := qt.Parent.findSibling(qt.Alias, qt.FieldName, withDirectiveArgs(args, qt.protoArgs())); sibling == qt {
+		cleanupArgs()
+		return nil
+	} else if sibling != nil {
+		cleanupArgs()
+		return fmt.Errorf("Invalid node %d, node %d already selects %s with the arguments.", qt.Id, sibling.Id, qt.FieldName)
+	}
+
+	// Arguments are replaced with a new map, as resolvers may be reading the old one.
+	oldArgs, oldLiterals := qt.Arguments, qt.literals
+	qt.Arguments, qt.literals = argMap, literals
+	if err := qt.rechargeComplexity(); err != nil {
+		qt.Arguments, qt.literals = oldArgs, oldLiterals
+		cleanupArgs()
+		return err
+	}
+	for _, ref := range oldArgs {
+		ref.Unsubscribe()
+	}
+
+	if qt.Inactive {
+		return nil
+	}
+	qt.Parent.nextUpdate(&QTNodeUpdate{
+		Operation: Operation_ArgsChanged,
+		Child:     qt,
+	})
+	return nil
+}
+
+// setArgs validates replacing the field arguments of a virtual node.
+// The complexity of the subtree is not estimated again.
+func (v *mutationValidator) setArgs(vn *validateNode, id uint32, args []*proto.FieldArgument) error {
+	if vn.node == nil {
+		return fmt.Errorf("Invalid node ID (not found): %d", id)
+	}
+	if _, ok := vn.node.refs[id]; vn.node.Id != id && !ok {
+		// Fragment spreads are tracked with the node they are spread into.
+		return fmt.Errorf("Invalid node ID (not found): %d", id)
+	}
+	if err := checkSettable(vn.node, vn.ids, args); err != nil {
+		return err
+	}
+
+	argMap := make(map[string]*VariableReference, len(args))
+	for _, arg := range args {
+		if name, literal, isInline := splitInlineArgument(arg.Name); isInline {
+			ref, err := inlineArgument(v.root.types, vn.node.fieldDef, name, literal)
+			if err != nil {
+				return err
+			}
+			argMap[name] = ref
+			continue
+		}
+		val, ok := v.lookupVariable(arg.VariableId)
+		if !ok {
+			return variableNotFoundError(arg)
+		}
+		val, err := coerceFieldArgument(v.root.types, vn.node.fieldDef, arg.Name, val)
+		if err != nil {
+			return err
+		}
+		argMap[arg.Name] = NewConstantReference(val)
+	}
+	if err := defaultArguments(vn.node.fieldDef, argMap); err != nil {
+		return err
+	}
+	if err := vn.node.checkImmutableArguments(argMap); err != nil {
+		return err
+	}
+
+	if v.existing[vn.node] == vn {
+		// Nodes added by the mutation are not compared, adding them merges duplicates.
+		siblingArgs := withDirectiveArgs(args, vn.node.protoArgs())
+		if sibling := vn.node.Parent.findSibling(vn.node.Alias, vn.node.FieldName, siblingArgs); sibling != nil && sibling != vn.node {
+			return fmt.Errorf("Invalid node %d, node %d already selects %s with the arguments.", vn.node.Id, sibling.Id, vn.node.FieldName)
+		}
+		return nil
+	}
+	vn.node.Arguments = argMap
+	vn.args = withDirectiveArgs(args, vn.args)
+	return nil
+}
+
+// withDirectiveArgs returns a copy of the field arguments args with the directive arguments of from.
+func withDirectiveArgs(args, from []*proto.FieldArgument) []*proto.FieldArgument {
+	res := append([]*proto.FieldArgument(nil), args...)
+	for _, arg := range from {
+		if _, ok := directiveArgName(arg.Name); ok {
+			res = append(res, arg)
+		}
+	}
+	return res
+}
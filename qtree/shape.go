@@ -0,0 +1,59 @@
+package qtree
+
+import (
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ResultShape predicts the JSON shape of the result of the subtree before it is resolved.
+// Objects are maps by response key, lists are slices with one element per list level and leaves are
+// the names of their scalar or enum types. The fields of inline fragments are merged into the object
+// they narrow, inactive nodes are left out.
+func (qt *QueryTreeNode) ResultShape() interface{} {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.resultShape()
+}
+
+// resultShape builds the shape of the subtree, expects the root lock to be held.
+func (qt *QueryTreeNode) resultShape() interface{} {
+	var shape interface{}
+	if name, ok := qt.leafTypeName(); ok {
+		shape = name
+	} else {
+		fields := make(map[string]interface{}, len(qt.Children))
+		qt.addFieldShapes(fields)
+		shape = fields
+	}
+	for i := 0; i < qt.ListDepth; i++ {
+		shape = []interface{}{shape}
+	}
+	return shape
+}
+
+// addFieldShapes adds the shapes of the active children to fields, flattening inline fragments.
+func (qt *QueryTreeNode) addFieldShapes(fields map[string]interface{}) {
+	for _, child := range qt.Children {
+		if child.Inactive {
+			continue
+		}
+		if child.TypeCondition != "" {
+			child.addFieldShapes(fields)
+			continue
+		}
+		if _, ok := fields[child.ResponseKey()]; !ok {
+			fields[child.ResponseKey()] = child.resultShape()
+		}
+	}
+}
+
+// leafTypeName returns the type name of a scalar or enum node.
+func (qt *QueryTreeNode) leafTypeName() (string, bool) {
+	if qt.IsPrimitive {
+		return qt.PrimitiveName, true
+	}
+	if enum, ok := qt.AST.(*ast.EnumDefinition); ok && enum.Name != nil {
+		return enum.Name.Value, true
+	}
+	return "", false
+}
@@ -0,0 +1,93 @@
+package qtree
+
+import (
+	"sort"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// ToProto snapshots the subtree as a tree node that can be replayed with AddChild.
+// Constant arguments, like defaults, are omitted, as they are applied again when added.
+func (qt *QueryTreeNode) ToProto() *proto.RGQLQueryTreeNode {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	return qt.toProto()
+}
+
+// toProto snapshots the subtree, expects the root lock to be held.
+func (qt *QueryTreeNode) toProto() *proto.RGQLQueryTreeNode {
+	return qt.toProtoRef(qt.Id)
+}
+
+// toProtoRef snapshots the subtree as selected under id, one of the IDs the node was added with.
+// A child merged under several IDs is snapshot once for each of them, below the ID of the parent it was
+// added under, expects the root lock to be held.
+func (qt *QueryTreeNode) toProtoRef(id uint32) *proto.RGQLQueryTreeNode {
+	if qt.pending != nil {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: qt.pending.FieldName,
+			Args:      qt.pending.Args,
+			Children:  qt.pending.Children,
+		}
+	}
+	nod := &proto.RGQLQueryTreeNode{
+		Id:        id,
+		FieldName: joinFieldAlias(qt.Alias, qt.FieldName),
+		Args:      qt.protoArgs(),
+	}
+	for _, child := range qt.Children {
+		for _, childId := range child.refIds(qt, id) {
+			nod.Children = append(nod.Children, child.toProtoRef(childId))
+		}
+	}
+	return nod
+}
+
+// refIds returns the IDs the node was added with below parent under parentRef, sorted.
+func (qt *QueryTreeNode) refIds(parent *QueryTreeNode, parentRef uint32) []uint32 {
+	if len(qt.refs) == 0 {
+		if parentRef != parent.Id {
+			return nil
+		}
+		return []uint32{qt.Id}
+	}
+	var ids []uint32
+	for id, ref := range qt.refs {
+		if ref == parentRef {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// protoArgs returns the arguments and directives of the node sorted by name, expects the root lock to be held.
+func (qt *QueryTreeNode) protoArgs() []*proto.FieldArgument {
+	var args []*proto.FieldArgument
+	for name, ref := range qt.Arguments {
+		if literal, ok := qt.literals[name]; ok {
+			args = append(args, &proto.FieldArgument{Name: joinInlineArgument(name, literal)})
+			continue
+		}
+		if ref.IsConstant() {
+			continue
+		}
+		args = append(args, &proto.FieldArgument{Name: name, VariableId: ref.Id})
+	}
+	for name, ref := range qt.Directives {
+		if literal, ok := qt.directiveLiterals[name]; ok {
+			args = append(args, &proto.FieldArgument{Name: joinInlineArgument(directiveArgPrefix+name, literal)})
+			continue
+		}
+		args = append(args, &proto.FieldArgument{
+			Name:       directiveArgPrefix + name,
+			VariableId: ref.Id,
+		})
+	}
+	sort.Slice(args, func(i, j int) bool {
+		return args[i].Name < args[j].Name
+	})
+	return args
+}
@@ -0,0 +1,57 @@
+package qtree
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	pb "github.com/golang/protobuf/proto"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// MaxMutationSize is the largest mutation message ApplyMutationStream accepts, in bytes.
+const MaxMutationSize = 4 << 20
+
+// ApplyMutationStream reads tree mutations from r and applies each with ApplyTreeMutation.
+// Each message is an encoded RGQLQueryTreeMutation prefixed with its length as an unsigned varint.
+// Failed operations are reported to the error channel as with ApplyTreeMutation, a message failing to decode
+// is reported for the root and skipped. Returns nil at the end of r, the framing error if the stream is
+// truncated or a message exceeds MaxMutationSize, or the context error once ctx is canceled.
+// The context is checked between messages, close r to interrupt a blocked read.
+func (qt *QueryTreeNode) ApplyMutationStream(ctx context.Context, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for seq := 1; ; seq++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid mutation %d length: %v", seq, err)
+		}
+		if size > MaxMutationSize {
+			return fmt.Errorf("Invalid mutation %d, %d bytes exceed the maximum of %d.", seq, size, MaxMutationSize)
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("Invalid mutation %d: %v", seq, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		mutation := &proto.RGQLQueryTreeMutation{}
+		if err := pb.Unmarshal(buf, mutation); err != nil {
+			qt.sendError(qt.Root.Id, fmt.Errorf("Invalid mutation %d: %v", seq, err))
+			continue
+		}
+		qt.ApplyTreeMutation(mutation)
+	}
+}
@@ -1,32 +1,78 @@
 package qtree
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	pb "github.com/golang/protobuf/proto"
 	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
 	. "github.com/rgraphql/magellan/qtree"
 	"github.com/rgraphql/magellan/schema"
+	"github.com/rgraphql/magellan/types"
 	proto "github.com/rgraphql/rgraphql/pkg/proto"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var schemaSrc string = `
+scalar DateTime
+
 type Planet {
 	name: String
 	radius: Int
 }
 
+enum Unit {
+	METER
+	FOOT
+}
+
 type Person {
 	name: String
-	height: Int
+	height(unit: Unit = METER): Int
 	home: Planet
+	friends: [Person]
+	born(after: DateTime): DateTime
+	friendGroups: [[Person!]!]!
+	nameCube: [[[String]]]
+	nickname: String @deprecated(reason: "Use name")
+	biography: String @timeout(ms: 200)
+}
+
+input Coordinates {
+	lat: Float!
+	lng: Float!
+}
+
+input PlanetFilter {
+	name: String
+	near: Coordinates
+	limit: Int = 5
 }
 
 type RootQuery {
-	allPeople: [Person]
+	allPeople(age: Int, limit: Int = 10, sort: String = "name"): [Person]
+	person(name: String!): Person
+	planets(minRadius: Float, names: [String]): [Planet]
+	findPlanets(filter: PlanetFilter!): [Planet]
+	planetsByName(names: [String!]!): [Planet]
+}
+
+type RootSubscription {
+	personChanged(name: String!): Person
 }
 
 schema {
 	query: RootQuery
+	subscription: RootSubscription
 }
 `
 
@@ -59,25 +105,5852 @@ func TestBasics(t *testing.T) {
 	t.Logf("%#v", qt.Children[0])
 }
 
-func TestSchemaErrors(t *testing.T) {
-	_, qt, errCh := buildMockTree(t)
-	qt.AddChild(&proto.RGQLQueryTreeNode{
+func TestDepthAndSize(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
 		Id:        1,
 		FieldName: "allPeople",
 		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
 			{
-				Id:        2,
-				FieldName: "names",
+				Id:        3,
+				FieldName: "home",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}},
 			},
 		},
 	})
-	var err error
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if d := qt.Depth(); d != 4 {
+		t.Fatalf("Expected depth 4, got %d.", d)
+	}
+	if s := qt.Size(); s != 5 {
+		t.Fatalf("Expected size 5, got %d.", s)
+	}
+	if s := qt.Children[0].Size(); s != 4 {
+		t.Fatalf("Expected subtree size 4, got %d.", s)
+	}
+}
+
+func TestSubscriptionRoot(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt, err := sch.BuildQueryTree(errCh, "subscription")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if qt.OperationType != OperationSubscription {
+		t.Fatalf("Expected a subscription tree, got %v.", qt.OperationType)
+	}
+
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id: 1,
+		Value: &proto.RGQLPrimitive{
+			Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_STRING,
+			StringValue: "Luke",
+		},
+	})
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "personChanged",
+		Args:      []*proto.FieldArgument{{Name: "name", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{Id: 3, FieldName: "allPeople"})
+	if err == nil || err.Error() != "Invalid field allPeople on RootSubscription." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	if _, err := sch.BuildQueryTree(errCh, "mutation"); err == nil || err.Error() != "Root mutation object not found." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestIsLeafComplete(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	if qt.IsLeafComplete() {
+		t.Fatal("Empty tree is leaf complete.")
+	}
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !qt.IsLeafComplete() || !qt.RootNodeMap[2].IsLeafComplete() {
+		t.Fatal("Tree with primitive leaves is not leaf complete.")
+	}
+
+	qt.RootNodeMap[4].Dispose()
+	if qt.IsLeafComplete() || qt.RootNodeMap[3].IsLeafComplete() {
+		t.Fatal("Object without selections is leaf complete.")
+	}
+	if !qt.RootNodeMap[2].IsLeafComplete() {
+		t.Fatal("Sibling subtree is not leaf complete.")
+	}
+}
+
+func TestStats(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "others: allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        4,
+			FieldName: "friends",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "names"}},
+		}},
+	})
+
+	expected := TreeStats{NodesAdded: 2, FailedAdds: 1, LiveNodes: 2}
+	if stats := qt.Stats(); stats != expected {
+		t.Fatalf("Unexpected stats: %#v", stats)
+	}
+
+	qt.Children[0].Dispose()
+	expected = TreeStats{NodesAdded: 2, NodesDeleted: 2, FailedAdds: 1}
+	if stats := qt.Stats(); stats != expected {
+		t.Fatalf("Unexpected stats after dispose: %#v", stats)
+	}
+}
+
+func TestSubscriberCount(t *testing.T) {
+	type leak struct {
+		id          uint32
+		subscribers int
+	}
+	leaks := make(chan leak, 1)
+	qt, shards := buildFanOutTree(t, QueryTreeOptions{
+		OnSubscriberLeak: func(node *QueryTreeNode, subscribers int) {
+			leaks <- leak{node.Id, subscribers}
+		},
+	}, 2)
+
+	rootSub := qt.SubscribeChanges()
+	subs := []QTNodeSubscription{shards[0].SubscribeChanges(), shards[0].SubscribeChanges()}
+	_, cancel := shards[1].SubscribeChangesChan()
+	if n := shards[0].SubscriberCount(); n != 2 {
+		t.Fatalf("Expected 2 subscribers, got %d.", n)
+	}
+	if n := qt.SubtreeSubscriberCount(); n != 4 {
+		t.Fatalf("Expected 4 subscribers in the tree, got %d.", n)
+	}
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	rootSub.Unsubscribe()
+	if n := shards[0].SubscriberCount(); n != 0 {
+		t.Fatalf("Expected no subscribers after unsubscribing, got %d.", n)
+	}
+	if n := qt.SubtreeSubscriberCount(); n != 1 {
+		t.Fatalf("Expected 1 subscriber in the tree, got %d.", n)
+	}
+
+	shards[0].Dispose()
 	select {
-	case e := <-errCh:
-		err = errors.New(e.Error)
+	case l := <-leaks:
+		t.Fatalf("Unexpected leak: %#v", l)
 	default:
 	}
-	if err == nil || err.Error() != "Invalid field names on Person." {
+	shards[1].Dispose()
+	if l := <-leaks; l.id != 2 || l.subscribers != 1 {
+		t.Fatalf("Unexpected leak: %#v", l)
+	}
+	cancel()
+	if n := qt.SubtreeSubscriberCount(); n != 0 {
+		t.Fatalf("Expected no subscribers in the tree, got %d.", n)
+	}
+}
+
+func TestDuplicateIds(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	dup := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{
+				Id:        3,
+				FieldName: "friends",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "height"}},
+			},
+		},
+	}
+	err := qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      dup,
+		}},
+	})
+	if err == nil || err.Error() != "Invalid node ID (used more than once): 2" {
+		t.Fatalf("Validation did not return expected error (%v).", err)
+	}
+
+	err = qt.AddChild(dup)
+	if err == nil || err.Error() != "Invalid node ID (used more than once): 2" {
 		t.Fatalf("Did not return expected error (%v).", err)
 	}
+	if len(qt.Children) != 0 || len(qt.RootNodeMap) != 1 {
+		t.Fatal("Subtree with duplicate IDs was partially added.")
+	}
+	select {
+	case qerr := <-errCh:
+		if qerr.QueryNodeId != 2 {
+			t.Fatalf("Unexpected error node: %#v", qerr)
+		}
+	default:
+		t.Fatal("No error was reported.")
+	}
+	if stats := qt.Stats(); stats.FailedAdds != 1 || stats.NodesAdded != 0 {
+		t.Fatalf("Unexpected stats: %#v", stats)
+	}
+}
+
+func TestEmptyNotification(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	expectEmpty := func(expected bool) {
+		select {
+		case <-qt.Empty():
+			if !expected {
+				t.Fatal("Unexpected empty signal.")
+			}
+		default:
+			if expected {
+				t.Fatal("Tree did not signal it became empty.")
+			}
+		}
+	}
+	people := func(id uint32) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: "allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		}
+	}
+	mutate := func(ops ...*proto.RGQLQueryTreeMutation_NodeMutation) {
+		qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{NodeMutation: ops})
+	}
+	add := func(id uint32) *proto.RGQLQueryTreeMutation_NodeMutation {
+		return &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      people(id),
+		}
+	}
+	del := func(id uint32) *proto.RGQLQueryTreeMutation_NodeMutation {
+		return &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    id,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+		}
+	}
+
+	mutate(add(1))
+	expectEmpty(false)
+	mutate(del(1), add(2))
+	expectEmpty(false)
+	mutate(del(2))
+	expectEmpty(true)
+
+	mutate(add(3))
+	qt.RootNodeMap[3].Dispose()
+	expectEmpty(true)
+	qt.Dispose()
+	expectEmpty(false)
+}
+
+func TestPauseSubscription(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{MaxPausedUpdates: 4})
+	people := func(id uint32) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: "allPeople",
+			Args:      []*proto.FieldArgument{{Name: "sort", VariableId: id}},
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		}
+	}
+	for i := uint32(1); i <= 8; i++ {
+		qt.VariableStore.Put(&proto.ASTVariable{
+			Id: i,
+			Value: &proto.RGQLPrimitive{
+				Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_STRING,
+				StringValue: fmt.Sprintf("sort%d", i),
+			},
+		})
+	}
+
+	qsub := qt.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	qsub.Pause()
+	qt.AddChild(people(1))
+	qt.AddChild(people(2))
+	qt.RootNodeMap[2].Dispose()
+	select {
+	case upd := <-changes:
+		t.Fatalf("Update delivered while paused: %#v", upd)
+	default:
+	}
+
+	qsub.Resume()
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_AddChild || upd.Child.Id != 1 {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Buffered update was not delivered.")
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Added and deleted child was not coalesced: %#v", upd)
+	default:
+	}
+
+	qsub.Pause()
+	for i := uint32(3); i <= 8; i++ {
+		qt.AddChild(people(i))
+	}
+	qsub.Resume()
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_Resync {
+			t.Fatalf("Expected a resync, got %#v", upd)
+		}
+	default:
+		t.Fatal("Overflowed buffer did not resync.")
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Unexpected update after resync: %#v", upd)
+	default:
+	}
+}
+
+func TestSubscribeChangesChan(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	people := func(id uint32) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: fmt.Sprintf("p%d: allPeople", id),
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1000, FieldName: "name"}},
+		}
+	}
+	changes, cancel := qt.SubscribeChangesChan()
+	defer cancel()
+
+	// The channel holds 50 updates, the rest are dropped until it has room.
+	for i := uint32(1); i <= 60; i++ {
+		if err := qt.AddChild(people(i)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for i := uint32(1); i <= 50; i++ {
+		if upd := <-changes; upd.Operation != Operation_AddChild || upd.Child.Id != i {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Unexpected update: %#v", upd)
+	default:
+	}
+
+	if err := qt.AddChild(people(61)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if upd := <-changes; upd.Operation != Operation_Resync {
+		t.Fatalf("Expected a resync, got %#v", upd)
+	}
+	if upd := <-changes; upd.Operation != Operation_AddChild || upd.Child.Id != 61 {
+		t.Fatalf("Unexpected update after resync: %#v", upd)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Fatal("Channel was not closed.")
+	}
+	qt.RootNodeMap[61].Dispose()
+}
+
+func TestBatchedSubscription(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTree(rootQ, sch.Definitions, errCh)
+
+	qsub := qt.SubscribeChangesBatched()
+	defer qsub.Unsubscribe()
+	batches := qsub.Batches()
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+				},
+			},
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        3,
+					FieldName: "others: allPeople",
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+				},
+			},
+		},
+	})
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 || batch[0].Child.Id != 1 || batch[1].Child.Id != 3 {
+			t.Fatalf("Unexpected batch: %#v", batch)
+		}
+		for _, upd := range batch {
+			if upd.Operation != Operation_AddChild {
+				t.Fatalf("Unexpected update: %#v", upd)
+			}
+		}
+	default:
+		t.Fatal("Batch was not flushed after the mutation.")
+	}
+	select {
+	case batch := <-batches:
+		t.Fatalf("Mutation flushed more than one batch: %#v", batch)
+	default:
+	}
+
+	qt.RootNodeMap[3].Dispose()
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 || batch[0].Operation != Operation_DelChild {
+			t.Fatalf("Unexpected batch: %#v", batch)
+		}
+	default:
+		t.Fatal("Update outside a mutation was not delivered.")
+	}
+}
+
+func TestSubscriberPanic(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	var recovered []interface{}
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		OnSubscriberPanic:  func(r interface{}) { recovered = append(recovered, r) },
+		UnsubscribeOnPanic: true,
+	})
+
+	calls := 0
+	psub := qt.SubscribeChangesFunc(func(upd *QTNodeUpdate) {
+		calls++
+		panic("subscriber failed")
+	})
+	defer psub.Unsubscribe()
+	qsub := qt.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	for i, fieldName := range []string{"allPeople", "others: allPeople"} {
+		id := uint32(i*2 + 1)
+		err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: fieldName,
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1, FieldName: "name"}},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		select {
+		case upd := <-changes:
+			if upd.Operation != Operation_AddChild || upd.Child.Id != id {
+				t.Fatalf("Unexpected update: %#v", upd)
+			}
+		default:
+			t.Fatal("Other subscriber did not receive the update.")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected the panicking subscriber to be removed after 1 call, got %d.", calls)
+	}
+	if len(recovered) != 1 || recovered[0] != "subscriber failed" {
+		t.Fatalf("Unexpected recovered panics %v.", recovered)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	var nodes []*QueryTreeNode
+	var errs []*QTError
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		OnError: func(node *QueryTreeNode, err error) {
+			nodes = append(nodes, node)
+			errs = append(errs, err.(*QTError))
+		},
+	})
+	ageVariable := func(val *proto.RGQLPrimitive) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{Variables: []*proto.ASTVariable{{Id: 1, Value: val}}}
+	}
+	mutation := ageVariable(&proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 30})
+	mutation.NodeMutation = []*proto.RGQLQueryTreeMutation_NodeMutation{{
+		NodeId:    0,
+		Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+		Node: &proto.RGQLQueryTreeNode{
+			Id:        1,
+			FieldName: "allPeople",
+			Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "nick: name"}},
+		},
+	}}
+	qt.ApplyTreeMutation(mutation)
+
+	name := qt.RootNodeMap[2]
+	name.SetError(errors.New("Name not found."))
+	if len(nodes) != 1 || nodes[0] != name {
+		t.Fatalf("Resolve error was not reported: %v", nodes)
+	}
+	if errs[0].Message != "Name not found." || !reflect.DeepEqual(errs[0].Path, []string{"allPeople", "nick"}) {
+		t.Fatalf("Unexpected error: %#v", errs[0])
+	}
+
+	qt.ApplyTreeMutation(ageVariable(&proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "old"}))
+	if len(nodes) != 2 || nodes[1] != qt.RootNodeMap[1] {
+		t.Fatalf("Argument error was not reported: %v", nodes)
+	}
+	if !reflect.DeepEqual(errs[1].Path, []string{"allPeople"}) || errs[1].Extensions["nodeId"] != uint32(1) {
+		t.Fatalf("Unexpected error: %#v", errs[1])
+	}
+	if age, _ := qt.RootNodeMap[1].ArgInt("age"); age != 30 {
+		t.Fatalf("Node did not keep its arguments: %d", age)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{Id: 3, FieldName: "unknown"})
+	if err == nil || len(nodes) != 2 {
+		t.Fatalf("Failed addition was reported: %v", err)
+	}
+}
+
+// countingResolver counts the type lookups reaching the schema, failing the first misses lookups.
+type countingResolver struct {
+	*schema.ASTParts
+	lookups int
+	misses  int
+}
+
+func (r *countingResolver) LookupType(typ ast.Type) ast.TypeDefinition {
+	r.lookups++
+	if r.misses != 0 {
+		r.misses--
+		return nil
+	}
+	return r.ASTParts.LookupType(typ)
+}
+
+func buildCountingTree(tb testing.TB) (*QueryTreeNode, *countingResolver) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	resolver := &countingResolver{ASTParts: sch.Definitions}
+	return NewQueryTree(rootQ, resolver, make(chan *proto.RGQLQueryError, 10)), resolver
+}
+
+func peopleWithHome(id uint32) *proto.RGQLQueryTreeNode {
+	return &proto.RGQLQueryTreeNode{
+		Id:        id,
+		FieldName: fmt.Sprintf("p%d: allPeople", id),
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        id + 1,
+			FieldName: "home",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 2, FieldName: "radius"}},
+		}},
+	}
+}
+
+// flakyResolver is a SchemaResolver failing type lookups while fail is set.
+type flakyResolver struct {
+	SchemaResolver
+	fail int32
+}
+
+// LookupType looks up a type unless the resolver is failing.
+func (r *flakyResolver) LookupType(typ ast.Type) ast.TypeDefinition {
+	if atomic.LoadInt32(&r.fail) != 0 {
+		return nil
+	}
+	return r.SchemaResolver.LookupType(typ)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	resolver := &flakyResolver{SchemaResolver: sch.Definitions}
+	backoff := 20 * time.Millisecond
+	qt := NewQueryTreeWithOptions(rootQ, resolver, errCh, QueryTreeOptions{RetryBackoff: backoff})
+
+	data := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        2,
+			FieldName: "friends",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+		}},
+	}
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	friends := qt.RootNodeMap[2]
+	friends.SetError(errors.New("schema still loading"))
+	<-errCh
+
+	// The retry fails while the schema cannot resolve Person.
+	atomic.StoreInt32(&resolver.fail, 1)
+	time.Sleep(backoff)
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 2 || qerr.Error != "Unable to resolve named Person." {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+	count, next := friends.Retries()
+	if count != 1 || friends.Error() == nil || time.Until(next) <= backoff {
+		t.Fatalf("expected one failed retry backing off, got %d until %v", count, next)
+	}
+
+	// Selecting the node again before the backoff passed does not retry.
+	atomic.StoreInt32(&resolver.fail, 0)
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if count, _ := friends.Retries(); count != 1 || friends.Error() == nil {
+		t.Fatal("expected no retry before the backoff passed")
+	}
+
+	time.Sleep(time.Until(next))
+	changes := qt.RootNodeMap[1].SubscribeChanges().Changes()
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if count, _ := friends.Retries(); count != 0 || friends.Error() != nil {
+		t.Fatalf("expected the retry to clear the error, got %v", friends.Error())
+	}
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_ArgsChanged || upd.Child != friends {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("expected the parent to be notified of the retried node")
+	}
+}
+
+func TestRetryRejectedExtension(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{RetryBackoff: time.Millisecond})
+
+	data := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	}
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.RootNodeMap[1]
+	people.SetError(errors.New("schema still loading"))
+	<-errCh
+	time.Sleep(time.Millisecond)
+
+	// The extension is rejected, so the node is not retried.
+	rejected := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "doesNotExist"},
+		},
+	}
+	if err := qt.AddChild(rejected); err == nil {
+		t.Fatal("expected the extension to be rejected")
+	}
+	if people.Error() == nil {
+		t.Fatal("expected the rejected extension not to retry the node")
+	}
+
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if people.Error() != nil {
+		t.Fatalf("expected the retry to clear the error, got %v", people.Error())
+	}
+}
+
+func TestRetryUnresolvedType(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	resolver := &flakyResolver{SchemaResolver: sch.Definitions, fail: 1}
+	backoff := 20 * time.Millisecond
+	qt := NewQueryTreeWithOptions(rootQ, resolver, errCh, QueryTreeOptions{RetryBackoff: backoff})
+
+	data := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	}
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := qt.RootNodeMap[1].ResolveError.(*UnresolvedTypeError); !ok {
+		t.Fatalf("expected the node to be kept unresolved, got %v", qt.RootNodeMap[1].ResolveError)
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 1 || qerr.Error != "Unable to resolve named Person." {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+
+	mutation := &proto.RGQLQueryTreeMutation{NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+		NodeId:    0,
+		Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+		Node:      data,
+	}}}
+	if err := qt.ValidateTreeMutation(mutation); err != nil {
+		t.Fatalf("Retrying an unresolved node failed validation: %v", err)
+	}
+
+	// The retry fails again while the schema is loading.
+	time.Sleep(backoff)
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	<-errCh
+	people := qt.RootNodeMap[1]
+	count, next := people.Retries()
+	if count != 1 || people.ResolveError == nil || time.Until(next) <= backoff {
+		t.Fatalf("expected one failed retry backing off, got %d until %v", count, next)
+	}
+	if len(qt.Children) != 1 {
+		t.Fatalf("expected the retried node to replace the unresolved node, got %d children", len(qt.Children))
+	}
+
+	// The schema recovered, the retry adds the node with its children.
+	atomic.StoreInt32(&resolver.fail, 0)
+	time.Sleep(time.Until(next))
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	people = qt.RootNodeMap[1]
+	if people.ResolveError != nil || people.AST == nil {
+		t.Fatalf("expected the retry to resolve the node, got %v", people.ResolveError)
+	}
+	if name, ok := qt.RootNodeMap[2]; !ok || name.Parent != people {
+		t.Fatal("expected the retry to add the children of the node")
+	}
+}
+
+func TestTypeCache(t *testing.T) {
+	qt, resolver := buildCountingTree(t)
+	if err := qt.AddChild(peopleWithHome(1)); err != nil {
+		t.Fatal(err.Error())
+	}
+	lookups := resolver.lookups
+	if lookups == 0 {
+		t.Fatal("Types were not looked up.")
+	}
+	for i := uint32(1); i <= 10; i++ {
+		if err := qt.AddChild(peopleWithHome(i * 10)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if resolver.lookups != lookups {
+		t.Fatalf("Cached types were looked up again, %d lookups after %d.", resolver.lookups, lookups)
+	}
+}
+
+func TestTypeCacheMiss(t *testing.T) {
+	qt, resolver := buildCountingTree(t)
+	resolver.misses = 1
+	data := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	}
+	if err := qt.AddChild(data); err == nil {
+		t.Fatal("Expected an error resolving the type.")
+	}
+	if err := qt.AddChild(data); err != nil {
+		t.Fatalf("Failed lookup was cached: %v", err)
+	}
+}
+
+func BenchmarkTypeCache(b *testing.B) {
+	qt, resolver := buildCountingTree(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := qt.AddChild(peopleWithHome(uint32(i*10 + 10))); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.ReportMetric(float64(resolver.lookups)/float64(b.N), "lookups/op")
+}
+
+// buildFanOutTree builds a tree with n top-level selections, returning the selection nodes.
+func buildFanOutTree(tb testing.TB, opts QueryTreeOptions, n int) (*QueryTreeNode, []*QueryTreeNode) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, opts)
+	var shards []*QueryTreeNode
+	for i := 1; i <= n; i++ {
+		err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        uint32(i),
+			FieldName: fmt.Sprintf("p%d: allPeople", i),
+			Children:  []*proto.RGQLQueryTreeNode{{Id: uint32(n + i), FieldName: "name"}},
+		})
+		if err != nil {
+			tb.Fatal(err.Error())
+		}
+		nod, _ := qt.LookupNode(uint32(i))
+		shards = append(shards, nod)
+	}
+	return qt, shards
+}
+
+// friendsSelection builds a friends selection with a unique alias.
+func friendsSelection(id uint32) *proto.RGQLQueryTreeNode {
+	return &proto.RGQLQueryTreeNode{
+		Id:        id,
+		FieldName: fmt.Sprintf("f%d: friends", id),
+		Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1, FieldName: "name"}},
+	}
+}
+
+func TestShardedLocks(t *testing.T) {
+	qt, shards := buildFanOutTree(t, QueryTreeOptions{ShardedLocks: true}, 8)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			qt.Walk(func(nod *QueryTreeNode) bool { return true })
+			qt.LookupNode(1)
+			qt.Stats()
+		}
+	}()
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(base uint32, shard *QueryTreeNode) {
+			defer wg.Done()
+			for j := uint32(0); j < 50; j++ {
+				id := base + j*2
+				if err := shard.AddChild(friendsSelection(id)); err != nil {
+					t.Error(err.Error())
+					return
+				}
+				if j%2 == 0 {
+					nod, _ := qt.LookupNode(id)
+					nod.Dispose()
+				}
+			}
+		}(uint32(1000*(i+1)), shard)
+	}
+	wg.Wait()
+	close(done)
+
+	if stats := qt.Stats(); stats.LiveNodes != 16+8*25*2 {
+		t.Fatalf("Unexpected live node count %d.", stats.LiveNodes)
+	}
+	for _, shard := range shards {
+		if len(shard.Children) != 26 {
+			t.Fatalf("Unexpected child count %d.", len(shard.Children))
+		}
+	}
+}
+
+func BenchmarkConcurrentAdds(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts QueryTreeOptions
+	}{
+		{"single", QueryTreeOptions{}},
+		{"sharded", QueryTreeOptions{ShardedLocks: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			qt, shards := buildFanOutTree(b, bench.opts, 64)
+			var shardCtr, idCtr uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine adds to its own top-level selection.
+				shard := shards[int(atomic.AddUint32(&shardCtr, 1))%len(shards)]
+				for pb.Next() {
+					id := 1000 + atomic.AddUint32(&idCtr, 2)
+					if err := shard.AddChild(friendsSelection(id)); err != nil {
+						b.Fatal(err.Error())
+					}
+					nod, _ := qt.LookupNode(id)
+					nod.Dispose()
+				}
+			})
+		})
+	}
+}
+
+// wideSelection builds an allPeople selection with n friends selections below it.
+func wideSelection(n int) *proto.RGQLQueryTreeNode {
+	nod := &proto.RGQLQueryTreeNode{Id: 1, FieldName: "allPeople"}
+	for i := 0; i < n; i++ {
+		nod.Children = append(nod.Children, friendsSelection(uint32(10+2*i)))
+	}
+	return nod
+}
+
+func TestAddWorkers(t *testing.T) {
+	seq, _ := buildFanOutTree(t, QueryTreeOptions{}, 0)
+	par, _ := buildFanOutTree(t, QueryTreeOptions{AddWorkers: 4}, 0)
+	if err := seq.AddChild(wideSelection(32)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := par.AddChild(wideSelection(32)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(seq.ToProto(), par.ToProto()) {
+		t.Fatal("expected the same tree with and without workers")
+	}
+	if seq.Stats().LiveNodes != par.Stats().LiveNodes {
+		t.Fatalf("expected %d live nodes, got %d", seq.Stats().LiveNodes, par.Stats().LiveNodes)
+	}
+
+	// An invalid selection deep in one subtree fails the whole addition.
+	bad := wideSelection(32)
+	bad.Id = 500
+	for _, child := range bad.Children {
+		child.Id += 500
+		child.Children[0].Id += 500
+	}
+	bad.Children[20].Children[0].FieldName = "nope"
+	seqErr := seq.AddChild(bad)
+	parErr := par.AddChild(bad)
+	if seqErr == nil || parErr == nil || seqErr.Error() != parErr.Error() {
+		t.Fatalf("expected the same error, got %v and %v", seqErr, parErr)
+	}
+	if _, ok := par.LookupNode(500); ok {
+		t.Fatal("expected the failed addition to be rolled back")
+	}
+
+	// Mutations are prepared the same way.
+	mutation := &proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    1,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1000,
+				FieldName: "more: friends",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 1001, FieldName: "name"}, {Id: 1002, FieldName: "nickname"}},
+			},
+		}},
+	}
+	if errs := par.ApplyTreeMutationErr(mutation); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if _, ok := par.LookupNode(1002); !ok {
+		t.Fatal("expected the mutation to add node 1002")
+	}
+}
+
+func TestDisposeCancelsAdd(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		qt, shards := buildFanOutTree(t, QueryTreeOptions{AddWorkers: 4, ShardedLocks: true}, 1)
+		people := shards[0]
+		ctx := people.Context()
+
+		data := &proto.RGQLQueryTreeNode{Id: 100, FieldName: "friends"}
+		for j := 0; j < 64; j++ {
+			data.Children = append(data.Children, friendsSelection(uint32(1000+2*j)))
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- people.AddChild(data)
+		}()
+		people.Dispose()
+		err := <-errCh
+		if err != nil && err.Error() != "Invalid node 100, parent 1 was disposed." {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ctx.Err() != context.Canceled {
+			t.Fatalf("expected the node context to be canceled, got %v", ctx.Err())
+		}
+		if n := len(qt.RootNodeMap); n != 1 {
+			t.Fatalf("expected the disposed subtree to stay removed, found %d nodes", n)
+		}
+	}
+}
+
+func BenchmarkWideAddChild(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts QueryTreeOptions
+	}{
+		{"sequential", QueryTreeOptions{}},
+		{"workers", QueryTreeOptions{AddWorkers: 4}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			qt, _ := buildFanOutTree(b, bench.opts, 0)
+			data := wideSelection(1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := qt.AddChild(data); err != nil {
+					b.Fatal(err.Error())
+				}
+				nod, _ := qt.LookupNode(1)
+				nod.Dispose()
+			}
+		})
+	}
+}
+
+func TestPoolNodes(t *testing.T) {
+	qt, shards := buildFanOutTree(t, QueryTreeOptions{PoolNodes: true}, 2)
+	if err := shards[1].AddChild(friendsSelection(100)); err != nil {
+		t.Fatal(err.Error())
+	}
+	disposed, _ := qt.LookupNode(101)
+	held, _ := qt.LookupNode(100)
+	held.Dispose()
+
+	// Failed additions are rolled back into the pool, disposed nodes are kept as they are.
+	for i := uint32(0); i < 10; i++ {
+		id := 200 + i*10
+		err := shards[1].AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: fmt.Sprintf("f%d: friends", id),
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1, FieldName: "name"}, {Id: id + 2, FieldName: "unknown"}},
+		})
+		if err == nil {
+			t.Fatal("Expected an error adding an unknown field.")
+		}
+		if err := shards[0].AddChild(friendsSelection(id + 5)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if disposed.FieldName != "name" || disposed.Parent != held || held.FieldName != "friends" || held.Parent != shards[1] {
+		t.Fatalf("Disposed node was reused: %#v", disposed)
+	}
+	if n := len(qt.RootNodeMap); n != 25 {
+		t.Fatalf("Expected 25 nodes, got %d.", n)
+	}
+	if nod, _ := qt.LookupNode(296); nod == nil || nod.FieldName != "name" || nod.Parent.Id != 295 || len(nod.Children) != 0 {
+		t.Fatalf("Node was not reset: %#v", nod)
+	}
+}
+
+func TestPoolNodesHeldNode(t *testing.T) {
+	qt, shards := buildFanOutTree(t, QueryTreeOptions{PoolNodes: true}, 1)
+	if err := shards[0].AddChild(friendsSelection(100)); err != nil {
+		t.Fatal(err.Error())
+	}
+	nod, _ := qt.LookupNode(101)
+
+	// A resolver still reads the node after it was deleted.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if nod.Id != 101 || nod.FieldName != "name" {
+				t.Error("Node held by a resolver was reused.")
+				return
+			}
+		}
+	}()
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    100,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+		}},
+	})
+	for i := uint32(0); i < 20; i++ {
+		id := 200 + i*10
+		shards[0].AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: fmt.Sprintf("f%d: friends", id),
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1, FieldName: "unknown"}},
+		})
+		if err := shards[0].AddChild(friendsSelection(id + 5)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestPoolNodesRollback(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh := make(chan *proto.RGQLQueryError, 10)
+			qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{PoolNodes: true})
+			for j := uint32(0); j < 50; j++ {
+				id := 7 + j
+				if err := qt.AddChild(&proto.RGQLQueryTreeNode{Id: id, FieldName: "nonexistent"}); err == nil {
+					t.Error("Expected an error adding an unknown field.")
+					return
+				}
+				for len(errCh) != 0 {
+					if qerr := <-errCh; qerr.QueryNodeId != id {
+						t.Errorf("Expected the error on node %d, got %d.", id, qerr.QueryNodeId)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolNodesDoubleDispose(t *testing.T) {
+	qt, shards := buildFanOutTree(t, QueryTreeOptions{PoolNodes: true}, 2)
+	if err := shards[1].AddChild(friendsSelection(100)); err != nil {
+		t.Fatal(err.Error())
+	}
+	nod, _ := qt.LookupNode(100)
+	nod.Dispose()
+	nod.Dispose()
+	if err := shards[1].AddChild(friendsSelection(110)); err != nil {
+		t.Fatal(err.Error())
+	}
+	nod.Dispose()
+	if _, ok := qt.LookupNode(110); !ok {
+		t.Fatal("Disposing a disposed node again disposed a reused node.")
+	}
+}
+
+func BenchmarkFailedAddCycle(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opts QueryTreeOptions
+	}{
+		{"alloc", QueryTreeOptions{}},
+		{"pooled", QueryTreeOptions{PoolNodes: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			_, shards := buildFanOutTree(b, bench.opts, 1)
+			data := &proto.RGQLQueryTreeNode{
+				Id:        100,
+				FieldName: "friends",
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 101, FieldName: "name"},
+					{Id: 102, FieldName: "height"},
+					{Id: 103, FieldName: "unknown"},
+				},
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := shards[0].AddChild(data); err == nil {
+					b.Fatal("Expected an error adding an unknown field.")
+				}
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{MaxDepth: 2})
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people, _ := qt.LookupNode(1)
+	err = people.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "home",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}},
+	})
+	if err == nil || err.Error() != "Invalid node 4, exceeds the maximum depth of 2." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(4); ok {
+		t.Fatal("Node exceeding the maximum depth was added.")
+	}
+	if _, ok := qt.LookupNode(2); !ok {
+		t.Fatal("Node at the maximum depth was not added.")
+	}
+	qerr := <-errCh
+	if qerr.QueryNodeId != 4 || qerr.Error != "Invalid node 4, exceeds the maximum depth of 2." {
+		t.Fatalf("Did not return expected error (%v).", qerr.Error)
+	}
+
+	err = qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    1,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        5,
+				FieldName: "home",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "name"}},
+			},
+		}},
+	})
+	if err == nil || err.Error() != "Invalid node 6, exceeds the maximum depth of 2." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestMaxNodes(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{MaxNodes: 4})
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	others := &proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "others: allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+	}
+	err = qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      others,
+		}},
+	})
+	if err == nil || err.Error() != "Invalid node 4, the tree has 4 nodes, the maximum is 4." {
+		t.Fatalf("Validation did not return expected error (%v).", err)
+	}
+	err = qt.AddChild(others)
+	if err == nil || err.Error() != "Invalid node 4, the tree has 4 nodes, the maximum is 4." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if len(qt.RootNodeMap) != 3 {
+		t.Fatalf("Rejected subtree was not cleaned up, %d nodes remain.", len(qt.RootNodeMap))
+	}
+
+	qt.RootNodeMap[1].Dispose()
+	if err := qt.AddChild(others); err != nil {
+		t.Fatalf("Subtree was rejected after nodes were deleted: %v", err)
+	}
+}
+
+func TestFieldNameMapper(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	goNames := map[string]string{"allPeople": "AllPeople", "name": "Name"}
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		FieldNameMapper: func(schemaName string) string {
+			if name, ok := goNames[schemaName]; ok {
+				return name
+			}
+			return schemaName
+		},
+	})
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "AllPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != "Invalid field AllPeople on RootQuery." {
+		t.Fatalf("Mapped name was accepted as a schema field (%v).", err)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "height"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.RootNodeMap[1]
+	if people.FieldName != "allPeople" || people.ResolverName != "AllPeople" {
+		t.Fatalf("Unexpected names %s and %s.", people.FieldName, people.ResolverName)
+	}
+	if name := qt.RootNodeMap[2].ResolverName; name != "Name" {
+		t.Fatalf("Unexpected resolver name %s.", name)
+	}
+	if name := qt.RootNodeMap[3].ResolverName; name != "height" {
+		t.Fatalf("Unmapped field has resolver name %s.", name)
+	}
+}
+
+func TestDeprecatedFields(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	people := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "nickname"},
+		},
+	}
+	expected := "Invalid node 3, field nickname on Person is deprecated (Use name)."
+
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{RejectDeprecated: true})
+	err = qt.AddChild(people)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(3); ok {
+		t.Fatal("Deprecated field was added.")
+	}
+
+	var warnings []string
+	qt = NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		OnDeprecated: func(warning error) {
+			warnings = append(warnings, warning.Error())
+		},
+	})
+	if err := qt.AddChild(people); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := qt.LookupNode(3); !ok {
+		t.Fatal("Deprecated field was not added in warn-only mode.")
+	}
+	if len(warnings) != 1 || warnings[0] != expected {
+		t.Fatalf("Unexpected warnings: %v", warnings)
+	}
+}
+
+func TestMaxTypeRecursion(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{MaxTypeRecursion: 2})
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        2,
+			FieldName: "friends",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	friends, _ := qt.LookupNode(2)
+	err = friends.AddChild(&proto.RGQLQueryTreeNode{Id: 4, FieldName: "friends"})
+	if err == nil || err.Error() != "Invalid node 4, type Person recurses more than 2 times." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(3); !ok {
+		t.Fatal("Node within the recursion bound was not added.")
+	}
+	if _, ok := qt.LookupNode(4); ok {
+		t.Fatal("Node exceeding the recursion bound was added.")
+	}
+	qerr := <-errCh
+	if qerr.QueryNodeId != 4 || qerr.Error != "Invalid node 4, type Person recurses more than 2 times." {
+		t.Fatalf("Did not return expected error (%v).", qerr.Error)
+	}
+}
+
+func TestComplexity(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		Complexity:    &ListComplexityEstimator{ListSize: 10, SizeArguments: []string{"limit"}},
+		MaxComplexity: 25,
+	})
+
+	// allPeople defaults to a limit of 10.
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c := qt.Complexity(); c != 11 {
+		t.Fatalf("Expected complexity 11, got %d.", c)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{Id: 3, FieldName: "person"})
+	if err == nil {
+		t.Fatal("Expected an error for the missing argument.")
+	}
+	<-errCh
+
+	qt.Children[0].AddChild(&proto.RGQLQueryTreeNode{Id: 4, FieldName: "height"})
+	qt.Children[0].AddChild(&proto.RGQLQueryTreeNode{
+		Id:        5,
+		FieldName: "home",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "radius"}},
+	})
+	qerr := <-errCh
+	if qerr.QueryNodeId != 5 || qerr.Error != "Invalid node 5, exceeds the maximum complexity of 25." {
+		t.Fatalf("Did not return expected error (%v).", qerr.Error)
+	}
+	if _, ok := qt.LookupNode(5); ok {
+		t.Fatal("Node exceeding the complexity budget was added.")
+	}
+	if c := qt.Complexity(); c != 21 {
+		t.Fatalf("Expected complexity 21, got %d.", c)
+	}
+
+	err = qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    1,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        5,
+					FieldName: "home",
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "radius"}},
+				},
+			},
+		},
+	})
+	if err == nil || err.Error() != "Invalid node 5, exceeds the maximum complexity of 25." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	qt.Children[0].Dispose()
+	if c := qt.Complexity(); c != 0 {
+		t.Fatalf("Expected complexity 0 after dispose, got %d.", c)
+	}
+}
+
+func TestToProto(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{{
+			Id:    1,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 30},
+		}},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 2, FieldName: "name"},
+					{
+						Id:        3,
+						FieldName: "home",
+						Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}},
+					},
+				},
+			},
+		}},
+	})
+
+	snap := qt.Children[0].ToProto()
+	if len(snap.Args) != 1 || snap.Args[0].Name != "age" || snap.Args[0].VariableId != 1 {
+		t.Fatalf("Arguments were not snapshotted: %#v", snap.Args)
+	}
+
+	// Replay onto a fresh tree.
+	_, rqt, _ := buildMockTree(t)
+	rqt.VariableStore.Put(&proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 30},
+	})
+	if err := rqt.AddChild(snap); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var compare func(a, b *QueryTreeNode)
+	compare = func(a, b *QueryTreeNode) {
+		if a.Id != b.Id || a.FieldName != b.FieldName || len(a.Children) != len(b.Children) {
+			t.Fatalf("Replayed node %d did not match.", b.Id)
+		}
+		for i := range a.Children {
+			compare(a.Children[i], b.Children[i])
+		}
+	}
+	compare(qt, rqt)
+}
+
+func TestDiffMergedSelection(t *testing.T) {
+	build := func(nodes ...*proto.RGQLQueryTreeNode) *QueryTreeNode {
+		_, qt, _ := buildMockTree(t)
+		for _, nod := range nodes {
+			if err := qt.AddChild(nod); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		return qt
+	}
+	people := func(id uint32) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: "allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1, FieldName: "name"}},
+		}
+	}
+	// The second selection is merged into the first, under its own IDs.
+	merged := build(people(1), people(3))
+	single := build(people(1))
+	if n := len(merged.Children); n != 1 {
+		t.Fatalf("Expected the selections to be merged, got %d children.", n)
+	}
+	if snap := merged.ToProto(); len(snap.Children) != 2 || snap.Children[1].Id != 3 ||
+		len(snap.Children[1].Children) != 1 || snap.Children[1].Children[0].Id != 4 {
+		t.Fatalf("Merged selection missing from the snapshot: %v", snap)
+	}
+
+	mutation := Diff(merged, single)
+	if len(mutation.NodeMutation) != 1 || mutation.NodeMutation[0].NodeId != 3 ||
+		mutation.NodeMutation[0].Operation != proto.RGQLQueryTreeMutation_SUBTREE_DELETE {
+		t.Fatalf("Unexpected mutation %v.", mutation.NodeMutation)
+	}
+	mutation = Diff(single, merged)
+	if len(mutation.NodeMutation) != 1 || mutation.NodeMutation[0].NodeId != 0 || mutation.NodeMutation[0].Node.Id != 3 {
+		t.Fatalf("Unexpected mutation %v.", mutation.NodeMutation)
+	}
+	single.ApplyTreeMutation(mutation)
+	if mutation := Diff(single, merged); len(mutation.NodeMutation) != 0 {
+		t.Fatalf("Trees differ after applying the diff: %v", mutation.NodeMutation)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	build := func(nodes ...*proto.RGQLQueryTreeNode) *QueryTreeNode {
+		_, qt, _ := buildMockTree(t)
+		for id := uint32(1); id <= 2; id++ {
+			qt.VariableStore.Put(&proto.ASTVariable{
+				Id: id,
+				Value: &proto.RGQLPrimitive{
+					Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_STRING,
+					StringValue: fmt.Sprintf("sort%d", id),
+				},
+			})
+		}
+		for _, nod := range nodes {
+			if err := qt.AddChild(nod); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		return qt
+	}
+	people := func(children ...*proto.RGQLQueryTreeNode) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{Id: 1, FieldName: "allPeople", Children: children}
+	}
+	others := func(sortVar uint32) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        4,
+			FieldName: "others: allPeople",
+			Args:      []*proto.FieldArgument{{Name: "sort", VariableId: sortVar}},
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "name"}},
+		}
+	}
+	friends := &proto.RGQLQueryTreeNode{
+		Id:        6,
+		FieldName: "friends",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 7, FieldName: "name"}},
+	}
+
+	old := build(people(&proto.RGQLQueryTreeNode{Id: 2, FieldName: "name"}, &proto.RGQLQueryTreeNode{Id: 3, FieldName: "height"}), others(1))
+	nqt := build(people(&proto.RGQLQueryTreeNode{Id: 2, FieldName: "name"}, friends), others(2))
+	mutation := Diff(old, nqt)
+
+	type op struct {
+		nodeId    uint32
+		operation proto.RGQLQueryTreeMutation_SubtreeOperation
+		childId   uint32
+	}
+	expected := []op{
+		{3, proto.RGQLQueryTreeMutation_SUBTREE_DELETE, 0},
+		{4, proto.RGQLQueryTreeMutation_SUBTREE_DELETE, 0},
+		{1, proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD, 6},
+		{0, proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD, 4},
+	}
+	if len(mutation.NodeMutation) != len(expected) {
+		t.Fatalf("Unexpected mutation %v.", mutation.NodeMutation)
+	}
+	for i, nm := range mutation.NodeMutation {
+		var childId uint32
+		if nm.Node != nil {
+			childId = nm.Node.Id
+		}
+		if (op{nm.NodeId, nm.Operation, childId}) != expected[i] {
+			t.Fatalf("Unexpected operation %d: %v.", i, nm)
+		}
+	}
+
+	// Equivalent trees built in another order give the same mutation.
+	reordered := build(others(2), people(friends, &proto.RGQLQueryTreeNode{Id: 2, FieldName: "name"}))
+	if !reflect.DeepEqual(Diff(old, reordered), mutation) {
+		t.Fatal("Diff of equivalent trees was not stable.")
+	}
+
+	if errs := old.ApplyTreeMutationErr(mutation); len(errs) != 0 {
+		t.Fatalf("Diff did not apply: %v", errs)
+	}
+	if old.String() != nqt.String() {
+		t.Fatalf("Applied diff gave\n%s\nexpected\n%s", old.String(), nqt.String())
+	}
+	if len(Diff(old, nqt).NodeMutation) != 0 {
+		t.Fatal("Diff of identical trees was not empty.")
+	}
+}
+
+func TestErrorChannelFull(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 2)
+	qt := NewQueryTree(rootQ, sch.Definitions, errCh)
+
+	var ops []*proto.RGQLQueryTreeMutation_NodeMutation
+	for i := uint32(1); i <= 10; i++ {
+		ops = append(ops, &proto.RGQLQueryTreeMutation_NodeMutation{
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      &proto.RGQLQueryTreeNode{Id: i, FieldName: "unknown"},
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{NodeMutation: ops})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Mutation blocked on the full error channel.")
+	}
+	if dropped := qt.Stats().ErrorsDropped; dropped != 8 {
+		t.Fatalf("Expected 8 dropped errors, got %d.", dropped)
+	}
+}
+
+func TestUnknownOperation(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mutation := &proto.RGQLQueryTreeMutation{NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+		NodeId:    1,
+		Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE + 1,
+		Node:      &proto.RGQLQueryTreeNode{Id: 2},
+	}}}
+	if err := qt.ValidateTreeMutation(mutation); err == nil {
+		t.Fatal("Expected an error validating an unknown operation.")
+	}
+	if errs := qt.ApplyTreeMutationErr(mutation); len(errs) != 1 || errs[0].NodeId != 1 {
+		t.Fatalf("Expected an error applying an unknown operation, got %v", errs)
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 1 {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+}
+
+func TestReparent(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "friends", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}}},
+			{Id: 5, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "radius"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        7,
+		FieldName: "others: allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 8, FieldName: "height"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people, others, friends := qt.RootNodeMap[1], qt.RootNodeMap[7], qt.RootNodeMap[3]
+	peopleSub := people.SubscribeChanges()
+	defer peopleSub.Unsubscribe()
+	othersSub := others.SubscribeChanges()
+	defer othersSub.Unsubscribe()
+	peopleChanges, othersChanges := peopleSub.Changes(), othersSub.Changes()
+
+	move := func(parentId, id uint32) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    parentId,
+				Operation: SubtreeReparent,
+				Node:      &proto.RGQLQueryTreeNode{Id: id},
+			}},
+		}
+	}
+	if err := qt.ValidateTreeMutation(move(7, 3)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if errs := qt.ApplyTreeMutationErr(move(7, 3)); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if friends.Parent != others || len(people.Children) != 2 || others.Children[1] != friends {
+		t.Fatalf("Node was not moved: %#v", friends.Parent)
+	}
+	if qt.RootNodeMap[3] != friends || qt.RootNodeMap[4].Parent != friends {
+		t.Fatal("Subtree of the moved node was not kept.")
+	}
+	select {
+	case upd := <-peopleChanges:
+		if upd.Operation != Operation_DelChild || upd.Child != friends {
+			t.Fatalf("Unexpected update on the old parent: %#v", upd)
+		}
+	default:
+		t.Fatal("Old parent was not notified.")
+	}
+	select {
+	case upd := <-othersChanges:
+		if upd.Operation != Operation_AddChild || upd.Child != friends {
+			t.Fatalf("Unexpected update on the new parent: %#v", upd)
+		}
+	default:
+		t.Fatal("New parent was not notified.")
+	}
+
+	// Planet also has a name field of type String.
+	if errs := qt.ApplyTreeMutationErr(move(5, 2)); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if nod := qt.RootNodeMap[2]; nod.Parent != qt.RootNodeMap[5] || people.Depth() != 3 {
+		t.Fatalf("Node was not moved below home: %#v", nod.Parent)
+	}
+
+	for _, tc := range []struct {
+		mutation *proto.RGQLQueryTreeMutation
+		err      string
+	}{
+		{move(5, 8), "Invalid field height on Planet."},
+		{move(3, 7), "Invalid node 7, cannot be moved below itself."},
+		{move(7, 0), "Invalid node 0, the root cannot be moved."},
+		{move(7, 42), "Invalid node ID (not found): 42"},
+	} {
+		if err := qt.ValidateTreeMutation(tc.mutation); err == nil || err.Error() != tc.err {
+			t.Fatalf("Expected validation error %q, got %v", tc.err, err)
+		}
+		errs := qt.ApplyTreeMutationErr(tc.mutation)
+		if len(errs) != 1 || errs[0].Err.Error() != tc.err {
+			t.Fatalf("Expected error %q, got %v", tc.err, errs)
+		}
+	}
+	if nod := qt.RootNodeMap[8]; nod.Parent != others {
+		t.Fatal("Node was moved by a failed mutation.")
+	}
+}
+
+func TestSetArgs(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		Complexity:    &ListComplexityEstimator{ListSize: 10, SizeArguments: []string{"limit"}},
+		MaxComplexity: 25,
+	})
+	intVar := func(id uint32, val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: val},
+		}
+	}
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{intVar(1, 5)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "limit", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			},
+		}},
+	})
+	people := qt.RootNodeMap[1]
+	if people == nil || qt.Complexity() != 6 {
+		t.Fatalf("Expected complexity 6, got %d.", qt.Complexity())
+	}
+	sub := qt.SubscribeChanges()
+	defer sub.Unsubscribe()
+	changes := sub.Changes()
+
+	setArgs := func(id uint32, args ...*proto.FieldArgument) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{
+			Variables: []*proto.ASTVariable{intVar(2, 30), intVar(3, 8)},
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    id,
+				Operation: SubtreeSetArgs,
+				Node:      &proto.RGQLQueryTreeNode{Id: id, Args: args},
+			}},
+		}
+	}
+
+	// Fetching the next page changes the limit in place.
+	next := setArgs(1, &proto.FieldArgument{Name: "limit", VariableId: 3})
+	if err := qt.ValidateTreeMutation(next); err != nil {
+		t.Fatal(err.Error())
+	}
+	if errs := qt.ApplyTreeMutationErr(next); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if qt.RootNodeMap[1] != people || qt.RootNodeMap[2].Parent != people {
+		t.Fatal("Node was recreated by setting its arguments.")
+	}
+	if limit, ok := people.ArgInt("limit"); !ok || limit != 8 {
+		t.Fatalf("Expected limit 8, got %v.", limit)
+	}
+	if c := qt.Complexity(); c != 9 {
+		t.Fatalf("Expected complexity 9, got %d.", c)
+	}
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_ArgsChanged || upd.Child != people {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Parent was not notified.")
+	}
+
+	// Arguments not given take their defaults again.
+	if errs := qt.ApplyTreeMutationErr(setArgs(1)); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if limit, ok := people.ArgInt("limit"); !ok || limit != 10 {
+		t.Fatalf("Expected the default limit, got %v.", limit)
+	}
+	<-changes
+
+	// The validator does not estimate the subtree again.
+	errs := qt.ApplyTreeMutationErr(setArgs(1, &proto.FieldArgument{Name: "limit", VariableId: 2}))
+	if len(errs) != 1 || errs[0].Err.Error() != "Invalid node 1, exceeds the maximum complexity of 25." {
+		t.Fatalf("Expected a complexity error, got %v", errs)
+	}
+	for _, tc := range []struct {
+		mutation *proto.RGQLQueryTreeMutation
+		err      string
+	}{
+		{setArgs(1, &proto.FieldArgument{Name: "count", VariableId: 2}), "Invalid argument count on field allPeople."},
+		{setArgs(1, &proto.FieldArgument{Name: "limit", VariableId: 42}), "Variable id 42 not found for argument limit."},
+		{setArgs(0), "Invalid node 0, the root has no arguments."},
+		{setArgs(42), "Invalid node ID (not found): 42"},
+	} {
+		if err := qt.ValidateTreeMutation(tc.mutation); err == nil || err.Error() != tc.err {
+			t.Fatalf("Expected validation error %q, got %v", tc.err, err)
+		}
+		errs := qt.ApplyTreeMutationErr(tc.mutation)
+		if len(errs) != 1 || errs[0].Err.Error() != tc.err {
+			t.Fatalf("Expected error %q, got %v", tc.err, errs)
+		}
+	}
+	if limit, ok := people.ArgInt("limit"); !ok || limit != 10 || qt.Complexity() != 11 {
+		t.Fatal("Arguments were changed by a failed mutation.")
+	}
+}
+
+func TestIncompleteSelections(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people, home := qt.RootNodeMap[1], qt.RootNodeMap[3]
+	sub := people.SubscribeChanges()
+	defer sub.Unsubscribe()
+	changes := sub.Changes()
+
+	deleteNodes := func(ids ...uint32) *proto.RGQLQueryTreeMutation {
+		mutation := &proto.RGQLQueryTreeMutation{}
+		for _, id := range ids {
+			mutation.NodeMutation = append(mutation.NodeMutation, &proto.RGQLQueryTreeMutation_NodeMutation{
+				NodeId:    id,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+			})
+		}
+		return mutation
+	}
+
+	// Deleting and adding back a child in one mutation keeps the node complete.
+	errs := qt.ApplyTreeMutationErr(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			deleteNodes(4).NodeMutation[0],
+			{
+				NodeId:    3,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      &proto.RGQLQueryTreeNode{Id: 5, FieldName: "name"},
+			},
+		},
+	})
+	if len(errs) != 0 || home.ResolveError != nil {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+
+	expected := "Invalid node 3, field home has no selections left."
+	if err := qt.ValidateTreeMutation(deleteNodes(5)); err == nil || err.Error() != expected {
+		t.Fatalf("Expected validation error %q, got %v", expected, err)
+	}
+	if err := qt.ValidateTreeMutation(deleteNodes(3)); err != nil {
+		t.Fatal(err.Error())
+	}
+	errs = qt.ApplyTreeMutationErr(deleteNodes(5))
+	if len(errs) != 1 || errs[0].NodeId != 3 || errs[0].Err.Error() != expected {
+		t.Fatalf("Expected error %q, got %v", expected, errs)
+	}
+	if _, ok := home.ResolveError.(*IncompleteSelectionError); !ok {
+		t.Fatalf("Node was not marked as incomplete: %v", home.ResolveError)
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 3 || qerr.Error != expected {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+
+	// Adding a child completes the node again and restarts its resolvers.
+	if err := home.AddChild(&proto.RGQLQueryTreeNode{Id: 6, FieldName: "radius"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if home.ResolveError != nil {
+		t.Fatalf("Node is still marked: %v", home.ResolveError)
+	}
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_ArgsChanged || upd.Child != home {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Parent was not notified.")
+	}
+}
+
+func TestChildrenOrder(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	people := func(id uint32, alias string) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: alias + ": allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		}
+	}
+	expectOrder := func(aliases ...string) {
+		var order []string
+		for _, child := range qt.Children {
+			order = append(order, child.Alias)
+		}
+		if !reflect.DeepEqual(order, aliases) {
+			t.Fatalf("Unexpected children order %v, expected %v.", order, aliases)
+		}
+	}
+
+	for i, alias := range []string{"a", "b", "c"} {
+		if err := qt.AddChild(people(uint32(i+1), alias)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	expectOrder("a", "b", "c")
+
+	qt.RootNodeMap[2].Dispose()
+	expectOrder("a", "c")
+	if err := qt.AddChild(people(4, "b")); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectOrder("a", "c", "b")
+
+	// Merged selections and failed adds leave the order unchanged.
+	if err := qt.AddChild(people(5, "a")); err != nil {
+		t.Fatal(err.Error())
+	}
+	qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        6,
+		FieldName: "d: allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 106, FieldName: "unknown"}},
+	})
+	expectOrder("a", "c", "b")
+}
+
+func TestIncrementalSelections(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.RootNodeMap[1]
+	qsub := people.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	err = qt.ApplyTreeMutationAtomic(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 2, FieldName: "name"},
+					{Id: 3, FieldName: "height"},
+				},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(qt.Children) != 1 || len(people.Children) != 2 || qt.RootNodeMap[3].Parent != people {
+		t.Fatal("Selection was not merged into the existing node.")
+	}
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_AddChild || upd.Child.Id != 3 {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Added selection was not delivered.")
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 4, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "radius"}}},
+			{Id: 6, FieldName: "unknown"},
+		},
+	})
+	if err == nil || err.Error() != "Invalid field unknown on Person." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(4); ok || len(people.Children) != 2 {
+		t.Fatal("Failed selection was partially added.")
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "person",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 7, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != "Invalid node ID (already exists): 1" {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id: 1,
+		Value: &proto.RGQLPrimitive{
+			Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+			IntValue: 30,
+		},
+	})
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "fullName: name"},
+			{Id: 3, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := `query {
+  allPeople(age: $1, limit: 10, sort: "name") #1 {
+    fullName: name #2 <String>
+    home #3 {
+      radius #4 <Int>
+    }
+  }
+}
+`
+	if str := qt.String(); str != expected {
+		t.Fatalf("Unexpected rendering:\n%s", str)
+	}
+	if str := qt.Children[0].Children[1].String(); str != "home #3 {\n  radius #4 <Int>\n}\n" {
+		t.Fatalf("Unexpected subtree rendering:\n%s", str)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "fullName: name"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data, err := json.Marshal(qt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := `{"id":0,"isPrimitive":false,"children":[` +
+		`{"id":1,"fieldName":"allPeople","isPrimitive":false,"arguments":["limit","sort"],"children":[` +
+		`{"id":2,"fieldName":"name","alias":"fullName","isPrimitive":true,"primitiveName":"String"}]}]}`
+	if string(data) != expected {
+		t.Fatalf("Unexpected JSON: %s", data)
+	}
+}
+
+func TestListFields(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "friends", Children: []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}}},
+			{Id: 4, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "radius"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        6,
+		FieldName: "person",
+		Args:      []*proto.FieldArgument{{Name: "name: \"Ada\""}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 7, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, tc := range []struct {
+		id        uint32
+		isList    bool
+		listDepth int
+	}{
+		{1, true, 1},
+		{2, true, 1},
+		{3, false, 0},
+		{4, false, 0},
+		{6, false, 0},
+	} {
+		nod := qt.RootNodeMap[tc.id]
+		if nod.IsList != tc.isList || nod.ListDepth != tc.listDepth {
+			t.Fatalf("Expected node %d list %v of depth %d, got %v of depth %d.",
+				tc.id, tc.isList, tc.listDepth, nod.IsList, nod.ListDepth)
+		}
+		if def, depth, _ := nod.ResolvedType(); depth != tc.listDepth || def != nod.AST {
+			t.Fatalf("Unexpected resolved type of node %d: %v of depth %d", tc.id, def, depth)
+		}
+	}
+	if people := qt.RootNodeMap[1]; people.AST != qt.RootNodeMap[6].AST {
+		t.Fatal("List node does not select on the element type.")
+	}
+}
+
+func TestNestedLists(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        2,
+				FieldName: "friendGroups",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+			},
+			{Id: 4, FieldName: "nameCube"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	groups := qt.RootNodeMap[2]
+	if !groups.IsList || groups.ListDepth != 2 || groups.IsPrimitive {
+		t.Fatalf("Unexpected two-level list node: %#v", groups)
+	}
+	if name := qt.RootNodeMap[3]; !name.IsPrimitive || name.ListDepth != 0 {
+		t.Fatalf("Unexpected node selected from nested lists: %#v", name)
+	}
+	cube := qt.RootNodeMap[4]
+	if !cube.IsList || cube.ListDepth != 3 || !cube.IsPrimitive || cube.PrimitiveName != "String" {
+		t.Fatalf("Unexpected three-level list node: %#v", cube)
+	}
+	if str := cube.String(); str != "nameCube #4 <[[[String]]]>\n" {
+		t.Fatalf("Unexpected rendering: %s", str)
+	}
+}
+
+func TestResolvedType(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        2,
+				FieldName: "friendGroups",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+			},
+			{Id: 4, FieldName: "nameCube"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, c := range []struct {
+		id        uint32
+		typeName  string
+		listDepth int
+		nonNull   bool
+	}{
+		{1, "Person", 1, false},
+		{2, "Person", 2, true},
+		{3, "", 0, false},
+		{4, "", 3, false},
+	} {
+		def, listDepth, nonNull := qt.RootNodeMap[c.id].ResolvedType()
+		typeName := ""
+		if def != nil {
+			typeName = def.(*ast.ObjectDefinition).Name.Value
+		}
+		if typeName != c.typeName || listDepth != c.listDepth || nonNull != c.nonNull {
+			t.Fatalf("node %d: expected %q %d %v, got %q %d %v",
+				c.id, c.typeName, c.listDepth, c.nonNull, typeName, listDepth, nonNull)
+		}
+	}
+	if def, listDepth, nonNull := qt.ResolvedType(); def != qt.AST || listDepth != 0 || nonNull {
+		t.Fatal("expected the root to resolve to the root type")
+	}
+}
+
+func TestResultShape(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "height"},
+			{
+				Id:        4,
+				FieldName: "friendGroups",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "nick: name"}},
+			},
+			{Id: 6, FieldName: "nameCube"},
+			{Id: 7, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 8, FieldName: "radius"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]interface{}{
+		"allPeople": []interface{}{map[string]interface{}{
+			"name":         "String",
+			"height":       "Int",
+			"friendGroups": []interface{}{[]interface{}{map[string]interface{}{"nick": "String"}}},
+			"nameCube":     []interface{}{[]interface{}{[]interface{}{"String"}}},
+			"home":         map[string]interface{}{"radius": "Int"},
+		}},
+	}
+	if shape := qt.ResultShape(); !reflect.DeepEqual(shape, expected) {
+		t.Fatalf("Unexpected shape %#v.", shape)
+	}
+	if shape := qt.RootNodeMap[7].ResultShape(); !reflect.DeepEqual(shape, expected["allPeople"].([]interface{})[0].(map[string]interface{})["home"]) {
+		t.Fatalf("Unexpected subtree shape %#v.", shape)
+	}
+
+	// Inline fragments are merged into the object they narrow.
+	sch, err := schema.Parse(abstractSchemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	qt = NewQueryTree(rootQ, sch.Definitions, make(chan *proto.RGQLQueryError, 10))
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "search",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "__typename"},
+			{Id: 3, FieldName: "... on Human", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "height"}}},
+			{Id: 5, FieldName: "... on Droid", Children: []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "primaryFunction"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected = map[string]interface{}{
+		"search": []interface{}{map[string]interface{}{
+			"__typename":      "String",
+			"height":          "Int",
+			"primaryFunction": "String",
+		}},
+	}
+	if shape := qt.ResultShape(); !reflect.DeepEqual(shape, expected) {
+		t.Fatalf("Unexpected shape %#v.", shape)
+	}
+}
+
+func TestPath(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        2,
+			FieldName: "friends",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if p := qt.Path(); len(p) != 0 {
+		t.Fatalf("Expected an empty root path, got %v.", p)
+	}
+	p := qt.RootNodeMap[3].Path()
+	if len(p) != 3 || p[0] != "allPeople" || p[1] != "friends" || p[2] != "name" {
+		t.Fatalf("Unexpected path %v.", p)
+	}
+}
+
+func TestPrimitivePaths(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{
+				Id:        3,
+				FieldName: "friends",
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 4, FieldName: "nick: name"},
+					{Id: 5, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "radius"}}},
+				},
+			},
+			{Id: 7, FieldName: "nameCube"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := [][]string{
+		{"allPeople", "name"},
+		{"allPeople", "friends", "nick"},
+		{"allPeople", "friends", "home", "radius"},
+		{"allPeople", "nameCube"},
+	}
+	if paths := qt.PrimitivePaths(); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Unexpected paths %v.", paths)
+	}
+	if paths := qt.RootNodeMap[5].PrimitivePaths(); !reflect.DeepEqual(paths, expected[2:3]) {
+		t.Fatalf("Unexpected subtree paths %v.", paths)
+	}
+}
+
+func TestFindByPath(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	friends := func(id uint32) []*proto.RGQLQueryTreeNode {
+		return []*proto.RGQLQueryTreeNode{{
+			Id:        id,
+			FieldName: "friends",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 1, FieldName: "name"}},
+		}}
+	}
+	for _, data := range []*proto.RGQLQueryTreeNode{
+		{Id: 1, FieldName: "allPeople", Children: friends(2)},
+		{Id: 4, FieldName: "others: allPeople", Children: friends(5)},
+	} {
+		if err := qt.AddChild(data); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	found := qt.FindByPath([]string{"allPeople", "friends"})
+	if len(found) != 2 || found[0].Id != 2 || found[1].Id != 5 {
+		t.Fatalf("Unexpected nodes %v.", found)
+	}
+	if found := qt.RootNodeMap[4].FindByPath([]string{"friends", "name"}); len(found) != 1 || found[0].Id != 6 {
+		t.Fatalf("Unexpected nodes %v.", found)
+	}
+	if found := qt.FindByPath(nil); len(found) != 1 || found[0] != qt {
+		t.Fatalf("Expected the empty path to match the receiver, got %v.", found)
+	}
+	if found := qt.FindByPath([]string{"others"}); len(found) != 0 {
+		t.Fatalf("Expected aliases not to match, got %v.", found)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        2,
+				FieldName: "home",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "radius"}},
+			},
+			{Id: 4, FieldName: "name"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var visited []uint32
+	qt.Walk(func(nod *QueryTreeNode) bool {
+		visited = append(visited, nod.Id)
+		return nod.FieldName != "home"
+	})
+	if len(visited) != 4 || visited[0] != 0 || visited[1] != 1 || visited[2] != 2 || visited[3] != 4 {
+		t.Fatalf("Unexpected walk order %v.", visited)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	qt, shards := buildFanOutTree(t, QueryTreeOptions{ShardedLocks: true}, 4)
+	if nodes := qt.Nodes(); len(nodes) != 9 || nodes[0] != qt || nodes[1] != shards[0] {
+		t.Fatalf("Unexpected nodes %v.", nodes)
+	}
+
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(base uint32, shard *QueryTreeNode) {
+			defer wg.Done()
+			for j := uint32(0); j < 50; j++ {
+				if err := shard.AddChild(friendsSelection(base + j*2)); err != nil {
+					t.Error(err.Error())
+					return
+				}
+			}
+		}(uint32(1000*(i+1)), shard)
+	}
+	for i := 0; i < 20; i++ {
+		nodes := qt.Nodes()
+		for j := 1; j < len(nodes); j++ {
+			if nodes[j-1].Id >= nodes[j].Id {
+				t.Fatalf("Nodes not ordered by ID: %d, %d.", nodes[j-1].Id, nodes[j].Id)
+			}
+		}
+	}
+	wg.Wait()
+
+	nodes := qt.Nodes()
+	if stats := qt.Stats(); len(nodes) != stats.LiveNodes+1 {
+		t.Fatalf("Expected %d nodes, got %d.", stats.LiveNodes+1, len(nodes))
+	}
+	shards[0].Dispose()
+	if len(nodes) != 9+4*50*2 {
+		t.Fatal("Snapshot was changed by a mutation.")
+	}
+	if len(qt.Nodes()) != len(nodes)-2-50*2 {
+		t.Fatal("Disposed nodes were returned.")
+	}
+}
+
+func TestTreeManager(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	mgr := NewTreeManager(rootQ, sch.Definitions, errCh, QueryTreeOptions{MaxDepth: 3})
+
+	var wg sync.WaitGroup
+	trees := make([]*QueryTreeNode, 4)
+	for i := range trees {
+		trees[i] = mgr.NewTree()
+		wg.Add(1)
+		go func(nqt *QueryTreeNode) {
+			defer wg.Done()
+			if err := nqt.AddChild(&proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			}); err != nil {
+				t.Error(err.Error())
+			}
+		}(trees[i])
+	}
+	wg.Wait()
+	if mgr.Len() != 4 {
+		t.Fatalf("Expected 4 trees, got %d.", mgr.Len())
+	}
+	if stats := mgr.Stats(); stats.LiveNodes != 8 || stats.NodesAdded != 8 {
+		t.Fatalf("Unexpected aggregate stats %#v.", stats)
+	}
+
+	// Trees keep their own options and error channels.
+	clientErrCh := make(chan *proto.RGQLQueryError, 10)
+	client := mgr.NewTreeWithErrors(clientErrCh)
+	deep := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        2,
+			FieldName: "friends",
+			Children: []*proto.RGQLQueryTreeNode{{
+				Id:        3,
+				FieldName: "friends",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+			}},
+		}},
+	}
+	if err := client.AddChild(deep); err == nil {
+		t.Fatal("Expected the depth limit to apply.")
+	}
+	select {
+	case <-clientErrCh:
+	default:
+		t.Fatal("Error was not sent to the client channel.")
+	}
+	if len(errCh) != 0 {
+		t.Fatal("Error was sent to the manager channel.")
+	}
+
+	trees[0].Dispose()
+	if mgr.Len() != 4 || mgr.Stats().LiveNodes != 6 {
+		t.Fatal("Disposed tree was still tracked.")
+	}
+	mgr.DisposeAll()
+	if mgr.Len() != 0 || len(mgr.Trees()) != 0 {
+		t.Fatal("Trees were still tracked.")
+	}
+	for _, nqt := range append(trees, client) {
+		select {
+		case <-nqt.Done():
+		default:
+			t.Fatal("Tree was not disposed.")
+		}
+	}
+}
+
+func TestFieldAliases(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	stringVariable := func(id uint32, val string) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: val},
+		}
+	}
+	qt.VariableStore.Put(stringVariable(1, "Luke"))
+	qt.VariableStore.Put(stringVariable(2, "Leia"))
+
+	for i, alias := range []string{"us", "them"} {
+		err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        uint32(i + 1),
+			FieldName: alias + ": person",
+			Args:      []*proto.FieldArgument{{Name: "name", VariableId: uint32(i + 1)}},
+			Children:  []*proto.RGQLQueryTreeNode{{Id: uint32(i + 10), FieldName: "n: name"}},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	us, them := qt.RootNodeMap[1], qt.RootNodeMap[2]
+	if us.FieldName != "person" || us.Alias != "us" || them.Alias != "them" {
+		t.Fatalf("Aliases were not recorded: %q %q", us.Alias, them.Alias)
+	}
+	if us.Arguments["name"].Value != "Luke" || them.Arguments["name"].Value != "Leia" {
+		t.Fatal("Aliased fields did not keep their own arguments.")
+	}
+	if p := qt.RootNodeMap[10].Path(); len(p) != 2 || p[0] != "us" || p[1] != "n" {
+		t.Fatalf("Unexpected path %v.", p)
+	}
+	if snap := them.ToProto(); snap.FieldName != "them: person" {
+		t.Fatalf("Alias was not snapshotted: %q", snap.FieldName)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	sch, qt, _ := buildMockTree(t)
+	introspectionQuery := func(qt *QueryTreeNode) error {
+		return qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        1,
+			FieldName: "__schema",
+			Children: []*proto.RGQLQueryTreeNode{{
+				Id:        2,
+				FieldName: "queryType",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+			}},
+		})
+	}
+	if err := introspectionQuery(qt); err != nil {
+		t.Fatal(err.Error())
+	}
+	if nod := qt.RootNodeMap[3]; nod == nil || nod.ResolveError != nil || !nod.IsPrimitive {
+		t.Fatalf("Introspection field was not resolved: %#v", nod)
+	}
+
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	dqt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{DisableIntrospection: true})
+	err := introspectionQuery(dqt)
+	if err == nil || err.Error() != "Invalid field __schema, introspection is disabled." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "__typename",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nod := qt.Children[0]
+	if !nod.IsPrimitive || nod.PrimitiveName != "String" {
+		t.Fatalf("__typename was not resolved as a primitive String: %#v", nod)
+	}
+}
+
+func TestCustomScalars(t *testing.T) {
+	types.RegisterScalar("DateTime", &types.Scalar{
+		Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING,
+		Coerce: func(value interface{}) (interface{}, error) {
+			str, ok := value.(string)
+			if !ok {
+				return nil, errors.New("expected a string")
+			}
+			return time.Parse(time.RFC3339, str)
+		},
+	})
+
+	_, qt, _ := buildMockTree(t)
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "2017-01-02T15:04:05Z"},
+	})
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    2,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 5},
+	})
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 100, FieldName: "name"}},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.Children[0]
+
+	err := people.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        2,
+		FieldName: "born",
+		Args:      []*proto.FieldArgument{{Name: "after", VariableId: 1}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	born := qt.RootNodeMap[2]
+	if !born.IsPrimitive || born.PrimitiveName != "DateTime" {
+		t.Fatalf("Custom scalar was not resolved as a primitive: %#v", born)
+	}
+	if _, ok := born.Arguments["after"].Value.(time.Time); !ok {
+		t.Fatalf("Custom scalar argument was not coerced: %#v", born.Arguments["after"].Value)
+	}
+
+	err = people.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "born",
+		Args:      []*proto.FieldArgument{{Name: "after", VariableId: 2}},
+	})
+	if err == nil || err.Error() != "Invalid value for argument after on field born: Invalid DateTime: expected a string" {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        2,
+				FieldName: "names",
+			},
+		},
+	})
+	var err error
+	select {
+	case e := <-errCh:
+		err = errors.New(e.Error)
+	default:
+	}
+	if err == nil || err.Error() != "Invalid field names on Person." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	select {
+	case e := <-errCh:
+		err = errors.New(e.Error)
+	default:
+	}
+	if err == nil || err.Error() != "Invalid node 1, descendant 2 failed: Invalid field names on Person." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	if len(qt.RootNodeMap) != 1 || len(qt.Children) != 0 {
+		t.Fatal("Failed subtree was retained in the tree.")
+	}
+}
+
+func TestMergeSiblings(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 4, FieldName: "name"},
+			{Id: 5, FieldName: "height"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(qt.Children) != 1 {
+		t.Fatalf("Expected one merged child, got %d.", len(qt.Children))
+	}
+	people := qt.Children[0]
+	if c := people.RefCount(); c != 2 {
+		t.Fatalf("Expected refcount 2, got %d.", c)
+	}
+	if nod, _ := qt.LookupNode(3); nod != people {
+		t.Fatal("Duplicate selection was not merged.")
+	}
+	if len(people.Children) != 2 || people.Children[0].RefCount() != 2 {
+		t.Fatalf("Children were not merged: %d children.", len(people.Children))
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        6,
+		FieldName: "others: allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 7, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(qt.Children) != 2 {
+		t.Fatal("Selection with a different alias was merged.")
+	}
+
+	deleteNode := func(id uint32) {
+		qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    id,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+			}},
+		})
+	}
+
+	// Deleting the second selection drops the children added with it.
+	deleteNode(3)
+	if _, ok := qt.LookupNode(1); !ok || people.RefCount() != 1 {
+		t.Fatal("Node was disposed while still referenced.")
+	}
+	if _, ok := qt.LookupNode(5); ok {
+		t.Fatal("Child of the deleted selection was retained.")
+	}
+	if nod, ok := qt.LookupNode(2); !ok || nod.RefCount() != 1 {
+		t.Fatal("Shared child was not released.")
+	}
+
+	deleteNode(1)
+	if _, ok := qt.LookupNode(2); ok {
+		t.Fatal("Node was retained after the last reference was deleted.")
+	}
+	if len(qt.Children) != 1 {
+		t.Fatalf("Expected one child after deletes, got %d.", len(qt.Children))
+	}
+}
+
+func TestFailedSubtreeRollback(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	size := len(qt.RootNodeMap)
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 4, FieldName: "name"},
+			{
+				Id:        5,
+				FieldName: "friends",
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 6, FieldName: "name"},
+					{
+						Id:        7,
+						FieldName: "home",
+						Children: []*proto.RGQLQueryTreeNode{
+							{Id: 8, FieldName: "name"},
+							{Id: 9, FieldName: "mass"},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err == nil || err.Error() != "Invalid field mass on Planet." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if len(qt.RootNodeMap) != size {
+		t.Fatalf("Expected %d nodes after the failed add, got %d.", size, len(qt.RootNodeMap))
+	}
+	if len(qt.Children) != 1 {
+		t.Fatalf("Expected 1 child after the failed add, got %d.", len(qt.Children))
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        2,
+			FieldName: "friends",
+			Children: []*proto.RGQLQueryTreeNode{
+				{Id: 3, FieldName: "best: names"},
+			},
+		}},
+	})
+	qerr, ok := err.(*QTError)
+	if !ok {
+		t.Fatalf("Expected a structured error, got %#v.", err)
+	}
+	if qerr.Message != "Invalid field names on Person." || !reflect.DeepEqual(qerr.Path, []string{"allPeople", "friends", "best"}) {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+	dat, err := json.Marshal(qerr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := `{"message":"Invalid field names on Person.","path":["allPeople","friends","best"],"extensions":{"nodeId":3}}`
+	if string(dat) != expected {
+		t.Fatalf("Unexpected error encoding: %s", dat)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{Id: 4, FieldName: "luke: person"})
+	if qerr, ok := err.(*QTError); !ok || qerr.Message != "Missing required argument name on field person." || !reflect.DeepEqual(qerr.Path, []string{"luke"}) {
+		t.Fatalf("Did not return expected error (%#v).", err)
+	}
+}
+
+func TestLeafSelections(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        2,
+			FieldName: "name",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "length"}},
+		}},
+	})
+	if err == nil || err.Error() != "Invalid node 2, field name of leaf type String cannot have selections." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "height", Children: []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "value"}}},
+		},
+	})
+	if err == nil || err.Error() != "Invalid node 2, field height of leaf type Int cannot have selections." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{Id: 1, FieldName: "allPeople"})
+	if err == nil || err.Error() != "Invalid node 1, field allPeople of type [Person] must have selections." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if len(qt.RootNodeMap) != 1 {
+		t.Fatal("Invalid selection was added to the tree.")
+	}
+
+	err = qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "home"}},
+			},
+		}},
+	})
+	if err == nil || err.Error() != "Invalid node 2, field home of type Planet must have selections." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestArgumentErrors(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id: 1,
+		Value: &proto.RGQLPrimitive{
+			Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+			IntValue: 30,
+		},
+	})
+
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "height", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 10, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != "Invalid argument height on field allPeople." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        2,
+		FieldName: "person",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 11, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != "Missing required argument name on field person." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestDefaultArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "height"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	people := qt.Children[0]
+	if ref := people.Arguments["limit"]; ref == nil || !ref.IsConstant() || ref.Value != int32(10) {
+		t.Fatalf("Int default was not applied: %#v", ref)
+	}
+	if ref := people.Arguments["sort"]; ref == nil || ref.Value != "name" {
+		t.Fatalf("String default was not applied: %#v", ref)
+	}
+	if _, ok := people.Arguments["age"]; ok {
+		t.Fatal("Argument without a default was applied.")
+	}
+	if ref := people.Children[0].Arguments["unit"]; ref == nil || ref.Value != "METER" {
+		t.Fatalf("Enum default was not applied: %#v", ref)
+	}
+}
+
+func TestInlineArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args: []*proto.FieldArgument{
+			{Name: "age: 30"},
+			{Name: "sort: \"age\""},
+		},
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "height", Args: []*proto.FieldArgument{{Name: "unit: FOOT"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	people := qt.Children[0]
+	if age, ok := people.ArgInt("age"); !ok || age != 30 {
+		t.Fatalf("Inline Int argument was not applied: %d", age)
+	}
+	if sort, ok := people.ArgString("sort"); !ok || sort != "age" {
+		t.Fatalf("Inline String argument was not applied: %s", sort)
+	}
+	if vals := people.Children[0].ArgumentValues(); vals["unit"] != "FOOT" {
+		t.Fatalf("Inline enum argument was not applied: %#v", vals)
+	}
+	if len(qt.VariableStore.Variables) != 0 {
+		t.Fatalf("Inline arguments referenced variables: %#v", qt.VariableStore.Variables)
+	}
+
+	nod := qt.ToProto()
+	if args := nod.Children[0].Children[0].Args; len(args) != 1 || args[0].Name != "unit: FOOT" {
+		t.Fatalf("Inline argument was not kept in the snapshot: %#v", args)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "age: \"old\""}},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid value for argument age on field allPeople:") {
+		t.Fatalf("Expected an invalid inline value error, got %v", err)
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        4,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: `@skip: "yes"`}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != `Invalid value for directive @skip: Expected Boolean, got "yes".` {
+		t.Fatalf("Expected an invalid inline directive error, got %v", err)
+	}
+}
+
+func TestArgumentValues(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	ageVariable := func(age int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id: 1,
+			Value: &proto.RGQLPrimitive{
+				Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+				IntValue: age,
+			},
+		}
+	}
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{ageVariable(30)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+				},
+			},
+		},
+	})
+
+	people := qt.Children[0]
+	values := people.ArgumentValues()
+	expected := map[string]interface{}{"age": int32(30), "limit": int32(10), "sort": "name"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Unexpected argument values: %#v", values)
+	}
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{ageVariable(40)},
+	})
+	if age := people.ArgumentValues()["age"]; age != int32(40) {
+		t.Fatalf("Argument values were not updated: %#v", age)
+	}
+	if values["age"] != int32(30) {
+		t.Fatal("Argument value snapshot was modified.")
+	}
+}
+
+func TestReferencedVariables(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{
+			{Id: 1, Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 30}},
+			{Id: 2, Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "FOOT"}},
+			{Id: 3, Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_BOOL, BoolValue: true}},
+		},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+					Children: []*proto.RGQLQueryTreeNode{
+						{Id: 2, FieldName: "height", Args: []*proto.FieldArgument{{Name: "unit", VariableId: 2}}},
+						{Id: 3, FieldName: "name", Args: []*proto.FieldArgument{{Name: "@include", VariableId: 3}}},
+					},
+				},
+			},
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        4,
+					FieldName: "others: allPeople",
+					Args:      []*proto.FieldArgument{{Name: "age: 20"}},
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "height"}},
+				},
+			},
+		},
+	})
+
+	expected := map[uint32]struct{}{1: {}, 2: {}, 3: {}}
+	if ids := qt.ReferencedVariables(); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Unexpected referenced variables: %#v", ids)
+	}
+	if ids := qt.RootNodeMap[2].ReferencedVariables(); !reflect.DeepEqual(ids, map[uint32]struct{}{2: {}}) {
+		t.Fatalf("Unexpected referenced variables of height: %#v", ids)
+	}
+	if ids := qt.RootNodeMap[4].ReferencedVariables(); len(ids) != 0 {
+		t.Fatalf("Constants were reported as referenced variables: %#v", ids)
+	}
+}
+
+func TestTypedArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id: 1,
+		Value: &proto.RGQLPrimitive{
+			Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+			IntValue: 30,
+		},
+	})
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "planets",
+		Args:      []*proto.FieldArgument{{Name: "minRadius", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	people := qt.RootNodeMap[1]
+	if age, ok := people.ArgInt("age"); !ok || age != 30 {
+		t.Fatalf("Unexpected int argument: %v %v", age, ok)
+	}
+	if sort, ok := people.ArgString("sort"); !ok || sort != "name" {
+		t.Fatalf("Unexpected default string argument: %v %v", sort, ok)
+	}
+	if _, ok := people.ArgInt("sort"); ok {
+		t.Fatal("String argument was returned as an int.")
+	}
+	if _, ok := people.ArgBool("age"); ok {
+		t.Fatal("Int argument was returned as a bool.")
+	}
+	if _, ok := people.ArgString("missing"); ok {
+		t.Fatal("Missing argument was returned.")
+	}
+
+	planets := qt.RootNodeMap[3]
+	if radius, ok := planets.ArgFloat("minRadius"); !ok || radius != 30 {
+		t.Fatalf("Unexpected float argument: %v %v", radius, ok)
+	}
+	if radius, ok := planets.ArgInt("minRadius"); !ok || radius != 30 {
+		t.Fatalf("Integral float argument was not returned as an int: %v %v", radius, ok)
+	}
+}
+
+func TestVariableDefaults(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	intVariable := func(id uint32, val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id: id,
+			Value: &proto.RGQLPrimitive{
+				Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+				IntValue: val,
+			},
+		}
+	}
+	qt.VariableStore.PutDefault(intVariable(1, 20))
+	if val, ok := qt.VariableStore.Value(1); !ok || val != int32(20) {
+		t.Fatalf("Unexpected default value: %#v", val)
+	}
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			},
+		}},
+	})
+	people, ok := qt.LookupNode(1)
+	if !ok {
+		t.Fatal("Node referencing a defaulted variable was not added.")
+	}
+	if age, _ := people.ArgInt("age"); age != 20 {
+		t.Fatalf("Default was not applied: %v", age)
+	}
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{intVariable(1, 40)},
+	})
+	if age, _ := people.ArgInt("age"); age != 40 {
+		t.Fatalf("Explicit value did not replace the default: %v", age)
+	}
+}
+
+func TestInvalidMutationVariables(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTree(rootQ, sch.Definitions, errCh)
+	qt.VariableStore.DeclareType(1, &ast.NonNull{Type: &ast.Named{Name: &ast.Name{Value: "Int"}}})
+
+	errs := qt.ApplyTreeMutationErr(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{{
+			Id: 1,
+			Value: &proto.RGQLPrimitive{
+				Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_STRING,
+				StringValue: "thirty",
+			},
+		}},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+				},
+			},
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        3,
+					FieldName: "others: allPeople",
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+				},
+			},
+		},
+	})
+	if len(errs) != 2 {
+		t.Fatalf("Expected an error for each node operation, got %v", errs)
+	}
+	if errs[0].NodeId != 0 || errs[0].Error() != `Invalid value for variable 1 of type Int!: Expected Int, got "thirty".` {
+		t.Fatalf("Unexpected error: %v", errs[0])
+	}
+	if len(qt.Children) != 0 {
+		t.Fatal("Node operations were applied with an invalid variable.")
+	}
+	if qt.VariableStore.Has(1) {
+		t.Fatal("Invalid variable value was stored.")
+	}
+	if len(errCh) != 2 {
+		t.Fatalf("Expected 2 errors to be reported, got %d.", len(errCh))
+	}
+	for len(errCh) != 0 {
+		<-errCh
+	}
+
+	if _, err := qt.VariableStore.TryPut(&proto.ASTVariable{Id: 1}); err == nil {
+		t.Fatal("Missing value for a non-null variable was accepted.")
+	}
+	changed, err := qt.VariableStore.TryPut(&proto.ASTVariable{
+		Id: 1,
+		Value: &proto.RGQLPrimitive{
+			Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+			IntValue: 30,
+		},
+	})
+	if err != nil || changed {
+		t.Fatalf("Valid variable was rejected: %v", err)
+	}
+}
+
+func TestLeakedVariables(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{{
+			Id: 1,
+			Value: &proto.RGQLPrimitive{
+				Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+				IntValue: 30,
+			},
+		}},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+				},
+			},
+		},
+	})
+	if leaked := qt.VariableStore.Leaked(); len(leaked) != 0 {
+		t.Fatalf("Unexpected leaked variables with a live node: %v", leaked)
+	}
+
+	qt.Children[0].Dispose()
+	if leaked := qt.VariableStore.Leaked(); len(leaked) != 0 {
+		t.Fatalf("Unexpected leaked variables after dispose: %v", leaked)
+	}
+
+	ref := qt.VariableStore.Get(1)
+	if leaked := qt.VariableStore.Leaked(); len(leaked) != 1 || leaked[0] != 1 {
+		t.Fatalf("Reference not held by the tree was not reported: %v", leaked)
+	}
+	ref.Unsubscribe()
+	if leaked := qt.VariableStore.Leaked(); len(leaked) != 0 {
+		t.Fatalf("Unexpected leaked variables after unsubscribe: %v", leaked)
+	}
+}
+
+func TestClone(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	ageVariable := func(age int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id: 1,
+			Value: &proto.RGQLPrimitive{
+				Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+				IntValue: age,
+			},
+		}
+	}
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{ageVariable(30)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+				},
+			},
+		},
+	})
+
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	clone := qt.CloneWithOptions(CloneOptions{CopyVariables: true, ErrorCh: errCh})
+	if clone.String() != qt.String() {
+		t.Fatalf("Clone does not match the original:\n%s", clone.String())
+	}
+	if clone.VariableStore == qt.VariableStore || clone.Children[0] == qt.Children[0] {
+		t.Fatal("Clone shares state with the original.")
+	}
+	if nod, ok := clone.LookupNode(2); !ok || nod.Parent != clone.Children[0] || nod.Root != clone {
+		t.Fatalf("Clone node map does not point at the cloned nodes: %#v", nod)
+	}
+
+	clone.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{ageVariable(40)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    1,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      &proto.RGQLQueryTreeNode{Id: 3, FieldName: "height"},
+			},
+		},
+	})
+	if age := clone.Children[0].ArgumentValues()["age"]; age != int32(40) {
+		t.Fatalf("Clone argument was not updated: %#v", age)
+	}
+	if age := qt.Children[0].ArgumentValues()["age"]; age != int32(30) {
+		t.Fatalf("Original argument was modified: %#v", age)
+	}
+	if _, ok := qt.LookupNode(3); ok || qt.Size() != 3 || clone.Size() != 4 {
+		t.Fatal("Mutating the clone modified the original.")
+	}
+
+	shared := qt.Clone()
+	if shared.VariableStore != qt.VariableStore {
+		t.Fatal("Clone does not share the variable store.")
+	}
+	shared.Dispose()
+	if leaked := qt.VariableStore.Leaked(); len(leaked) != 0 {
+		t.Fatalf("Disposed clone leaked variables: %v", leaked)
+	}
+}
+
+func TestArgumentCoercion(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 5},
+	})
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    2,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "Earth"},
+	})
+
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "age", VariableId: 2}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 10, FieldName: "name"}},
+	})
+	expected := "Invalid value for argument age on field allPeople: Expected Int, got \"Earth\"."
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        2,
+		FieldName: "planets",
+		Args: []*proto.FieldArgument{
+			{Name: "minRadius", VariableId: 1},
+			{Name: "names", VariableId: 2},
+		},
+		Children: []*proto.RGQLQueryTreeNode{{Id: 11, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	planets := qt.RootNodeMap[2]
+	if planets.Arguments["minRadius"].Value != float64(5) {
+		t.Fatalf("Int was not promoted to Float: %#v", planets.Arguments["minRadius"].Value)
+	}
+	names, ok := planets.Arguments["names"].Value.([]interface{})
+	if !ok || len(names) != 1 || names[0] != "Earth" {
+		t.Fatalf("Value was not wrapped into a list: %#v", planets.Arguments["names"].Value)
+	}
+}
+
+func TestIDArgumentCoercion(t *testing.T) {
+	sch, err := schema.Parse(`
+type Person {
+	name: String
+}
+
+input PersonFilter {
+	id: ID
+}
+
+type RootQuery {
+	node(id: ID!): Person
+	nodes(ids: [ID!]): [Person]
+	findPeople(filter: PersonFilter!): [Person]
+}
+
+schema {
+	query: RootQuery
+}
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	qt := NewQueryTree(rootQ, sch.Definitions, make(chan *proto.RGQLQueryError, 10))
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 42},
+	})
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    2,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "person-7"},
+	})
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    3,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT, StringValue: `{"id": 9}`},
+	})
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    4,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_FLOAT, FloatValue: 1.5},
+	})
+	add := func(id uint32, fieldName string, args ...*proto.FieldArgument) error {
+		return qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: fieldName,
+			Args:      args,
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		})
+	}
+
+	for _, test := range []struct {
+		alias    string
+		variable uint32
+		expected string
+	}{
+		{"byInt", 1, "42"},
+		{"byString", 2, "person-7"},
+	} {
+		id := uint32(len(qt.Children) + 1)
+		if err := add(id, test.alias+": node", &proto.FieldArgument{Name: "id", VariableId: test.variable}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if val := qt.RootNodeMap[id].Arguments["id"].Value; val != test.expected {
+			t.Fatalf("Expected ID %q, got %#v.", test.expected, val)
+		}
+	}
+
+	if err := add(3, "nodes", &proto.FieldArgument{Name: "ids", VariableId: 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ids, ok := qt.RootNodeMap[3].Arguments["ids"].Value.([]interface{}); !ok || len(ids) != 1 || ids[0] != "42" {
+		t.Fatalf("List of IDs was not coerced: %#v", qt.RootNodeMap[3].Arguments["ids"].Value)
+	}
+	if err := add(4, "findPeople", &proto.FieldArgument{Name: "filter", VariableId: 3}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if filter, ok := qt.RootNodeMap[4].Arguments["filter"].Value.(map[string]interface{}); !ok || filter["id"] != "9" {
+		t.Fatalf("Input object ID was not coerced: %#v", qt.RootNodeMap[4].Arguments["filter"].Value)
+	}
+
+	err = add(5, "node", &proto.FieldArgument{Name: "id", VariableId: 4})
+	if err == nil || err.Error() != "Invalid value for argument id on field node: Expected ID, got 1.5." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestArgumentsChanged(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	intVariable := func(id uint32, val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: val},
+		}
+	}
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{intVariable(1, 30)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			},
+		}},
+	})
+	nod := qt.RootNodeMap[1]
+
+	qsub := qt.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{intVariable(1, 40)},
+	})
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_ArgsChanged || upd.Child != nod {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Argument change was not sent.")
+	}
+	if val := nod.Arguments["age"].Value; val != int32(40) {
+		t.Fatalf("Argument was not updated: %#v", val)
+	}
+
+	// Unchanged values do not re-run resolvers.
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{intVariable(1, 40)},
+	})
+	select {
+	case upd := <-changes:
+		t.Fatalf("Unexpected update: %#v", upd)
+	default:
+	}
+}
+
+func TestArgsChangedDebounce(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{
+		ArgsChangedDebounce: 50 * time.Millisecond,
+	})
+	ageVariable := func(val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    1,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: val},
+		}
+	}
+	setAge := func(val int32) {
+		qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{Variables: []*proto.ASTVariable{ageVariable(val)}})
+	}
+	qt.VariableStore.Put(ageVariable(20))
+	for i := uint32(1); i <= 2; i++ {
+		if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        i,
+			FieldName: fmt.Sprintf("p%d: allPeople", i),
+			Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+			Children:  []*proto.RGQLQueryTreeNode{{Id: i + 100, FieldName: "name"}},
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	nod := qt.RootNodeMap[1]
+
+	qsub := qt.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	for val := int32(21); val <= 25; val++ {
+		setAge(val)
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Update was not debounced: %#v", upd)
+	default:
+	}
+	if val := nod.Arguments["age"].Value; val != int32(25) {
+		t.Fatalf("Argument was not updated: %#v", val)
+	}
+
+	received := make(map[*QueryTreeNode]int)
+	timeout := time.After(time.Second)
+	for len(received) < 2 {
+		select {
+		case upd := <-changes:
+			if upd.Operation != Operation_ArgsChanged {
+				t.Fatalf("Unexpected update: %#v", upd)
+			}
+			received[upd.Child]++
+		case <-timeout:
+			t.Fatal("Debounced updates were not sent.")
+		}
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Changes were not coalesced: %#v", upd)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if received[nod] != 1 || received[qt.RootNodeMap[2]] != 1 {
+		t.Fatalf("Unexpected updates %v.", received)
+	}
+
+	// Pending updates of disposed nodes are dropped.
+	setAge(30)
+	nod.Dispose()
+	if upd := <-changes; upd.Operation != Operation_DelChild || upd.Child != nod {
+		t.Fatalf("Unexpected update: %#v", upd)
+	}
+	select {
+	case upd := <-changes:
+		if upd.Child == nod {
+			t.Fatalf("Update of disposed node was sent: %#v", upd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Debounced update was not sent.")
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Unexpected update: %#v", upd)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRebindArgument(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	intVariable := func(id uint32, val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: val},
+		}
+	}
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{intVariable(1, 30)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "limit", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			},
+		}},
+	})
+	nod := qt.RootNodeMap[1]
+	qt.VariableStore.Put(intVariable(2, 5))
+
+	qsub := qt.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	if err := nod.RebindArgument("limit", 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_ArgsChanged || upd.Child != nod {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Argument change was not sent.")
+	}
+	if ref := nod.Arguments["limit"]; ref.Id != 2 || ref.Value != int32(5) {
+		t.Fatalf("Argument was not rebound: %#v", ref)
+	}
+	if len(nod.Children) != 1 {
+		t.Fatal("Subtree was not kept.")
+	}
+	qt.VariableStore.GarbageCollect()
+	if qt.VariableStore.Has(1) {
+		t.Fatal("Previous variable was still referenced.")
+	}
+
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    3,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "ten"},
+	})
+	if err := nod.RebindArgument("limit", 3); err == nil || err.Error() != "Invalid value for argument limit on field allPeople: Expected Int, got \"ten\"." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if err := nod.RebindArgument("height", 2); err == nil || err.Error() != "Invalid argument height on field allPeople." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if err := nod.RebindArgument("age", 9); err == nil || err.Error() != "Variable id 9 not found for argument age." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if ref := nod.Arguments["limit"]; ref.Id != 2 {
+		t.Fatal("Failed rebind changed the argument.")
+	}
+}
+
+func TestImmutableArguments(t *testing.T) {
+	sch, err := schema.Parse(`
+type Person {
+	name: String
+}
+
+type RootQuery {
+	person(name: String! @immutable, limit: Int): Person
+}
+
+schema {
+	query: RootQuery
+}
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTree(rootQ, sch.Definitions, errCh)
+	stringVariable := func(id uint32, val string) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: val},
+		}
+	}
+	intVariable := func(id uint32, val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: val},
+		}
+	}
+	if errs := qt.ApplyTreeMutationErr(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{stringVariable(1, "Ada"), intVariable(2, 5)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "person",
+				Args: []*proto.FieldArgument{
+					{Name: "name", VariableId: 1},
+					{Name: "limit", VariableId: 2},
+				},
+				Children: []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			},
+		}},
+	}); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	nod := qt.RootNodeMap[1]
+	if !nod.IsImmutableArgument("name") || nod.IsImmutableArgument("limit") {
+		t.Fatal("Immutable arguments were not recorded.")
+	}
+
+	expected := "Invalid argument name on field person, the argument is immutable."
+	qt.VariableStore.Put(stringVariable(3, "Grace"))
+	qt.VariableStore.Put(stringVariable(4, "Ada"))
+	if err := nod.RebindArgument("name", 3); err == nil || err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if err := nod.RebindArgument("name", 4); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Mutable arguments can still be changed.
+	qt.VariableStore.Put(intVariable(5, 7))
+	if err := nod.RebindArgument("limit", 5); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	setArgs := func(args ...*proto.FieldArgument) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    1,
+				Operation: SubtreeSetArgs,
+				Node:      &proto.RGQLQueryTreeNode{Args: args},
+			}},
+		}
+	}
+	rename := setArgs(&proto.FieldArgument{Name: "name", VariableId: 3})
+	if err := qt.ValidateTreeMutation(rename); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if errs := qt.ApplyTreeMutationErr(rename); len(errs) != 1 || errs[0].Err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", errs)
+	}
+	<-errCh
+	if errs := qt.ApplyTreeMutationErr(setArgs(&proto.FieldArgument{Name: "name", VariableId: 4})); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if _, ok := nod.Arguments["limit"]; ok {
+		t.Fatal("Arguments were not set.")
+	}
+
+	// Changing the value of the variable keeps the current arguments.
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{stringVariable(4, "Grace")},
+	})
+	select {
+	case qerr := <-errCh:
+		if qerr.QueryNodeId != 1 || qerr.Error != expected {
+			t.Fatalf("Unexpected error: %#v", qerr)
+		}
+	default:
+		t.Fatal("Variable change was not rejected.")
+	}
+	if val := nod.Arguments["name"].Value; val != "Ada" {
+		t.Fatalf("Immutable argument was changed to %v.", val)
+	}
+}
+
+func TestSubscribeChangesContext(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	qsub := qt.SubscribeChangesContext(ctx)
+	changes := qsub.Changes()
+
+	ctxCancel()
+	for i := 0; i < 100; i++ {
+		if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        uint32(i + 1),
+			FieldName: "allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: uint32(i + 101), FieldName: "name"}},
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(time.Millisecond)
+		select {
+		case <-changes:
+			continue
+		default:
+		}
+		// No update received, the subscription was removed.
+		return
+	}
+	t.Fatal("Subscription was not removed when the context was canceled.")
+}
+
+func TestEnumArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	stringVariable := func(id uint32, val string) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: val},
+		}
+	}
+	qt.VariableStore.Put(stringVariable(1, "FOOT"))
+	qt.VariableStore.Put(stringVariable(2, "INCH"))
+	qt.VariableStore.Put(&proto.ASTVariable{Id: 3, Value: &proto.RGQLPrimitive{}})
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 100, FieldName: "name"}},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.Children[0]
+	height := func(id, varId uint32) error {
+		return people.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: "height",
+			Args:      []*proto.FieldArgument{{Name: "unit", VariableId: varId}},
+		})
+	}
+
+	if err := height(2, 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if val := qt.RootNodeMap[2].Arguments["unit"].Value; val != "FOOT" {
+		t.Fatalf("Unexpected enum value %#v.", val)
+	}
+
+	err := height(3, 2)
+	expected := "Invalid value for argument unit on field height: Invalid value INCH for enum Unit."
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	// The argument is nullable.
+	if err := height(4, 3); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestInputObjectArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	objectVariable := func(id uint32, json string) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT, StringValue: json},
+		}
+	}
+	qt.VariableStore.Put(objectVariable(1, `{"name": "Earth", "near": {"lat": 1, "lng": 2.5}}`))
+	qt.VariableStore.Put(objectVariable(2, `{"near": {"lat": 1}}`))
+
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "findPlanets",
+		Args:      []*proto.FieldArgument{{Name: "filter", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 10, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	filter, ok := qt.Children[0].Arguments["filter"].Value.(map[string]interface{})
+	if !ok || filter["name"] != "Earth" || filter["limit"] != int32(5) {
+		t.Fatalf("Input object was not coerced: %#v", filter)
+	}
+	near, ok := filter["near"].(map[string]interface{})
+	if !ok || near["lat"] != float64(1) || near["lng"] != float64(2.5) {
+		t.Fatalf("Nested input object was not coerced: %#v", filter["near"])
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        2,
+		FieldName: "findPlanets",
+		Args:      []*proto.FieldArgument{{Name: "filter", VariableId: 2}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 11, FieldName: "name"}},
+	})
+	expected := "Invalid value for argument filter on field findPlanets: " +
+		"Invalid value for field near on input PlanetFilter: " +
+		"Missing required field lng on input Coordinates."
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestListArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	arrayVariable := func(id uint32, json string) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    id,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_ARRAY, StringValue: json},
+		}
+	}
+	qt.VariableStore.Put(arrayVariable(1, `[]`))
+	qt.VariableStore.Put(arrayVariable(2, `["Earth", null]`))
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    3,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "Mars"},
+	})
+	byName := func(id, varId uint32) error {
+		return qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: "planetsByName",
+			Args:      []*proto.FieldArgument{{Name: "names", VariableId: varId}},
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		})
+	}
+
+	if err := byName(1, 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ref := qt.RootNodeMap[1].Arguments["names"]; !ref.IsList() || len(ref.Value.([]interface{})) != 0 {
+		t.Fatalf("Empty list was not kept: %#v", ref.Value)
+	}
+
+	err := byName(2, 2)
+	expected := "Invalid value for argument names on field planetsByName: " +
+		"Invalid list item 1: Expected non-null String, got null."
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	if err := byName(3, 3); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ref := qt.RootNodeMap[3].Arguments["names"]; !ref.IsList() || ref.Value.([]interface{})[0] != "Mars" {
+		t.Fatalf("Single value was not wrapped: %#v", ref.Value)
+	}
+}
+
+func TestVariableSubscribe(t *testing.T) {
+	vs := NewVariableStore()
+	intVariable := func(val int32) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id:    1,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: val},
+		}
+	}
+
+	values, cancel := vs.Subscribe(1)
+	vs.Put(intVariable(1))
+	if val := <-values; val != int32(1) {
+		t.Fatalf("Unexpected value: %#v", val)
+	}
+
+	// Only the latest value is kept.
+	vs.Put(intVariable(1))
+	vs.Put(intVariable(2))
+	vs.Put(intVariable(3))
+	if val := <-values; val != int32(3) {
+		t.Fatalf("Unexpected value: %#v", val)
+	}
+
+	cancel()
+	cancel()
+	vs.Put(intVariable(4))
+	if _, ok := <-values; ok {
+		t.Fatal("Values were delivered after cancel.")
+	}
+}
+
+func TestResolverTree(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 100, FieldName: "height"}},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	started := make(chan uint32, 10)
+	stopped := make(chan uint32, 10)
+	resolver := FieldResolverFunc(func(ctx context.Context, node *QueryTreeNode) {
+		started <- node.Id
+		<-ctx.Done()
+		stopped <- node.Id
+	})
+	rt := NewResolverTree(qt)
+	rt.Register("RootQuery", "allPeople", resolver)
+	rt.Register("Person", "name", resolver)
+	rt.Start(context.Background())
+
+	expectId := func(ch <-chan uint32, id uint32) {
+		select {
+		case nid := <-ch:
+			if nid != id {
+				t.Fatalf("Expected node %d, got %d.", id, nid)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for node %d.", id)
+		}
+	}
+	expectId(started, 1)
+
+	if err := qt.Children[0].AddChild(&proto.RGQLQueryTreeNode{Id: 2, FieldName: "name"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	expectId(started, 2)
+
+	qt.RootNodeMap[2].Dispose()
+	expectId(stopped, 2)
+
+	rt.Stop()
+	expectId(stopped, 1)
+}
+
+func TestResolveTimeout(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	for id, ms := range map[uint32]string{1: `{"ms": 50}`, 2: `{"ms": 500}`, 3: `{"ms": "soon"}`} {
+		qt.VariableStore.Put(&proto.ASTVariable{
+			Id: id,
+			Value: &proto.RGQLPrimitive{
+				Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT,
+				StringValue: ms,
+			},
+		})
+	}
+
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "@timeout", VariableId: 1}},
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "biography", Args: []*proto.FieldArgument{{Name: "@timeout", VariableId: 2}}},
+			{Id: 3, FieldName: "slow: biography"},
+			{Id: 4, FieldName: "name"},
+		},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for id, timeout := range map[uint32]time.Duration{
+		1: 50 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 200 * time.Millisecond,
+		4: 0,
+	} {
+		if nod := qt.RootNodeMap[id]; nod.ResolveTimeout != timeout {
+			t.Fatalf("Expected node %d to time out after %v, got %v.", id, timeout, nod.ResolveTimeout)
+		}
+	}
+
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        5,
+		FieldName: "others: allPeople",
+		Args:      []*proto.FieldArgument{{Name: "@timeout", VariableId: 3}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != `Directive @timeout requires an integer ms argument, got "soon".` {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	<-errCh
+
+	deadlines := make(chan time.Duration, 1)
+	rt := NewResolverTree(qt)
+	rt.Register("RootQuery", "allPeople", FieldResolverFunc(func(ctx context.Context, node *QueryTreeNode) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Error("Resolver context has no deadline.")
+		}
+		deadlines <- time.Until(deadline)
+		<-ctx.Done()
+	}))
+	rt.Start(context.Background())
+	defer rt.Stop()
+	select {
+	case remaining := <-deadlines:
+		if remaining > 50*time.Millisecond {
+			t.Fatalf("Deadline is %v away, expected at most 50ms.", remaining)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Resolver was not started.")
+	}
+}
+
+func TestIncrementalDelivery(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	for id, args := range map[uint32]string{
+		1: `{"label": "people", "initialCount": 2}`,
+		2: `{"label": "home"}`,
+		3: `{"if": false}`,
+		4: `{"label": 5}`,
+	} {
+		qt.VariableStore.Put(&proto.ASTVariable{
+			Id: id,
+			Value: &proto.RGQLPrimitive{
+				Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT,
+				StringValue: args,
+			},
+		})
+	}
+
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "@stream", VariableId: 1}},
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        2,
+				FieldName: "home",
+				Args:      []*proto.FieldArgument{{Name: "@defer", VariableId: 2}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "radius"}},
+			},
+			{
+				Id:        4,
+				FieldName: "friends",
+				Args:      []*proto.FieldArgument{{Name: "@defer", VariableId: 3}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "name"}},
+			},
+			{Id: 6, FieldName: "name"},
+		},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for id, expected := range map[uint32]*IncrementalDelivery{
+		1: {Stream: true, Label: "people", InitialCount: 2},
+		2: {Label: "home"},
+		4: nil,
+		6: nil,
+	} {
+		if inc := qt.RootNodeMap[id].Incremental; !reflect.DeepEqual(inc, expected) {
+			t.Fatalf("Expected node %d to be delivered with %#v, got %#v.", id, expected, inc)
+		}
+	}
+
+	for _, tc := range []struct {
+		data *proto.RGQLQueryTreeNode
+		err  string
+	}{
+		{
+			&proto.RGQLQueryTreeNode{
+				Id:        7,
+				FieldName: "person",
+				Args:      []*proto.FieldArgument{{Name: "name: \"Ada\""}, {Name: "@stream", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 8, FieldName: "name"}},
+			},
+			"Invalid node 7, directive @stream requires a list field.",
+		},
+		{
+			&proto.RGQLQueryTreeNode{
+				Id:        7,
+				FieldName: "others: allPeople",
+				Args:      []*proto.FieldArgument{{Name: "@defer", VariableId: 4}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 8, FieldName: "name"}},
+			},
+			"Directive @defer requires a string label argument, got 5.",
+		},
+		{
+			&proto.RGQLQueryTreeNode{
+				Id:        7,
+				FieldName: "others: allPeople",
+				Args:      []*proto.FieldArgument{{Name: "@defer", VariableId: 2}, {Name: "@stream", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 8, FieldName: "name"}},
+			},
+			"Invalid node 7, directives @defer and @stream cannot be combined.",
+		},
+	} {
+		mutation := &proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      tc.data,
+			}},
+		}
+		if err := qt.ValidateTreeMutation(mutation); err == nil || err.Error() != tc.err {
+			t.Fatalf("Expected validation error %q, got %v", tc.err, err)
+		}
+		if err := qt.AddChild(tc.data); err == nil || err.Error() != tc.err {
+			t.Fatalf("Expected error %q, got %v", tc.err, err)
+		}
+		<-errCh
+	}
+}
+func TestConcurrentMutations(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	for _, id := range []uint32{1, 2} {
+		if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: "allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	var wg sync.WaitGroup
+	mutate := func(parentId uint32, baseId uint32) {
+		defer wg.Done()
+		for i := uint32(0); i < 50; i++ {
+			id := baseId + i
+			qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+				NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+					{
+						NodeId:    parentId,
+						Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+						Node:      &proto.RGQLQueryTreeNode{Id: id, FieldName: "name"},
+					},
+				},
+			})
+			if nod, ok := qt.LookupNode(id); ok {
+				nod.Dispose()
+			}
+		}
+	}
+	wg.Add(2)
+	go mutate(1, 100)
+	go mutate(2, 200)
+	wg.Wait()
+
+	for _, id := range []uint32{0, 1, 2} {
+		if _, ok := qt.LookupNode(id); !ok {
+			t.Fatalf("Expected node %d to remain in the tree.", id)
+		}
+	}
+	if _, ok := qt.LookupNode(100); ok {
+		t.Fatal("Expected disposed node to be removed from the tree.")
+	}
+}
+
+func TestOnDispose(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.Children[0]
+	name := people.Children[0]
+
+	var calls []string
+	people.OnDispose(func() {
+		if _, ok := qt.RootNodeMap[1]; !ok {
+			t.Fatal("Node left the tree before the callback.")
+		}
+		if _, ok := qt.RootNodeMap[2]; ok {
+			t.Fatal("Children were not disposed before the callback.")
+		}
+		calls = append(calls, "first")
+	})
+	people.OnDispose(func() {
+		calls = append(calls, "second")
+	})
+	name.OnDispose(func() {
+		calls = append(calls, "child")
+	})
+
+	people.Dispose()
+	people.Dispose()
+	if !reflect.DeepEqual(calls, []string{"child", "first", "second"}) {
+		t.Fatalf("Unexpected callbacks: %v", calls)
+	}
+
+	people.OnDispose(func() {
+		calls = append(calls, "late")
+	})
+	if len(calls) != 4 || calls[3] != "late" {
+		t.Fatal("Callback on a disposed node was not called.")
+	}
+}
+
+func TestConcurrentDispose(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	for i := uint32(0); i < 50; i++ {
+		base := i * 10
+		if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        base + 1,
+			FieldName: "allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: base + 2, FieldName: "name"}},
+		}); err != nil {
+			t.Fatal(err.Error())
+		}
+		people := qt.RootNodeMap[base+1]
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			people.Dispose()
+		}()
+		go func() {
+			defer wg.Done()
+			people.Dispose()
+		}()
+		go func() {
+			defer wg.Done()
+			qt.AddChild(&proto.RGQLQueryTreeNode{
+				Id:        base + 3,
+				FieldName: "others: allPeople",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: base + 5, FieldName: "name"}},
+			})
+			people.AddChild(&proto.RGQLQueryTreeNode{Id: base + 4, FieldName: "height"})
+		}()
+		wg.Wait()
+
+		if _, ok := qt.LookupNode(base + 1); ok {
+			t.Fatal("Disposed node is still in the tree.")
+		}
+		if _, ok := qt.LookupNode(base + 4); ok {
+			t.Fatal("Child of a disposed node is in the tree.")
+		}
+		if _, ok := qt.LookupNode(base + 3); !ok {
+			t.Fatal("Sibling of a disposed node was not added.")
+		}
+	}
+}
+
+func TestApplyTreeMutationAtomic(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	addChild := func(parent uint32, node *proto.RGQLQueryTreeNode) *proto.RGQLQueryTreeMutation_NodeMutation {
+		return &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    parent,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      node,
+		}
+	}
+	deleteNode := func(id uint32) *proto.RGQLQueryTreeMutation_NodeMutation {
+		return &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    id,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+		}
+	}
+
+	err := qt.ApplyTreeMutationAtomic(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{{
+			Id: 1,
+			Value: &proto.RGQLPrimitive{
+				Kind:     proto.RGQLPrimitive_PRIMITIVE_KIND_INT,
+				IntValue: 30,
+			},
+		}},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			addChild(0, &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "age", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			}),
+			addChild(1, &proto.RGQLQueryTreeNode{Id: 3, FieldName: "names"}),
+			addChild(4, &proto.RGQLQueryTreeNode{Id: 5, FieldName: "name"}),
+		},
+	})
+	errs, ok := err.(MutationErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Expected two mutation errors, got %v.", err)
+	}
+	if errs[0].Error() != "Invalid field names on Person." || errs[1].Error() != "Invalid node ID (not found): 4" {
+		t.Fatalf("Did not return expected errors (%v).", err)
+	}
+	if len(qt.RootNodeMap) != 1 {
+		t.Fatal("Failed mutation changed the tree.")
+	}
+	if _, ok := qt.VariableStore.Value(1); ok {
+		t.Fatal("Failed mutation stored variables.")
+	}
+	select {
+	case qerr := <-errCh:
+		t.Fatalf("Unexpected error reported: %v", qerr.Error)
+	default:
+	}
+
+	// Adding below a node and then deleting it is ordered correctly.
+	err = qt.ApplyTreeMutationAtomic(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			addChild(0, &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+			}),
+			addChild(1, &proto.RGQLQueryTreeNode{
+				Id:        2,
+				FieldName: "friends",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "name"}},
+			}),
+			deleteNode(1),
+			addChild(0, &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(qt.RootNodeMap) != 3 || len(qt.Children) != 1 {
+		t.Fatalf("Expected the re-added subtree only, got %d nodes.", len(qt.RootNodeMap))
+	}
+	if _, ok := qt.LookupNode(2); ok {
+		t.Fatal("Deleted node was retained in the tree.")
+	}
+
+	// Adding below a node deleted earlier in the batch fails.
+	err = qt.ApplyTreeMutationAtomic(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			deleteNode(1),
+			addChild(1, &proto.RGQLQueryTreeNode{
+				Id:        4,
+				FieldName: "home",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "name"}},
+			}),
+		},
+	})
+	if err == nil || err.Error() != "Invalid node ID (not found): 1" {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(1); !ok {
+		t.Fatal("Failed mutation deleted a node.")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	qt.Freeze()
+	if !qt.RootNodeMap[2].Frozen() {
+		t.Fatal("Tree was not frozen.")
+	}
+	expected := "Invalid mutation, the tree is frozen."
+	err = qt.RootNodeMap[1].AddChild(&proto.RGQLQueryTreeNode{Id: 3, FieldName: "height"})
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected a frozen error, got %v", err)
+	}
+	qt.RootNodeMap[2].Dispose()
+	if _, ok := qt.LookupNode(2); !ok {
+		t.Fatal("Node was disposed while frozen.")
+	}
+	errs := qt.ApplyTreeMutationErr(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{NodeId: 1, Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE},
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      &proto.RGQLQueryTreeNode{Id: 4, FieldName: "person: allPeople"},
+			},
+		},
+	})
+	if len(errs) != 2 || errs[0].Err.Error() != expected || errs[1].Err.Error() != expected {
+		t.Fatalf("Expected frozen errors, got %v", errs)
+	}
+	err = qt.ApplyTreeMutationAtomic(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{NodeId: 1, Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE},
+		},
+	})
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected a frozen error, got %v", err)
+	}
+	if len(qt.Children) != 1 || len(qt.Children[0].Children) != 1 {
+		t.Fatal("Frozen tree was modified.")
+	}
+
+	qt.Unfreeze()
+	if err := qt.RootNodeMap[1].AddChild(&proto.RGQLQueryTreeNode{Id: 3, FieldName: "height"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	qt.RootNodeMap[2].Dispose()
+	if _, ok := qt.LookupNode(2); ok {
+		t.Fatal("Node was not disposed after unfreezing.")
+	}
+}
+
+func TestApplyTreeMutationErr(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	errs := qt.ApplyTreeMutationErr(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+				},
+			},
+			{
+				NodeId:    99,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      &proto.RGQLQueryTreeNode{Id: 3, FieldName: "name"},
+			},
+			{
+				NodeId:    1,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			},
+			{
+				NodeId:    1,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      &proto.RGQLQueryTreeNode{Id: 4, FieldName: "unknown"},
+			},
+		},
+	})
+
+	expected := []NodeMutationError{
+		{NodeId: 99, Err: errors.New("Invalid node ID (not found): 99")},
+		{NodeId: 1, Err: errors.New("Invalid mutation on node 1, no child given.")},
+		{NodeId: 1, Err: errors.New("Invalid field unknown on Person.")},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	for i, err := range errs {
+		if err.NodeId != expected[i].NodeId || err.Error() != expected[i].Error() {
+			t.Fatalf("Unexpected error %d: %d %v", i, err.NodeId, err)
+		}
+	}
+	if _, ok := qt.LookupNode(1); !ok {
+		t.Fatal("Valid operation was not applied.")
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTreeWithVersion(rootQ, sch.Definitions, errCh, "v2")
+	if qt.SchemaVersion() != "v2" {
+		t.Fatalf("Expected schema version v2, got %s.", qt.SchemaVersion())
+	}
+	add := func(id uint32) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        id,
+					FieldName: fmt.Sprintf("p%d: allPeople", id),
+					Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+				},
+			}},
+		}
+	}
+
+	errs := qt.ApplyTreeMutationVersioned(add(1), "v1")
+	if len(errs) != 1 || errs[0].NodeId != 0 {
+		t.Fatalf("Unexpected errors %v.", errs)
+	}
+	var mismatch *SchemaMismatchError
+	if !errors.As(errs[0].Err, &mismatch) || mismatch.Version != "v2" || mismatch.MutationVersion != "v1" {
+		t.Fatalf("Expected a schema mismatch, got %v.", errs[0].Err)
+	}
+	select {
+	case qerr := <-errCh:
+		if qerr.QueryNodeId != 0 || qerr.Error != "Invalid mutation, schema version v1 does not match v2." {
+			t.Fatalf("Unexpected error: %#v", qerr)
+		}
+	default:
+		t.Fatal("Mismatch was not reported.")
+	}
+	if _, ok := qt.LookupNode(1); ok {
+		t.Fatal("Mutation was applied with another schema version.")
+	}
+
+	if errs := qt.ApplyTreeMutationVersioned(add(2), "v2"); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if errs := qt.ApplyTreeMutationVersioned(add(3), ""); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if len(qt.Children) != 2 {
+		t.Fatalf("Expected 2 children, got %d.", len(qt.Children))
+	}
+
+	_, unversioned, _ := buildMockTree(t)
+	if err := unversioned.CheckSchemaVersion("v1"); err != nil {
+		t.Fatalf("Tree without a schema version rejected %v.", err)
+	}
+}
+
+func TestApplyMutationStream(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	var stream bytes.Buffer
+	writeMessage := func(msg []byte) {
+		var prefix [binary.MaxVarintLen64]byte
+		stream.Write(prefix[:binary.PutUvarint(prefix[:], uint64(len(msg)))])
+		stream.Write(msg)
+	}
+	writeMutation := func(parentId uint32, node *proto.RGQLQueryTreeNode) {
+		msg, err := pb.Marshal(&proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    parentId,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      node,
+			}},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		writeMessage(msg)
+	}
+
+	writeMutation(0, &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	writeMessage([]byte{0xff, 0x00})
+	writeMutation(0, &proto.RGQLQueryTreeNode{Id: 3, FieldName: "allPeople.nope"})
+	writeMutation(1, &proto.RGQLQueryTreeNode{Id: 4, FieldName: "height"})
+	if err := qt.ApplyMutationStream(context.Background(), &stream); err != nil {
+		t.Fatal(err.Error())
+	}
+	if qt.RootNodeMap[2] == nil || qt.RootNodeMap[4] == nil || qt.RootNodeMap[3] != nil {
+		t.Fatal("Mutations of the stream were not applied.")
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 0 || !strings.HasPrefix(qerr.Error, "Invalid mutation 2:") {
+		t.Fatalf("Unexpected error for the invalid message: %#v", qerr)
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 3 {
+		t.Fatalf("Unexpected error for the invalid node: %#v", qerr)
+	}
+
+	// A truncated message ends the stream.
+	writeMutation(1, &proto.RGQLQueryTreeNode{Id: 5, FieldName: "nickname"})
+	stream.Truncate(stream.Len() - 1)
+	err := qt.ApplyMutationStream(context.Background(), &stream)
+	if err == nil || err.Error() != "Invalid mutation 1: unexpected EOF" {
+		t.Fatalf("Expected a framing error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	writeMutation(1, &proto.RGQLQueryTreeNode{Id: 5, FieldName: "nickname"})
+	if err := qt.ApplyMutationStream(ctx, &stream); err != context.Canceled {
+		t.Fatalf("Expected the context error, got %v", err)
+	}
+	if qt.RootNodeMap[5] != nil {
+		t.Fatal("Mutation was applied after the context was canceled.")
+	}
+}
+
+func TestApplyTreeMutationScoped(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "friends", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        5,
+		FieldName: "others: allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	add := func(parent, id uint32) *proto.RGQLQueryTreeMutation_NodeMutation {
+		return &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    parent,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      &proto.RGQLQueryTreeNode{Id: id, FieldName: "height"},
+		}
+	}
+	del := func(id uint32) *proto.RGQLQueryTreeMutation_NodeMutation {
+		return &proto.RGQLQueryTreeMutation_NodeMutation{
+			NodeId:    id,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+		}
+	}
+	people := qt.RootNodeMap[1]
+	people.ApplyTreeMutationScoped(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			add(0, 7),
+			add(3, 8),
+			add(5, 9),
+			del(0),
+			del(6),
+			del(2),
+		},
+	})
+
+	if nod, ok := qt.LookupNode(7); !ok || nod.Parent != people {
+		t.Fatal("Node ID 0 did not refer to the scope.")
+	}
+	if nod, ok := qt.LookupNode(8); !ok || nod.Parent != qt.RootNodeMap[3] {
+		t.Fatal("Descendant of the scope was not mutated.")
+	}
+	if _, ok := qt.LookupNode(9); ok {
+		t.Fatal("Node outside the scope was mutated.")
+	}
+	if _, ok := qt.LookupNode(6); !ok {
+		t.Fatal("Node outside the scope was deleted.")
+	}
+	if _, ok := qt.LookupNode(2); ok || qt.RootNodeMap[1] != people {
+		t.Fatal("Scoped delete was not applied.")
+	}
+	select {
+	case qerr := <-errCh:
+		if qerr.QueryNodeId != 5 || qerr.Error != "Invalid node ID (not in scope): 5" {
+			t.Fatalf("Unexpected error: %#v", qerr)
+		}
+	default:
+		t.Fatal("Out of scope operation was not reported.")
+	}
+}
+
+func TestDeleteBeforeAdd(t *testing.T) {
+	add := &proto.RGQLQueryTreeMutation_NodeMutation{
+		NodeId:    1,
+		Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+		Node: &proto.RGQLQueryTreeNode{
+			Id:        2,
+			FieldName: "friends",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}},
+		},
+	}
+	del := &proto.RGQLQueryTreeMutation_NodeMutation{
+		NodeId:    2,
+		Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE,
+	}
+	for _, c := range []struct {
+		name   string
+		ops    []*proto.RGQLQueryTreeMutation_NodeMutation
+		atomic bool
+	}{
+		{"delete then add", []*proto.RGQLQueryTreeMutation_NodeMutation{del, add}, false},
+		{"add then delete", []*proto.RGQLQueryTreeMutation_NodeMutation{add, del}, false},
+		{"atomic", []*proto.RGQLQueryTreeMutation_NodeMutation{add, del}, true},
+	} {
+		_, qt, _ := buildMockTree(t)
+		err := qt.AddChild(&proto.RGQLQueryTreeNode{
+			Id:        1,
+			FieldName: "allPeople",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		mutation := &proto.RGQLQueryTreeMutation{NodeMutation: c.ops}
+		if c.atomic {
+			if err := qt.ApplyTreeMutationAtomic(mutation); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		} else if errs := qt.ApplyTreeMutationErr(mutation); len(errs) != 0 {
+			t.Fatalf("%s: %v", c.name, errs[0])
+		}
+		nod, ok := qt.LookupNode(2)
+		if !ok || nod.FieldName != "friends" || len(qt.RootNodeMap[1].Children) != 1 {
+			t.Fatalf("%s: expected node 2 to be replaced by friends", c.name)
+		}
+	}
+
+	// Deletes of a subtree an earlier operation added below keep their place.
+	_, qt, _ := buildMockTree(t)
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	errs := qt.ApplyTreeMutationErr(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    1,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      &proto.RGQLQueryTreeNode{Id: 3, FieldName: "height"},
+			},
+			{NodeId: 1, Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE},
+		},
+	})
+	if len(errs) != 0 || len(qt.RootNodeMap) != 1 {
+		t.Fatalf("expected the addition to apply before the delete, got %v", errs)
+	}
+}
+
+func TestValidateQueryDocument(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	valid := &proto.RGQLQueryTreeNode{
+		Id: 0,
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "limit: 5"}, {Name: "age", VariableId: 1}},
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 2, FieldName: "name"},
+					{Id: 3, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "radius"}}},
+				},
+			},
+			{Id: 5, FieldName: "...PersonFields"},
+		},
+	}
+	if errs := ValidateQueryDocument(valid, sch.Definitions); len(errs) != 0 {
+		t.Fatalf("Unexpected errors %v.", errs)
+	}
+
+	invalid := &proto.RGQLQueryTreeNode{
+		Id: 0,
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: `limit: "ten"`}, {Name: "height", VariableId: 1}},
+				Children: []*proto.RGQLQueryTreeNode{
+					{Id: 2, FieldName: "name", Children: []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "name"}}},
+					{Id: 4, FieldName: "spouse", Children: []*proto.RGQLQueryTreeNode{{Id: 5, FieldName: "name"}}},
+					{Id: 2, FieldName: "home"},
+				},
+			},
+			{Id: 6, FieldName: "person"},
+		},
+	}
+	expected := []string{
+		"Invalid argument height on field allPeople.",
+		"Invalid value for argument limit on field allPeople: Expected Int, got \"ten\".",
+		"Invalid node 2, field name of leaf type String cannot have selections.",
+		"Invalid field spouse on Person.",
+		"Invalid node ID (used more than once): 2",
+		"Invalid node 2, field home of type Planet must have selections.",
+		"Missing required argument name on field person.",
+		"Invalid node 6, field person of type Person must have selections.",
+	}
+	errs := ValidateQueryDocument(invalid, sch.Definitions)
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v.", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Fatalf("Expected error %q, got %q.", expected[i], err.Error())
+		}
+	}
+}
+
+func TestValidateTreeMutation(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	addMutation := func(node *proto.RGQLQueryTreeNode) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+				{
+					NodeId:    0,
+					Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+					Node:      node,
+				},
+			},
+		}
+	}
+
+	err := qt.ValidateTreeMutation(addMutation(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{
+				{Id: 3, FieldName: "radius"},
+			}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = qt.ValidateTreeMutation(addMutation(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "names"},
+		},
+	}))
+	if err == nil || err.Error() != "Invalid field names on Person." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	err = qt.ValidateTreeMutation(addMutation(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "age", VariableId: 4}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 10, FieldName: "name"}},
+	}))
+	if err == nil || err.Error() != "Variable id 4 not found for argument age." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+
+	if len(qt.Children) != 0 || len(qt.RootNodeMap) != 1 {
+		t.Fatal("Validation modified the tree.")
+	}
+}
+
+func TestFragmentSpread(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: "fragment PersonFields on Person { name home { radius } }",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	qt.RegisterFragment("PersonFields", doc.Definitions[0].(*ast.FragmentDefinition))
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "...PersonFields"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.Children[0]
+	if len(people.Children) != 2 ||
+		people.Children[0].FieldName != "name" ||
+		people.Children[1].FieldName != "home" ||
+		len(people.Children[1].Children) != 1 {
+		t.Fatalf("Fragment was not expanded: %#v", people.Children)
+	}
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{NodeId: 2, Operation: proto.RGQLQueryTreeMutation_SUBTREE_DELETE},
+		},
+	})
+	if len(people.Children) != 0 || len(qt.RootNodeMap) != 2 {
+		t.Fatal("Fragment spread was not deleted.")
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{Id: 3, FieldName: "...PersonFields"})
+	if err == nil || err.Error() != "Fragment on Person cannot be spread on RootQuery." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	<-errCh
+}
+
+func TestFragmentArguments(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: "fragment PersonFields on Person { height(unit: FOOT) } fragment VariableFields on Person { height(unit: $unit) }",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	qt.RegisterFragment("PersonFields", doc.Definitions[0].(*ast.FragmentDefinition))
+	qt.RegisterFragment("VariableFields", doc.Definitions[1].(*ast.FragmentDefinition))
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "...PersonFields"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	people := qt.Children[0]
+	if len(people.Children) != 1 || people.Children[0].FieldName != "height" {
+		t.Fatalf("Fragment was not expanded: %#v", people.Children)
+	}
+	if vals := people.Children[0].ArgumentValues(); vals["unit"] != "FOOT" {
+		t.Fatalf("Unexpected argument values %v.", vals)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "...VariableFields"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "Invalid argument unit on field height in fragment: Variable $unit cannot be used in a fragment.") {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	<-errCh
+}
+
+var abstractSchemaSrc string = `
+interface Character {
+	name: String
+}
+
+type Human implements Character {
+	name: String
+	height: Int
+}
+
+type Droid implements Character {
+	name: String
+	primaryFunction: String
+}
+
+union SearchResult = Human | Droid
+
+type RootQuery {
+	hero: Character
+	search: [SearchResult]
+}
+
+type RootSubscription {
+	personChanged(name: String!): Person
+}
+
+schema {
+	query: RootQuery
+	subscription: RootSubscription
+}
+`
+
+func TestServerNodeIds(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: "fragment PersonFields on Person { name }",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	qt.RegisterFragment("PersonFields", doc.Definitions[0].(*ast.FragmentDefinition))
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: MaxClientNodeId + 1, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != fmt.Sprintf("Invalid node ID (reserved for the server): %d", MaxClientNodeId+1) {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	<-errCh
+	if len(qt.RootNodeMap) != 1 {
+		t.Fatal("expected nothing to be added")
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: MaxClientNodeId, FieldName: "...PersonFields"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	name := qt.Children[0].Children[0]
+	if name.Id <= MaxClientNodeId {
+		t.Fatalf("expected a server ID for the expanded node, got %d", name.Id)
+	}
+}
+
+func TestAbstractTypes(t *testing.T) {
+	sch, err := schema.Parse(abstractSchemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTree(rootQ, sch.Definitions, errCh)
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "hero",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{
+				Id:        3,
+				FieldName: "... on Droid",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "primaryFunction"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hero := qt.Children[0]
+	if len(hero.PossibleTypes) != 2 {
+		t.Fatalf("Expected two possible types, got %d.", len(hero.PossibleTypes))
+	}
+	droid := hero.Children[1]
+	if droid.TypeCondition != "Droid" || len(droid.PossibleTypes) != 1 || droid.Children[0].ResolveError != nil {
+		t.Fatalf("Inline fragment was not narrowed: %#v", droid)
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        5,
+		FieldName: "search",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "__typename"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        7,
+		FieldName: "search",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 8, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != "Invalid field name on SearchResult." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(7); ok {
+		t.Fatal("Failed subtree was retained in the tree.")
+	}
+}
+
+func TestSelectionsFor(t *testing.T) {
+	sch, err := schema.Parse(abstractSchemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	qt := NewQueryTree(rootQ, sch.Definitions, errCh)
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "hero",
+		Children: []*proto.RGQLQueryTreeNode{
+			{
+				Id:        2,
+				FieldName: "... on Droid",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 3, FieldName: "primaryFunction"}},
+			},
+			{Id: 4, FieldName: "name"},
+			{
+				Id:        5,
+				FieldName: "... on Human",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "height"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        7,
+		FieldName: "search",
+		Children: []*proto.RGQLQueryTreeNode{{
+			Id:        8,
+			FieldName: "... on Character",
+			Children:  []*proto.RGQLQueryTreeNode{{Id: 9, FieldName: "name"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids := func(nodes []*QueryTreeNode) []uint32 {
+		res := make([]uint32, len(nodes))
+		for i, nod := range nodes {
+			res[i] = nod.Id
+		}
+		return res
+	}
+	hero, search := qt.RootNodeMap[1], qt.RootNodeMap[7]
+	for typeName, expected := range map[string][]uint32{
+		"Droid":  {4, 2},
+		"Human":  {4, 5},
+		"Planet": {4},
+	} {
+		if sel := ids(hero.SelectionsFor(typeName)); !reflect.DeepEqual(sel, expected) {
+			t.Fatalf("Unexpected selections for %s: %v", typeName, sel)
+		}
+	}
+	for _, typeName := range []string{"Droid", "Human"} {
+		if sel := ids(search.SelectionsFor(typeName)); !reflect.DeepEqual(sel, []uint32{8}) {
+			t.Fatalf("Interface fragment was not grouped under %s: %v", typeName, sel)
+		}
+	}
+
+	qt.RootNodeMap[2].Dispose()
+	if sel := ids(hero.SelectionsFor("Droid")); !reflect.DeepEqual(sel, []uint32{4}) {
+		t.Fatalf("Disposed fragment was still selected: %v", sel)
+	}
+	if sel := ids(hero.Clone().SelectionsFor("Human")); !reflect.DeepEqual(sel, []uint32{4, 5}) {
+		t.Fatalf("Clone did not keep the selections: %v", sel)
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	boolVariable := func(id uint32, val bool) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id: id,
+			Value: &proto.RGQLPrimitive{
+				Kind:      proto.RGQLPrimitive_PRIMITIVE_KIND_BOOL,
+				BoolValue: val,
+			},
+		}
+	}
+
+	qsub := qt.SubscribeChanges()
+	defer qsub.Unsubscribe()
+	changes := qsub.Changes()
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{boolVariable(1, false)},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{
+			{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:        1,
+					FieldName: "allPeople",
+					Args:      []*proto.FieldArgument{{Name: "@include", VariableId: 1}},
+					Children:  []*proto.RGQLQueryTreeNode{{Id: 10, FieldName: "name"}},
+				},
+			},
+		},
+	})
+	nod := qt.RootNodeMap[1]
+	if nod == nil || nod.ResolveError != nil || !nod.Inactive || nod.Arguments["@include"] != nil {
+		t.Fatalf("Node was not excluded: %#v", nod)
+	}
+	select {
+	case upd := <-changes:
+		t.Fatalf("Excluded node was added: %#v", upd)
+	default:
+	}
+
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{boolVariable(1, true)},
+	})
+	if nod.Inactive {
+		t.Fatal("Node was not included after the variable changed.")
+	}
+	select {
+	case upd := <-changes:
+		if upd.Operation != Operation_AddChild || upd.Child != nod {
+			t.Fatalf("Unexpected update: %#v", upd)
+		}
+	default:
+		t.Fatal("Included node was not added.")
+	}
+
+	err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        2,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "@live", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 10, FieldName: "name"}},
+	})
+	if err == nil || err.Error() != "Unknown directive @live." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestDirectiveHandlers(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.RegisterDirective("auth", DirectiveHandlerFunc(func(node *QueryTreeNode, args map[string]interface{}) error {
+		if args["role"] != "admin" {
+			return fmt.Errorf("Access denied to field %s for role %v.", node.FieldName, args["role"])
+		}
+		node.Annotate("role", args["role"])
+		return nil
+	}))
+	roleVariable := func(id uint32, role string) *proto.ASTVariable {
+		return &proto.ASTVariable{
+			Id: id,
+			Value: &proto.RGQLPrimitive{
+				Kind:        proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT,
+				StringValue: fmt.Sprintf("{\"role\": %q}", role),
+			},
+		}
+	}
+	qt.VariableStore.Put(roleVariable(1, "guest"))
+	qt.VariableStore.Put(roleVariable(2, "admin"))
+
+	denied := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "@auth", VariableId: 1}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	}
+	err := qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			NodeId:    0,
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node:      denied,
+		}},
+	})
+	if err == nil || err.Error() != "Access denied to field allPeople for role guest." {
+		t.Fatalf("Validation did not return expected error (%v).", err)
+	}
+	err = qt.AddChild(denied)
+	if err == nil || err.Error() != "Access denied to field allPeople for role guest." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	if _, ok := qt.LookupNode(1); ok || len(qt.Children) != 0 {
+		t.Fatal("Denied node was added.")
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        3,
+		FieldName: "allPeople",
+		Args:      []*proto.FieldArgument{{Name: "@auth", VariableId: 2}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nod, ok := qt.LookupNode(3)
+	if !ok || nod.Inactive || nod.Annotations["role"] != "admin" {
+		t.Fatalf("Allowed node was not added and annotated: %#v", nod)
+	}
+}
+
+func TestResolveDirectiveArg(t *testing.T) {
+	vs := NewVariableStore()
+	vs.Put(&proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_BOOL, BoolValue: true},
+	})
+	vs.Put(&proto.ASTVariable{
+		Id:    2,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "true"},
+	})
+	for _, test := range []struct {
+		name  string
+		arg   *proto.FieldArgument
+		value interface{}
+		err   bool
+	}{
+		{"literal", &proto.FieldArgument{Name: "@skip: false"}, false, false},
+		{"variable", &proto.FieldArgument{Name: "@include", VariableId: 1}, true, false},
+		{"unknown variable", &proto.FieldArgument{Name: "@include", VariableId: 3}, nil, true},
+		{"bad literal type", &proto.FieldArgument{Name: "@skip: 1"}, nil, true},
+		{"bad variable type", &proto.FieldArgument{Name: "@skip", VariableId: 2}, nil, true},
+		{"not a directive", &proto.FieldArgument{Name: "skip", VariableId: 1}, nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			val, err := ResolveDirectiveArg(test.arg, vs)
+			if (err != nil) != test.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if val != test.value {
+				t.Fatalf("Expected %#v, got %#v.", test.value, val)
+			}
+		})
+	}
+}
+
+func TestDirectiveUpdateCoercion(t *testing.T) {
+	_, qt, errCh := buildMockTree(t)
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{
+		Variables: []*proto.ASTVariable{{
+			Id:    1,
+			Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_BOOL, BoolValue: true},
+		}},
+		NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+			Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+			Node: &proto.RGQLQueryTreeNode{
+				Id:        1,
+				FieldName: "allPeople",
+				Args:      []*proto.FieldArgument{{Name: "@skip", VariableId: 1}},
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+			},
+		}},
+	})
+	people := qt.RootNodeMap[1]
+	if people == nil || !people.Inactive {
+		t.Fatal("Expected the node to be skipped.")
+	}
+
+	// A string condition is rejected as when adding the node, the node keeps its state.
+	qt.ApplyTreeMutation(&proto.RGQLQueryTreeMutation{Variables: []*proto.ASTVariable{{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_STRING, StringValue: "false"},
+	}}})
+	if !people.Inactive {
+		t.Fatal("Uncoerced condition changed the state of the node.")
+	}
+	select {
+	case qerr := <-errCh:
+		if qerr.QueryNodeId != 1 {
+			t.Fatalf("Unexpected error: %#v", qerr)
+		}
+	default:
+		t.Fatal("Expected an error for the invalid condition.")
+	}
+}
+
+func TestDirectiveArguments(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.RegisterDirective("auth", DirectiveHandlerFunc(func(node *QueryTreeNode, args map[string]interface{}) error {
+		node.Annotate("role", args["role"])
+		return nil
+	}))
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_BOOL, BoolValue: true},
+	})
+	qt.VariableStore.Put(&proto.ASTVariable{
+		Id:    2,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_INT, IntValue: 5},
+	})
+	people := func(id uint32, alias string, args ...*proto.FieldArgument) *proto.RGQLQueryTreeNode {
+		return &proto.RGQLQueryTreeNode{
+			Id:        id,
+			FieldName: alias + ": allPeople",
+			Args:      args,
+			Children:  []*proto.RGQLQueryTreeNode{{Id: id + 100, FieldName: "name"}},
+		}
+	}
+	validate := func(data *proto.RGQLQueryTreeNode) error {
+		return qt.ValidateTreeMutation(&proto.RGQLQueryTreeMutation{
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node:      data,
+			}},
+		})
+	}
+
+	// Directives are given inline or by variable.
+	for _, test := range []struct {
+		arg      *proto.FieldArgument
+		inactive bool
+	}{
+		{&proto.FieldArgument{Name: "@include: false"}, true},
+		{&proto.FieldArgument{Name: "@skip: false"}, false},
+		{&proto.FieldArgument{Name: "@skip", VariableId: 1}, true},
+	} {
+		id := uint32(len(qt.Children) + 1)
+		data := people(id, fmt.Sprintf("p%d", id), test.arg)
+		if err := validate(data); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := qt.AddChild(data); err != nil {
+			t.Fatal(err.Error())
+		}
+		if nod := qt.RootNodeMap[id]; nod.Inactive != test.inactive {
+			t.Fatalf("Expected %s to set inactive %v.", test.arg.Name, test.inactive)
+		}
+	}
+	if err := qt.AddChild(people(10, "p1", &proto.FieldArgument{Name: "@include: false"})); err != nil {
+		t.Fatal(err.Error())
+	}
+	if qt.RootNodeMap[10] != qt.RootNodeMap[1] {
+		t.Fatal("Selection with the same inline directive was not merged.")
+	}
+
+	// Values are coerced and checked as field arguments are.
+	for _, test := range []struct {
+		arg      *proto.FieldArgument
+		expected string
+	}{
+		{&proto.FieldArgument{Name: "@include", VariableId: 2}, "Invalid value for directive @include: Expected Boolean, got 5."},
+		{&proto.FieldArgument{Name: "@skip: null"}, "Invalid value for directive @skip: Expected non-null Boolean, got null."},
+		{&proto.FieldArgument{Name: "@skip", VariableId: 9}, "Variable id 9 not found for argument @skip."},
+		{&proto.FieldArgument{Name: `@auth: "admin"`}, `Directive @auth requires an object of arguments, got "admin".`},
+		{&proto.FieldArgument{Name: "@timeout: {ms: soon}"}, `Directive @timeout requires an integer ms argument, got "soon".`},
+	} {
+		data := people(20, "invalid", test.arg)
+		if err := validate(data); err == nil || err.Error() != test.expected {
+			t.Fatalf("Validation did not return expected error %q (%v).", test.expected, err)
+		}
+		if err := qt.AddChild(data); err == nil || err.Error() != test.expected {
+			t.Fatalf("Did not return expected error %q (%v).", test.expected, err)
+		}
+	}
+
+	if err := qt.AddChild(people(30, "admins",
+		&proto.FieldArgument{Name: `@auth: {role: "admin"}`},
+		&proto.FieldArgument{Name: "@timeout: {ms: 50}"},
+	)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if nod := qt.RootNodeMap[30]; nod.Annotations["role"] != "admin" || nod.ResolveTimeout != 50*time.Millisecond {
+		t.Fatalf("Inline directive arguments were not applied: %#v", nod)
+	}
+
+	// The root accepts inline custom directives.
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:   0,
+		Args: []*proto.FieldArgument{{Name: `@auth: {role: "viewer"}`}},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if qt.Annotations["role"] != "viewer" {
+		t.Fatalf("Root directive was not applied: %#v", qt.Annotations)
+	}
+}
+
+func TestFieldAuthorizer(t *testing.T) {
+	sch, err := schema.Parse(schemaSrc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rootQ := sch.Definitions.AllNamed["RootQuery"].(*ast.ObjectDefinition)
+	errCh := make(chan *proto.RGQLQueryError, 10)
+	backoff := time.Millisecond
+	qt := NewQueryTreeWithOptions(rootQ, sch.Definitions, errCh, QueryTreeOptions{RetryBackoff: backoff})
+	var granted int32
+	errRestricted := errors.New("restricted to members")
+	qt.SetFieldAuthorizer(FieldAuthorizerFunc(func(node *QueryTreeNode, fieldName string) (bool, error) {
+		switch fieldName {
+		case "friends":
+			return atomic.LoadInt32(&granted) != 0, nil
+		case "home":
+			return false, errRestricted
+		}
+		return true, nil
+	}))
+
+	data := &proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "allPeople",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{
+				Id:        3,
+				FieldName: "friends",
+				Children:  []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}},
+			},
+		},
+	}
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	friends := qt.RootNodeMap[3]
+	var authErr *AuthorizationError
+	if !errors.As(friends.Error(), &authErr) || authErr.NodeId != 3 || authErr.FieldName != "friends" {
+		t.Fatalf("Denied field was not marked, got %v.", friends.Error())
+	}
+	if qerr := <-errCh; qerr.QueryNodeId != 3 || qerr.Error != "Invalid node 3, not authorized to select field friends." {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+	if qt.RootNodeMap[2].Error() != nil || len(friends.Children) != 1 {
+		t.Fatal("Allowed selections were not kept.")
+	}
+
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        5,
+		FieldName: "person",
+		Args:      []*proto.FieldArgument{{Name: `name: "Ada"`}},
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "home", Children: []*proto.RGQLQueryTreeNode{{Id: 7, FieldName: "name"}}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !errors.Is(qt.RootNodeMap[6].Error(), errRestricted) {
+		t.Fatalf("Authorizer error was not kept, got %v.", qt.RootNodeMap[6].Error())
+	}
+	if qerr := <-errCh; qerr.Error != "Invalid node 6, not authorized to select field home: restricted to members" {
+		t.Fatalf("Unexpected error: %#v", qerr)
+	}
+
+	// Selecting the node again after a grant retries it.
+	atomic.StoreInt32(&granted, 1)
+	time.Sleep(2 * backoff)
+	if err := qt.AddChild(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if friends.Error() != nil {
+		t.Fatalf("Expected the retry to clear the error, got %v.", friends.Error())
+	}
+}
+
+func TestRootDirectives(t *testing.T) {
+	_, qt, _ := buildMockTree(t)
+	qt.RegisterDirective("cached", DirectiveHandlerFunc(func(node *QueryTreeNode, args map[string]interface{}) error {
+		node.Annotate("ttl", args["ttl"])
+		return nil
+	}))
+	ttlVariable := &proto.ASTVariable{
+		Id:    1,
+		Value: &proto.RGQLPrimitive{Kind: proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT, StringValue: "{\"ttl\": 60}"},
+	}
+	rootMutation := func(args ...*proto.FieldArgument) *proto.RGQLQueryTreeMutation {
+		return &proto.RGQLQueryTreeMutation{
+			Variables: []*proto.ASTVariable{ttlVariable},
+			NodeMutation: []*proto.RGQLQueryTreeMutation_NodeMutation{{
+				NodeId:    0,
+				Operation: proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD,
+				Node: &proto.RGQLQueryTreeNode{
+					Id:       0,
+					Args:     args,
+					Children: []*proto.RGQLQueryTreeNode{{Id: 1, FieldName: "allPeople", Children: []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}}}},
+				},
+			}},
+		}
+	}
+
+	for _, tc := range []struct {
+		arg *proto.FieldArgument
+		err string
+	}{
+		{&proto.FieldArgument{Name: "limit", VariableId: 1}, "Invalid argument limit on RootQuery, the root only accepts directives."},
+		{&proto.FieldArgument{Name: "@skip", VariableId: 1}, "Directive @skip cannot be used on the root."},
+		{&proto.FieldArgument{Name: "@unknown", VariableId: 1}, "Unknown directive @unknown."},
+	} {
+		if err := qt.ValidateTreeMutation(rootMutation(tc.arg)); err == nil || err.Error() != tc.err {
+			t.Fatalf("Validation did not return expected error %q (%v).", tc.err, err)
+		}
+		if errs := qt.ApplyTreeMutationErr(rootMutation(tc.arg)); len(errs) != 1 || errs[0].Err.Error() != tc.err {
+			t.Fatalf("Did not return expected error %q (%v).", tc.err, errs)
+		}
+		if len(qt.Children) != 0 {
+			t.Fatal("Children of a rejected root were added.")
+		}
+	}
+
+	mutation := rootMutation(&proto.FieldArgument{Name: "@cached", VariableId: 1})
+	if err := qt.ValidateTreeMutation(mutation); err != nil {
+		t.Fatal(err.Error())
+	}
+	if errs := qt.ApplyTreeMutationErr(mutation); len(errs) != 0 {
+		t.Fatal(errs[0].Error())
+	}
+	if qt.Annotations["ttl"] != float64(60) || qt.Directives["cached"] == nil || len(qt.Children) != 1 {
+		t.Fatalf("Root directive was not applied: %#v", qt.Annotations)
+	}
+	if nod := qt.ToProto(); len(nod.Args) != 1 || nod.Args[0].Name != "@cached" {
+		t.Fatalf("Root directive was not kept in the snapshot: %#v", nod.Args)
+	}
 }
@@ -0,0 +1,77 @@
+package qtree
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// directiveTimeout sets the resolve timeout of a node in milliseconds, as in @timeout(ms: 500).
+// Fields can declare a timeout with the same directive in the schema.
+const directiveTimeout = "timeout"
+
+// resolveTimeout returns the timeout of a node given the field and the directive values, zero for none.
+// A timeout from the query can shorten the timeout declared on the field, but not extend it.
+func resolveTimeout(field *ast.FieldDefinition, directiveValues map[string]interface{}) (time.Duration, error) {
+	timeout := fieldTimeout(field)
+	val, ok := directiveValues[directiveTimeout]
+	if !ok {
+		return timeout, nil
+	}
+	args, err := directiveArguments(directiveTimeout, val)
+	if err != nil {
+		return 0, err
+	}
+	qtimeout, err := timeoutArgument(args["ms"])
+	if err != nil {
+		return 0, err
+	}
+	if timeout == 0 || qtimeout < timeout {
+		timeout = qtimeout
+	}
+	return timeout, nil
+}
+
+// timeoutArgument converts the ms argument of the timeout directive.
+func timeoutArgument(ms interface{}) (time.Duration, error) {
+	var n float64
+	switch v := ms.(type) {
+	case int32:
+		n = float64(v)
+	case float64:
+		// Numbers decoded from JSON objects.
+		n = v
+	default:
+		return 0, fmt.Errorf("Directive @%s requires an integer ms argument, got %#v.", directiveTimeout, ms)
+	}
+	if n != math.Trunc(n) || n <= 0 {
+		return 0, fmt.Errorf("Directive @%s requires a positive integer ms argument, got %v.", directiveTimeout, n)
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// fieldTimeout returns the timeout declared on a field with the timeout directive, zero for none.
+func fieldTimeout(field *ast.FieldDefinition) time.Duration {
+	if field == nil {
+		return 0
+	}
+	for _, directive := range field.Directives {
+		if directive.Name == nil || directive.Name.Value != directiveTimeout {
+			continue
+		}
+		for _, arg := range directive.Arguments {
+			if arg.Name == nil || arg.Name.Value != "ms" {
+				continue
+			}
+			if iv, ok := arg.Value.(*ast.IntValue); ok {
+				if ms, err := strconv.Atoi(iv.Value); err == nil && ms > 0 {
+					return time.Duration(ms) * time.Millisecond
+				}
+			}
+		}
+	}
+	return 0
+}
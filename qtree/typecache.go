@@ -0,0 +1,87 @@
+package qtree
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// typeCacheSize is the number of type definitions a tree keeps cached.
+const typeCacheSize = 128
+
+// typeCache is a SchemaResolver caching the named type lookups of another resolver.
+// Schemas are immutable for the lifetime of a tree, so resolved entries are never invalidated.
+type typeCache struct {
+	resolver SchemaResolver
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	// order holds the cached entries, most recently used first.
+	order *list.List
+}
+
+// typeCacheEntry is a cached type lookup.
+type typeCacheEntry struct {
+	name string
+	def  ast.TypeDefinition
+}
+
+// newTypeCache builds a type cache in front of a schema resolver.
+func newTypeCache(resolver SchemaResolver) *typeCache {
+	return &typeCache{
+		resolver: resolver,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// LookupType looks up a type, serving named types from the cache.
+func (c *typeCache) LookupType(typ ast.Type) ast.TypeDefinition {
+	named, _ := unwrapType(typ)
+	n, ok := named.(*ast.Named)
+	if !ok || n.Name == nil {
+		return c.resolver.LookupType(typ)
+	}
+
+	name := n.Name.Value
+	c.mtx.Lock()
+	if elem, ok := c.entries[name]; ok {
+		c.order.MoveToFront(elem)
+		def := elem.Value.(*typeCacheEntry).def
+		c.mtx.Unlock()
+		return def
+	}
+	c.mtx.Unlock()
+
+	// Failed lookups are not cached, the schema may still be loading.
+	def := c.resolver.LookupType(typ)
+	if def == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.entries[name]; !ok {
+		c.entries[name] = c.order.PushFront(&typeCacheEntry{name: name, def: def})
+		if c.order.Len() > typeCacheSize {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*typeCacheEntry).name)
+		}
+	}
+	return def
+}
+
+// RootType returns the root object of an operation type from the underlying resolver.
+func (c *typeCache) RootType(op OperationType) *ast.ObjectDefinition {
+	return c.resolver.RootType(op)
+}
+
+// LookupImplementations finds the implementations of an interface, if the underlying resolver can.
+func (c *typeCache) LookupImplementations(iface *ast.InterfaceDefinition) []*ast.ObjectDefinition {
+	if ir, ok := c.resolver.(ImplementationResolver); ok {
+		return ir.LookupImplementations(iface)
+	}
+	return nil
+}
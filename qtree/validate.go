@@ -0,0 +1,631 @@
+package qtree
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// validateNode is a virtual node used while validating a mutation.
+type validateNode struct {
+	parent  *validateNode
+	typeDef ast.TypeDefinition
+	level   int
+	// fragment is set on inline fragment and fragment spread nodes.
+	fragment bool
+	deleted  bool
+	// moved is set on nodes moved below another parent by the mutation.
+	moved bool
+
+	// node is the tree node, or a detached copy for added nodes.
+	node *QueryTreeNode
+	// cost is the complexity charged for the node.
+	cost int
+	// children are the nodes added below this node by the mutation.
+	children []*validateNode
+	// existing are the tree nodes below this node.
+	existing []*QueryTreeNode
+	// ids is the number of node IDs the node holds in the tree.
+	ids int
+	// args are the arguments of nodes added by the mutation.
+	args []*proto.FieldArgument
+}
+
+// alive checks if the node and all of its parents still exist.
+func (n *validateNode) alive() bool {
+	for nod := n; nod != nil; nod = nod.parent {
+		if nod.deleted {
+			return false
+		}
+	}
+	return true
+}
+
+// MutationErrors contains every error found while validating a tree mutation.
+type MutationErrors []error
+
+// Error joins the error messages.
+func (e MutationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// mutationValidator applies a mutation to a virtual copy of the tree.
+type mutationValidator struct {
+	root           *QueryTreeNode
+	lookupVariable func(id uint32) (interface{}, bool)
+	// complexity is the estimated cost of the virtual tree.
+	complexity int
+
+	// added contains nodes added by the mutation, by ID.
+	added map[uint32]*validateNode
+	// existing contains virtual nodes for nodes in the tree.
+	existing map[*QueryTreeNode]*validateNode
+	// released contains IDs of merged nodes deleted by the mutation.
+	released map[uint32]bool
+	// nodeCount is the number of node IDs in the virtual tree.
+	nodeCount int
+	// journal contains the nodes added by the mutation, in order.
+	journal []*validateNode
+}
+
+// wrapExisting returns the virtual node for a node in the tree.
+func (v *mutationValidator) wrapExisting(nod *QueryTreeNode) *validateNode {
+	if nod == nil {
+		return nil
+	}
+	if vn, ok := v.existing[nod]; ok {
+		return vn
+	}
+	vn := &validateNode{
+		parent:   v.wrapExisting(nod.Parent),
+		typeDef:  nod.AST,
+		level:    nod.level,
+		fragment: nod.TypeCondition != "",
+		node:     nod,
+		cost:     nod.cost,
+		existing: nod.Children,
+		ids:      1,
+	}
+	if len(nod.refs) != 0 {
+		vn.ids = len(nod.refs)
+	}
+	v.existing[nod] = vn
+	return vn
+}
+
+// lookup finds a live virtual node by ID.
+func (v *mutationValidator) lookup(id uint32) *validateNode {
+	if v.released[id] {
+		return nil
+	}
+	vn, ok := v.added[id]
+	if !ok {
+		nod, nok := v.root.RootNodeMap[id]
+		if !nok {
+			spread, sok := v.root.fragmentSpreads[id]
+			if !sok || len(spread.nodes) == 0 {
+				return nil
+			}
+			// Spreads are not selectable, track them under their parent.
+			sparent := v.wrapExisting(spread.nodes[0].Parent)
+			vn = &validateNode{
+				parent:   sparent,
+				typeDef:  sparent.typeDef,
+				level:    sparent.level,
+				fragment: true,
+				node:     sparent.node,
+				existing: spread.nodes,
+			}
+			v.added[id] = vn
+		} else {
+			vn = v.wrapExisting(nod)
+		}
+	}
+	if !vn.alive() {
+		return nil
+	}
+	return vn
+}
+
+// remove deletes a virtual node and its subtree, refunding the complexity.
+func (v *mutationValidator) remove(vn *validateNode) {
+	if vn.deleted {
+		return
+	}
+	vn.deleted = true
+	v.complexity -= vn.cost
+	v.nodeCount -= vn.ids
+	// Nodes moved away by the mutation are removed with their new parent.
+	for _, nod := range vn.existing {
+		if child := v.wrapExisting(nod); !child.moved {
+			v.remove(child)
+		}
+	}
+	for _, child := range vn.children {
+		if child.parent == vn {
+			v.remove(child)
+		}
+	}
+}
+
+// release deletes one of the IDs of a merged node in the tree.
+// Returns false if the ID is the last reference to the node.
+func (v *mutationValidator) release(vn *validateNode, id uint32) bool {
+	if vn.node == nil || v.existing[vn.node] != vn {
+		return false
+	}
+	for refId := range vn.node.refs {
+		if refId != id && !v.released[refId] {
+			v.released[id] = true
+			vn.ids--
+			v.nodeCount--
+			return true
+		}
+	}
+	return false
+}
+
+// directiveValue resolves the value of a directive argument like ResolveDirectiveArg, looking up the variables
+// of the mutation.
+func (v *mutationValidator) directiveValue(directive string, arg *proto.FieldArgument) (interface{}, error) {
+	if _, literal, isInline := splitInlineArgument(arg.Name); isInline {
+		return inlineDirectiveValue(directive, literal)
+	}
+	val, ok := v.lookupVariable(arg.VariableId)
+	if !ok {
+		return nil, variableNotFoundError(arg)
+	}
+	return coerceDirectiveValue(directive, val)
+}
+
+// addChild validates adding a child tree to a virtual node.
+// Nodes expanded from a fragment spread have no IDs yet and are not tracked by ID.
+func (v *mutationValidator) addChild(parent *validateNode, data *proto.RGQLQueryTreeNode, expanded bool) error {
+	if !expanded && parent.parent == nil && data.Id == parent.node.Id {
+		// Directive handlers are not called for the root, it is not detached.
+		for _, arg := range data.Args {
+			directive, err := v.root.rootDirective(arg)
+			if err != nil {
+				return err
+			}
+			if _, err := v.directiveValue(directive, arg); err != nil {
+				return err
+			}
+		}
+		return v.extend(parent, data)
+	}
+	if !expanded {
+		if existing := v.lookup(data.Id); existing != nil {
+			if !v.isSelection(parent, existing, data) {
+				return fmt.Errorf("Invalid node ID (already exists): %d", data.Id)
+			}
+			if existing.node.pending != nil {
+				// Retried once its type resolves, see retryPending.
+				return nil
+			}
+			return v.extend(existing, data)
+		}
+	}
+
+	if err := checkDepthLimit(v.root.options.MaxDepth, parent.level+1, data.Id); err != nil {
+		return err
+	}
+
+	if name, ok := fragmentSpreadName(data.FieldName); ok {
+		nodes, err := v.root.expandFragmentSpread(parent.typeDef, name)
+		if err != nil {
+			return err
+		}
+		if err := checkDepthLimit(v.root.options.MaxDepth, parent.level+protoDepth(nodes), data.Id); err != nil {
+			return err
+		}
+		spread := &validateNode{
+			parent:   parent,
+			typeDef:  parent.typeDef,
+			level:    parent.level,
+			fragment: true,
+			node:     parent.node,
+		}
+		v.added[data.Id] = spread
+		v.journal = append(v.journal, spread)
+		parent.children = append(parent.children, spread)
+		for _, nod := range nodes {
+			if err := v.addChild(spread, nod, true); err != nil {
+				v.remove(spread)
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := checkNodeLimit(v.root.options.MaxNodes, v.nodeCount, data.Id); err != nil {
+		return err
+	}
+	alias, fieldName := splitFieldAlias(data.FieldName)
+	if err := v.root.checkIntrospection(fieldName); err != nil {
+		return err
+	}
+	sel, err := resolveFieldSelection(v.root.types, parent.typeDef, data)
+	if err != nil {
+		if _, ok := err.(*UnresolvedTypeError); ok && v.root.options.RetryBackoff > 0 {
+			v.addPending(parent, data, expanded)
+			return nil
+		}
+		return err
+	}
+	if sel.typeCondition == "" && v.root.options.RejectDeprecated {
+		if err := deprecationError(data.Id, parent.typeDef, sel.field); err != nil {
+			return err
+		}
+	}
+	if sel.typeCondition == "" {
+		if err := checkFieldArguments(sel.field, data.Args); err != nil {
+			return err
+		}
+		var ancestors []ast.TypeDefinition
+		for nod := parent; nod != nil; nod = nod.parent {
+			if !nod.fragment {
+				ancestors = append(ancestors, nod.typeDef)
+			}
+		}
+		if err := checkTypeRecursion(v.root.options.MaxTypeRecursion, data.Id, sel.typeDef, ancestors); err != nil {
+			return err
+		}
+	}
+
+	argMap := make(map[string]*VariableReference)
+	directiveValues := make(map[string]interface{})
+	for _, arg := range data.Args {
+		name, literal, isInline := splitInlineArgument(arg.Name)
+		if directive, isDirective := directiveArgName(name); isDirective {
+			if err := v.root.checkDirective(directive); err != nil {
+				return err
+			}
+			val, err := v.directiveValue(directive, arg)
+			if err != nil {
+				return err
+			}
+			directiveValues[directive] = val
+			continue
+		}
+		if isInline {
+			ref, err := inlineArgument(v.root.types, sel.field, name, literal)
+			if err != nil {
+				return err
+			}
+			argMap[name] = ref
+			continue
+		}
+		val, ok := v.lookupVariable(arg.VariableId)
+		if !ok {
+			return variableNotFoundError(arg)
+		}
+		val, err := coerceFieldArgument(v.root.types, sel.field, arg.Name, val)
+		if err != nil {
+			return err
+		}
+		argMap[arg.Name] = NewConstantReference(val)
+	}
+	if err := defaultArguments(sel.field, argMap); err != nil {
+		return err
+	}
+	if err := sel.checkSelections(data); err != nil {
+		return err
+	}
+	timeout, err := resolveTimeout(sel.field, directiveValues)
+	if err != nil {
+		return err
+	}
+	incremental, err := resolveIncremental(data.Id, sel.isList, directiveValues)
+	if err != nil {
+		return err
+	}
+
+	nnod := &validateNode{
+		parent:   parent,
+		typeDef:  sel.typeDef,
+		level:    parent.level + 1,
+		fragment: sel.typeCondition != "",
+		ids:      1,
+		args:     data.Args,
+		node: &QueryTreeNode{
+			Id:             data.Id,
+			level:          parent.level + 1,
+			Parent:         parent.node,
+			Root:           v.root,
+			FieldName:      fieldName,
+			ResolverName:   v.root.options.resolverName(fieldName),
+			Alias:          alias,
+			AST:            sel.typeDef,
+			fieldDef:       sel.field,
+			IsPrimitive:    sel.isPrimitive,
+			PrimitiveName:  sel.primitiveName,
+			IsList:         sel.isList,
+			ListDepth:      sel.listDepth,
+			Arguments:      argMap,
+			immutableArgs:  immutableArguments(sel.field),
+			TypeCondition:  sel.typeCondition,
+			ResolveTimeout: timeout,
+			Incremental:    incremental,
+		},
+	}
+	if err := v.root.handleDirectives(nnod.node, directiveValues); err != nil {
+		return err
+	}
+	if err := v.chargeComplexity(nnod); err != nil {
+		return err
+	}
+	v.nodeCount++
+	v.journal = append(v.journal, nnod)
+	if !expanded {
+		v.added[data.Id] = nnod
+	}
+	parent.children = append(parent.children, nnod)
+	for _, child := range data.Children {
+		if err := v.addChild(nnod, child, expanded); err != nil {
+			v.remove(nnod)
+			return err
+		}
+	}
+	return nil
+}
+
+// addPending tracks a node kept in the tree after its type failed to resolve, see keepPending.
+func (v *mutationValidator) addPending(parent *validateNode, data *proto.RGQLQueryTreeNode, expanded bool) {
+	alias, fieldName := splitFieldAlias(data.FieldName)
+	nnod := &validateNode{
+		parent: parent,
+		level:  parent.level + 1,
+		ids:    1,
+		args:   data.Args,
+		node: &QueryTreeNode{
+			Id:        data.Id,
+			level:     parent.level + 1,
+			Parent:    parent.node,
+			Root:      v.root,
+			FieldName: fieldName,
+			Alias:     alias,
+			pending:   data,
+		},
+	}
+	v.nodeCount++
+	v.journal = append(v.journal, nnod)
+	if !expanded {
+		v.added[data.Id] = nnod
+	}
+	parent.children = append(parent.children, nnod)
+}
+
+// isSelection checks if a virtual node is the selection a child tree adds again below parent.
+func (v *mutationValidator) isSelection(parent, vn *validateNode, data *proto.RGQLQueryTreeNode) bool {
+	if vn.parent != parent || vn.node == nil || vn.node == parent.node {
+		return false
+	}
+	alias, fieldName := splitFieldAlias(data.FieldName)
+	if vn.node.Alias != alias || vn.node.FieldName != fieldName {
+		return false
+	}
+	if v.existing[vn.node] == vn {
+		if vn.node.pending != nil {
+			return sameProtoArguments(vn.node.pending.Args, data.Args)
+		}
+		return vn.node.sameArguments(data.Args)
+	}
+	return sameFieldArguments(vn.args, data.Args)
+}
+
+// extend validates adding the children of a child tree selecting a virtual node again.
+// If any child fails, the nodes added while extending are removed again.
+func (v *mutationValidator) extend(vn *validateNode, data *proto.RGQLQueryTreeNode) error {
+	mark := len(v.journal)
+	for _, child := range data.Children {
+		if err := v.addChild(vn, child, false); err != nil {
+			for _, added := range v.journal[mark:] {
+				v.remove(added)
+			}
+			v.journal = v.journal[:mark]
+			return err
+		}
+	}
+	return nil
+}
+
+// sameFieldArguments checks if two argument lists reference the same variables, in any order.
+func sameFieldArguments(a, b []*proto.FieldArgument) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	refs := make(map[string]uint32, len(a))
+	for _, arg := range a {
+		refs[arg.Name] = arg.VariableId
+	}
+	for _, arg := range b {
+		if id, ok := refs[arg.Name]; !ok || id != arg.VariableId {
+			return false
+		}
+	}
+	return true
+}
+
+// reparent validates moving the virtual node with the given ID below parent.
+// The depth of the moved subtree is checked, its complexity is not charged again.
+func (v *mutationValidator) reparent(parent *validateNode, id uint32) error {
+	vn := v.lookup(id)
+	if vn == nil || vn.node == nil || vn.node.Id != id {
+		return fmt.Errorf("Invalid node ID (not found): %d", id)
+	}
+	if vn.parent == parent {
+		return nil
+	}
+	if vn.parent == nil {
+		return fmt.Errorf("Invalid node %d, the root cannot be moved.", id)
+	}
+	for nod := parent; nod != nil; nod = nod.parent {
+		if nod == vn {
+			return fmt.Errorf("Invalid node %d, cannot be moved below itself.", id)
+		}
+	}
+	if vn.ids > 1 || vn.node.fragmentSpreadId != 0 || id&serverNodeIdFlag != 0 {
+		return fmt.Errorf("Invalid node %d, merged and generated selections cannot be moved.", id)
+	}
+	args := vn.args
+	if v.existing[vn.node] == vn {
+		args = vn.node.protoArgs()
+	}
+	if _, err := v.root.checkMove(v.root.types, parent.typeDef, vn.node, args); err != nil {
+		return err
+	}
+	if err := checkDepthLimit(v.root.options.MaxDepth, parent.level+v.height(vn), id); err != nil {
+		return err
+	}
+	vn.parent = parent
+	vn.moved = true
+	parent.children = append(parent.children, vn)
+	return nil
+}
+
+// height returns the number of levels in the live subtree of a virtual node.
+func (v *mutationValidator) height(vn *validateNode) int {
+	max := 0
+	for _, nod := range vn.existing {
+		if child := v.wrapExisting(nod); !child.deleted && !child.moved {
+			if h := v.height(child); h > max {
+				max = h
+			}
+		}
+	}
+	for _, child := range vn.children {
+		if !child.deleted && child.parent == vn {
+			if h := v.height(child); h > max {
+				max = h
+			}
+		}
+	}
+	return max + 1
+}
+
+// chargeComplexity adds the cost of a virtual node to the virtual tree total.
+func (v *mutationValidator) chargeComplexity(vn *validateNode) error {
+	opts := v.root.options
+	if opts.Complexity == nil {
+		return nil
+	}
+
+	cost := opts.Complexity.Cost(vn.node)
+	if opts.MaxComplexity > 0 && v.complexity+cost > opts.MaxComplexity {
+		return fmt.Errorf("Invalid node %d, exceeds the maximum complexity of %d.", vn.node.Id, opts.MaxComplexity)
+	}
+	vn.cost = cost
+	v.complexity += cost
+	return nil
+}
+
+// validateTreeMutation checks a tree mutation, expects the root lock to be held.
+// Returns every error that applying the mutation would produce.
+func (qt *QueryTreeNode) validateTreeMutation(mutation *proto.RGQLQueryTreeMutation) MutationErrors {
+	var errs MutationErrors
+	pendingVariables := make(map[uint32]interface{})
+	for _, variable := range mutation.Variables {
+		val, err := qt.VariableStore.check(variable)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pendingVariables[variable.Id] = val
+	}
+
+	v := &mutationValidator{
+		root: qt.Root,
+		lookupVariable: func(id uint32) (interface{}, bool) {
+			if val, ok := pendingVariables[id]; ok {
+				return val, true
+			}
+			return qt.VariableStore.Value(id)
+		},
+		complexity: qt.Root.complexity,
+		added:      make(map[uint32]*validateNode),
+		existing:   make(map[*QueryTreeNode]*validateNode),
+		released:   make(map[uint32]bool),
+		nodeCount:  len(qt.Root.RootNodeMap),
+	}
+
+	var vacated []*validateNode
+	for _, aqn := range qt.orderNodeMutations(mutation, nil) {
+		if err := qt.checkFrozen(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nod := v.lookup(aqn.NodeId)
+		if nod == nil {
+			errs = append(errs, fmt.Errorf("Invalid node ID (not found): %d", aqn.NodeId))
+			continue
+		}
+
+		switch aqn.Operation {
+		case proto.RGQLQueryTreeMutation_SUBTREE_ADD_CHILD:
+			if aqn.Node == nil {
+				errs = append(errs, fmt.Errorf("Invalid mutation on node %d, no child given.", aqn.NodeId))
+				continue
+			}
+			if _, err := checkUniqueIds(aqn.Node); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := v.addChild(nod, aqn.Node, false); err != nil {
+				errs = append(errs, err)
+			}
+		case proto.RGQLQueryTreeMutation_SUBTREE_DELETE:
+			if aqn.NodeId != 0 && !v.release(nod, aqn.NodeId) {
+				vacated = append(vacated, nod.parent)
+				v.remove(nod)
+			}
+		case SubtreeReparent:
+			if aqn.Node == nil {
+				errs = append(errs, fmt.Errorf("Invalid mutation on node %d, no child given.", aqn.NodeId))
+				continue
+			}
+			if moved := v.lookup(aqn.Node.Id); moved != nil && moved.parent != nil {
+				vacated = append(vacated, moved.parent)
+			}
+			if err := v.reparent(nod, aqn.Node.Id); err != nil {
+				errs = append(errs, err)
+			}
+		case SubtreeSetArgs:
+			if aqn.Node == nil {
+				errs = append(errs, fmt.Errorf("Invalid mutation on node %d, no child given.", aqn.NodeId))
+				continue
+			}
+			if err := v.setArgs(nod, aqn.NodeId, aqn.Node.Args); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			errs = append(errs, unknownOperationError(aqn))
+		}
+	}
+
+	return append(errs, v.checkSelectionsLeft(vacated)...)
+}
+
+// unknownOperationError builds the error for a node mutation with an operation that is not one of the named
+// operations of the proto or the extended operations.
+func unknownOperationError(aqn *proto.RGQLQueryTreeMutation_NodeMutation) error {
+	return fmt.Errorf("Invalid mutation on node %d, unknown operation %d.", aqn.NodeId, aqn.Operation)
+}
+
+// ValidateTreeMutation checks a tree mutation without applying it.
+// Returns the first error that applying the mutation would produce.
+func (qt *QueryTreeNode) ValidateTreeMutation(mutation *proto.RGQLQueryTreeMutation) error {
+	unlock := qt.rlockTree()
+	defer unlock()
+
+	if errs := qt.validateTreeMutation(mutation); len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
@@ -1,8 +1,13 @@
 package qtree
 
 import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 
+	"github.com/graphql-go/graphql/language/ast"
 	proto "github.com/rgraphql/rgraphql/pkg/proto"
 )
 
@@ -10,18 +15,48 @@ import (
 type VariableStore struct {
 	Variables map[uint32]*Variable
 
-	mtx sync.Mutex
+	mtx         sync.Mutex
+	subCtr      uint32
+	subscribers map[uint32]map[uint32]chan interface{}
+	// defaults are the values of variables used when no value was put.
+	defaults map[uint32]interface{}
+	// types are the declared types values are validated against when put.
+	types map[uint32]ast.Type
+	// tree is the root of the query tree holding references to the store, if any.
+	tree *QueryTreeNode
 }
 
 func NewVariableStore() *VariableStore {
 	return &VariableStore{
-		Variables: make(map[uint32]*Variable),
+		Variables:   make(map[uint32]*Variable),
+		subscribers: make(map[uint32]map[uint32]chan interface{}),
+		defaults:    make(map[uint32]interface{}),
 	}
 }
 
 // unpackValue converts a Primitive into a Go value.
+// Object and array values carry their JSON encoding in the string value, a missing primitive is null.
 func unpackValue(prim *proto.RGQLPrimitive) interface{} {
+	if prim == nil {
+		return nil
+	}
 	switch prim.Kind {
+	case proto.RGQLPrimitive_PRIMITIVE_KIND_OBJECT:
+		obj := make(map[string]interface{})
+		if prim.GetStringValue() != "" {
+			if err := json.Unmarshal([]byte(prim.GetStringValue()), &obj); err != nil {
+				return nil
+			}
+		}
+		return obj
+	case proto.RGQLPrimitive_PRIMITIVE_KIND_ARRAY:
+		arr := []interface{}{}
+		if prim.GetStringValue() != "" {
+			if err := json.Unmarshal([]byte(prim.GetStringValue()), &arr); err != nil {
+				return nil
+			}
+		}
+		return arr
 	case proto.RGQLPrimitive_PRIMITIVE_KIND_BOOL:
 		return prim.GetBoolValue()
 	case proto.RGQLPrimitive_PRIMITIVE_KIND_INT:
@@ -35,29 +70,180 @@ func unpackValue(prim *proto.RGQLPrimitive) interface{} {
 	}
 }
 
-func (vs *VariableStore) Put(varb *proto.ASTVariable) {
+// Put stores a variable value, returns true if an existing variable changed value.
+// Values invalid for the declared type of the variable are not stored, use TryPut to get the error.
+func (vs *VariableStore) Put(varb *proto.ASTVariable) bool {
+	changed, _ := vs.TryPut(varb)
+	return changed
+}
+
+// TryPut validates and stores a variable value, returns true if an existing variable changed value.
+// Values of variables with a declared type are coerced to it, an invalid value is not stored and returns an error.
+func (vs *VariableStore) TryPut(varb *proto.ASTVariable) (bool, error) {
 	vs.mtx.Lock()
 	defer vs.mtx.Unlock()
 
+	val, err := vs.validate(varb.Id, unpackValue(varb.Value))
+	if err != nil {
+		return false, err
+	}
 	vb, eok := vs.Variables[varb.Id]
 	if !eok {
 		vb = NewVariable(varb.Id)
 	}
-	vb.Value = unpackValue(varb.Value)
+	changed := eok && !reflect.DeepEqual(vb.Value, val)
+	vb.Value = val
 	vs.Variables[varb.Id] = vb
+	if !eok || changed {
+		vs.notify(varb.Id, val)
+	}
+	return changed, nil
+}
+
+// DeclareType registers the type of a variable declared by the operation, as in query($limit: Int!).
+// Values put afterwards are checked against the type, missing values of non-null types are rejected.
+func (vs *VariableStore) DeclareType(id uint32, typ ast.Type) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	if vs.types == nil {
+		vs.types = make(map[uint32]ast.Type)
+	}
+	vs.types[id] = typ
+}
+
+// check returns the value a variable would be stored with, or the error TryPut would return.
+func (vs *VariableStore) check(varb *proto.ASTVariable) (interface{}, error) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	return vs.validate(varb.Id, unpackValue(varb.Value))
+}
+
+// validate checks a value against the declared type of the variable, returning the coerced value.
+// Expects mtx to be held.
+func (vs *VariableStore) validate(id uint32, val interface{}) (interface{}, error) {
+	typ, ok := vs.types[id]
+	if !ok {
+		return val, nil
+	}
+	var schemaResolver SchemaResolver
+	if vs.tree != nil {
+		schemaResolver = vs.tree.types
+	}
+	cval, err := coerceArgument(schemaResolver, typ, val)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for variable %d of type %s: %v", id, typeString(typ), err)
+	}
+	return cval, nil
+}
+
+// PutDefault registers the default value of a variable declared by the operation, as in query($limit: Int = 10).
+// The default is used by variables looked up without a value, including after the value was garbage collected.
+func (vs *VariableStore) PutDefault(varb *proto.ASTVariable) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	if vs.defaults == nil {
+		vs.defaults = make(map[uint32]interface{})
+	}
+	vs.defaults[varb.Id] = unpackValue(varb.Value)
+}
+
+// lookup finds a variable, creating it from the default value if there is one.
+// Expects mtx to be held.
+func (vs *VariableStore) lookup(id uint32) *Variable {
+	if existing, ok := vs.Variables[id]; ok && existing != nil {
+		return existing
+	}
+	def, ok := vs.defaults[id]
+	if !ok {
+		return nil
+	}
+	vb := NewVariable(id)
+	vb.Value = def
+	vs.Variables[id] = vb
+	return vb
+}
+
+// Subscribe delivers the new values of a variable until the returned cancel func is called.
+// Slow subscribers only receive the latest value.
+func (vs *VariableStore) Subscribe(variableId uint32) (<-chan interface{}, func()) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	if vs.subscribers == nil {
+		vs.subscribers = make(map[uint32]map[uint32]chan interface{})
+	}
+	vs.subCtr++
+	id := vs.subCtr
+	ch := make(chan interface{}, 1)
+	subs, ok := vs.subscribers[variableId]
+	if !ok {
+		subs = make(map[uint32]chan interface{})
+		vs.subscribers[variableId] = subs
+	}
+	subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			vs.mtx.Lock()
+			defer vs.mtx.Unlock()
+
+			delete(subs, id)
+			if len(subs) == 0 {
+				delete(vs.subscribers, variableId)
+			}
+			close(ch)
+		})
+	}
+}
+
+// notify delivers a variable value to subscribers, expects mtx to be held.
+func (vs *VariableStore) notify(variableId uint32, val interface{}) {
+	for _, ch := range vs.subscribers[variableId] {
+		// Replace any value not yet received.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- val
+	}
 }
 
 func (vs *VariableStore) Get(id uint32) *VariableReference {
 	vs.mtx.Lock()
 	defer vs.mtx.Unlock()
 
-	existing, ok := vs.Variables[id]
-	if ok && existing != nil {
+	if existing := vs.lookup(id); existing != nil {
 		return existing.AddReference()
 	}
 	return nil
 }
 
+// Has checks if a variable exists or has a default without adding a reference.
+func (vs *VariableStore) Has(id uint32) bool {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	_, ok := vs.Variables[id]
+	_, dok := vs.defaults[id]
+	return ok || dok
+}
+
+// Value returns the current value of a variable.
+func (vs *VariableStore) Value(id uint32) (interface{}, bool) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	if existing, ok := vs.Variables[id]; ok && existing != nil {
+		return existing.Value, true
+	}
+	def, ok := vs.defaults[id]
+	return def, ok
+}
+
 func (vs *VariableStore) GarbageCollect() {
 	vs.mtx.Lock()
 	defer vs.mtx.Unlock()
@@ -69,6 +255,37 @@ func (vs *VariableStore) GarbageCollect() {
 	}
 }
 
+// Leaked returns the ids of variables with references not held by any live node in the tree.
+// A leaked reference usually means a VariableReference was never unsubscribed.
+func (vs *VariableStore) Leaked() []uint32 {
+	live := make(map[*VariableReference]struct{})
+	if vs.tree != nil {
+		unlock := vs.tree.rlockTree()
+		defer unlock()
+
+		for _, node := range vs.tree.RootNodeMap {
+			for _, ref := range node.Arguments {
+				live[ref] = struct{}{}
+			}
+			for _, ref := range node.Directives {
+				live[ref] = struct{}{}
+			}
+		}
+	}
+
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+
+	var leaked []uint32
+	for id, varb := range vs.Variables {
+		if varb.hasReferencesOutside(live) {
+			leaked = append(leaked, id)
+		}
+	}
+	sort.Slice(leaked, func(i, j int) bool { return leaked[i] < leaked[j] })
+	return leaked
+}
+
 type Variable struct {
 	Id         uint32
 	Value      interface{}
@@ -91,6 +308,19 @@ func (v *Variable) HasReferences() bool {
 	return len(v.References) > 0
 }
 
+// hasReferencesOutside checks if any reference to the variable is missing from live.
+func (v *Variable) hasReferencesOutside(live map[*VariableReference]struct{}) bool {
+	v.refMtx.RLock()
+	defer v.refMtx.RUnlock()
+
+	for _, ref := range v.References {
+		if _, ok := live[ref]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (v *Variable) AddReference() *VariableReference {
 	v.refMtx.Lock()
 	defer v.refMtx.Unlock()
@@ -116,7 +346,26 @@ type VariableReference struct {
 	once  sync.Once
 }
 
+// NewConstantReference builds a reference to a constant value not backed by a variable.
+func NewConstantReference(value interface{}) *VariableReference {
+	return &VariableReference{Value: value}
+}
+
+// IsConstant checks if the reference holds a constant value instead of a variable.
+func (vr *VariableReference) IsConstant() bool {
+	return vr.vb == nil
+}
+
+// IsList checks if the referenced value is a list.
+func (vr *VariableReference) IsList() bool {
+	_, ok := vr.Value.([]interface{})
+	return ok
+}
+
 func (vr *VariableReference) Unsubscribe() {
+	if vr.vb == nil {
+		return
+	}
 	vr.once.Do(func() {
 		vr.vb.refMtx.Lock()
 		defer vr.vb.refMtx.Unlock()
@@ -0,0 +1,47 @@
+package qtree
+
+import (
+	"fmt"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// SchemaMismatchError is returned for a mutation built against another version of the schema.
+// The client should fetch the schema again and rebuild its query.
+type SchemaMismatchError struct {
+	// Version is the schema version of the tree.
+	Version string
+	// MutationVersion is the schema version the mutation was built against.
+	MutationVersion string
+}
+
+// Error returns the error message.
+func (e *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("Invalid mutation, schema version %s does not match %s.", e.MutationVersion, e.Version)
+}
+
+// SchemaVersion returns the version of the schema the tree is built with, given by the SchemaVersion option.
+func (qt *QueryTreeNode) SchemaVersion() string {
+	return qt.Root.options.SchemaVersion
+}
+
+// CheckSchemaVersion checks that a client built its query against the schema version of the tree.
+// An empty version, or a tree without the SchemaVersion option, is not checked.
+func (qt *QueryTreeNode) CheckSchemaVersion(version string) error {
+	treeVersion := qt.SchemaVersion()
+	if version == "" || treeVersion == "" || version == treeVersion {
+		return nil
+	}
+	return &SchemaMismatchError{Version: treeVersion, MutationVersion: version}
+}
+
+// ApplyTreeMutationVersioned applies a tree mutation built against the schema version like ApplyTreeMutationErr.
+// If the version does not match the tree, none of the mutation is applied and a *SchemaMismatchError is
+// reported on node 0 and returned as the only error.
+func (qt *QueryTreeNode) ApplyTreeMutationVersioned(mutation *proto.RGQLQueryTreeMutation, schemaVersion string) []*NodeMutationError {
+	if err := qt.CheckSchemaVersion(schemaVersion); err != nil {
+		qt.Root.sendError(0, err)
+		return []*NodeMutationError{{NodeId: 0, Err: err}}
+	}
+	return qt.ApplyTreeMutationErr(mutation)
+}
@@ -0,0 +1,20 @@
+package qtree
+
+// Walk visits the subtree in pre-order, skipping the children of nodes for which fn returns false.
+// The root lock is held for reading during the walk, fn must not mutate the tree.
+func (qt *QueryTreeNode) Walk(fn func(*QueryTreeNode) bool) {
+	unlock := qt.rlockSubtree()
+	defer unlock()
+
+	qt.walk(fn)
+}
+
+// walk visits the subtree in pre-order, expects the root lock to be held.
+func (qt *QueryTreeNode) walk(fn func(*QueryTreeNode) bool) {
+	if !fn(qt) {
+		return
+	}
+	for _, child := range qt.Children {
+		child.walk(fn)
+	}
+}
@@ -1,7 +1,10 @@
 package schema
 
 import (
+	"sort"
+
 	"github.com/graphql-go/graphql/language/ast"
+	"github.com/rgraphql/magellan/qtree"
 	"github.com/rgraphql/magellan/types"
 )
 
@@ -15,6 +18,8 @@ type ASTParts struct {
 	Objects          map[string]*ast.ObjectDefinition
 	Enums            map[string]*ast.EnumDefinition
 	Unions           map[string]*ast.UnionDefinition
+	Interfaces       map[string]*ast.InterfaceDefinition
+	InputObjects     map[string]*ast.InputObjectDefinition
 	SchemaOperations map[string]*ast.OperationTypeDefinition
 	AllNamed         map[string]ast.Node
 
@@ -78,12 +83,46 @@ func (ap *ASTParts) Apply(other *ASTParts) {
 		if ud, ok := typ.(*ast.UnionDefinition); ok {
 			ap.Unions[name] = ud
 		}
+		if id, ok := typ.(*ast.InterfaceDefinition); ok {
+			ap.Interfaces[name] = id
+		}
+		if iod, ok := typ.(*ast.InputObjectDefinition); ok {
+			ap.InputObjects[name] = iod
+		}
 		if td, ok := typ.(ast.TypeDefinition); ok {
 			ap.Types[name] = td
 		}
 	}
 }
 
+// defaultRootNames are the root type names used when the schema block omits an operation.
+var defaultRootNames = map[qtree.OperationType]string{
+	qtree.OperationQuery:        "Query",
+	qtree.OperationMutation:     "Mutation",
+	qtree.OperationSubscription: "Subscription",
+}
+
+// RootType returns the root object of an operation type.
+// Without a schema block, the object with the default name, like Query, is used.
+func (ap *ASTParts) RootType(op qtree.OperationType) *ast.ObjectDefinition {
+	var root ast.TypeDefinition
+	switch op {
+	case qtree.OperationQuery:
+		root = ap.RootQuery
+	case qtree.OperationMutation:
+		root = ap.RootMutation
+	case qtree.OperationSubscription:
+		root = ap.RootSubscription
+	}
+	if obj, ok := root.(*ast.ObjectDefinition); ok && obj != nil {
+		return obj
+	}
+	if root == nil && len(ap.Schemas) == 0 {
+		return ap.Objects[defaultRootNames[op]]
+	}
+	return nil
+}
+
 // LookupType finds what the GraphQL type `typ` is pointing to.
 func (ap *ASTParts) LookupType(typ ast.Type) (atd ast.TypeDefinition) {
 	if nn, ok := typ.(*ast.NonNull); ok {
@@ -106,6 +145,26 @@ func (ap *ASTParts) LookupType(typ ast.Type) (atd ast.TypeDefinition) {
 	}
 }
 
+// LookupImplementations finds all object types implementing an interface.
+func (ap *ASTParts) LookupImplementations(iface *ast.InterfaceDefinition) []*ast.ObjectDefinition {
+	if iface == nil || iface.Name == nil {
+		return nil
+	}
+	var res []*ast.ObjectDefinition
+	for _, od := range ap.Objects {
+		for _, impl := range od.Interfaces {
+			if impl.Name != nil && impl.Name.Value == iface.Name.Value {
+				res = append(res, od)
+				break
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name.Value < res[j].Name.Value
+	})
+	return res
+}
+
 // DocumentToParts classifies the parts of a ast.Document in an AstParts
 func DocumentToParts(doc *ast.Document) *ASTParts {
 	pts := &ASTParts{
@@ -113,6 +172,8 @@ func DocumentToParts(doc *ast.Document) *ASTParts {
 		Objects:          make(map[string]*ast.ObjectDefinition),
 		Enums:            make(map[string]*ast.EnumDefinition),
 		Unions:           make(map[string]*ast.UnionDefinition),
+		Interfaces:       make(map[string]*ast.InterfaceDefinition),
+		InputObjects:     make(map[string]*ast.InputObjectDefinition),
 		SchemaOperations: make(map[string]*ast.OperationTypeDefinition),
 		AllNamed:         make(map[string]ast.Node),
 	}
@@ -141,6 +202,18 @@ func DocumentToParts(doc *ast.Document) *ASTParts {
 			}
 			pts.Types[tdef.Name.Value] = tdef
 			pts.Enums[tdef.Name.Value] = tdef
+		case *ast.InterfaceDefinition:
+			if tdef.Name == nil || tdef.Name.Value == "" {
+				break
+			}
+			pts.Types[tdef.Name.Value] = tdef
+			pts.Interfaces[tdef.Name.Value] = tdef
+		case *ast.InputObjectDefinition:
+			if tdef.Name == nil || tdef.Name.Value == "" {
+				break
+			}
+			pts.Types[tdef.Name.Value] = tdef
+			pts.InputObjects[tdef.Name.Value] = tdef
 		}
 		if nm, ok := def.(namedAstNode); ok {
 			name := nm.GetName()
@@ -0,0 +1,254 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/rgraphql/magellan/qtree"
+	"github.com/rgraphql/magellan/types"
+)
+
+// NewSchemaResolverFromSchema maps the type registry of a graphql-go schema onto a schema resolver.
+// The types are converted to the AST definitions parsing the equivalent SDL would give, so query trees
+// resolve them like a parsed schema. Introspection types are left out, the resolver adds its own.
+func NewSchemaResolverFromSchema(s *graphql.Schema) qtree.SchemaResolver {
+	return FromDocument(schemaDocument(s)).Definitions
+}
+
+// schemaDocument builds an AST document with the types and operation roots of a graphql-go schema.
+func schemaDocument(s *graphql.Schema) *ast.Document {
+	doc := &ast.Document{Kind: "Document"}
+	typeMap := s.TypeMap()
+	names := make([]string, 0, len(typeMap))
+	for name := range typeMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		if def := typeDefinition(typeMap[name]); def != nil {
+			doc.Definitions = append(doc.Definitions, def)
+		}
+	}
+
+	schemaDef := &ast.SchemaDefinition{Kind: "SchemaDefinition"}
+	for _, op := range []struct {
+		operation string
+		root      *graphql.Object
+	}{
+		{"query", s.QueryType()},
+		{"mutation", s.MutationType()},
+		{"subscription", s.SubscriptionType()},
+	} {
+		if op.root == nil {
+			continue
+		}
+		schemaDef.OperationTypes = append(schemaDef.OperationTypes, &ast.OperationTypeDefinition{
+			Kind:      "OperationTypeDefinition",
+			Operation: op.operation,
+			Type:      astNamed(op.root.Name()),
+		})
+	}
+	doc.Definitions = append(doc.Definitions, schemaDef)
+	return doc
+}
+
+// typeDefinition converts a named graphql-go type, nil for the built-in scalars.
+func typeDefinition(typ graphql.Type) ast.Node {
+	switch t := typ.(type) {
+	case *graphql.Object:
+		def := &ast.ObjectDefinition{
+			Kind:   "ObjectDefinition",
+			Name:   astName(t.Name()),
+			Fields: fieldDefinitions(t.Fields()),
+		}
+		for _, iface := range t.Interfaces() {
+			def.Interfaces = append(def.Interfaces, astNamed(iface.Name()))
+		}
+		return def
+	case *graphql.Interface:
+		return &ast.InterfaceDefinition{
+			Kind:   "InterfaceDefinition",
+			Name:   astName(t.Name()),
+			Fields: fieldDefinitions(t.Fields()),
+		}
+	case *graphql.Union:
+		def := &ast.UnionDefinition{Kind: "UnionDefinition", Name: astName(t.Name())}
+		for _, obj := range t.Types() {
+			def.Types = append(def.Types, astNamed(obj.Name()))
+		}
+		return def
+	case *graphql.Enum:
+		def := &ast.EnumDefinition{Kind: "EnumDefinition", Name: astName(t.Name())}
+		for _, val := range t.Values() {
+			def.Values = append(def.Values, &ast.EnumValueDefinition{
+				Kind:       "EnumValueDefinition",
+				Name:       astName(val.Name),
+				Directives: deprecatedDirectives(val.DeprecationReason),
+			})
+		}
+		sort.Slice(def.Values, func(i, j int) bool {
+			return def.Values[i].Name.Value < def.Values[j].Name.Value
+		})
+		return def
+	case *graphql.InputObject:
+		def := &ast.InputObjectDefinition{Kind: "InputObjectDefinition", Name: astName(t.Name())}
+		for name, field := range t.Fields() {
+			def.Fields = append(def.Fields, inputValueDefinition(name, field.Type, field.DefaultValue))
+		}
+		sort.Slice(def.Fields, func(i, j int) bool {
+			return def.Fields[i].Name.Value < def.Fields[j].Name.Value
+		})
+		return def
+	case *graphql.Scalar:
+		if _, ok := types.GraphQLPrimitives[t.Name()]; ok {
+			return nil
+		}
+		return &ast.ScalarDefinition{Kind: "ScalarDefinition", Name: astName(t.Name())}
+	}
+	return nil
+}
+
+// fieldDefinitions converts the fields of an object or interface, sorted by name.
+func fieldDefinitions(fields graphql.FieldDefinitionMap) []*ast.FieldDefinition {
+	res := make([]*ast.FieldDefinition, 0, len(fields))
+	for name, field := range fields {
+		def := &ast.FieldDefinition{
+			Kind:       "FieldDefinition",
+			Name:       astName(name),
+			Type:       astType(field.Type),
+			Directives: deprecatedDirectives(field.DeprecationReason),
+		}
+		for _, arg := range field.Args {
+			def.Arguments = append(def.Arguments, inputValueDefinition(arg.Name(), arg.Type, arg.DefaultValue))
+		}
+		sort.Slice(def.Arguments, func(i, j int) bool {
+			return def.Arguments[i].Name.Value < def.Arguments[j].Name.Value
+		})
+		res = append(res, def)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name.Value < res[j].Name.Value
+	})
+	return res
+}
+
+// inputValueDefinition converts an argument or input field with its default value, if it can be represented.
+func inputValueDefinition(name string, typ graphql.Input, defaultValue interface{}) *ast.InputValueDefinition {
+	return &ast.InputValueDefinition{
+		Kind:         "InputValueDefinition",
+		Name:         astName(name),
+		Type:         astType(typ),
+		DefaultValue: astValue(typ, defaultValue),
+	}
+}
+
+// deprecatedDirectives returns the @deprecated directive for a deprecation reason, if any.
+func deprecatedDirectives(reason string) []*ast.Directive {
+	if reason == "" {
+		return nil
+	}
+	return []*ast.Directive{{
+		Kind: "Directive",
+		Name: astName("deprecated"),
+		Arguments: []*ast.Argument{{
+			Kind:  "Argument",
+			Name:  astName("reason"),
+			Value: &ast.StringValue{Kind: "StringValue", Value: reason},
+		}},
+	}}
+}
+
+// astType converts a graphql-go type reference, unwrapping lists and non-null types.
+func astType(typ graphql.Type) ast.Type {
+	switch t := typ.(type) {
+	case *graphql.NonNull:
+		return &ast.NonNull{Kind: "NonNull", Type: astType(t.OfType)}
+	case *graphql.List:
+		return &ast.List{Kind: "List", Type: astType(t.OfType)}
+	}
+	return astNamed(typ.Name())
+}
+
+// astValue converts a graphql-go default value of a type, nil if there is none or it cannot be represented.
+func astValue(typ graphql.Type, val interface{}) ast.Value {
+	if val == nil {
+		return nil
+	}
+	switch t := typ.(type) {
+	case *graphql.NonNull:
+		return astValue(t.OfType, val)
+	case *graphql.List:
+		rv := reflect.ValueOf(val)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			// A single value is coerced to a list of one.
+			return astValue(t.OfType, val)
+		}
+		list := &ast.ListValue{Kind: "ListValue"}
+		for i := 0; i < rv.Len(); i++ {
+			item := astValue(t.OfType, rv.Index(i).Interface())
+			if item == nil {
+				return nil
+			}
+			list.Values = append(list.Values, item)
+		}
+		return list
+	case *graphql.Enum:
+		for _, ev := range t.Values() {
+			if reflect.DeepEqual(ev.Value, val) {
+				return &ast.EnumValue{Kind: "EnumValue", Value: ev.Name}
+			}
+		}
+		return nil
+	case *graphql.InputObject:
+		fields, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		obj := &ast.ObjectValue{Kind: "ObjectValue"}
+		for name, fval := range fields {
+			field, ok := t.Fields()[name]
+			if !ok {
+				return nil
+			}
+			value := astValue(field.Type, fval)
+			if value == nil {
+				return nil
+			}
+			obj.Fields = append(obj.Fields, &ast.ObjectField{Kind: "ObjectField", Name: astName(name), Value: value})
+		}
+		sort.Slice(obj.Fields, func(i, j int) bool {
+			return obj.Fields[i].Name.Value < obj.Fields[j].Name.Value
+		})
+		return obj
+	}
+
+	switch v := val.(type) {
+	case string:
+		return &ast.StringValue{Kind: "StringValue", Value: v}
+	case bool:
+		return &ast.BooleanValue{Kind: "BooleanValue", Value: v}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return &ast.IntValue{Kind: "IntValue", Value: fmt.Sprint(v)}
+	case float32, float64:
+		return &ast.FloatValue{Kind: "FloatValue", Value: strconv.FormatFloat(reflect.ValueOf(v).Float(), 'g', -1, 64)}
+	}
+	return nil
+}
+
+// astName builds an AST name.
+func astName(name string) *ast.Name {
+	return &ast.Name{Kind: "Name", Value: name}
+}
+
+// astNamed builds a named AST type reference.
+func astNamed(name string) *ast.Named {
+	return &ast.Named{Kind: "Named", Name: astName(name)}
+}
@@ -2,6 +2,7 @@ package schema
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
@@ -22,6 +23,8 @@ type Schema struct {
 	QueryModel    *execution.Model
 	MutationModel *execution.Model
 	CacheSize     uint32
+	// TreeOptions are applied to query trees built from this schema.
+	TreeOptions qtree.QueryTreeOptions
 }
 
 // FromDocument makes a Schema from an AST document.
@@ -61,6 +64,45 @@ func Parse(docStr string) (*Schema, error) {
 	return FromDocument(doc), nil
 }
 
+// NewSchemaResolverFromSDL parses a GraphQL SDL document into a schema resolver and the query root.
+func NewSchemaResolverFromSDL(sdl string) (qtree.SchemaResolver, *ast.ObjectDefinition, error) {
+	doc, err := parser.Parse(
+		parser.ParseParams{
+			Source: sdl,
+			Options: parser.ParseOptions{
+				NoLocation: true,
+				NoSource:   true,
+			},
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defined := make(map[string]bool, len(doc.Definitions))
+	for _, def := range doc.Definitions {
+		tdef, ok := def.(ast.TypeDefinition)
+		if !ok {
+			continue
+		}
+		nm, ok := tdef.(namedAstNode)
+		if !ok || nm.GetName() == nil {
+			continue
+		}
+		name := nm.GetName().Value
+		if defined[name] {
+			return nil, nil, fmt.Errorf("Duplicate definition of type %s.", name)
+		}
+		defined[name] = true
+	}
+
+	definitions := FromDocument(doc).Definitions
+	root := definitions.RootType(qtree.OperationQuery)
+	if root == nil {
+		return nil, nil, errors.New("Root query object not found.")
+	}
+	return definitions, root, nil
+}
+
 // SetResolvers applies a prototype resolver instance to the tree.
 func (s *Schema) SetResolvers(rootQueryResolver interface{},
 	rootMutationResolver interface{}) error {
@@ -112,28 +154,12 @@ func (s *Schema) HasMutationResolvers() bool {
 
 // BuildQueryTree builds a new query tree from this schema.
 func (s *Schema) BuildQueryTree(sendCh chan<- *proto.RGQLQueryError, operationKind string) (*qtree.QueryTreeNode, error) {
-	var rootObj *ast.ObjectDefinition
 	if s.Definitions == nil {
 		return nil, errors.New("Schema not parsed yet.")
 	}
-	isMutation := operationKind == "mutation"
-	if !isMutation && operationKind != "query" {
-		return nil, errors.New("Only query and mutation operations are supported.")
-	}
-	if isMutation {
-		if s.Definitions.RootMutation == nil {
-			return nil, errors.New("Root mutation object not found.")
-		}
-		rootObj = s.Definitions.RootMutation.(*ast.ObjectDefinition)
-	} else {
-		if s.Definitions.RootQuery == nil {
-			return nil, errors.New("Root query object not found.")
-		}
-		rootObj = s.Definitions.RootQuery.(*ast.ObjectDefinition)
+	opType, err := qtree.ParseOperationType(operationKind)
+	if err != nil {
+		return nil, errors.New("Only query, mutation and subscription operations are supported.")
 	}
-	return qtree.NewQueryTree(
-		rootObj,
-		s.Definitions,
-		sendCh,
-	), nil
+	return qtree.NewQueryTreeForOperation(opType, s.Definitions, sendCh, s.TreeOptions)
 }
@@ -2,7 +2,14 @@ package schema
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/rgraphql/magellan/qtree"
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
 )
 
 var testSchema string = `
@@ -72,3 +79,145 @@ func TestBuildSchema(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 }
+
+func TestRootType(t *testing.T) {
+	schema, err := Parse(testSchema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if root := schema.Definitions.RootType(qtree.OperationQuery); root == nil || root.Name.Value != "RootQuery" {
+		t.Fatalf("Unexpected query root: %#v", root)
+	}
+	if root := schema.Definitions.RootType(qtree.OperationMutation); root != nil {
+		t.Fatalf("Unexpected mutation root: %#v", root)
+	}
+
+	schema, err = Parse(`
+type Query {
+	name: String
+}
+
+type Subscription {
+	name: String
+}
+`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if root := schema.Definitions.RootType(qtree.OperationSubscription); root == nil || root.Name.Value != "Subscription" {
+		t.Fatalf("Default subscription root was not found: %#v", root)
+	}
+	if _, err := schema.BuildQueryTree(make(chan *proto.RGQLQueryError), "query"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := schema.BuildQueryTree(make(chan *proto.RGQLQueryError), "mutation"); err == nil || err.Error() != "Root mutation object not found." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestSchemaResolverFromSDL(t *testing.T) {
+	resolver, root, err := NewSchemaResolverFromSDL(testSchema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if root.Name.Value != "RootQuery" {
+		t.Fatalf("Unexpected query root: %s", root.Name.Value)
+	}
+	qt := qtree.NewQueryTree(root, resolver, make(chan *proto.RGQLQueryError, 10))
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "people",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 2, FieldName: "name"}},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, _, err = NewSchemaResolverFromSDL(testSchema + "\ntype Person {\n\tage: Int\n}\n")
+	if err == nil || err.Error() != "Duplicate definition of type Person." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+	_, _, err = NewSchemaResolverFromSDL("type Person {\n\tname: String\n}\n")
+	if err == nil || err.Error() != "Root query object not found." {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
+
+func TestSchemaResolverFromSchema(t *testing.T) {
+	sort := graphql.NewEnum(graphql.EnumConfig{
+		Name: "Sort",
+		Values: graphql.EnumValueConfigMap{
+			"NAME": &graphql.EnumValueConfig{Value: 0},
+			"AGE":  &graphql.EnumValueConfig{Value: 1},
+		},
+	})
+	named := graphql.NewInterface(graphql.InterfaceConfig{
+		Name:   "Named",
+		Fields: graphql.Fields{"name": &graphql.Field{Type: graphql.String}},
+	})
+	person := graphql.NewObject(graphql.ObjectConfig{
+		Name:       "Person",
+		Interfaces: []*graphql.Interface{named},
+		Fields: graphql.Fields{
+			"name":     &graphql.Field{Type: graphql.String},
+			"nickname": &graphql.Field{Type: graphql.String, DeprecationReason: "Use name"},
+		},
+	})
+	person.AddFieldConfig("friends", &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(person))})
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"people": &graphql.Field{
+				Type: graphql.NewList(person),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+					"sort":  &graphql.ArgumentConfig{Type: sort, DefaultValue: 1},
+				},
+			},
+		},
+	})
+	gqlSchema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	resolver := NewSchemaResolverFromSchema(&gqlSchema)
+	root := resolver.RootType(qtree.OperationQuery)
+	if root == nil || root.Name.Value != "Query" {
+		t.Fatalf("Unexpected query root: %#v", root)
+	}
+	if impls := resolver.(qtree.ImplementationResolver).LookupImplementations(
+		resolver.LookupType(&ast.Named{Kind: "Named", Name: &ast.Name{Kind: "Name", Value: "Named"}}).(*ast.InterfaceDefinition),
+	); len(impls) != 1 || impls[0].Name.Value != "Person" {
+		t.Fatalf("Unexpected implementations: %v", impls)
+	}
+
+	qt := qtree.NewQueryTreeWithOptions(root, resolver, make(chan *proto.RGQLQueryError, 10), qtree.QueryTreeOptions{
+		RejectDeprecated: true,
+	})
+	if err := qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        1,
+		FieldName: "people",
+		Children: []*proto.RGQLQueryTreeNode{
+			{Id: 2, FieldName: "name"},
+			{Id: 3, FieldName: "friends", Children: []*proto.RGQLQueryTreeNode{{Id: 4, FieldName: "name"}}},
+		},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	people, _ := qt.LookupNode(1)
+	args := people.ArgumentValues()
+	if fmt.Sprint(args["limit"]) != "10" || args["sort"] != "AGE" {
+		t.Fatalf("Unexpected default arguments: %v", args)
+	}
+	if friends, _ := qt.LookupNode(3); friends.ListDepth != 1 || friends.IsPrimitive {
+		t.Fatalf("Unexpected friends node: %#v", friends)
+	}
+	err = qt.AddChild(&proto.RGQLQueryTreeNode{
+		Id:        5,
+		FieldName: "others: people",
+		Children:  []*proto.RGQLQueryTreeNode{{Id: 6, FieldName: "nickname"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "deprecated (Use name)") {
+		t.Fatalf("Did not return expected error (%v).", err)
+	}
+}
@@ -69,7 +69,10 @@ func init() {
 }
 
 func IsPrimitive(name string) bool {
-	_, ok := GraphQLPrimitives[name]
+	if _, ok := GraphQLPrimitives[name]; ok {
+		return true
+	}
+	_, ok := LookupScalar(name)
 	return ok
 }
 
@@ -0,0 +1,36 @@
+package types
+
+import (
+	"sync"
+
+	proto "github.com/rgraphql/rgraphql/pkg/proto"
+)
+
+// Scalar describes a custom scalar type treated as a primitive.
+type Scalar struct {
+	// Kind is the primitive kind values are transmitted as.
+	Kind proto.RGQLPrimitive_Kind
+	// Serialize converts a resolved Go value to a value of Kind, nil to send values as-is.
+	Serialize func(value interface{}) (interface{}, error)
+	// Coerce checks and converts an argument value, nil to pass values as-is.
+	Coerce func(value interface{}) (interface{}, error)
+}
+
+var customScalarsMtx sync.RWMutex
+var customScalars = make(map[string]*Scalar)
+
+// RegisterScalar registers a custom scalar type by name.
+func RegisterScalar(name string, scalar *Scalar) {
+	customScalarsMtx.Lock()
+	customScalars[name] = scalar
+	customScalarsMtx.Unlock()
+}
+
+// LookupScalar finds a registered custom scalar type.
+func LookupScalar(name string) (*Scalar, bool) {
+	customScalarsMtx.RLock()
+	defer customScalarsMtx.RUnlock()
+
+	scalar, ok := customScalars[name]
+	return scalar, ok
+}